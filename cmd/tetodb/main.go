@@ -0,0 +1,131 @@
+// Command tetodb checks and repairs TetoDB storage files offline
+//
+//	tetodb verify [-json] <file>
+//	tetodb repair [-json] [-passphrase <passphrase>] <file>
+//
+// verify exits with status 1 if the file has unreadable records; repair
+// writes what it can read to <file>.repaired and leaves the file unchanged
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/malazaysc/tetodb/engine"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "verify":
+		err = verify(os.Args[2:])
+	case "repair":
+		err = repair(os.Args[2:])
+	case "help", "-h", "-help", "--help":
+		usage()
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "tetodb: unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tetodb: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage:")
+	fmt.Fprintln(os.Stderr, "  tetodb verify [-json] <file>")
+	fmt.Fprintln(os.Stderr, "  tetodb repair [-json] [-passphrase <passphrase>] <file>")
+}
+
+// verify reports on a storage file with engine.ValidateFile
+func verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	report, err := engine.ValidateFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		if err := printJSON(report); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("%s: %d records, %d documents in %d collections, last sequence %d\n",
+			report.Path, report.Records, report.Documents, len(report.Collections), report.LastSequence)
+		for _, failure := range report.ChecksumFailures {
+			fmt.Printf("  record %d: %s\n", failure.Line, failure.Message)
+		}
+		for _, failure := range report.ParseErrors {
+			fmt.Printf("  record %d: %s\n", failure.Line, failure.Message)
+		}
+		if snapshot := report.Snapshot; snapshot != nil {
+			fmt.Printf("%s: %d records up to sequence %d (the documents above include them)\n",
+				snapshot.Path, snapshot.Records, snapshot.LastSequence)
+			for _, failure := range snapshot.ChecksumFailures {
+				fmt.Printf("  record %d: %s\n", failure.Line, failure.Message)
+			}
+			for _, failure := range snapshot.ParseErrors {
+				fmt.Printf("  record %d: %s\n", failure.Line, failure.Message)
+			}
+		}
+	}
+	if !report.Valid() {
+		return fmt.Errorf("%s has unreadable records; run tetodb repair", report.Path)
+	}
+	return nil
+}
+
+// repair rebuilds a storage file with engine.Repair
+func repair(args []string) error {
+	flags := flag.NewFlagSet("repair", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	passphrase := flags.String("passphrase", "", "passphrase of an encrypted file")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	var opts []engine.Option
+	if *passphrase != "" {
+		opts = append(opts, engine.WithEncryption(*passphrase))
+	}
+	report, err := engine.Repair(flags.Arg(0), opts...)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(report)
+	}
+	for _, damaged := range report.Damaged {
+		fmt.Printf("  byte %d (%d bytes): %s\n", damaged.Offset, damaged.Length, damaged.Message)
+	}
+	fmt.Println(report.Summary())
+	return nil
+}
+
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
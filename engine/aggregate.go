@@ -0,0 +1,504 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Aggregate runs an aggregation pipeline over the collection
+// A pipeline is a list of stages, each a single-key map, applied in order:
+//
+//	{"$match": {filter}}                         // Keep matching documents
+//	{"$group": {"_id": "$role", "n": {"$sum": 1}}} // Group and accumulate
+//	{"$sort": {"n": -1}} or {"$sort": "-n,_id"}  // Sort (see ParseSort for string/array forms)
+//	{"$skip": 10}, {"$limit": 5}                 // Paginate
+//	{"$project": {"name": 1}}                    // Select fields (see NewProjection)
+//	{"$lookup": {"from": "orders", "localField": "id",
+//	             "foreignField": "userId", "as": "orders"}} // Join (see lookupSpec)
+//	{"$sample": {"size": 5}}                     // Random documents (see Collection.Sample)
+//	{"$facet": {"a": [stages], "b": [stages]}}   // Several sub-pipelines over the same input (see parseFacets)
+//	{"$bucket": {"groupBy": "$price", "boundaries": [0, 50, 100]}} // Group into ranges (see bucketSpec)
+//	{"$bucketAuto": {"groupBy": "$price", "buckets": 4}}           // Group into even ranges (see bucketAutoSpec)
+//
+// $group accumulators: $sum, $avg, $min, $max and $count; $bucket and
+// $bucketAuto take the same accumulators in their "output"
+// Leading $match stages are evaluated while scanning, so only matching
+// documents are collected; a $sample right after them is also taken during the
+// scan, so only the sampled documents are kept
+func (c *Collection) Aggregate(pipeline []map[string]interface{}) ([]map[string]interface{}, error) {
+	return c.AggregateContext(context.Background(), pipeline)
+}
+
+// AggregateContext is Aggregate with cancellation
+// ctx is checked while scanning and between stages
+func (c *Collection) AggregateContext(ctx context.Context, pipeline []map[string]interface{}) ([]map[string]interface{}, error) {
+	stages, err := parsePipeline(pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	// Resolve joined collections before taking any locks
+	if err := resolveLookups(stages, c.source()); err != nil {
+		return nil, err
+	}
+
+	// Fold leading $match stages into the scan
+	var scanFilters []map[string]interface{}
+	for len(stages) > 0 && stages[0].name == "$match" {
+		scanFilters = append(scanFilters, stages[0].filter)
+		stages = stages[1:]
+	}
+
+	// Sample during the scan rather than collecting every match first
+	var sample *reservoir
+	if len(stages) > 0 && stages[0].name == "$sample" {
+		sample = newReservoir(stages[0].count)
+		stages = stages[1:]
+	}
+
+	// Scanned from a snapshot, so writers aren't held up meanwhile
+	docs := make([]map[string]interface{}, 0)
+	scanned := 0
+	for _, doc := range c.snapshot().all() {
+		if err := scanCanceled(ctx, scanned); err != nil {
+			return nil, err
+		}
+		scanned++
+
+		if !matchesAll(c.match, doc, scanFilters) {
+			continue
+		}
+		if sample != nil {
+			sample.add(doc)
+		} else {
+			docs = append(docs, doc)
+		}
+	}
+
+	if sample != nil {
+		docs = sample.result()
+	}
+
+	for _, stage := range stages {
+		if err := contextErr(ctx); err != nil {
+			return nil, err
+		}
+		docs = stage.run(c.match, docs)
+	}
+	return c.detach(docs), nil
+}
+
+// resolveLookups resolves the collections joined by $lookup stages, including those inside $facet
+func resolveLookups(stages []pipelineStage, source collectionSource) error {
+	for i, stage := range stages {
+		if stage.lookup != nil {
+			if err := stage.lookup.resolve(source); err != nil {
+				return fmt.Errorf("stage %d ($lookup): %w", i, err)
+			}
+		}
+		for name, sub := range stage.facets {
+			if err := resolveLookups(sub, source); err != nil {
+				return fmt.Errorf("stage %d ($facet %s): %w", i, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// matchesAll reports whether a document matches every filter
+func matchesAll(match MatchOptions, doc map[string]interface{}, filters []map[string]interface{}) bool {
+	for _, filter := range filters {
+		if !match.Matches(doc, filter) {
+			return false
+		}
+	}
+	return true
+}
+
+// pipelineStage is a parsed, validated aggregation stage
+type pipelineStage struct {
+	name       string                     // Stage operator, e.g. "$match"
+	filter     map[string]interface{}     // $match filter
+	group      *groupSpec                 // $group specification
+	sort       []SortField                // $sort keys
+	count      int                        // $skip / $limit amount, $sample size
+	projection *Projection                // $project specification
+	lookup     *lookupSpec                // $lookup specification
+	facets     map[string][]pipelineStage // $facet sub-pipelines by output field
+	bucket     *bucketSpec                // $bucket specification
+	bucketAuto *bucketAutoSpec            // $bucketAuto specification
+}
+
+// parsePipeline validates every stage up front so a bad pipeline fails before scanning
+func parsePipeline(pipeline []map[string]interface{}) ([]pipelineStage, error) {
+	stages := make([]pipelineStage, 0, len(pipeline))
+	for i, raw := range pipeline {
+		if len(raw) != 1 {
+			return nil, fmt.Errorf("stage %d must have exactly one operator", i)
+		}
+
+		for name, spec := range raw {
+			stage, err := parseStage(name, spec)
+			if err != nil {
+				return nil, fmt.Errorf("stage %d (%s): %w", i, name, err)
+			}
+			stages = append(stages, stage)
+		}
+	}
+	return stages, nil
+}
+
+// parseStage parses a single stage operator and its specification
+func parseStage(name string, spec interface{}) (pipelineStage, error) {
+	stage := pipelineStage{name: name}
+
+	switch name {
+	case "$match":
+		filter, ok := spec.(map[string]interface{})
+		if !ok {
+			return stage, fmt.Errorf("expected a filter object")
+		}
+		stage.filter = filter
+
+	case "$group":
+		groupMap, ok := spec.(map[string]interface{})
+		if !ok {
+			return stage, fmt.Errorf("expected a group object")
+		}
+		group, err := parseGroup(groupMap)
+		if err != nil {
+			return stage, err
+		}
+		stage.group = group
+
+	case "$sort":
+		fields, err := parseSortStage(spec)
+		if err != nil {
+			return stage, err
+		}
+		stage.sort = fields
+
+	case "$skip", "$limit":
+		n, ok := toFloat64(spec)
+		if !ok || n < 0 || n != float64(int(n)) {
+			return stage, fmt.Errorf("expected a non-negative integer")
+		}
+		stage.count = int(n)
+
+	case "$sample":
+		sampleMap, ok := spec.(map[string]interface{})
+		if !ok || len(sampleMap) != 1 {
+			return stage, fmt.Errorf("expected {\"size\": n}")
+		}
+		n, ok := toFloat64(sampleMap["size"])
+		if !ok || n < 0 || n != float64(int(n)) {
+			return stage, fmt.Errorf("size must be a non-negative integer")
+		}
+		stage.count = int(n)
+
+	case "$project":
+		projMap, ok := spec.(map[string]interface{})
+		if !ok {
+			return stage, fmt.Errorf("expected a projection object")
+		}
+		projection, err := NewProjection(projMap)
+		if err != nil {
+			return stage, err
+		}
+		stage.projection = projection
+
+	case "$lookup":
+		lookupMap, ok := spec.(map[string]interface{})
+		if !ok {
+			return stage, fmt.Errorf("expected a lookup object")
+		}
+		lookup, err := parseLookup(lookupMap)
+		if err != nil {
+			return stage, err
+		}
+		stage.lookup = lookup
+
+	case "$facet":
+		facetMap, ok := spec.(map[string]interface{})
+		if !ok || len(facetMap) == 0 {
+			return stage, fmt.Errorf("expected an object of sub-pipelines")
+		}
+		facets, err := parseFacets(facetMap)
+		if err != nil {
+			return stage, err
+		}
+		stage.facets = facets
+
+	case "$bucket":
+		bucketMap, ok := spec.(map[string]interface{})
+		if !ok {
+			return stage, fmt.Errorf("expected a bucket object")
+		}
+		bucket, err := parseBucket(bucketMap)
+		if err != nil {
+			return stage, err
+		}
+		stage.bucket = bucket
+
+	case "$bucketAuto":
+		bucketMap, ok := spec.(map[string]interface{})
+		if !ok {
+			return stage, fmt.Errorf("expected a bucketAuto object")
+		}
+		bucketAuto, err := parseBucketAuto(bucketMap)
+		if err != nil {
+			return stage, err
+		}
+		stage.bucketAuto = bucketAuto
+
+	default:
+		return stage, fmt.Errorf("unknown stage")
+	}
+
+	return stage, nil
+}
+
+// parseSortStage accepts {"field": 1/-1, ...} as well as the ParseSort forms
+// Object keys have no reliable order once decoded, so multi-key objects are
+// sorted by key name; use the string or array form when priority matters
+func parseSortStage(spec interface{}) ([]SortField, error) {
+	keys, ok := spec.(map[string]interface{})
+	if !ok {
+		return ParseSort(spec)
+	}
+
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := make([]SortField, 0, len(names))
+	for _, name := range names {
+		dir, ok := toFloat64(keys[name])
+		if !ok || (dir != 1 && dir != -1) {
+			return nil, fmt.Errorf("sort direction for %s must be 1 or -1", name)
+		}
+		direction := "asc"
+		if dir < 0 {
+			direction = "desc"
+		}
+		fields = append(fields, SortField{Field: name, Direction: direction})
+	}
+	return fields, nil
+}
+
+// run applies the stage to a set of documents
+func (s pipelineStage) run(match MatchOptions, docs []map[string]interface{}) []map[string]interface{} {
+	switch s.name {
+	case "$match":
+		matched := make([]map[string]interface{}, 0, len(docs))
+		for _, doc := range docs {
+			if match.Matches(doc, s.filter) {
+				matched = append(matched, doc)
+			}
+		}
+		return matched
+	case "$group":
+		return s.group.run(docs)
+	case "$sort":
+		sorted := append([]map[string]interface{}(nil), docs...)
+		match.Collation.sortDocuments(sorted, s.sort)
+		return sorted
+	case "$skip":
+		if s.count >= len(docs) {
+			return docs[:0]
+		}
+		return docs[s.count:]
+	case "$limit":
+		if s.count < len(docs) {
+			return docs[:s.count]
+		}
+		return docs
+	case "$project":
+		projected := make([]map[string]interface{}, len(docs))
+		for i, doc := range docs {
+			projected[i] = s.projection.Apply(doc)
+		}
+		return projected
+	case "$lookup":
+		return s.lookup.run(docs)
+	case "$sample":
+		r := newReservoir(s.count)
+		for _, doc := range docs {
+			r.add(doc)
+		}
+		return r.result()
+	case "$facet":
+		return runFacets(match, s.facets, docs)
+	case "$bucket":
+		return s.bucket.run(docs)
+	case "$bucketAuto":
+		return s.bucketAuto.run(docs)
+	}
+	return docs
+}
+
+// groupSpec describes a $group stage
+type groupSpec struct {
+	id           interface{}   // Group key expression
+	accumulators []accumulator // Output fields
+}
+
+// accumulator is a single output field of a $group stage
+type accumulator struct {
+	field string      // Output field name
+	op    string      // $sum, $avg, $min, $max or $count
+	expr  interface{} // Expression evaluated per document
+}
+
+// parseGroup parses a $group specification
+func parseGroup(spec map[string]interface{}) (*groupSpec, error) {
+	id, hasID := spec["_id"]
+	if !hasID {
+		return nil, fmt.Errorf("missing _id")
+	}
+
+	accumulators, err := parseAccumulators(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &groupSpec{id: id, accumulators: accumulators}, nil
+}
+
+// parseAccumulators parses the output fields of a $group-like stage (every key but _id)
+func parseAccumulators(spec map[string]interface{}) ([]accumulator, error) {
+	var accumulators []accumulator
+	for field, raw := range spec {
+		if field == "_id" {
+			continue
+		}
+
+		accMap, ok := raw.(map[string]interface{})
+		if !ok || len(accMap) != 1 {
+			return nil, fmt.Errorf("field %s must be a single accumulator", field)
+		}
+		for op, expr := range accMap {
+			switch op {
+			case "$sum", "$avg", "$min", "$max", "$count":
+			default:
+				return nil, fmt.Errorf("unknown accumulator %s", op)
+			}
+			accumulators = append(accumulators, accumulator{field: field, op: op, expr: expr})
+		}
+	}
+	return accumulators, nil
+}
+
+// groupState holds the running accumulator values for one group
+type groupState struct {
+	key    interface{}   // Evaluated _id
+	sums   []float64     // Running sums ($sum, $avg)
+	counts []int         // Number of values seen ($avg, $count)
+	values []interface{} // Current $min/$max value
+}
+
+// run groups documents and computes the accumulators
+// Groups are returned in the order their first document was seen
+func (g *groupSpec) run(docs []map[string]interface{}) []map[string]interface{} {
+	return g.runBy(docs, func(doc map[string]interface{}) (interface{}, bool) {
+		return evalExpression(doc, g.id), true
+	})
+}
+
+// runBy groups documents by the key function instead of the _id expression
+// Documents for which key returns false are left out
+func (g *groupSpec) runBy(docs []map[string]interface{}, keyOf func(doc map[string]interface{}) (interface{}, bool)) []map[string]interface{} {
+	groups := make(map[string]*groupState)
+	var order []string
+
+	for _, doc := range docs {
+		key, ok := keyOf(doc)
+		if !ok {
+			continue
+		}
+		hash := groupHash(key)
+		state, exists := groups[hash]
+		if !exists {
+			n := len(g.accumulators)
+			state = &groupState{
+				key:    key,
+				sums:   make([]float64, n),
+				counts: make([]int, n),
+				values: make([]interface{}, n),
+			}
+			groups[hash] = state
+			order = append(order, hash)
+		}
+
+		for i, acc := range g.accumulators {
+			acc.add(state, i, doc)
+		}
+	}
+
+	results := make([]map[string]interface{}, 0, len(order))
+	for _, hash := range order {
+		state := groups[hash]
+		out := map[string]interface{}{"_id": state.key}
+		for i, acc := range g.accumulators {
+			out[acc.field] = acc.result(state, i)
+		}
+		results = append(results, out)
+	}
+	return results
+}
+
+// add folds one document into the accumulator's running state
+func (a accumulator) add(state *groupState, i int, doc map[string]interface{}) {
+	if a.op == "$count" {
+		state.counts[i]++
+		return
+	}
+
+	value := evalExpression(doc, a.expr)
+	switch a.op {
+	case "$sum", "$avg":
+		if n, ok := toFloat64(value); ok {
+			state.sums[i] += n
+			state.counts[i]++
+		}
+	case "$min", "$max":
+		if value == nil {
+			return
+		}
+		current := state.values[i]
+		if current == nil ||
+			(a.op == "$min" && compareValues(value, current) < 0) ||
+			(a.op == "$max" && compareValues(value, current) > 0) {
+			state.values[i] = value
+		}
+	}
+}
+
+// result returns the final accumulator value
+func (a accumulator) result(state *groupState, i int) interface{} {
+	switch a.op {
+	case "$sum":
+		return state.sums[i]
+	case "$avg":
+		if state.counts[i] == 0 {
+			return nil
+		}
+		return state.sums[i] / float64(state.counts[i])
+	case "$count":
+		return state.counts[i]
+	default:
+		return state.values[i]
+	}
+}
+
+// groupHash returns a stable string key for a group value
+func groupHash(key interface{}) string {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return fmt.Sprintf("%v", key)
+	}
+	return string(data)
+}
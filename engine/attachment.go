@@ -0,0 +1,259 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// attachmentChunkBytes is the most data one attachment record holds; larger
+// attachments are split across records, so no record grows with the blob
+const attachmentChunkBytes = 1 << 20
+
+// ErrAttachmentNotFound is returned when a document has no attachment by
+// the given name
+var ErrAttachmentNotFound = errors.New("attachment not found")
+
+// AttachmentPart is one chunk of an attachment in a StorageRecord
+// The chunks of an attachment are written in one batch, in order; replaying
+// installs the attachment only once all of them are read, so a torn write
+// leaves the previous version in place
+type AttachmentPart struct {
+	Name  string `json:"name"`           // Attachment name, unique per document
+	Part  int    `json:"part"`           // Position of this chunk in the attachment
+	Parts int    `json:"parts"`          // Chunks the attachment has; 0 removes the attachment
+	Data  []byte `json:"data,omitempty"` // The chunk's bytes
+}
+
+// AttachmentInfo describes an attachment of a document (see ListAttachments)
+type AttachmentInfo struct {
+	Name string `json:"name"` // Attachment name
+	Size int64  `json:"size"` // Length of its data in bytes
+}
+
+// attachment is an attachment held in memory: the records of its chunks, in
+// order. The chunks are never modified, only replaced, so readers can keep
+// them after the collection lock is released
+type attachment struct {
+	parts []StorageRecord
+	size  int64
+}
+
+// reader streams the attachment's data chunk by chunk
+func (a *attachment) reader() io.Reader {
+	readers := make([]io.Reader, len(a.parts))
+	for i, part := range a.parts {
+		readers[i] = bytes.NewReader(part.Attachment.Data)
+	}
+	return io.MultiReader(readers...)
+}
+
+// PutAttachment stores a blob under a name alongside a document, replacing
+// any attachment of that name. Large blobs are split into chunks of 1 MiB,
+// all written in a single batch
+// Attachments are removed with their document, and kept by compaction,
+// checkpoints and backups like documents; they aren't part of the document,
+// so queries never see them
+func (c *Collection) PutAttachment(id, name string, data []byte) error {
+	if name == "" {
+		return fmt.Errorf("attachment name is empty")
+	}
+
+	unlock := c.lockDocument(id)
+	defer unlock()
+
+	if _, exists := c.stored(id); !exists {
+		return fmt.Errorf("document with id %s not found", id)
+	}
+
+	// Copied so later changes to the caller's slice can't reach the stored chunks
+	data = bytes.Clone(data)
+	parts := max(1, (len(data)+attachmentChunkBytes-1)/attachmentChunkBytes)
+	now := recordTime()
+	records := make([]StorageRecord, parts)
+	for i := range records {
+		chunk := data[i*attachmentChunkBytes : min(len(data), (i+1)*attachmentChunkBytes)]
+		records[i] = StorageRecord{
+			Collection: c.name,
+			ID:         id,
+			Attachment: &AttachmentPart{Name: name, Part: i, Parts: parts, Data: chunk},
+			Time:       now,
+		}
+	}
+	if err := c.checkLimits(records, 0); err != nil {
+		return err
+	}
+	if err := c.storage.AppendBatch(records); err != nil {
+		return fmt.Errorf("failed to persist attachment: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.attachments == nil {
+		c.attachments = make(map[string]map[string]*attachment)
+	}
+	if c.attachments[id] == nil {
+		c.attachments[id] = make(map[string]*attachment)
+	}
+	c.attachments[id][name] = &attachment{parts: records, size: int64(len(data))}
+	return nil
+}
+
+// OpenAttachment returns a reader for a document's attachment, which streams
+// it from the chunks it was stored in; later writes to the attachment don't
+// affect a reader already open
+// Fails with ErrAttachmentNotFound if there is none by that name
+func (c *Collection) OpenAttachment(id, name string) (io.Reader, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	a, exists := c.attachments[id][name]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s on document %s", ErrAttachmentNotFound, name, id)
+	}
+	return a.reader(), nil
+}
+
+// GetAttachment returns the data of a document's attachment
+// Fails with ErrAttachmentNotFound if there is none by that name
+func (c *Collection) GetAttachment(id, name string) ([]byte, error) {
+	reader, err := c.OpenAttachment(id, name)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+// ListAttachments returns the attachments of a document, sorted by name
+func (c *Collection) ListAttachments(id string) []AttachmentInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	infos := make([]AttachmentInfo, 0, len(c.attachments[id]))
+	for name, a := range c.attachments[id] {
+		infos = append(infos, AttachmentInfo{Name: name, Size: a.size})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// DeleteAttachment removes a document's attachment
+// Fails with ErrAttachmentNotFound if there is none by that name
+func (c *Collection) DeleteAttachment(id, name string) error {
+	unlock := c.lockDocument(id)
+	defer unlock()
+
+	c.mu.RLock()
+	_, exists := c.attachments[id][name]
+	c.mu.RUnlock()
+	if !exists {
+		return fmt.Errorf("%w: %s on document %s", ErrAttachmentNotFound, name, id)
+	}
+
+	record := StorageRecord{Collection: c.name, ID: id, Attachment: &AttachmentPart{Name: name}, Time: recordTime()}
+	if _, err := c.storage.Append(record); err != nil {
+		return fmt.Errorf("failed to persist attachment removal: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.attachments[id], name)
+	if len(c.attachments[id]) == 0 {
+		delete(c.attachments, id)
+	}
+	return nil
+}
+
+// attachmentRecords returns the records of every attachment's chunks, for
+// compaction and snapshots
+// Caller must hold the lock
+func (c *Collection) attachmentRecords() []StorageRecord {
+	var records []StorageRecord
+	for _, named := range c.attachments {
+		for _, a := range named {
+			records = append(records, a.parts...)
+		}
+	}
+	return records
+}
+
+// attachmentKey names an attachment while records are replayed
+type attachmentKey struct {
+	collection, id, name string
+}
+
+// attachmentLoader rebuilds attachments from their chunk records as the log
+// is replayed
+type attachmentLoader struct {
+	loaded   map[string]map[string]map[string]*attachment // Collection -> document ID -> name
+	building map[attachmentKey]*attachment                // Attachments whose later chunks are still to come
+}
+
+func newAttachmentLoader() *attachmentLoader {
+	return &attachmentLoader{
+		loaded:   make(map[string]map[string]map[string]*attachment),
+		building: make(map[attachmentKey]*attachment),
+	}
+}
+
+// add applies an attachment record
+func (l *attachmentLoader) add(record StorageRecord) {
+	part := record.Attachment
+	key := attachmentKey{collection: record.Collection, id: record.ID, name: part.Name}
+	if part.Parts == 0 {
+		delete(l.building, key)
+		delete(l.loaded[key.collection][key.id], key.name)
+		return
+	}
+
+	if part.Part == 0 {
+		l.building[key] = &attachment{}
+	}
+	a := l.building[key]
+	if a == nil || len(a.parts) != part.Part {
+		// A chunk out of place; the chunks before it were lost, so the
+		// attachment is incomplete and what was there stays
+		delete(l.building, key)
+		return
+	}
+	a.parts = append(a.parts, record)
+	a.size += int64(len(part.Data))
+	if len(a.parts) < part.Parts {
+		return
+	}
+
+	delete(l.building, key)
+	if l.loaded[key.collection] == nil {
+		l.loaded[key.collection] = make(map[string]map[string]*attachment)
+	}
+	if l.loaded[key.collection][key.id] == nil {
+		l.loaded[key.collection][key.id] = make(map[string]*attachment)
+	}
+	l.loaded[key.collection][key.id][key.name] = a
+}
+
+// deleted drops the attachments of a deleted document
+func (l *attachmentLoader) deleted(collName, id string) {
+	delete(l.loaded[collName], id)
+}
+
+// install gives each collection the attachments of its documents
+func (l *attachmentLoader) install(collections map[string]*Collection) {
+	for collName, byID := range l.loaded {
+		coll, exists := collections[collName]
+		if !exists {
+			continue
+		}
+		for id, named := range byID {
+			if _, exists := coll.documents.get(id); !exists || len(named) == 0 {
+				continue
+			}
+			if coll.attachments == nil {
+				coll.attachments = make(map[string]map[string]*attachment)
+			}
+			coll.attachments[id] = named
+		}
+	}
+}
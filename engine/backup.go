@@ -0,0 +1,81 @@
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// backupWriter backends write backups in their own file format and
+// encryption, e.g. so a backup of an encrypted database stays encrypted
+type backupWriter interface {
+	WriteBackup(w io.Writer, records []StorageRecord) error
+}
+
+// Backup writes a consistent copy of the database to w while writes carry
+// on: the live documents and indexes are captured under the collection
+// locks, which are released before anything is written, and stored
+// documents are never modified in place, so later writes can't change the
+// copy as it streams
+// The copy is a database file (in the storage file's format and encryption,
+// or JSON lines for other engines), so restoring it is a matter of writing
+// it to a path and opening that. Superseded versions aren't copied
+func (db *Database) Backup(w io.Writer) error {
+	records, err := db.copyRecords()
+	if err != nil {
+		return err
+	}
+
+	if writer, ok := db.storage.(backupWriter); ok {
+		return writer.WriteBackup(w, records)
+	}
+	buffered := bufio.NewWriter(w)
+	if _, _, err := writeLog(buffered, recordEncoding{format: FormatJSONLines}, backupHeader(), records); err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+	return nil
+}
+
+// copyRecords captures the records of every live document, index and
+// attachment, in sequence order, for a copy of the database
+func (db *Database) copyRecords() ([]StorageRecord, error) {
+	if err := db.loadAll(); err != nil {
+		return nil, err
+	}
+	db.mu.RLock()
+	unlock := db.lockCollections()
+	records := db.currentRecords()
+	unlock()
+	db.mu.RUnlock()
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Seq < records[j].Seq })
+	return records, nil
+}
+
+// backupHeader returns the header record content of a backup, which holds
+// only live records
+func backupHeader() FileHeader {
+	return FileHeader{Version: StorageVersion, Compacted: recordTime()}
+}
+
+// WriteBackup writes records to w as a storage file in the format, and with
+// the compression and encryption, the file is written with
+// The storage lock is only held to read the settings
+func (s *Storage) WriteBackup(w io.Writer, records []StorageRecord) error {
+	s.mu.Lock()
+	enc := s.targetEncoding()
+	s.mu.Unlock()
+
+	buffered := bufio.NewWriter(w)
+	if _, _, err := writeLog(buffered, enc, backupHeader(), records); err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+	return nil
+}
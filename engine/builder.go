@@ -0,0 +1,211 @@
+package engine
+
+import "fmt"
+
+// QueryBuilder provides a fluent API for building queries
+// Conditions produce the same filter syntax accepted by MatchesFilter, and
+// Sort, Skip, Limit and Projection set the FindOptions used by Execute:
+//
+//	docs, err := NewQuery().
+//		Where("status", "active").
+//		Gte("age", 18).
+//		Or(NewQuery().Where("role", "admin"), NewQuery().Gt("level", 5)).
+//		Sort("age", "desc").
+//		Limit(10).
+//		Execute(users)
+type QueryBuilder struct {
+	filter  map[string]interface{} // Conditions built so far
+	options FindOptions            // Sort, Skip, Limit and Projection
+	err     error                  // First invalid option, reported by Options and Execute
+}
+
+// NewQuery creates a new QueryBuilder
+func NewQuery() *QueryBuilder {
+	return &QueryBuilder{
+		filter: make(map[string]interface{}),
+	}
+}
+
+// Where adds an equality condition to the query
+func (q *QueryBuilder) Where(field string, value interface{}) *QueryBuilder {
+	q.filter[field] = value
+	return q
+}
+
+// Gt adds a greater-than condition ($gt) to the query
+func (q *QueryBuilder) Gt(field string, value interface{}) *QueryBuilder {
+	return q.addOperator(field, "$gt", value)
+}
+
+// Gte adds a greater-than-or-equal condition ($gte) to the query
+func (q *QueryBuilder) Gte(field string, value interface{}) *QueryBuilder {
+	return q.addOperator(field, "$gte", value)
+}
+
+// Lt adds a less-than condition ($lt) to the query
+func (q *QueryBuilder) Lt(field string, value interface{}) *QueryBuilder {
+	return q.addOperator(field, "$lt", value)
+}
+
+// Lte adds a less-than-or-equal condition ($lte) to the query
+func (q *QueryBuilder) Lte(field string, value interface{}) *QueryBuilder {
+	return q.addOperator(field, "$lte", value)
+}
+
+// In adds a membership condition ($in): the field equals any of the values
+func (q *QueryBuilder) In(field string, values ...interface{}) *QueryBuilder {
+	return q.addOperator(field, "$in", append([]interface{}{}, values...))
+}
+
+// Nin adds an exclusion condition ($nin): the field equals none of the values
+func (q *QueryBuilder) Nin(field string, values ...interface{}) *QueryBuilder {
+	return q.addOperator(field, "$nin", append([]interface{}{}, values...))
+}
+
+// Exists adds a field presence condition ($exists) to the query
+func (q *QueryBuilder) Exists(field string, exists bool) *QueryBuilder {
+	return q.addOperator(field, "$exists", exists)
+}
+
+// Type adds a field type condition ($type) to the query
+// typeName is one of "string", "number", "bool", "object", "array" or "null"
+func (q *QueryBuilder) Type(field string, typeName string) *QueryBuilder {
+	return q.addOperator(field, "$type", typeName)
+}
+
+// Regex adds a pattern condition ($regex) to the query
+// options may contain "i" for a case-insensitive match
+func (q *QueryBuilder) Regex(field string, pattern string, options string) *QueryBuilder {
+	q.addOperator(field, "$regex", pattern)
+	if options != "" {
+		q.addOperator(field, "$options", options)
+	}
+	return q
+}
+
+// Or requires at least one of the sub-queries to match ($or)
+// Only the sub-queries' conditions are used; their options are ignored
+func (q *QueryBuilder) Or(queries ...*QueryBuilder) *QueryBuilder {
+	return q.addLogical("$or", queries)
+}
+
+// Nor requires none of the sub-queries to match ($nor)
+func (q *QueryBuilder) Nor(queries ...*QueryBuilder) *QueryBuilder {
+	return q.addLogical("$nor", queries)
+}
+
+// Not requires the sub-query not to match ($not)
+func (q *QueryBuilder) Not(query *QueryBuilder) *QueryBuilder {
+	if query == nil {
+		return q
+	}
+	if _, exists := q.filter["$not"]; exists {
+		// A second Not can't share the key; "not A and not B" is "nor A, B"
+		return q.Nor(query)
+	}
+	q.filter["$not"] = query.Build()
+	return q
+}
+
+// Sort adds a sort key; call it again to sort by further fields
+// direction is "asc" or "desc"
+func (q *QueryBuilder) Sort(field string, direction string) *QueryBuilder {
+	if direction != "asc" && direction != "desc" {
+		q.fail(fmt.Errorf("invalid sort direction %q for %s", direction, field))
+		return q
+	}
+	q.options.Sort = append(q.options.Sort, SortField{Field: field, Direction: direction})
+	return q
+}
+
+// Skip sets the number of matching documents to skip
+func (q *QueryBuilder) Skip(n int) *QueryBuilder {
+	if n < 0 {
+		q.fail(fmt.Errorf("skip must not be negative"))
+		return q
+	}
+	q.options.Skip = n
+	return q
+}
+
+// Limit sets the maximum number of documents to return (0 means no limit)
+func (q *QueryBuilder) Limit(n int) *QueryBuilder {
+	if n < 0 {
+		q.fail(fmt.Errorf("limit must not be negative"))
+		return q
+	}
+	q.options.Limit = n
+	return q
+}
+
+// Projection selects the fields to return (see NewProjection)
+func (q *QueryBuilder) Projection(spec map[string]interface{}) *QueryBuilder {
+	projection, err := NewProjection(spec)
+	if err != nil {
+		q.fail(err)
+		return q
+	}
+	q.options.Projection = projection
+	return q
+}
+
+// addOperator adds an operator condition on a field
+// Operators on the same field are combined; a plain equality value is replaced
+func (q *QueryBuilder) addOperator(field, op string, value interface{}) *QueryBuilder {
+	ops, isOps := operatorExpression(q.filter[field])
+	if !isOps {
+		ops = make(map[string]interface{})
+		q.filter[field] = ops
+	}
+	ops[op] = value
+	return q
+}
+
+// addLogical adds a logical operator over sub-queries
+// Repeating an operator ANDs the groups together rather than replacing the first
+func (q *QueryBuilder) addLogical(op string, queries []*QueryBuilder) *QueryBuilder {
+	filters := make([]interface{}, 0, len(queries))
+	for _, sub := range queries {
+		if sub != nil {
+			filters = append(filters, sub.Build())
+		}
+	}
+	if len(filters) == 0 {
+		return q
+	}
+
+	if _, exists := q.filter[op]; !exists {
+		q.filter[op] = filters
+		return q
+	}
+
+	and, _ := q.filter["$and"].([]interface{})
+	q.filter["$and"] = append(and, map[string]interface{}{op: filters})
+	return q
+}
+
+// fail records the first invalid option
+func (q *QueryBuilder) fail(err error) {
+	if q.err == nil {
+		q.err = err
+	}
+}
+
+// Build returns the constructed filter
+func (q *QueryBuilder) Build() map[string]interface{} {
+	return q.filter
+}
+
+// Options returns the constructed find options
+// The error reports the first invalid Sort, Skip, Limit or Projection call
+func (q *QueryBuilder) Options() (FindOptions, error) {
+	return q.options, q.err
+}
+
+// Execute runs the query against a collection
+func (q *QueryBuilder) Execute(coll *Collection) ([]map[string]interface{}, error) {
+	if q.err != nil {
+		return nil, fmt.Errorf("invalid query: %w", q.err)
+	}
+	return coll.Find(q.filter, q.options), nil
+}
@@ -0,0 +1,109 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// Bulk write operation types (see WriteOperation)
+const (
+	WriteInsert  = "insert"  // Insert Doc, generating an ID if it has none
+	WriteUpdate  = "update"  // Apply Update to document ID, as Collection.Update does
+	WriteReplace = "replace" // Replace document ID with Doc, as Collection.Replace does
+	WriteDelete  = "delete"  // Delete document ID
+)
+
+// WriteOperation is one write of a BulkWrite
+type WriteOperation struct {
+	Type   string                 `json:"type"`             // WriteInsert, WriteUpdate, WriteReplace or WriteDelete
+	ID     string                 `json:"id,omitempty"`     // Document to update, replace or delete
+	Doc    map[string]interface{} `json:"doc,omitempty"`    // Document to insert, or the replacement
+	Update map[string]interface{} `json:"update,omitempty"` // Plain or operator update
+}
+
+// WriteResult reports the outcome of one operation of a BulkWrite
+type WriteResult struct {
+	ID  string // Document written; for inserts, its ID
+	Err error  // Why the operation was skipped; nil if it was applied
+}
+
+// BulkWrite makes a list of inserts, updates, replacements and deletions
+// under one lock acquisition, persisting them as a single batch in one write
+// and sync, which is far cheaper than writing them one by one
+// Operations run in order, each seeing the ones before it. One that fails
+// (e.g. an update of a missing document) is skipped, its result saying why,
+// and the rest still go ahead; use a transaction (Database.Begin) to make all
+// or none. The error is only set if the batch couldn't be written, or would
+// exceed a limit (see WithLimits), in which case none of the operations were made
+// Returns one result per operation, in the order of ops
+func (c *Collection) BulkWrite(ops []WriteOperation) ([]WriteResult, error) {
+	changes := c.db.changeSet()
+	defer changes.deliver()
+
+	defer c.lockAll()()
+
+	results := make([]WriteResult, len(ops))
+	set := newWriteSet()
+	for i, op := range ops {
+		w, err := bulkWrite(op)
+		results[i].ID = w.id
+		if err == nil {
+			err = set.stage(c, w)
+		}
+		results[i].Err = err
+	}
+	if len(set.records) == 0 {
+		return results, nil
+	}
+
+	if err := set.checkLimits(); err != nil {
+		return nil, err
+	}
+	if err := c.storage.AppendBatch(set.records); err != nil {
+		return nil, fmt.Errorf("failed to persist bulk write: %w", err)
+	}
+
+	c.install(changes, set.records...)
+	return results, nil
+}
+
+// bulkWrite turns an operation into the write it stages
+func bulkWrite(op WriteOperation) (txWrite, error) {
+	w := txWrite{id: op.ID}
+	switch op.Type {
+	case WriteInsert:
+		if op.Doc == nil {
+			return w, fmt.Errorf("insert has no document")
+		}
+		if idVal, exists := op.Doc["id"]; exists {
+			w.id = fmt.Sprintf("%v", idVal)
+		} else {
+			w.id = uuid.New().String()
+			op.Doc["id"] = w.id
+		}
+		w.doc = op.Doc
+		return w, nil
+	case WriteUpdate:
+		plan, err := parseUpdate(op.Update)
+		if err != nil {
+			return w, fmt.Errorf("invalid update: %w", err)
+		}
+		w.plan = plan
+	case WriteReplace:
+		plan, err := parseReplacement(op.ID, op.Doc)
+		if err != nil {
+			return w, fmt.Errorf("invalid replacement: %w", err)
+		}
+		w.plan = plan
+	case WriteDelete:
+		w.delete = true
+	default:
+		return w, fmt.Errorf("unknown operation type %q", op.Type)
+	}
+
+	if op.ID == "" {
+		return w, fmt.Errorf("%s has no document id", op.Type)
+	}
+	return w, nil
+}
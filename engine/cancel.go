@@ -0,0 +1,31 @@
+package engine
+
+import (
+	"context"
+	"time"
+)
+
+// cancelCheckInterval is how many documents a scan handles between cancellation checks
+const cancelCheckInterval = 256
+
+// contextErr returns the reason ctx is done, or nil if it isn't
+// The deadline is also compared against the clock directly: under js/wasm a
+// scan never yields, so the timer that would cancel ctx can't fire mid-scan
+func contextErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// scanCanceled checks ctx every cancelCheckInterval documents
+// n is the number of documents handled so far, so the first call always checks
+func scanCanceled(ctx context.Context, n int) error {
+	if n%cancelCheckInterval != 0 {
+		return nil
+	}
+	return contextErr(ctx)
+}
@@ -0,0 +1,272 @@
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// CBOR encoding of record payloads (see CodecCBOR), covering the types
+// records hold in definite lengths; tags are read past to the value they
+// wrap, and indefinite lengths are refused
+
+// CBOR major types
+const (
+	cborUint   = 0 << 5
+	cborNegint = 1 << 5
+	cborBytes  = 2 << 5
+	cborText   = 3 << 5
+	cborArray  = 4 << 5
+	cborMap    = 5 << 5
+	cborTag    = 6 << 5
+	cborSimple = 7 << 5
+)
+
+// CBOR simple values and float heads of major type 7
+const (
+	cborFalse   = cborSimple | 20
+	cborTrue    = cborSimple | 21
+	cborNull    = cborSimple | 22
+	cborUndef   = cborSimple | 23
+	cborFloat16 = cborSimple | 25
+	cborFloat32 = cborSimple | 26
+	cborFloat64 = cborSimple | 27
+)
+
+// cborEncoder builds a CBOR payload
+type cborEncoder struct {
+	buf []byte
+}
+
+func (e *cborEncoder) bytes() []byte { return e.buf }
+
+// head writes a major type with its argument in the shortest form
+func (e *cborEncoder) head(major byte, n uint64) {
+	switch {
+	case n < 24:
+		e.buf = append(e.buf, major|byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, major|24, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, major|26), uint32(n))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, major|27), n)
+	}
+}
+
+func (e *cborEncoder) null() { e.buf = append(e.buf, cborNull) }
+
+func (e *cborEncoder) boolean(b bool) {
+	if b {
+		e.buf = append(e.buf, cborTrue)
+	} else {
+		e.buf = append(e.buf, cborFalse)
+	}
+}
+
+func (e *cborEncoder) integer(n int64) {
+	if n >= 0 {
+		e.head(cborUint, uint64(n))
+	} else {
+		e.head(cborNegint, uint64(-1-n))
+	}
+}
+
+func (e *cborEncoder) float(f float64) {
+	e.buf = binary.BigEndian.AppendUint64(append(e.buf, cborFloat64), math.Float64bits(f))
+}
+
+func (e *cborEncoder) text(s string) {
+	e.head(cborText, uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *cborEncoder) blob(b []byte) {
+	e.head(cborBytes, uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *cborEncoder) arrayHeader(n int) { e.head(cborArray, uint64(n)) }
+
+func (e *cborEncoder) mapHeader(n int) { e.head(cborMap, uint64(n)) }
+
+// cborDecoder reads a CBOR payload
+type cborDecoder struct {
+	payloadCursor
+}
+
+// head reads a data item's initial byte and its argument: the value of an
+// integer, the length of a string, array or map, or the number of a tag;
+// for major type 7 the raw bits of a float. Tags are skipped
+func (d *cborDecoder) head() (byte, uint64, error) {
+	for {
+		b, err := d.take(1)
+		if err != nil {
+			return 0, 0, err
+		}
+		major, info := b[0]&0xe0, b[0]&0x1f
+		var n uint64
+		switch {
+		case info < 24:
+			n = uint64(info)
+		case info <= 27:
+			field, err := d.take(1 << (info - 24))
+			if err != nil {
+				return 0, 0, err
+			}
+			for _, c := range field {
+				n = n<<8 | uint64(c)
+			}
+		default:
+			return 0, 0, fmt.Errorf("unsupported CBOR item %#x", b[0])
+		}
+		if major == cborTag {
+			continue // The tag's meaning is dropped; the value it wraps is read
+		}
+		if major == cborSimple {
+			return b[0], n, nil
+		}
+		return major, n, nil
+	}
+}
+
+func (d *cborDecoder) isNull() bool {
+	b, err := d.peek()
+	return err == nil && (b == cborNull || b == cborUndef)
+}
+
+func (d *cborDecoder) mapHeader() (int, error) {
+	major, n, err := d.head()
+	if err != nil {
+		return 0, err
+	}
+	if major != cborMap {
+		return 0, fmt.Errorf("expected a map, found major type %d", major>>5)
+	}
+	return d.checkLength(n)
+}
+
+func (d *cborDecoder) text() (string, error) {
+	major, n, err := d.head()
+	if err != nil {
+		return "", err
+	}
+	if major == cborNull {
+		return "", nil
+	}
+	if major != cborText {
+		return "", fmt.Errorf("expected a string, found major type %d", major>>5)
+	}
+	b, err := d.take(n)
+	return string(b), err
+}
+
+func (d *cborDecoder) blob() ([]byte, error) {
+	major, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	if major != cborBytes {
+		return nil, fmt.Errorf("expected binary data, found major type %d", major>>5)
+	}
+	return d.take(n)
+}
+
+func (d *cborDecoder) integer() (int64, error) {
+	major, n, err := d.head()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case major == cborUint && n <= math.MaxInt64:
+		return int64(n), nil
+	case major == cborNegint && n <= math.MaxInt64:
+		return -1 - int64(n), nil
+	}
+	return 0, fmt.Errorf("expected an integer, found major type %d", major>>5)
+}
+
+func (d *cborDecoder) value(depth int) (interface{}, error) {
+	if depth > maxValueDepth {
+		return nil, fmt.Errorf("payload nests more than %d levels deep", maxValueDepth)
+	}
+	major, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case cborUint:
+		return float64(n), nil
+	case cborNegint:
+		return -1 - float64(n), nil
+	case cborBytes:
+		// Appears only in embedded fields; kept as bytes for a field this engine doesn't know
+		return d.take(n)
+	case cborText:
+		b, err := d.take(n)
+		return string(b), err
+	case cborArray:
+		count, err := d.checkLength(n)
+		if err != nil {
+			return nil, err
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = d.value(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	case cborMap:
+		count, err := d.checkLength(n)
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[string]interface{}, count)
+		for i := 0; i < count; i++ {
+			key, err := d.text()
+			if err != nil {
+				return nil, err
+			}
+			if m[key], err = d.value(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case cborFalse, cborTrue:
+		return major == cborTrue, nil
+	case cborNull, cborUndef:
+		return nil, nil
+	case cborFloat16:
+		return float16(uint16(n)), nil
+	case cborFloat32:
+		return float64(math.Float32frombits(uint32(n))), nil
+	case cborFloat64:
+		return math.Float64frombits(n), nil
+	}
+	return nil, fmt.Errorf("unsupported CBOR item %#x", major)
+}
+
+// float16 converts the bits of an IEEE 754 half-precision float
+func float16(bits uint16) float64 {
+	exp := int(bits>>10) & 0x1f
+	frac := float64(bits & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(frac, -24)
+	case 0x1f:
+		f = math.Inf(1)
+		if frac != 0 {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(frac+1024, exp-25)
+	}
+	if bits&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
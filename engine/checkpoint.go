@@ -0,0 +1,77 @@
+package engine
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// autoCheckpoint is the state of automatic checkpoints
+type autoCheckpoint struct {
+	every   int           // Writes to the log that trigger a checkpoint
+	writes  atomic.Uint64 // Writes since the last checkpoint
+	running atomic.Bool   // A checkpoint is in progress
+	runs    atomic.Uint64 // Automatic checkpoints completed
+	lastRun atomic.Int64  // Unix nanoseconds of the last automatic checkpoint
+	lastErr atomic.Value  // Error message of the last failed automatic checkpoint
+}
+
+// checkpointOnWrite counts a write to the log and starts a checkpoint in the
+// background once enough have accumulated
+// It is called with the storage lock held, so must not wait on any lock
+func (db *Database) checkpointOnWrite() {
+	auto := db.checkpoints
+	if auto.writes.Add(1) < uint64(auto.every) {
+		return
+	}
+	if !auto.running.CompareAndSwap(false, true) {
+		return
+	}
+	db.background.Add(1)
+	go func() {
+		defer db.background.Done()
+		defer auto.running.Store(false)
+		db.autoCheckpoint()
+	}()
+}
+
+// autoCheckpoint takes a checkpoint unless the database is closing
+func (db *Database) autoCheckpoint() {
+	db.mu.RLock()
+	closed := db.closed
+	db.mu.RUnlock()
+	if closed {
+		return
+	}
+
+	auto := db.checkpoints
+	if err := db.Checkpoint(); err != nil {
+		auto.lastErr.Store(err.Error())
+		return
+	}
+	auto.lastErr.Store("")
+	auto.runs.Add(1)
+	auto.lastRun.Store(time.Now().UnixNano())
+}
+
+// Checkpoint writes a snapshot of every live document and index and restarts
+// the log after it, so the next open replays only the writes since
+// Like Compact, it drops superseded records; writes wait until it is done
+func (db *Database) Checkpoint() error {
+	if err := db.loadAll(); err != nil {
+		return err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	defer db.lockCollections()()
+
+	checkpointer, ok := db.storage.(checkpointer)
+	if !ok {
+		return fmt.Errorf("checkpoints are not supported by this storage engine")
+	}
+	if err := checkpointer.Checkpoint(db.currentRecords()); err != nil {
+		return err
+	}
+	db.compacted()
+	return nil
+}
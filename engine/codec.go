@@ -0,0 +1,419 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Record codecs, how binary record payloads are serialized (see WithRecordCodec)
+const (
+	CodecJSON        = "json"    // JSON, as in JSON-lines files; the default
+	CodecMessagePack = "msgpack" // MessagePack
+	CodecCBOR        = "cbor"    // CBOR (RFC 8949)
+)
+
+// headerCodecMask holds a binary file's codec in its header flags (see
+// binaryMagic); JSON files leave these bits clear
+const headerCodecMask = 0x06
+
+// codecFlags are the header flag bits naming each codec
+var codecFlags = map[string]byte{
+	CodecJSON:        0x00,
+	CodecMessagePack: 0x02,
+	CodecCBOR:        0x04,
+}
+
+// maxValueDepth bounds how deeply a decoded payload may nest, as
+// encoding/json does, so a corrupt payload can't exhaust the stack
+const maxValueDepth = 10000
+
+// errPayloadTruncated reports a payload that ends partway through a value
+var errPayloadTruncated = errors.New("record payload ends partway through a value")
+
+// validCodec checks that a codec is one this engine implements
+func validCodec(codec string) error {
+	if _, ok := codecFlags[codec]; !ok {
+		return fmt.Errorf("record codec %q is not supported (available: %s, %s, %s)", codec, CodecJSON, CodecMessagePack, CodecCBOR)
+	}
+	return nil
+}
+
+// codecFromFlags returns the codec named by a binary file's header flags
+func codecFromFlags(flags byte) (string, error) {
+	for codec, bits := range codecFlags {
+		if flags&headerCodecMask == bits {
+			return codec, nil
+		}
+	}
+	return "", fmt.Errorf("storage file uses an unknown record codec (flags %#x); upgrade tetodb to open it", flags&headerCodecMask)
+}
+
+// valueEncoder writes the values of a record payload in one codec
+type valueEncoder interface {
+	null()
+	boolean(b bool)
+	integer(n int64)
+	float(f float64)
+	text(s string)
+	blob(b []byte)
+	arrayHeader(n int)
+	mapHeader(n int)
+	bytes() []byte
+}
+
+// valueDecoder reads the values of a record payload in one codec
+// Numbers in documents decode as float64, as they do from JSON
+type valueDecoder interface {
+	mapHeader() (int, error)
+	text() (string, error)
+	integer() (int64, error) // An exact integer, for sequence numbers and times
+	blob() ([]byte, error)
+	isNull() bool
+	value(depth int) (interface{}, error)
+	remaining() int
+}
+
+// marshalRecord serializes a record payload in the given codec
+// Index definitions and file headers are embedded as JSON, so every codec
+// keeps their fields exactly as encoding/json does
+func marshalRecord(record StorageRecord, codec string) ([]byte, error) {
+	var e valueEncoder
+	switch codec {
+	case CodecMessagePack:
+		e = &msgpackEncoder{}
+	case CodecCBOR:
+		e = &cborEncoder{}
+	default:
+		return json.Marshal(record)
+	}
+
+	// Fields are written as the JSON tags name them, leaving out the same empty ones
+	fields := 3
+	for _, present := range []bool{record.Seq != 0, record.Index != nil, record.Attachment != nil, record.Header != nil, record.Time != 0, record.Op != ""} {
+		if present {
+			fields++
+		}
+	}
+	e.mapHeader(fields)
+	e.text("collection")
+	e.text(record.Collection)
+	e.text("id")
+	e.text(record.ID)
+	e.text("doc")
+	if record.Doc == nil {
+		e.null()
+	} else if err := encodeValue(e, record.Doc, 0); err != nil {
+		return nil, err
+	}
+	if record.Seq != 0 {
+		e.text("seq")
+		e.integer(int64(record.Seq))
+	}
+	if record.Index != nil {
+		if err := encodeEmbedded(e, "index", record.Index); err != nil {
+			return nil, err
+		}
+	}
+	if part := record.Attachment; part != nil {
+		// Written out rather than embedded, so the data is stored as raw bytes
+		e.text("attachment")
+		e.mapHeader(4)
+		e.text("name")
+		e.text(part.Name)
+		e.text("part")
+		e.integer(int64(part.Part))
+		e.text("parts")
+		e.integer(int64(part.Parts))
+		e.text("data")
+		e.blob(part.Data)
+	}
+	if record.Header != nil {
+		if err := encodeEmbedded(e, "header", record.Header); err != nil {
+			return nil, err
+		}
+	}
+	if record.Time != 0 {
+		e.text("time")
+		e.integer(record.Time)
+	}
+	if record.Op != "" {
+		e.text("op")
+		e.text(record.Op)
+	}
+	return e.bytes(), nil
+}
+
+// encodeEmbedded writes a field holding v as JSON
+func encodeEmbedded(e valueEncoder, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	e.text(key)
+	e.blob(data)
+	return nil
+}
+
+// encodeValue writes a document value. Types without a codec form of their
+// own are written as encoding/json would see them, so a document reads back
+// the same whichever codec stored it
+func encodeValue(e valueEncoder, v interface{}, depth int) error {
+	if depth > maxValueDepth {
+		return fmt.Errorf("document nests more than %d levels deep", maxValueDepth)
+	}
+	switch v := v.(type) {
+	case nil:
+		e.null()
+	case bool:
+		e.boolean(v)
+	case string:
+		e.text(v)
+	case float64:
+		return encodeFloat(e, v)
+	case float32:
+		return encodeFloat(e, float64(v))
+	case int:
+		e.integer(int64(v))
+	case int8:
+		e.integer(int64(v))
+	case int16:
+		e.integer(int64(v))
+	case int32:
+		e.integer(int64(v))
+	case int64:
+		e.integer(v)
+	case uint:
+		return encodeValue(e, uint64(v), depth)
+	case uint8:
+		e.integer(int64(v))
+	case uint16:
+		e.integer(int64(v))
+	case uint32:
+		e.integer(int64(v))
+	case uint64:
+		if v > math.MaxInt64 {
+			return encodeFloat(e, float64(v))
+		}
+		e.integer(int64(v))
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			e.integer(n)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return fmt.Errorf("invalid number %q", v)
+		}
+		return encodeFloat(e, f)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys) // As encoding/json orders them, so payloads are deterministic
+		e.mapHeader(len(keys))
+		for _, key := range keys {
+			e.text(key)
+			if err := encodeValue(e, v[key], depth+1); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		e.arrayHeader(len(v))
+		for _, item := range v {
+			if err := encodeValue(e, item, depth+1); err != nil {
+				return err
+			}
+		}
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		var generic interface{}
+		if err := json.Unmarshal(data, &generic); err != nil {
+			return err
+		}
+		return encodeValue(e, generic, depth)
+	}
+	return nil
+}
+
+// encodeFloat writes a number, as an integer when it is one that a float64
+// holds exactly, since most codecs store those more compactly
+// NaN and infinities are refused, as encoding/json refuses them
+func encodeFloat(e valueEncoder, f float64) error {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Errorf("unsupported number %v", f)
+	}
+	if f == math.Trunc(f) && math.Abs(f) <= 1<<53 {
+		e.integer(int64(f))
+		return nil
+	}
+	e.float(f)
+	return nil
+}
+
+// unmarshalRecord decodes a MessagePack or CBOR record payload, leaving out
+// the document, though noting whether there is one, if heads is set (see
+// recordHead)
+func unmarshalRecord(payload []byte, codec string, heads bool) (StorageRecord, error) {
+	var d valueDecoder
+	if codec == CodecCBOR {
+		d = &cborDecoder{payloadCursor{data: payload}}
+	} else {
+		d = &msgpackDecoder{payloadCursor{data: payload}}
+	}
+
+	var record StorageRecord
+	fields, err := d.mapHeader()
+	if err != nil {
+		return record, err
+	}
+	for i := 0; i < fields; i++ {
+		key, err := d.text()
+		if err != nil {
+			return record, err
+		}
+		switch key {
+		case "collection":
+			record.Collection, err = d.text()
+		case "id":
+			record.ID, err = d.text()
+		case "doc":
+			record.Doc, err = decodeDocument(d, heads)
+		case "seq":
+			var n int64
+			n, err = d.integer()
+			record.Seq = uint64(n)
+		case "time":
+			record.Time, err = d.integer()
+		case "op":
+			record.Op, err = d.text()
+		case "index":
+			record.Index = &IndexDefinition{}
+			err = decodeEmbedded(d, record.Index)
+		case "attachment":
+			record.Attachment, err = decodeAttachment(d, heads)
+		case "header":
+			record.Header = &FileHeader{}
+			err = decodeEmbedded(d, record.Header)
+		default:
+			_, err = d.value(1) // A field this engine doesn't know
+		}
+		if err != nil {
+			return record, fmt.Errorf("invalid record field %q: %w", key, err)
+		}
+	}
+	if d.remaining() != 0 {
+		return record, fmt.Errorf("record payload has %d bytes after the record", d.remaining())
+	}
+	return record, nil
+}
+
+// decodeDocument reads a record's document; for a head, only whether it is there
+func decodeDocument(d valueDecoder, heads bool) (map[string]interface{}, error) {
+	if d.isNull() {
+		_, err := d.value(1)
+		return nil, err
+	}
+	v, err := d.value(1)
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("document is not a map")
+	}
+	if heads {
+		return headDoc, nil
+	}
+	return doc, nil
+}
+
+// decodeAttachment reads a record's attachment chunk; for a head, without its data
+func decodeAttachment(d valueDecoder, heads bool) (*AttachmentPart, error) {
+	fields, err := d.mapHeader()
+	if err != nil {
+		return nil, err
+	}
+	part := &AttachmentPart{}
+	for i := 0; i < fields; i++ {
+		key, err := d.text()
+		if err != nil {
+			return nil, err
+		}
+		var n int64
+		switch key {
+		case "name":
+			part.Name, err = d.text()
+		case "part":
+			n, err = d.integer()
+			part.Part = int(n)
+		case "parts":
+			n, err = d.integer()
+			part.Parts = int(n)
+		case "data":
+			var data []byte
+			if data, err = d.blob(); err == nil && !heads {
+				part.Data = bytes.Clone(data)
+			}
+		default:
+			_, err = d.value(1)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return part, nil
+}
+
+// decodeEmbedded reads a field written by encodeEmbedded into v
+func decodeEmbedded(d valueDecoder, v interface{}) error {
+	data, err := d.blob()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// payloadCursor walks the bytes of a payload for the decoders
+type payloadCursor struct {
+	data []byte
+	pos  int
+}
+
+// take returns the next n bytes
+func (c *payloadCursor) take(n uint64) ([]byte, error) {
+	if n > uint64(len(c.data)-c.pos) {
+		return nil, errPayloadTruncated
+	}
+	b := c.data[c.pos : c.pos+int(n)]
+	c.pos += int(n)
+	return b, nil
+}
+
+// peek returns the next byte without consuming it
+func (c *payloadCursor) peek() (byte, error) {
+	if c.pos >= len(c.data) {
+		return 0, errPayloadTruncated
+	}
+	return c.data[c.pos], nil
+}
+
+func (c *payloadCursor) remaining() int {
+	return len(c.data) - c.pos
+}
+
+// checkLength refuses a declared collection length that the rest of the
+// payload can't hold, at least a byte per item, before anything is allocated
+func (c *payloadCursor) checkLength(n uint64) (int, error) {
+	if n > uint64(c.remaining()) {
+		return 0, errPayloadTruncated
+	}
+	return int(n), nil
+}
@@ -0,0 +1,207 @@
+package engine
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Collation configures locale-aware string comparison
+// Without a collation strings compare byte by byte, so "Zebra" sorts before
+// "apple" and "Äpfel" after "Zucker". With one, letters compare by their base
+// form first, then by accent, then by case:
+//
+//	apple < Apple < Äpfel < banana                  // Collation{Locale: "de"}
+//	apple == Apple                                  // Collation{CaseInsensitive: true}
+//	"item2" < "item10"                              // Collation{Numeric: true}
+//	"zebra" < "äpple"                               // Collation{Locale: "sv"}: å, ä, ö follow z
+//
+// Collations apply to filter equality and ranges, sorts and index keys (see Key)
+type Collation struct {
+	Locale          string `json:"locale"`          // Language tag such as "de", "sv" or "es-ES"; unknown languages use the root order
+	CaseInsensitive bool   `json:"caseInsensitive"` // Treat "a" and "A" as equal; accents still matter
+	Numeric         bool   `json:"numeric"`         // Compare runs of digits by their numeric value
+}
+
+// collationWeight is a letter's place in the order: primary separates base
+// letters, secondary separates accented forms of the same letter
+type collationWeight struct {
+	primary   uint32
+	secondary byte
+}
+
+// foldedLetters lists accented letters by base letter; a letter's secondary
+// weight is its position in the list, so accented forms sort after the base
+var foldedLetters = map[rune]string{
+	'a': "àáâãäåāăą",
+	'c': "çćĉċč",
+	'd': "ďđð",
+	'e': "èéêëēĕėęě",
+	'g': "ĝğġģ",
+	'h': "ĥħ",
+	'i': "ìíîïĩīĭįı",
+	'j': "ĵ",
+	'k': "ķ",
+	'l': "ĺļľŀł",
+	'n': "ñńņňŉ",
+	'o': "òóôõöøōŏő",
+	'r': "ŕŗř",
+	's': "śŝşš",
+	't': "ţťŧ",
+	'u': "ùúûüũūŭůűų",
+	'w': "ŵ",
+	'y': "ýÿŷ",
+	'z': "źżž",
+}
+
+// expandedLetters are letters that sort as a sequence of base letters
+var expandedLetters = map[rune]string{
+	'ß': "ss",
+	'æ': "ae",
+	'œ': "oe",
+	'þ': "th",
+}
+
+// rootWeights maps each accented lowercase letter onto its base letter
+var rootWeights = func() map[rune]collationWeight {
+	weights := make(map[rune]collationWeight)
+	for base, accented := range foldedLetters {
+		for i, r := range []rune(accented) {
+			weights[r] = collationWeight{primary: letterWeight(base), secondary: byte(i + 2)}
+		}
+	}
+	return weights
+}()
+
+// localeWeights holds per-language letters that sort as letters of their own
+// Each language's entries take precedence over rootWeights and expandedLetters
+var localeWeights = map[string]map[rune]collationWeight{
+	"sv": nordicWeights("åäö", map[rune]rune{'æ': 'ä', 'ø': 'ö'}),
+	"fi": nordicWeights("åäö", map[rune]rune{'æ': 'ä', 'ø': 'ö'}),
+	"da": nordicWeights("æøå", map[rune]rune{'ä': 'æ', 'ö': 'ø'}),
+	"nb": nordicWeights("æøå", map[rune]rune{'ä': 'æ', 'ö': 'ø'}),
+	"nn": nordicWeights("æøå", map[rune]rune{'ä': 'æ', 'ö': 'ø'}),
+	"no": nordicWeights("æøå", map[rune]rune{'ä': 'æ', 'ö': 'ø'}),
+	"es": {'ñ': {primary: letterWeight('n') + 1, secondary: 1}},
+}
+
+// nordicWeights places letters after z in the given order; variants sort
+// as accented forms of the letter they map onto
+func nordicWeights(letters string, variants map[rune]rune) map[rune]collationWeight {
+	weights := make(map[rune]collationWeight)
+	for i, r := range []rune(letters) {
+		weights[r] = collationWeight{primary: letterWeight('z') + uint32(i) + 1, secondary: 1}
+	}
+	for variant, letter := range variants {
+		weights[variant] = collationWeight{primary: weights[letter].primary, secondary: 2}
+	}
+	return weights
+}
+
+// letterWeight is the primary weight of an unaccented character
+// The low byte is left free for letters tailored in between (see localeWeights)
+func letterWeight(r rune) uint32 {
+	return uint32(r+1) << 8
+}
+
+// language returns the lowercase language subtag of the locale ("de-AT" -> "de")
+func (c *Collation) language() string {
+	lang, _, _ := strings.Cut(strings.ReplaceAll(c.Locale, "_", "-"), "-")
+	return strings.ToLower(lang)
+}
+
+// Key returns a sort key for s: comparing two keys byte by byte gives the same
+// result as Compare, and equal keys mean equal strings under this collation
+// Indexes store keys rather than raw strings so lookups honour the collation
+// A nil collation returns s unchanged
+func (c *Collation) Key(s string) string {
+	if c == nil {
+		return s
+	}
+	tailored := localeWeights[c.language()]
+
+	// Primary weights are 4 bytes per element; secondary and tertiary weights
+	// are one byte per element. Levels are separated by zero bytes, which sort
+	// below every weight, so a prefix orders before the longer string
+	var primary, secondary, tertiary []byte
+	appendElement := func(weight collationWeight, upper bool) {
+		primary = append(primary, byte(weight.primary>>24), byte(weight.primary>>16), byte(weight.primary>>8), byte(weight.primary))
+		secondary = append(secondary, weight.secondary)
+		caseWeight := byte(1)
+		if upper {
+			caseWeight = 2
+		}
+		tertiary = append(tertiary, caseWeight)
+	}
+
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		// A run of digits is one element ordered by length, then digits
+		if c.Numeric && r >= '0' && r <= '9' {
+			start := i
+			for i+1 < len(runes) && runes[i+1] >= '0' && runes[i+1] <= '9' {
+				i++
+			}
+			digits := string(runes[start : i+1])
+			trimmed := strings.TrimLeft(digits, "0")
+			zeros := min(len(digits)-len(trimmed), 254)
+
+			appendElement(collationWeight{primary: letterWeight('0'), secondary: byte(zeros + 1)}, false)
+			primary = append(primary, byte(len(trimmed)>>8), byte(len(trimmed)))
+			primary = append(primary, trimmed...)
+			continue
+		}
+
+		lower := unicode.ToLower(r)
+		upper := lower != r
+		if weight, ok := tailored[lower]; ok {
+			appendElement(weight, upper)
+			continue
+		}
+		if expansion, ok := expandedLetters[lower]; ok {
+			for _, base := range expansion {
+				// Mark the expansion so "ß" stays distinct from "ss"
+				appendElement(collationWeight{primary: letterWeight(base), secondary: 1}, upper)
+			}
+			secondary[len(secondary)-len(expansion)] = 0xff
+			continue
+		}
+		if weight, ok := rootWeights[lower]; ok {
+			appendElement(weight, upper)
+			continue
+		}
+		appendElement(collationWeight{primary: letterWeight(lower), secondary: 1}, upper)
+	}
+
+	key := make([]byte, 0, len(primary)+len(secondary)+len(tertiary)+8)
+	key = append(key, primary...)
+	key = append(key, 0, 0, 0, 0)
+	key = append(key, secondary...)
+	if !c.CaseInsensitive {
+		key = append(key, 0)
+		key = append(key, tertiary...)
+	}
+	return string(key)
+}
+
+// Compare orders two strings under the collation, returning -1, 0 or 1
+// A nil collation compares bytes, like strings.Compare
+func (c *Collation) Compare(a, b string) int {
+	if c == nil {
+		return strings.Compare(a, b)
+	}
+	return strings.Compare(c.Key(a), c.Key(b))
+}
+
+// compareValues is compareValues with strings ordered by the collation
+func (c *Collation) compareValues(a, b interface{}) int {
+	if c != nil {
+		aStr, aIsStr := a.(string)
+		bStr, bIsStr := b.(string)
+		if aIsStr && bIsStr {
+			return c.Compare(aStr, bStr)
+		}
+	}
+	return compareValues(a, b)
+}
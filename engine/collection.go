@@ -1,8 +1,11 @@
 package engine
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/google/uuid"
 )
@@ -10,18 +13,41 @@ import (
 // Collection represents a named collection of documents
 // Similar to a table in SQL or a collection in MongoDB
 type Collection struct {
-	name      string                            // Collection name
-	documents map[string]map[string]interface{} // Map of document ID -> document data
-	storage   *Storage                          // Reference to storage layer
-	mu        sync.RWMutex                      // Protects concurrent access to documents
+	name        string                            // Collection name
+	documents   documentStore                     // Map of document ID -> document data (see documentStore)
+	seqs        map[string]uint64                 // Map of document ID -> sequence of its latest record
+	times       map[string]int64                  // Map of document ID -> time of its latest record (see StorageRecord.Time)
+	attachments map[string]map[string]*attachment // Map of document ID -> attachment name -> attachment (see PutAttachment)
+	storage     StorageEngine                     // Reference to storage layer
+	db          *Database                         // Owning database, for stages like $lookup (nil if standalone)
+	frozen      *Snapshot                         // Snapshot this is a frozen copy in, which stages like $lookup read instead (see Database.Snapshot)
+	match       MatchOptions                      // How filters are evaluated
+	limits      Limits                            // Caps writes are checked against (see WithLimits)
+	zeroCopy    bool                              // Reads return stored documents rather than copies (see WithZeroCopyReads)
+	indexes     map[string]*fieldIndex            // Map of field path -> value index (see CreateIndex)
+	geoIndexes  map[string]*geoIndex              // Map of field path -> geohash index (see CreateGeoIndex)
+	textIndex   *textIndex                        // Inverted index for Search, if any (see CreateTextIndex)
+	stats       queryStats                        // Query counters, reported by Database.Stats
+	mu          sync.RWMutex                      // Protects the in-memory state; only held briefly by writes (see locks.go)
+	writers     sync.RWMutex                      // Shared by single-document writes, exclusive for the others (see lockAll)
+	stripes     [lockStripes]sync.Mutex           // Serialize writes to the same document (see lockDocument)
+}
+
+// queryStats counts the work done by queries
+// Queries run concurrently, so the counters are atomic
+type queryStats struct {
+	queries          atomic.Uint64 // Queries run
+	indexedQueries   atomic.Uint64 // Queries narrowed by an index
+	documentsScanned atomic.Uint64 // Documents the filters were evaluated against
 }
 
 // NewCollection creates a new Collection instance
-func NewCollection(name string, storage *Storage) *Collection {
+func NewCollection(name string, storage StorageEngine) *Collection {
 	return &Collection{
-		name:      name,
-		documents: make(map[string]map[string]interface{}),
-		storage:   storage,
+		name:    name,
+		seqs:    make(map[string]uint64),
+		times:   make(map[string]int64),
+		storage: storage,
 	}
 }
 
@@ -29,9 +55,6 @@ func NewCollection(name string, storage *Storage) *Collection {
 // If the document doesn't have an "id" field, one is generated automatically
 // Returns the document ID
 func (c *Collection) Insert(doc map[string]interface{}) (string, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
 	// Check if document has an ID, if not generate one
 	var id string
 	if idVal, exists := doc["id"]; exists {
@@ -42,162 +65,657 @@ func (c *Collection) Insert(doc map[string]interface{}) (string, error) {
 		doc["id"] = id
 	}
 
+	changes := c.db.changeSet()
+	defer changes.deliver()
+
+	unlock := c.lockInsert(id)
+	defer unlock()
+
 	// Check if document with this ID already exists
-	if _, exists := c.documents[id]; exists {
+	if _, exists := c.stored(id); exists {
 		return "", fmt.Errorf("document with id %s already exists", id)
 	}
+	stampVersion(doc, nil)
 
-	// Store document in memory
-	c.documents[id] = doc
-
-	// Persist to disk
+	// The store keeps its own copy, so the caller can go on changing doc
 	record := StorageRecord{
 		Collection: c.name,
 		ID:         id,
-		Doc:        doc,
+		Doc:        copyDocument(doc),
+		Time:       recordTime(),
+		Op:         OpInsert,
+	}
+	if err := c.checkLimits([]StorageRecord{record}, 1); err != nil {
+		return "", err
 	}
 
-	if err := c.storage.Append(record); err != nil {
-		// Rollback in-memory change if disk write fails
-		delete(c.documents, id)
+	// Persist to disk, then store in memory
+	seq, err := c.storage.Append(record)
+	if err != nil {
 		return "", fmt.Errorf("failed to persist document: %w", err)
 	}
+	record.Seq = seq
+	c.install(changes, record)
 
 	return id, nil
 }
 
+// InsertMany adds several documents as one batch: they are all checked
+// first, so a missing or duplicate ID inserts none of them, and then
+// persisted together in a single write and sync
+// Documents without an "id" field get one generated, as Insert does; if the
+// batch can't be written those generated IDs are removed again
+// Returns the document IDs, in the order of docs
+func (c *Collection) InsertMany(docs []map[string]interface{}) ([]string, error) {
+	changes := c.db.changeSet()
+	defer changes.deliver()
+
+	defer c.lockAll()()
+
+	ids := make([]string, len(docs))
+	generated := make([]bool, len(docs))
+	seen := make(map[string]bool, len(docs))
+	records := make([]StorageRecord, len(docs))
+	now := recordTime()
+	for i, doc := range docs {
+		if doc == nil {
+			return nil, fmt.Errorf("document %d is nil", i)
+		}
+		if idVal, exists := doc["id"]; exists {
+			ids[i] = fmt.Sprintf("%v", idVal)
+		} else {
+			ids[i] = uuid.New().String()
+			generated[i] = true
+		}
+
+		if _, exists := c.documents.get(ids[i]); exists || seen[ids[i]] {
+			return nil, fmt.Errorf("document with id %s already exists", ids[i])
+		}
+		seen[ids[i]] = true
+
+		records[i] = StorageRecord{
+			Collection: c.name,
+			ID:         ids[i],
+			Time:       now,
+			Op:         OpInsert,
+		}
+	}
+
+	for i, doc := range docs {
+		if generated[i] {
+			doc["id"] = ids[i]
+		}
+		stampVersion(doc, nil)
+		records[i].Doc = copyDocument(doc)
+	}
+	removeGenerated := func() {
+		for i, doc := range docs {
+			if generated[i] {
+				delete(doc, "id")
+			}
+		}
+	}
+
+	if err := c.checkLimits(records, len(records)); err != nil {
+		removeGenerated()
+		return nil, err
+	}
+	if err := c.storage.AppendBatch(records); err != nil {
+		removeGenerated()
+		return nil, fmt.Errorf("failed to persist documents: %w", err)
+	}
+
+	c.install(changes, records...)
+	return ids, nil
+}
+
 // FindByID retrieves a single document by its ID
 // Returns nil if document doesn't exist
+// Like every read, it returns a copy, so changing it doesn't change the
+// stored document (unless reads are zero-copy, see WithZeroCopyReads)
 func (c *Collection) FindByID(id string) map[string]interface{} {
 	c.mu.RLock()
-	defer c.mu.RUnlock()
+	doc := c.documents.doc(id)
+	c.mu.RUnlock()
 
-	return c.documents[id]
+	return c.detachDocument(doc)
 }
 
 // FindAll returns all documents in the collection
 func (c *Collection) FindAll() []map[string]interface{} {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-
-	docs := make([]map[string]interface{}, 0, len(c.documents))
-	for _, doc := range c.documents {
+	snapshot := c.snapshot()
+	docs := make([]map[string]interface{}, 0, snapshot.len())
+	for _, doc := range snapshot.all() {
 		docs = append(docs, doc)
 	}
-	return docs
+	return c.detach(docs)
 }
 
 // Find searches for documents matching the given filter
 // The filter is applied using the Query engine
-func (c *Collection) Find(filter map[string]interface{}) []map[string]interface{} {
+// An optional FindOptions can sort, paginate and project the results
+func (c *Collection) Find(filter map[string]interface{}, opts ...FindOptions) []map[string]interface{} {
+	docs, _ := c.FindContext(context.Background(), filter, opts...)
+	return docs
+}
+
+// FindContext is Find with cancellation: the scan stops early, returning
+// ctx's error, once ctx is cancelled or its deadline passes
+func (c *Collection) FindContext(ctx context.Context, filter map[string]interface{}, opts ...FindOptions) ([]map[string]interface{}, error) {
+	var options FindOptions
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+
+	docs, err := c.find(ctx, filter, options, nil)
+	return c.detach(docs), err
+}
+
+// find runs a query, recording execution details into plan when it is non-nil
+// The read lock is only held while the query is planned and the documents
+// snapshotted, not during the scan, so writers aren't held up by a long query
+// and it sees the collection as it was when it started
+func (c *Collection) find(ctx context.Context, filter map[string]interface{}, options FindOptions, plan *QueryPlan) ([]map[string]interface{}, error) {
+	// A per-query collation overrides the database default for both the filter and the sort
+	match := c.match
+	if options.Collation != nil {
+		match.Collation = options.Collation
+	}
+	options.Collation = match.Collation
+
+	// Without sorting we can stop as soon as the requested page is filled
+	stopAt := -1
+	if len(options.Sort) == 0 && options.Limit > 0 {
+		stopAt = options.Skip + options.Limit
+	}
+
+	// $near results are ordered by distance unless an explicit sort is given
+	nearField, origin, near := nearOrigin(filter)
+	near = near && len(options.Sort) == 0
+	if near {
+		stopAt = -1
+	}
+
+	scanned := 0
+	results := make([]map[string]interface{}, 0)
+	var scanErr error
+	visit := func(doc map[string]interface{}) bool {
+		if scanErr = scanCanceled(ctx, scanned); scanErr != nil {
+			return false
+		}
+		scanned++
+		if len(filter) > 0 && !match.Matches(doc, filter) {
+			return true
+		}
+		results = append(results, doc)
+		return len(results) != stopAt
+	}
+
+	docs, ids, ok, err := c.candidates(filter, match, options.Hint, plan)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		for _, id := range ids {
+			if doc, exists := docs.get(id); exists && !visit(doc) {
+				break
+			}
+		}
+	} else {
+		for _, doc := range docs.all() {
+			if !visit(doc) {
+				break
+			}
+		}
+	}
+
+	c.stats.queries.Add(1)
+	c.stats.documentsScanned.Add(uint64(scanned))
+	if scanErr != nil {
+		return nil, scanErr
+	}
+
+	if plan != nil {
+		plan.DocumentsScanned = scanned
+		plan.DocumentsMatched = len(results)
+	}
+
+	if near {
+		sortByDistance(results, nearField, origin)
+	}
+	return options.apply(results), nil
+}
+
+// candidates snapshots the documents under the read lock, along with the IDs
+// of those an index narrows the query to; ok is false if no index applies
+// and every document has to be scanned
+func (c *Collection) candidates(filter map[string]interface{}, match MatchOptions, hintSpec string, plan *QueryPlan) (docs *documentStore, ids []string, ok bool, err error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	if len(filter) == 0 {
-		// No filter, return all documents
-		return c.FindAll()
+	hint, err := c.parseHint(hintSpec)
+	if err != nil {
+		return docs, nil, false, err
 	}
 
-	var results []map[string]interface{}
-	for _, doc := range c.documents {
-		if MatchesFilter(doc, filter) {
-			results = append(results, doc)
+	// A geo index narrows the scan to documents in the queried area, and
+	// field indexes to documents holding the queried values
+	ids, index, ok := c.geoCandidates(filter, hint)
+	strategy := "geo_index"
+	if !ok {
+		var indexes []string
+		var considered []PlanCandidate
+		ids, indexes, considered, ok = c.indexCandidates(filter, match, hint)
+		if plan != nil {
+			plan.Candidates = considered
+		}
+		index = strings.Join(indexes, ",")
+		strategy = "index_scan"
+		if len(indexes) > 1 {
+			strategy = "index_intersection"
 		}
 	}
+	if !ok && hint.only != "" {
+		return docs, nil, false, fmt.Errorf("hint: index %s can't be used for this query", hint.only)
+	}
+	if ok {
+		c.stats.indexedQueries.Add(1)
+		if plan != nil {
+			plan.Strategy = strategy
+			plan.IndexUsed = true
+			plan.Index = index
+		}
+	}
+	return c.documents.snapshot(), ids, ok, nil
+}
 
-	return results
+// updateIndexes keeps the collection's indexes in step with a document change
+// oldDoc is nil for an insert and newDoc is nil for a delete
+// Caller must hold the write lock
+func (c *Collection) updateIndexes(id string, oldDoc, newDoc map[string]interface{}) {
+	for _, index := range c.indexes {
+		if oldDoc != nil {
+			index.remove(id)
+		}
+		if newDoc != nil {
+			index.add(id, newDoc)
+		}
+	}
+	for _, index := range c.geoIndexes {
+		if oldDoc != nil {
+			index.remove(id)
+		}
+		if newDoc != nil {
+			index.add(id, newDoc)
+		}
+	}
+	if c.textIndex != nil {
+		if oldDoc != nil {
+			c.textIndex.remove(id)
+		}
+		if newDoc != nil {
+			c.textIndex.add(id, newDoc)
+		}
+	}
+}
+
+// FindEach calls fn with a copy of each matching document as soon as it is found,
+// so processing can start before the scan finishes and no result slice is built
+// Return false from fn to stop early. The scan reads a snapshot of the
+// collection taken when it starts, without holding the lock, so fn may call
+// back into the collection; writes made meanwhile don't show in the scan
+func (c *Collection) FindEach(filter map[string]interface{}, fn func(doc map[string]interface{}) bool) {
+	c.forEachMatch(filter, fn)
+}
+
+// Stream delivers copies of matching documents over a channel
+// A goroutine feeds the channel, blocking when bufSize documents are pending,
+// so a slow consumer applies backpressure instead of building a large slice
+// The stream reads a snapshot of the collection taken when it starts, so the
+// lock isn't held while waiting on the consumer and writes made meanwhile
+// don't show in it
+//
+// The returned cancel function stops the stream early and must be called if
+// the consumer stops reading before the channel is closed. The channel is
+// closed once the feeding goroutine has exited, whether it finished or was cancelled
+func (c *Collection) Stream(filter map[string]interface{}, bufSize int) (<-chan map[string]interface{}, func()) {
+	stop := make(chan struct{})
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() { close(stop) })
+	}
+	return c.stream(filter, bufSize, stop), cancel
+}
+
+// StreamContext is Stream stopped by a context rather than a cancel function
+// The channel is closed when every match has been sent or ctx is done
+func (c *Collection) StreamContext(ctx context.Context, filter map[string]interface{}, bufSize int) <-chan map[string]interface{} {
+	return c.stream(filter, bufSize, ctx.Done())
+}
+
+// stream feeds matching documents into a channel until they run out or stop is closed
+func (c *Collection) stream(filter map[string]interface{}, bufSize int, stop <-chan struct{}) <-chan map[string]interface{} {
+	if bufSize < 0 {
+		bufSize = 0
+	}
+
+	out := make(chan map[string]interface{}, bufSize)
+	docs := c.snapshot()
+
+	go func() {
+		defer close(out)
+
+		c.forEachIn(docs, filter, func(doc map[string]interface{}) bool {
+			select {
+			case out <- doc:
+				return true
+			case <-stop:
+				return false
+			}
+		})
+	}()
+
+	return out
+}
+
+// forEachMatch calls fn with a copy of each matching document until fn returns false
+func (c *Collection) forEachMatch(filter map[string]interface{}, fn func(doc map[string]interface{}) bool) {
+	c.forEachIn(c.snapshot(), filter, fn)
+}
+
+// snapshot returns the documents as they are now, so a scan doesn't hold the
+// lock (see documentStore)
+func (c *Collection) snapshot() *documentStore {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.documents.snapshot()
+}
+
+// forEachIn visits a snapshot of the documents and calls fn with a copy of
+// each match until fn returns false
+func (c *Collection) forEachIn(docs *documentStore, filter map[string]interface{}, fn func(doc map[string]interface{}) bool) {
+	for _, doc := range docs.all() {
+		if !c.match.Matches(doc, filter) {
+			continue
+		}
+		if !fn(copyDocument(doc)) {
+			return
+		}
+	}
 }
 
 // Update modifies an existing document
-// Merges the update fields into the existing document
+// A plain update merges its fields into the existing document; an update made
+// of operators ($set, $unset, $inc, $push, $pull, $rename) applies them instead
+// (see updatePlan). Nothing is changed if any operator fails
 func (c *Collection) Update(id string, update map[string]interface{}) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	plan, err := parseUpdate(update)
+	if err != nil {
+		return fmt.Errorf("invalid update: %w", err)
+	}
+
+	changes := c.db.changeSet()
+	defer changes.deliver()
+
+	unlock := c.lockDocument(id)
+	defer unlock()
 
 	// Check if document exists
-	existingDoc, exists := c.documents[id]
+	existingDoc, exists := c.stored(id)
 	if !exists {
 		return fmt.Errorf("document with id %s not found", id)
 	}
 
-	// Merge update into existing document
-	for key, value := range update {
-		existingDoc[key] = value
+	return c.applyUpdate(changes, id, existingDoc, plan)
+}
+
+// UpdateWhere updates a document as Update does, but only if it still matches
+// condition; the check and the write are made under the collection lock, so
+// no other write can come between them. This makes it a compare-and-swap,
+// e.g. for moving a document from one state to the next:
+//
+//	coll.UpdateWhere(id, map[string]interface{}{"status": "pending"}, map[string]interface{}{"$set": map[string]interface{}{"status": "paid"}})
+//
+// Returns whether the update was applied
+func (c *Collection) UpdateWhere(id string, condition, update map[string]interface{}) (bool, error) {
+	plan, err := parseUpdate(update)
+	if err != nil {
+		return false, fmt.Errorf("invalid update: %w", err)
 	}
 
-	// Ensure ID is preserved
-	existingDoc["id"] = id
+	changes := c.db.changeSet()
+	defer changes.deliver()
 
-	// Persist to disk
-	record := StorageRecord{
-		Collection: c.name,
-		ID:         id,
-		Doc:        existingDoc,
+	unlock := c.lockDocument(id)
+	defer unlock()
+
+	existingDoc, exists := c.stored(id)
+	if !exists {
+		return false, fmt.Errorf("document with id %s not found", id)
+	}
+	if !c.match.Matches(existingDoc, condition) {
+		return false, nil
+	}
+
+	if err := c.applyUpdate(changes, id, existingDoc, plan); err != nil {
+		return false, err
 	}
+	return true, nil
+}
+
+// Replace overwrites an existing document entirely, keeping its ID
+// Unlike Update, fields missing from doc are removed from the stored document
+// doc may contain the same "id" but can't change it, and can't use update operators
+func (c *Collection) Replace(id string, doc map[string]interface{}) error {
+	plan, err := parseReplacement(id, doc)
+	if err != nil {
+		return fmt.Errorf("invalid replacement: %w", err)
+	}
+
+	changes := c.db.changeSet()
+	defer changes.deliver()
+
+	unlock := c.lockDocument(id)
+	defer unlock()
+
+	// Check if document exists
+	existingDoc, exists := c.stored(id)
+	if !exists {
+		return fmt.Errorf("document with id %s not found", id)
+	}
+
+	return c.applyUpdate(changes, id, existingDoc, plan)
+}
+
+// ReplaceOne overwrites the first document matching the filter, as Replace does
+// If several documents match, which one is replaced is unspecified
+// Returns the ID of the replaced document, or "" if nothing matched
+func (c *Collection) ReplaceOne(filter map[string]interface{}, doc map[string]interface{}) (string, error) {
+	changes := c.db.changeSet()
+	defer changes.deliver()
 
-	if err := c.storage.Append(record); err != nil {
+	defer c.lockAll()()
+
+	for id, existingDoc := range c.documents.all() {
+		if !c.match.Matches(existingDoc, filter) {
+			continue
+		}
+
+		plan, err := parseReplacement(id, doc)
+		if err != nil {
+			return "", fmt.Errorf("invalid replacement: %w", err)
+		}
+		if err := c.applyUpdate(changes, id, existingDoc, plan); err != nil {
+			return "", err
+		}
+		return id, nil
+	}
+
+	return "", nil
+}
+
+// applyUpdate applies an update plan to a stored document and persists the result
+// The in-memory document is only replaced once the record has been written
+// Caller must have locked the document (see lockDocument and lockAll), and
+// delivers changes (see install)
+func (c *Collection) applyUpdate(changes *changeSet, id string, doc map[string]interface{}, plan *updatePlan) error {
+	record, err := c.updateRecord(id, doc, plan)
+	if err != nil {
+		return err
+	}
+	if err := c.checkLimits([]StorageRecord{record}, 0); err != nil {
+		return err
+	}
+
+	seq, err := c.storage.Append(record)
+	if err != nil {
 		return fmt.Errorf("failed to persist update: %w", err)
 	}
+	record.Seq = seq
+	c.install(changes, record)
 
 	return nil
 }
 
+// updateRecord applies an update plan to a stored document and returns the
+// record of the result, leaving the stored document as it is
+func (c *Collection) updateRecord(id string, doc map[string]interface{}, plan *updatePlan) (StorageRecord, error) {
+	updated, err := plan.apply(c.match, doc)
+	if err != nil {
+		return StorageRecord{}, fmt.Errorf("failed to update document %s: %w", id, err)
+	}
+
+	// Ensure ID is preserved
+	updated["id"] = id
+	stampVersion(updated, doc)
+
+	return StorageRecord{
+		Collection: c.name,
+		ID:         id,
+		Doc:        updated,
+		Time:       recordTime(),
+		Op:         OpUpdate,
+	}, nil
+}
+
 // UpdateMany updates all documents matching the filter
+// The update is a plain or operator update, as for Update
+// The updated documents are persisted as a single batch and installed
+// together, so reads see either none or all of them updated, but aren't
+// held up while the batch is written
 // Returns the number of documents updated
 func (c *Collection) UpdateMany(filter map[string]interface{}, update map[string]interface{}) (int, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	return c.UpdateManyContext(context.Background(), filter, update)
+}
 
-	count := 0
-	for id, doc := range c.documents {
-		if MatchesFilter(doc, filter) {
-			// Merge update into document
-			for key, value := range update {
-				doc[key] = value
-			}
-			doc["id"] = id
+// UpdateManyContext is UpdateMany with cancellation
+// Cancelling while the documents are matched and updated updates none of them
+func (c *Collection) UpdateManyContext(ctx context.Context, filter map[string]interface{}, update map[string]interface{}) (int, error) {
+	plan, err := parseUpdate(update)
+	if err != nil {
+		return 0, fmt.Errorf("invalid update: %w", err)
+	}
 
-			// Persist to disk
-			record := StorageRecord{
-				Collection: c.name,
-				ID:         id,
-				Doc:        doc,
-			}
+	changes := c.db.changeSet()
+	defer changes.deliver()
 
-			if err := c.storage.Append(record); err != nil {
-				return count, fmt.Errorf("failed to persist update: %w", err)
-			}
+	defer c.lockAll()()
 
-			count++
+	return c.updateMatching(ctx, changes, filter, nil, plan)
+}
+
+// UpdateManyIf updates documents matching matchFilter that also still satisfy
+// conditionFilter at the moment they are written
+// This makes bulk updates conditional, e.g. only advancing documents whose
+// status hasn't already been changed by an earlier UpdateMany
+// Returns the number of documents actually updated
+func (c *Collection) UpdateManyIf(matchFilter, conditionFilter, update map[string]interface{}) (int, error) {
+	plan, err := parseUpdate(update)
+	if err != nil {
+		return 0, fmt.Errorf("invalid update: %w", err)
+	}
+
+	changes := c.db.changeSet()
+	defer changes.deliver()
+
+	defer c.lockAll()()
+
+	return c.updateMatching(context.Background(), changes, matchFilter, conditionFilter, plan)
+}
+
+// updateMatching applies an update plan to every document matching filter,
+// persisting the results as one batch and installing them at once
+// If condition is non-nil, each document must also match it
+// Caller must lock the collection (see lockAll), and delivers changes (see install)
+func (c *Collection) updateMatching(ctx context.Context, changes *changeSet, filter, condition map[string]interface{}, plan *updatePlan) (int, error) {
+	var records []StorageRecord
+	scanned := 0
+	for id, doc := range c.documents.all() {
+		if err := scanCanceled(ctx, scanned); err != nil {
+			return 0, err
 		}
+		scanned++
+
+		if !c.match.Matches(doc, filter) {
+			continue
+		}
+
+		// Checked along with the filter, under the collection lock, so no
+		// other write can change the document before it is written
+		if condition != nil && !c.match.Matches(doc, condition) {
+			continue
+		}
+
+		record, err := c.updateRecord(id, doc, plan)
+		if err != nil {
+			return 0, err
+		}
+		records = append(records, record)
+	}
+	if len(records) == 0 {
+		return 0, nil
+	}
+
+	if err := c.checkLimits(records, 0); err != nil {
+		return 0, err
+	}
+	if err := c.storage.AppendBatch(records); err != nil {
+		return 0, fmt.Errorf("failed to persist update: %w", err)
 	}
+	c.install(changes, records...)
 
-	return count, nil
+	return len(records), nil
 }
 
 // Delete removes a document from the collection
 func (c *Collection) Delete(id string) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	changes := c.db.changeSet()
+	defer changes.deliver()
+
+	unlock := c.lockDocument(id)
+	defer unlock()
 
 	// Check if document exists
-	if _, exists := c.documents[id]; !exists {
+	if _, exists := c.stored(id); !exists {
 		return fmt.Errorf("document with id %s not found", id)
 	}
 
-	// Remove from memory
-	delete(c.documents, id)
-
-	// Persist deletion to disk (nil document indicates deletion)
+	// Persist deletion to disk (nil document indicates deletion), then remove from memory
 	record := StorageRecord{
 		Collection: c.name,
 		ID:         id,
 		Doc:        nil,
+		Time:       recordTime(),
+		Op:         OpDelete,
 	}
 
-	if err := c.storage.Append(record); err != nil {
+	seq, err := c.storage.Append(record)
+	if err != nil {
 		return fmt.Errorf("failed to persist deletion: %w", err)
 	}
+	record.Seq = seq
+	c.install(changes, record)
 
 	return nil
 }
@@ -205,38 +723,117 @@ func (c *Collection) Delete(id string) error {
 // DeleteMany deletes all documents matching the filter
 // Returns the number of documents deleted
 func (c *Collection) DeleteMany(filter map[string]interface{}) (int, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	return c.DeleteManyContext(context.Background(), filter)
+}
 
-	count := 0
-	idsToDelete := []string{}
+// DeleteManyContext is DeleteMany with cancellation
+// The deletions are persisted as a single batch and installed together, so
+// reads see either none or all of the documents deleted; cancelling while
+// matching deletes nothing
+func (c *Collection) DeleteManyContext(ctx context.Context, filter map[string]interface{}) (int, error) {
+	changes := c.db.changeSet()
+	defer changes.deliver()
+
+	defer c.lockAll()()
 
 	// Find all matching documents
-	for id, doc := range c.documents {
-		if MatchesFilter(doc, filter) {
-			idsToDelete = append(idsToDelete, id)
+	var records []StorageRecord
+	now := recordTime()
+	scanned := 0
+	for id, doc := range c.documents.all() {
+		if err := scanCanceled(ctx, scanned); err != nil {
+			return 0, err
 		}
+		scanned++
+
+		if c.match.Matches(doc, filter) {
+			records = append(records, StorageRecord{
+				Collection: c.name,
+				ID:         id,
+				Doc:        nil,
+				Time:       now,
+				Op:         OpDelete,
+			})
+		}
+	}
+	if len(records) == 0 {
+		return 0, nil
 	}
 
-	// Delete each document
-	for _, id := range idsToDelete {
-		delete(c.documents, id)
+	// Persist the deletions to disk, then remove the documents from memory
+	if err := c.storage.AppendBatch(records); err != nil {
+		return 0, fmt.Errorf("failed to persist deletion: %w", err)
+	}
+	c.install(changes, records...)
 
-		// Persist deletion to disk
-		record := StorageRecord{
-			Collection: c.name,
-			ID:         id,
-			Doc:        nil,
+	return len(records), nil
+}
+
+// CopyTo copies all documents matching the filter into the destination collection
+// Each copy is a deep copy, so later changes to either collection don't affect the other
+// If preserveIDs is true the source IDs are kept, otherwise new IDs are generated
+// The copies are persisted as a single batch; if any document can't be inserted
+// (e.g. an ID already exists in the destination) nothing is copied
+// Collections have no schemas or unique indexes yet, so the only constraints
+// checked are unique IDs and the destination's limits (see WithLimits)
+// Returns the number of documents copied
+func (c *Collection) CopyTo(dst *Collection, filter map[string]interface{}, preserveIDs bool) (int, error) {
+	if dst == nil {
+		return 0, fmt.Errorf("destination collection is nil")
+	}
+
+	// Snapshot matching documents first so we never hold both collection locks
+	copies := make(map[string]map[string]interface{})
+	for id, doc := range c.snapshot().all() {
+		if c.match.Matches(doc, filter) {
+			copies[id] = copyDocument(doc)
+		}
+	}
+
+	changes := dst.db.changeSet()
+	defer changes.deliver()
+
+	defer dst.lockAll()()
+
+	// Assign IDs and validate every document before touching the destination
+	records := make([]StorageRecord, 0, len(copies))
+	seen := make(map[string]bool, len(copies))
+	now := recordTime()
+	for srcID, doc := range copies {
+		id := srcID
+		if !preserveIDs {
+			id = uuid.New().String()
 		}
+		doc["id"] = id
 
-		if err := c.storage.Append(record); err != nil {
-			return count, fmt.Errorf("failed to persist deletion: %w", err)
+		if _, exists := dst.documents.get(id); exists || seen[id] {
+			return 0, fmt.Errorf("document with id %s already exists", id)
 		}
+		seen[id] = true
+		stampVersion(doc, nil)
+
+		records = append(records, StorageRecord{
+			Collection: dst.name,
+			ID:         id,
+			Doc:        doc,
+			Time:       now,
+			Op:         OpInsert,
+		})
+	}
 
-		count++
+	if err := dst.checkLimits(records, len(records)); err != nil {
+		return 0, err
 	}
 
-	return count, nil
+	// Persist the whole batch at once
+	if err := dst.storage.AppendBatch(records); err != nil {
+		return 0, fmt.Errorf("failed to persist copies: %w", err)
+	}
+
+	// Only apply to memory once the batch is on disk
+	dst.install(changes, records...)
+
+	return len(records), nil
 }
 
 // Count returns the number of documents in the collection
@@ -244,21 +841,19 @@ func (c *Collection) Count() int {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	return len(c.documents)
+	return c.documents.len()
 }
 
 // CountWhere returns the number of documents matching the filter
 func (c *Collection) CountWhere(filter map[string]interface{}) int {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-
+	snapshot := c.snapshot()
 	if len(filter) == 0 {
-		return len(c.documents)
+		return snapshot.len()
 	}
 
 	count := 0
-	for _, doc := range c.documents {
-		if MatchesFilter(doc, filter) {
+	for _, doc := range snapshot.all() {
+		if c.match.Matches(doc, filter) {
 			count++
 		}
 	}
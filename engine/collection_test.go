@@ -0,0 +1,401 @@
+package engine
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openTestDatabase opens a database in a temporary directory, closed when
+// the test ends
+func openTestDatabase(t *testing.T, opts ...Option) *Database {
+	t.Helper()
+	db, err := OpenDatabase(filepath.Join(t.TempDir(), "test.db"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// insertCounters inserts n documents {group, v: 0}
+func insertCounters(t *testing.T, coll *Collection, group string, n int) {
+	t.Helper()
+	docs := make([]map[string]interface{}, n)
+	for i := range docs {
+		docs[i] = map[string]interface{}{"group": group, "v": 0}
+	}
+	if _, err := coll.InsertMany(docs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestBulkWritesAreAtomicToReaders checks that readers never see an
+// UpdateMany or DeleteMany half applied
+func TestBulkWritesAreAtomicToReaders(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(coll *Collection, round int) error
+		check func(docs []map[string]interface{}) (bool, string)
+	}{
+		{
+			name: "UpdateMany",
+			write: func(coll *Collection, round int) error {
+				_, err := coll.UpdateMany(map[string]interface{}{}, map[string]interface{}{"$inc": map[string]interface{}{"v": 1}})
+				return err
+			},
+			check: func(docs []map[string]interface{}) (bool, string) {
+				first, _ := toFloat64(docs[0]["v"])
+				for _, doc := range docs {
+					if v, _ := toFloat64(doc["v"]); v != first {
+						return false, "documents hold different counts"
+					}
+				}
+				return true, ""
+			},
+		},
+		{
+			name: "DeleteMany",
+			write: func(coll *Collection, round int) error {
+				if _, err := coll.DeleteMany(map[string]interface{}{"group": "a"}); err != nil {
+					return err
+				}
+				docs := make([]map[string]interface{}, 50)
+				for i := range docs {
+					docs[i] = map[string]interface{}{"group": "a", "v": round}
+				}
+				_, err := coll.InsertMany(docs)
+				return err
+			},
+			check: func(docs []map[string]interface{}) (bool, string) {
+				// InsertMany is atomic too, so the group is always whole or gone
+				if len(docs) != 0 && len(docs) != 50 {
+					return false, "group partly deleted"
+				}
+				return true, ""
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDatabase(t)
+			coll := db.GetCollection("counters")
+			insertCounters(t, coll, "a", 50)
+
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer close(done)
+				for round := 1; round <= 50; round++ {
+					if err := tt.write(coll, round); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+
+			for reads := 0; ; reads++ {
+				select {
+				case <-done:
+					wg.Wait()
+					return
+				default:
+				}
+				docs := coll.Find(map[string]interface{}{"group": "a"})
+				if len(docs) == 0 {
+					continue
+				}
+				if ok, why := tt.check(docs); !ok {
+					t.Fatalf("read %d: %s", reads, why)
+				}
+			}
+		})
+	}
+}
+
+func TestCopyTo(t *testing.T) {
+	tests := []struct {
+		name        string
+		filter      map[string]interface{}
+		preserveIDs bool
+		existing    []string // IDs already in the destination
+		want        int
+		wantErr     bool
+	}{
+		{name: "filtered subset with new IDs", filter: map[string]interface{}{"month": 3}, want: 2},
+		{name: "filtered subset keeping IDs", filter: map[string]interface{}{"month": 3}, preserveIDs: true, want: 2},
+		{name: "everything", filter: map[string]interface{}{}, preserveIDs: true, want: 3},
+		{name: "no matches", filter: map[string]interface{}{"month": 12}, want: 0},
+		{name: "an ID collision copies nothing", filter: map[string]interface{}{}, preserveIDs: true, existing: []string{"r2"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDatabase(t)
+			src, dst := db.GetCollection("records"), db.GetCollection("archive")
+			for _, doc := range []map[string]interface{}{
+				{"id": "r1", "month": 3, "tags": []interface{}{"a"}},
+				{"id": "r2", "month": 3, "tags": []interface{}{"b"}},
+				{"id": "r3", "month": 4, "tags": []interface{}{"c"}},
+			} {
+				if _, err := src.Insert(doc); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, id := range tt.existing {
+				if _, err := dst.Insert(map[string]interface{}{"id": id}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			n, err := src.CopyTo(dst, tt.filter, tt.preserveIDs)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if got := dst.Count(); got != len(tt.existing) {
+					t.Fatalf("destination holds %d documents after a failed copy, want %d", got, len(tt.existing))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.want || dst.Count() != tt.want {
+				t.Fatalf("copied %d, destination holds %d, want %d", n, dst.Count(), tt.want)
+			}
+
+			// Each copy matches its source apart from the ID, unless IDs are kept
+			sources := src.Find(tt.filter)
+			for _, copied := range dst.FindAll() {
+				id := copied["id"].(string)
+				if original := src.FindByID(id); (original != nil) != tt.preserveIDs {
+					t.Fatalf("copy %s: got a source with the same ID %v, want %v", id, original != nil, tt.preserveIDs)
+				}
+				var source map[string]interface{}
+				for _, s := range sources {
+					if reflect.DeepEqual(s["tags"], copied["tags"]) {
+						source = s
+					}
+				}
+				if source == nil || !reflect.DeepEqual(source["month"], copied["month"]) {
+					t.Fatalf("copy %v matches no source document", copied)
+				}
+			}
+
+			// Copies are deep: changing the source leaves them alone
+			if err := src.Update("r1", map[string]interface{}{"tags": []interface{}{"changed"}}); err != nil {
+				t.Fatal(err)
+			}
+			for _, copied := range dst.FindAll() {
+				if reflect.DeepEqual(copied["tags"], []interface{}{"changed"}) {
+					t.Fatal("changing a source document changed its copy")
+				}
+			}
+		})
+	}
+}
+
+// TestUpdateManyIf checks that only the documents matching both filters are
+// updated, and that the condition is checked atomically with the write, so
+// concurrent writers flipping it never have a document updated twice or
+// after it stopped matching
+func TestUpdateManyIf(t *testing.T) {
+	t.Run("Condition", func(t *testing.T) {
+		db := openTestDatabase(t)
+		coll := db.GetCollection("orders")
+		if _, err := coll.InsertMany([]map[string]interface{}{
+			{"id": "p1", "group": "a", "status": "pending"},
+			{"id": "p2", "group": "a", "status": "pending"},
+			{"id": "s1", "group": "a", "status": "shipped"},
+			{"id": "b1", "group": "b", "status": "pending"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		n, err := coll.UpdateManyIf(map[string]interface{}{"group": "a"}, map[string]interface{}{"status": "pending"}, map[string]interface{}{"$set": map[string]interface{}{"status": "paid"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Fatalf("updated %d documents, want 2", n)
+		}
+		for id, want := range map[string]string{"p1": "paid", "p2": "paid", "s1": "shipped", "b1": "pending"} {
+			if got := coll.FindByID(id)["status"]; got != want {
+				t.Fatalf("%s has status %v, want %s", id, got, want)
+			}
+		}
+
+		// Nothing matches the condition any more, so a second run updates nothing
+		if n, err := coll.UpdateManyIf(map[string]interface{}{"group": "a"}, map[string]interface{}{"status": "pending"}, map[string]interface{}{"$set": map[string]interface{}{"status": "paid"}}); err != nil || n != 0 {
+			t.Fatalf("second run updated %d documents (%v), want 0", n, err)
+		}
+	})
+
+	t.Run("ConcurrentWriters", func(t *testing.T) {
+		db := openTestDatabase(t)
+		coll := db.GetCollection("orders")
+		const count = 200
+		ids := make([]string, count)
+		for i := range ids {
+			id, err := coll.Insert(map[string]interface{}{"group": "a", "status": "pending"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids[i] = id
+		}
+
+		// Two bulk updates race to pay the pending orders while another
+		// writer cancels them, one at a time, if they are still pending
+		var wg sync.WaitGroup
+		var paid [2]int
+		for i := range paid {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 20 {
+					n, err := coll.UpdateManyIf(map[string]interface{}{"group": "a"}, map[string]interface{}{"status": "pending"}, map[string]interface{}{"$set": map[string]interface{}{"status": "paid"}, "$inc": map[string]interface{}{"payments": 1}})
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					paid[i] += n
+				}
+			}()
+		}
+		cancelled := 0
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, id := range ids {
+				ok, err := coll.UpdateWhere(id, map[string]interface{}{"status": "pending"}, map[string]interface{}{"$set": map[string]interface{}{"status": "cancelled"}})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if ok {
+					cancelled++
+				}
+			}
+		}()
+		wg.Wait()
+
+		if got := coll.CountWhere(map[string]interface{}{"status": "paid"}); got != paid[0]+paid[1] {
+			t.Fatalf("%d documents are paid, but the bulk updates reported %d", got, paid[0]+paid[1])
+		}
+		if got := coll.CountWhere(map[string]interface{}{"status": "cancelled"}); got != cancelled {
+			t.Fatalf("%d documents are cancelled, but the writer reported %d", got, cancelled)
+		}
+		if paid[0]+paid[1]+cancelled != count {
+			t.Fatalf("%d paid and %d cancelled, want %d in all", paid[0]+paid[1], cancelled, count)
+		}
+		if got := coll.CountWhere(map[string]interface{}{"payments": map[string]interface{}{"$gt": 1}}); got != 0 {
+			t.Fatalf("%d documents were paid more than once", got)
+		}
+	})
+}
+
+// TestStream checks that the stream closes its channel once every match has
+// been sent, and once it is stopped early, which is also when its goroutine
+// has exited; and that it runs at most bufSize documents ahead of the reader
+func TestStream(t *testing.T) {
+	// drain reads a stream until it closes, failing if it doesn't
+	drain := func(t *testing.T, ch <-chan map[string]interface{}) []map[string]interface{} {
+		t.Helper()
+		var docs []map[string]interface{}
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case doc, ok := <-ch:
+				if !ok {
+					return docs
+				}
+				docs = append(docs, doc)
+			case <-timeout:
+				t.Fatal("the stream's channel was never closed")
+			}
+		}
+	}
+
+	db := openTestDatabase(t)
+	coll := db.GetCollection("counters")
+	insertCounters(t, coll, "a", 100)
+	insertCounters(t, coll, "b", 10)
+
+	t.Run("Finishes", func(t *testing.T) {
+		ch, cancel := coll.Stream(map[string]interface{}{"group": "a"}, 4)
+		defer cancel()
+
+		// Writes made while streaming don't show in it
+		first := <-ch
+		insertCounters(t, coll, "a", 1)
+		docs := append(drain(t, ch), first)
+
+		if len(docs) != 100 {
+			t.Fatalf("streamed %d documents, want 100", len(docs))
+		}
+		seen := make(map[interface{}]bool)
+		for _, doc := range docs {
+			if doc["group"] != "a" || seen[doc["id"]] {
+				t.Fatalf("streamed %v, which doesn't match or was streamed before", doc)
+			}
+			seen[doc["id"]] = true
+		}
+	})
+
+	stops := []struct {
+		name   string
+		stream func() (<-chan map[string]interface{}, func())
+	}{
+		{"Cancel", func() (<-chan map[string]interface{}, func()) {
+			return coll.Stream(map[string]interface{}{}, 0)
+		}},
+		{"Context", func() (<-chan map[string]interface{}, func()) {
+			ctx, cancel := context.WithCancel(context.Background())
+			return coll.StreamContext(ctx, map[string]interface{}{}, 0), cancel
+		}},
+	}
+	for _, tt := range stops {
+		t.Run(tt.name, func(t *testing.T) {
+			ch, stop := tt.stream()
+			for range 3 {
+				<-ch
+			}
+			stop()
+			stop() // Stopping twice is harmless
+
+			// The channel is closed as the goroutine feeding it returns
+			drain(t, ch)
+		})
+	}
+
+	t.Run("BufferBound", func(t *testing.T) {
+		const bufSize = 8
+		ch, cancel := coll.Stream(map[string]interface{}{}, bufSize)
+		defer cancel()
+
+		// Unread, the stream fills its buffer and then waits for the reader
+		deadline := time.Now().Add(5 * time.Second)
+		for len(ch) < bufSize {
+			if time.Now().After(deadline) {
+				t.Fatalf("the stream only buffered %d documents, want %d", len(ch), bufSize)
+			}
+			runtime.Gosched()
+		}
+		if cap(ch) != bufSize {
+			t.Fatalf("the stream buffers %d documents, want %d", cap(ch), bufSize)
+		}
+
+		// A negative size is an unbuffered stream
+		unbuffered, cancel := coll.Stream(map[string]interface{}{}, -1)
+		defer cancel()
+		if cap(unbuffered) != 0 {
+			t.Fatalf("a negative bufSize buffers %d documents, want 0", cap(unbuffered))
+		}
+	})
+}
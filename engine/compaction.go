@@ -0,0 +1,169 @@
+package engine
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// CompactionPolicy decides when the database compacts itself (see WithAutoCompaction)
+type CompactionPolicy struct {
+	// DeadRatio triggers compaction once superseded and deleted records make
+	// up more than this fraction of a collection's records in the file,
+	// e.g. 0.5. 0 disables the check
+	DeadRatio float64 `json:"deadRatio"`
+
+	// MinRecords exempts collections with fewer records in the file from
+	// DeadRatio, so small collections don't compact over a handful of updates
+	MinRecords int `json:"minRecords"`
+
+	// MaxFileBytes triggers compaction once the file grows past this size.
+	// If the live data alone outgrows it, the limit becomes twice the size
+	// the last compaction left, so compaction doesn't repeat on every write.
+	// 0 disables the check
+	MaxFileBytes int64 `json:"maxFileBytes"`
+}
+
+// DefaultCompactionPolicy compacts once half of a collection's records are
+// dead, for collections with at least 1000 records
+var DefaultCompactionPolicy = CompactionPolicy{DeadRatio: 0.5, MinRecords: 1000}
+
+// compactCheckInterval is how many writes pass between dead-record checks
+const compactCheckInterval = 256
+
+// autoCompaction is the state of automatic compaction
+type autoCompaction struct {
+	policy   CompactionPolicy
+	writes   atomic.Uint64 // Writes since the database was opened
+	running  atomic.Bool   // A check or compaction is in progress
+	baseSize atomic.Int64  // File size after the last compaction
+	runs     atomic.Uint64 // Automatic compactions completed
+	lastRun  atomic.Int64  // Unix nanoseconds of the last automatic compaction
+	lastErr  atomic.Value  // Error message of the last failed automatic compaction
+}
+
+// compactOnWrite runs after every storage write; now and then, or as soon as
+// the file passes MaxFileBytes, it starts a check in the background
+// It is called with the storage lock held, so must not wait on any lock
+func (db *Database) compactOnWrite(size int64) {
+	auto := db.compaction
+	if auto.writes.Add(1)%compactCheckInterval != 0 && !auto.oversized(size) {
+		return
+	}
+	if !auto.running.CompareAndSwap(false, true) {
+		return
+	}
+	db.background.Add(1)
+	go func() {
+		defer db.background.Done()
+		defer auto.running.Store(false)
+		db.autoCompact()
+	}()
+}
+
+// oversized reports whether the file has grown past the size limit
+func (a *autoCompaction) oversized(size int64) bool {
+	if a.policy.MaxFileBytes <= 0 {
+		return false
+	}
+	limit := a.policy.MaxFileBytes
+	if base := 2 * a.baseSize.Load(); base > limit {
+		limit = base
+	}
+	return size > limit
+}
+
+// autoCompact compacts the database if the policy calls for it
+func (db *Database) autoCompact() {
+	db.mu.RLock()
+	closed := db.closed
+	db.mu.RUnlock()
+	if closed || !db.compactionDue() {
+		return
+	}
+
+	auto := db.compaction
+	if err := db.Compact(); err != nil {
+		auto.lastErr.Store(err.Error())
+		return
+	}
+	auto.lastErr.Store("")
+	auto.runs.Add(1)
+	auto.lastRun.Store(time.Now().UnixNano())
+}
+
+// compactionDue reports whether the file is oversized or any collection has
+// too many dead records
+func (db *Database) compactionDue() bool {
+	auto := db.compaction
+	if auto.oversized(db.storage.(storageSizer).Size()) {
+		return true
+	}
+	if auto.policy.DeadRatio <= 0 {
+		return false
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for name, records := range db.storage.(storageSizer).RecordCounts() {
+		if records < auto.policy.MinRecords || records == 0 || db.pending[name] {
+			continue
+		}
+		dead := records - db.liveRecords(name)
+		if float64(dead)/float64(records) > auto.policy.DeadRatio {
+			return true
+		}
+	}
+	return false
+}
+
+// liveRecords returns how many records a collection keeps through compaction:
+// its documents and index definitions. A dropped collection keeps none
+// Caller must hold the read lock
+func (db *Database) liveRecords(name string) int {
+	coll, exists := db.collections[name]
+	if !exists {
+		return 0
+	}
+
+	coll.mu.RLock()
+	defer coll.mu.RUnlock()
+	return coll.documents.len() + len(coll.indexRecords()) + len(coll.attachmentRecords())
+}
+
+// deadRecords returns the records compaction would remove from the file,
+// leaving out collections lazy loading hasn't read, whose documents aren't known
+// Caller must hold the read lock
+func (db *Database) deadRecords(sizer storageSizer) int {
+	dead := 0
+	for name, records := range sizer.RecordCounts() {
+		if db.pending[name] {
+			continue
+		}
+		if n := records - db.liveRecords(name); n > 0 {
+			dead += n
+		}
+	}
+	return dead
+}
+
+// lockCollections locks out the writers of every collection and read-locks
+// it, in name order, so the database can be snapshotted consistently; the
+// returned function unlocks them. Caller must hold db.mu
+func (db *Database) lockCollections() func() {
+	names := make([]string, 0, len(db.collections))
+	for name := range db.collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		db.collections[name].writers.Lock()
+		db.collections[name].mu.RLock()
+	}
+	return func() {
+		for _, name := range names {
+			db.collections[name].mu.RUnlock()
+			db.collections[name].writers.Unlock()
+		}
+	}
+}
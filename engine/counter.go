@@ -0,0 +1,97 @@
+package engine
+
+import "fmt"
+
+// SequenceCollection holds the counters of NextSequence, one document per
+// sequence with its last value in "value"
+const SequenceCollection = "_sequences"
+
+// Increment adds delta to a numeric field of a document, as an $inc update
+// does (a missing field starts at 0), and returns the new value. The read
+// and the write are made under the collection lock, so concurrent callers
+// never get the same value
+func (c *Collection) Increment(id, field string, delta float64) (float64, error) {
+	return c.increment(id, field, delta, false)
+}
+
+// NextSequence advances the named sequence and returns its new value: 1 the
+// first time, then one more on each call. Values are persisted through the
+// log like any write, so they keep increasing across reopens, e.g. for
+// invoice numbers; the sequences are documents of SequenceCollection
+func (db *Database) NextSequence(name string) (int64, error) {
+	if name == "" {
+		return 0, fmt.Errorf("sequence name is empty")
+	}
+
+	coll, err := db.LoadCollection(SequenceCollection)
+	if err != nil {
+		return 0, err
+	}
+	value, err := coll.increment(name, "value", 1, true)
+	if err != nil {
+		return 0, fmt.Errorf("sequence %s: %w", name, err)
+	}
+	return int64(value), nil
+}
+
+// increment makes an Increment; if create is set, a missing document is
+// inserted holding the field at delta
+func (c *Collection) increment(id, field string, delta float64, create bool) (float64, error) {
+	plan, err := parseUpdate(map[string]interface{}{"$inc": map[string]interface{}{field: delta}})
+	if err != nil {
+		return 0, fmt.Errorf("invalid update: %w", err)
+	}
+
+	changes := c.db.changeSet()
+	defer changes.deliver()
+
+	lock := c.lockDocument
+	if create {
+		lock = c.lockInsert
+	}
+	unlock := lock(id)
+	defer unlock()
+
+	existingDoc, exists := c.stored(id)
+	switch {
+	case exists:
+		if err := c.applyUpdate(changes, id, existingDoc, plan); err != nil {
+			return 0, err
+		}
+	case create:
+		if err := c.insertCounter(changes, id, plan); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("document with id %s not found", id)
+	}
+
+	doc, _ := c.stored(id)
+	value, _ := lookupPath(doc, field)
+	number, _ := toFloat64(value)
+	return number, nil
+}
+
+// insertCounter inserts a document made by applying an increment to an
+// empty one
+// Caller must have locked the document (see lockInsert), and delivers
+// changes (see install)
+func (c *Collection) insertCounter(changes *changeSet, id string, plan *updatePlan) error {
+	doc, err := plan.apply(c.match, map[string]interface{}{"id": id})
+	if err != nil {
+		return fmt.Errorf("failed to create document %s: %w", id, err)
+	}
+	stampVersion(doc, nil)
+
+	record := StorageRecord{Collection: c.name, ID: id, Doc: doc, Time: recordTime(), Op: OpInsert}
+	if err := c.checkLimits([]StorageRecord{record}, 1); err != nil {
+		return err
+	}
+	seq, err := c.storage.Append(record)
+	if err != nil {
+		return fmt.Errorf("failed to persist document: %w", err)
+	}
+	record.Seq = seq
+	c.install(changes, record)
+	return nil
+}
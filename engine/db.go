@@ -2,29 +2,85 @@ package engine
 
 import (
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 )
 
 // Database represents the main database instance
 // It manages multiple collections and coordinates persistence
 type Database struct {
-	storage     *Storage                // Underlying storage layer
-	collections map[string]*Collection  // Map of collection name -> Collection
-	mu          sync.RWMutex            // Protects access to collections map
+	storage     StorageEngine          // Underlying storage layer
+	collections map[string]*Collection // Map of collection name -> Collection
+	options     Options                // Options the database was opened with
+	mu          sync.RWMutex           // Protects access to collections map
+	closed      bool                   // Close has been called
+	pending     map[string]bool        // Collections lazy loading hasn't read from disk yet (see WithLazyLoading)
+
+	compaction  *autoCompaction // Automatic compaction state, nil unless enabled
+	checkpoints *autoCheckpoint // Automatic checkpoint state, nil unless enabled
+	background  sync.WaitGroup  // Background work (automatic compaction, checkpoints) that Close waits for
+	watchers    watchers        // Functions told about writes (see Watch)
 }
 
 // OpenDatabase opens (or creates) a database at the given file path
 // It loads all existing data from the file into memory
-func OpenDatabase(path string) (*Database, error) {
+// A path of the form "scheme://location" opens a registered storage engine
+// instead (see RegisterStorageEngine)
+// Optional behaviour (e.g. WithWriteLatencyTracking) is enabled through opts
+func OpenDatabase(path string, opts ...Option) (*Database, error) {
+	options := buildOptions(opts)
+
 	// Create storage layer
-	storage, err := NewStorage(path)
+	storage, err := openStorageEngine(path, options)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create storage: %w", err)
 	}
+	return openDatabase(storage, options)
+}
+
+// OpenDatabaseWithStorage opens a database on a storage engine the caller
+// has already created, loading everything it holds into memory
+// The database takes ownership of the engine and closes it on Close
+func OpenDatabaseWithStorage(storage StorageEngine, opts ...Option) (*Database, error) {
+	if storage == nil {
+		return nil, fmt.Errorf("storage engine is nil")
+	}
+	return openDatabase(storage, buildOptions(opts))
+}
+
+// openDatabase configures the storage engine and loads the database from it
+// The engine is closed if anything fails
+func openDatabase(storage StorageEngine, options Options) (*Database, error) {
+	if tracker, ok := storage.(latencyTracker); ok && options.TrackWriteLatency {
+		tracker.EnableLatencyTracking()
+	}
+	if err := checkReadOnly(storage, options); err != nil {
+		storage.Close()
+		return nil, err
+	}
+	if err := configureStorage(storage, options); err != nil {
+		storage.Close()
+		return nil, err
+	}
+	if err := validLimits(options.Limits); err != nil {
+		storage.Close()
+		return nil, err
+	}
+	// Checked on open: a file limit needs an engine that enforces it as it writes
+	if options.Limits.MaxFileBytes > 0 {
+		limiter, ok := storage.(sizeLimiter)
+		if !ok {
+			storage.Close()
+			return nil, fmt.Errorf("a file size limit is not supported by this storage engine")
+		}
+		limiter.SetMaxSize(options.Limits.MaxFileBytes)
+	}
 
 	db := &Database{
 		storage:     storage,
 		collections: make(map[string]*Collection),
+		options:     options,
 	}
 
 	// Load all records from disk
@@ -33,61 +89,279 @@ func OpenDatabase(path string) (*Database, error) {
 		return nil, fmt.Errorf("failed to load from disk: %w", err)
 	}
 
+	// Watch writes for automatic compaction and checkpoints
+	if options.Compaction != nil || options.CheckpointEvery > 0 {
+		observer, observed := storage.(writeObserver)
+		if !observed {
+			storage.Close()
+			return nil, fmt.Errorf("automatic compaction and checkpoints are not supported by this storage engine")
+		}
+		if err := db.watchWrites(observer); err != nil {
+			storage.Close()
+			return nil, err
+		}
+	}
+
 	return db, nil
 }
 
+// watchWrites sets up automatic compaction and checkpoints and installs the
+// write hook that triggers them; compaction also checks the loaded file
+// straight away
+func (db *Database) watchWrites(observer writeObserver) error {
+	if db.options.CheckpointEvery > 0 {
+		checkpointer, ok := db.storage.(checkpointer)
+		if !ok {
+			return fmt.Errorf("checkpoints are not supported by this storage engine")
+		}
+		db.checkpoints = &autoCheckpoint{every: db.options.CheckpointEvery}
+		db.checkpoints.writes.Store(uint64(checkpointer.WALRecords()))
+	}
+	if db.options.Compaction != nil {
+		sizer, ok := db.storage.(storageSizer)
+		if !ok {
+			return fmt.Errorf("automatic compaction is not supported by this storage engine")
+		}
+		db.compaction = &autoCompaction{policy: *db.options.Compaction}
+		db.compaction.baseSize.Store(sizer.Size())
+	}
+	observer.SetWriteHook(db.onWrite)
+
+	if db.compaction != nil {
+		db.compaction.running.Store(true)
+		db.background.Add(1)
+		go func() {
+			defer db.background.Done()
+			defer db.compaction.running.Store(false)
+			db.autoCompact()
+		}()
+	}
+	return nil
+}
+
+// onWrite runs after every storage write and starts automatic compaction or
+// a checkpoint when one is due
+// It is called with the storage lock held, so must not wait on any lock
+func (db *Database) onWrite(size int64) {
+	if db.compaction != nil {
+		db.compactOnWrite(size)
+	}
+	if db.checkpoints != nil {
+		db.checkpointOnWrite()
+	}
+}
+
+// checkReadOnly makes sure a read-only open got a read-only engine and asks
+// for nothing that writes
+func checkReadOnly(storage StorageEngine, options Options) error {
+	if !options.ReadOnly {
+		return nil
+	}
+	if ro, ok := storage.(readOnlyStorage); !ok || !ro.ReadOnly() {
+		return fmt.Errorf("this storage engine can't be opened read-only")
+	}
+	if options.Compaction != nil || options.CheckpointEvery > 0 {
+		return fmt.Errorf("automatic compaction and checkpoints need a writable database")
+	}
+	return nil
+}
+
+// configureStorage applies the file format, codec, compression and encryption options
+// Engines without those settings only accept the defaults
+func configureStorage(storage StorageEngine, options Options) error {
+	format := options.StorageFormat
+	if options.Compression != CompressionNone {
+		if format == FormatJSONLines {
+			return fmt.Errorf("compression requires the binary storage format")
+		}
+		format = FormatBinary
+	}
+	if options.Codec != "" && options.Codec != CodecJSON {
+		if format == FormatJSONLines {
+			return fmt.Errorf("record codec %s requires the binary storage format", options.Codec)
+		}
+		format = FormatBinary
+	}
+	encrypt := options.encrypt || options.Passphrase != ""
+
+	formatter, ok := storage.(storageFormatter)
+	if !ok {
+		if format != 0 || encrypt || options.Codec != "" {
+			return fmt.Errorf("storage format, codec, compression and encryption are not supported by this storage engine")
+		}
+		return nil
+	}
+
+	if encrypt {
+		if format == FormatJSONLines {
+			return fmt.Errorf("encryption requires the binary storage format")
+		}
+		if err := formatter.SetPassphrase(options.Passphrase); err != nil {
+			return err
+		}
+	} else if formatter.Encrypted() {
+		return fmt.Errorf("database is encrypted; open it with WithEncryption")
+	}
+	if format != 0 {
+		if err := formatter.SetFormat(format); err != nil {
+			return err
+		}
+	}
+	if options.Codec != "" {
+		setter, ok := storage.(codecSetter)
+		if !ok {
+			return fmt.Errorf("record codecs are not supported by this storage engine")
+		}
+		if err := setter.SetCodec(options.Codec); err != nil {
+			return err
+		}
+	}
+	return formatter.SetCompression(options.Compression)
+}
+
 // loadFromDisk reads all records from storage and rebuilds the in-memory collections
+// With lazy loading it only learns which collections there are
 func (db *Database) loadFromDisk() error {
+	if db.options.LazyLoading {
+		loader, ok := db.storage.(lazyLoader)
+		if !ok {
+			return fmt.Errorf("lazy loading is not supported by this storage engine")
+		}
+		names, err := loader.LoadCollections()
+		if err != nil {
+			return err
+		}
+		if !db.options.asOf.IsZero() {
+			if err := db.checkHistory(db.options.asOf); err != nil {
+				return err
+			}
+		}
+		db.pending = make(map[string]bool, len(names))
+		for _, name := range names {
+			db.pending[name] = true
+		}
+		return nil
+	}
+
 	records, err := db.storage.LoadAll()
 	if err != nil {
 		return err
 	}
+	if !db.options.asOf.IsZero() {
+		if err := db.checkHistory(db.options.asOf); err != nil {
+			return err
+		}
+		records = recordsAt(records, db.options.asOf)
+	}
+	db.applyRecords(records)
+	return nil
+}
 
+// applyRecords replays records into the collections they belong to, which
+// must not be loaded yet
+// Caller must hold the write lock (or own the database exclusively)
+func (db *Database) applyRecords(records []StorageRecord) {
 	// Reconstruct collections from records
 	// We use a temporary map to track the latest version of each document
 	tempData := make(map[string]map[string]map[string]interface{})
+	tempSeqs := make(map[string]map[string]uint64)
+	tempTimes := make(map[string]map[string]int64)
+	tempIndexes := make(map[string][]StorageRecord)
+	attachments := newAttachmentLoader()
 
 	for _, record := range records {
+		// Index definitions are applied once every document is loaded
+		if record.Index != nil {
+			pending := tempIndexes[record.Collection]
+			for i, existing := range pending {
+				if existing.ID == record.ID {
+					pending = append(pending[:i], pending[i+1:]...)
+					break
+				}
+			}
+			if !record.Index.Dropped {
+				pending = append(pending, record)
+			}
+			tempIndexes[record.Collection] = pending
+			continue
+		}
+		if record.Attachment != nil {
+			attachments.add(record)
+			continue
+		}
+
 		// Ensure collection exists in temp map
 		if tempData[record.Collection] == nil {
 			tempData[record.Collection] = make(map[string]map[string]interface{})
+			tempSeqs[record.Collection] = make(map[string]uint64)
+			tempTimes[record.Collection] = make(map[string]int64)
 		}
 
 		// If doc is nil, it means this document was deleted
 		if record.Doc == nil {
 			delete(tempData[record.Collection], record.ID)
+			delete(tempSeqs[record.Collection], record.ID)
+			delete(tempTimes[record.Collection], record.ID)
+			attachments.deleted(record.Collection, record.ID)
 		} else {
 			// Store or update the document
 			tempData[record.Collection][record.ID] = record.Doc
+			tempSeqs[record.Collection][record.ID] = record.Seq
+			tempTimes[record.Collection][record.ID] = record.Time
 		}
 	}
 
 	// Create Collection objects from the temp data
 	for collName, docs := range tempData {
 		if len(docs) > 0 {
-			coll := NewCollection(collName, db.storage)
-			coll.documents = docs
+			coll := db.newCollection(collName)
+			coll.documents = newDocumentStore(docs)
+			coll.seqs = tempSeqs[collName]
+			coll.times = tempTimes[collName]
 			db.collections[collName] = coll
 		}
 	}
+	attachments.install(db.collections)
 
-	return nil
+	// Rebuild indexes from the loaded documents, each in a single pass
+	// Collections with indexes are kept even when they have no documents
+	for collName, indexRecords := range tempIndexes {
+		if len(indexRecords) == 0 {
+			continue
+		}
+		coll, exists := db.collections[collName]
+		if !exists {
+			coll = db.newCollection(collName)
+			db.collections[collName] = coll
+		}
+		for _, record := range indexRecords {
+			coll.restoreIndex(*record.Index, record.Seq)
+		}
+	}
 }
 
 // GetCollection returns a collection by name
 // Creates the collection if it doesn't exist
+// With lazy loading, a collection that can't be read from disk is returned
+// empty, with every write failing; LoadCollection reports the error instead
 func (db *Database) GetCollection(name string) *Collection {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	// Check if collection already exists
-	if coll, exists := db.collections[name]; exists {
-		return coll
+	coll, err := db.LoadCollection(name)
+	if err != nil {
+		fmt.Printf("Warning: %v\n", err)
+		coll = NewCollection(name, unloadedStorage{StorageEngine: db.storage, err: err})
+		coll.match = db.options.matchOptions()
+		coll.db = db
 	}
+	return coll
+}
 
-	// Create new collection
+// newCollection creates a collection configured with the database options
+func (db *Database) newCollection(name string) *Collection {
 	coll := NewCollection(name, db.storage)
-	db.collections[name] = coll
+	coll.match = db.options.matchOptions()
+	coll.limits = db.options.Limits
+	coll.zeroCopy = db.options.ZeroCopyReads
+	coll.db = db
 	return coll
 }
 
@@ -96,28 +370,57 @@ func (db *Database) ListCollections() []string {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
-	names := make([]string, 0, len(db.collections))
+	names := make([]string, 0, len(db.collections)+len(db.pending))
 	for name := range db.collections {
 		names = append(names, name)
 	}
+	for name := range db.pending {
+		names = append(names, name)
+	}
 	return names
 }
 
 // DropCollection removes a collection and all its documents
+// The deletions are persisted as a single batch; watches are told about
+// them once the database is unlocked, so they may read it
 func (db *Database) DropCollection(name string) error {
+	changes := db.changeSet()
+	defer changes.deliver()
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	if db.pending[name] {
+		if err := db.loadCollection(name); err != nil {
+			return err
+		}
+	}
 	coll, exists := db.collections[name]
 	if !exists {
 		return nil // Collection doesn't exist, nothing to do
 	}
 
+	coll.writers.Lock()
+	defer coll.writers.Unlock()
+	coll.mu.Lock()
+	defer coll.mu.Unlock()
+
 	// Delete all documents in the collection
-	for id := range coll.documents {
-		if err := coll.Delete(id); err != nil {
-			return fmt.Errorf("failed to delete document: %w", err)
-		}
+	now := recordTime()
+	var records []StorageRecord
+	for id := range coll.documents.all() {
+		records = append(records, StorageRecord{Collection: name, ID: id, Time: now, Op: OpDelete})
+	}
+	if err := db.storage.AppendBatch(records); err != nil {
+		return fmt.Errorf("failed to delete documents: %w", err)
+	}
+	for _, record := range records {
+		changes.add(coll, record)
+		coll.applyRecord(record)
+	}
+
+	if err := coll.dropIndexRecords(); err != nil {
+		return err
 	}
 
 	// Remove collection from map
@@ -125,8 +428,115 @@ func (db *Database) DropCollection(name string) error {
 	return nil
 }
 
+// RenameCollection moves a collection's documents, indexes and attachments
+// to a new name, which must not be in use by a collection with documents or
+// indexes. The move is persisted as a single batch; watches see it as the
+// documents being inserted under the new name and deleted from the old one.
+// Collections got before the rename must be got again
+func (db *Database) RenameCollection(from, to string) error {
+	if to == "" {
+		return fmt.Errorf("new collection name is empty")
+	}
+	if from == to {
+		return nil
+	}
+
+	changes := db.changeSet()
+	defer changes.deliver()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, name := range []string{from, to} {
+		if db.pending[name] {
+			if err := db.loadCollection(name); err != nil {
+				return err
+			}
+		}
+	}
+	coll, exists := db.collections[from]
+	if !exists {
+		return fmt.Errorf("collection %s does not exist", from)
+	}
+	if target, exists := db.collections[to]; exists {
+		target.mu.RLock()
+		used := target.documents.len() > 0 || len(target.indexRecords()) > 0
+		target.mu.RUnlock()
+		if used {
+			return fmt.Errorf("collection %s already exists", to)
+		}
+	}
+
+	coll.writers.Lock()
+	defer coll.writers.Unlock()
+	coll.mu.Lock()
+	defer coll.mu.Unlock()
+
+	// The collection under its new name, then its removal from the old one
+	now := recordTime()
+	var moved, removed []StorageRecord
+	for id, doc := range coll.documents.all() {
+		moved = append(moved, StorageRecord{Collection: to, ID: id, Doc: doc, Time: now, Op: OpInsert})
+		removed = append(removed, StorageRecord{Collection: from, ID: id, Time: now, Op: OpDelete})
+	}
+	for _, record := range coll.indexRecords() {
+		def := *record.Index
+		dropped := def
+		dropped.Dropped = true
+		moved = append(moved, StorageRecord{Collection: to, ID: record.ID, Index: &def, Time: now})
+		removed = append(removed, StorageRecord{Collection: from, ID: record.ID, Index: &dropped, Time: now})
+	}
+	for _, record := range coll.attachmentRecords() {
+		part := *record.Attachment
+		record.Collection, record.Seq, record.Time, record.Attachment = to, 0, now, &part
+		moved = append(moved, record)
+		if part.Part == 0 {
+			removed = append(removed, StorageRecord{Collection: from, ID: record.ID, Time: now, Attachment: &AttachmentPart{Name: part.Name}})
+		}
+	}
+	if len(moved) == 0 {
+		delete(db.collections, from)
+		return nil
+	}
+
+	records := append(moved, removed...)
+	if err := db.storage.AppendBatch(records); err != nil {
+		return fmt.Errorf("failed to persist rename: %w", err)
+	}
+
+	moved = records[:len(moved)]
+	delete(db.collections, to)
+	db.applyRecords(moved)
+	renamed := db.collections[to]
+	if changes != nil {
+		for _, record := range moved {
+			if record.Index == nil && record.Attachment == nil {
+				changes.changes = append(changes.changes, change{coll: renamed, record: record})
+			}
+		}
+	}
+	for _, record := range removed {
+		if record.Index == nil && record.Attachment == nil {
+			changes.add(coll, record)
+			coll.applyRecord(record)
+		}
+	}
+	coll.indexes = nil
+	coll.geoIndexes = nil
+	coll.textIndex = nil
+
+	delete(db.collections, from)
+	return nil
+}
+
 // Close closes the database and flushes all data to disk
+// It first waits for a running automatic compaction to finish
 func (db *Database) Close() error {
+	db.mu.Lock()
+	db.closed = true
+	db.mu.Unlock()
+	db.background.Wait()
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
@@ -138,23 +548,122 @@ func (db *Database) Close() error {
 
 // Compact performs compaction on the storage file
 // This removes deleted/updated records and reclaims disk space
+// Writes wait until it is done, so none are lost in the rewrite
 func (db *Database) Compact() error {
+	if err := db.loadAll(); err != nil {
+		return err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	defer db.lockCollections()()
+
+	if err := db.storage.Compact(db.currentRecords()); err != nil {
+		return err
+	}
+	db.compacted()
+	return nil
+}
+
+// ChangePassphrase rotates the key of an encrypted database: it checks the
+// current passphrase, then compacts the database under a key derived from
+// the new one (with scrypt, as WithEncryption does), so from then on it only
+// opens with next. Writes wait until it is done. If the rewrite fails the
+// database stays under the current passphrase
+func (db *Database) ChangePassphrase(current, next string) error {
+	changer, ok := db.storage.(passphraseChanger)
+	if !ok {
+		return fmt.Errorf("encryption is not supported by this storage engine")
+	}
+	if err := db.loadAll(); err != nil {
+		return err
+	}
 	db.mu.RLock()
 	defer db.mu.RUnlock()
+	defer db.lockCollections()()
+
+	if err := changer.ChangePassphrase(current, next); err != nil {
+		return err
+	}
+	if err := db.storage.Compact(db.currentRecords()); err != nil {
+		// Point the next compaction back at the current passphrase
+		if restoreErr := changer.ChangePassphrase(next, current); restoreErr != nil {
+			return fmt.Errorf("%w (and restoring the current passphrase failed: %v)", err, restoreErr)
+		}
+		return err
+	}
+	db.compacted()
+	return nil
+}
 
-	// Collect all current records
+// currentRecords returns the records of every live document and index
+// Caller must hold the read lock and lock the collections
+func (db *Database) currentRecords() []StorageRecord {
 	var records []StorageRecord
 	for collName, coll := range db.collections {
-		for id, doc := range coll.documents {
+		for id, doc := range coll.documents.all() {
 			records = append(records, StorageRecord{
 				Collection: collName,
 				ID:         id,
 				Doc:        doc,
+				Seq:        coll.seqs[id],
+				Time:       coll.times[id],
+				Op:         OpInsert,
 			})
 		}
+		records = append(records, coll.indexRecords()...)
+		records = append(records, coll.attachmentRecords()...)
+	}
+	return records
+}
+
+// compacted resets the automatic compaction and checkpoint state after the
+// storage was rewritten down to the current records
+func (db *Database) compacted() {
+	if db.compaction != nil {
+		db.compaction.baseSize.Store(db.storage.(storageSizer).Size())
+	}
+	if db.checkpoints != nil {
+		db.checkpoints.writes.Store(uint64(db.storage.(checkpointer).WALRecords()))
+	}
+}
+
+// Sync flushes any writes the storage engine has buffered to durable storage
+func (db *Database) Sync() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.storage.Sync()
+}
+
+// CurrentSequence returns the sequence number of the latest write
+// Sequence numbers increase by one for every stored record and survive reopening,
+// so a consumer can record the last sequence it processed and resume from there
+func (db *Database) CurrentSequence() uint64 {
+	return db.storage.CurrentSequence()
+}
+
+// ReadSince returns all stored records with a sequence number greater than seq
+// Deleted documents are returned as records with a nil Doc; index
+// definitions and attachments are left out. Each record's Op tells inserts,
+// updates and deletions apart, except in records from older files
+// Compaction and checkpoints keep only the live documents, so a deletion made
+// before the last of them is no longer reported, even to a consumer that last
+// read before it
+// It reads every stored record (the whole file, on disk) while holding the
+// storage lock, so writes wait, however few records are newer than seq
+func (db *Database) ReadSince(seq uint64) ([]StorageRecord, error) {
+	records, err := db.storage.ReadSince(seq)
+	if err != nil {
+		return nil, err
 	}
 
-	return db.storage.Compact(records)
+	docs := records[:0]
+	for _, record := range records {
+		if record.Index == nil && record.Attachment == nil {
+			docs = append(docs, record)
+		}
+	}
+	return docs, nil
 }
 
 // Stats returns statistics about the database
@@ -163,20 +672,120 @@ func (db *Database) Stats() map[string]interface{} {
 	defer db.mu.RUnlock()
 
 	stats := map[string]interface{}{
-		"collections": len(db.collections),
+		"collections": len(db.collections) + len(db.pending),
 		"documents":   0,
 	}
 
 	totalDocs := 0
 	collStats := make(map[string]int)
+	queryStats := make(map[string]interface{})
+	indexStats := make(map[string][]IndexInfo)
 	for name, coll := range db.collections {
-		count := len(coll.documents)
+		count := coll.Count()
 		collStats[name] = count
 		totalDocs += count
+		queryStats[name] = map[string]interface{}{
+			"queries":           coll.stats.queries.Load(),
+			"indexed_queries":   coll.stats.indexedQueries.Load(),
+			"documents_scanned": coll.stats.documentsScanned.Load(),
+		}
+		if indexes := coll.ListIndexes(); len(indexes) > 0 {
+			indexStats[name] = indexes
+		}
 	}
 
 	stats["documents"] = totalDocs
+	if len(db.pending) > 0 {
+		// Their documents aren't counted until they are loaded
+		unloaded := make([]string, 0, len(db.pending))
+		for name := range db.pending {
+			unloaded = append(unloaded, name)
+		}
+		sort.Strings(unloaded)
+		stats["unloaded_collections"] = unloaded
+	}
 	stats["collection_stats"] = collStats
+	stats["query_stats"] = queryStats
+	stats["index_stats"] = indexStats
+	if formatter, ok := db.storage.(storageFormatter); ok {
+		stats["storage_format"] = formatter.Format()
+		if db.options.Compression != CompressionNone {
+			stats["compression"] = db.options.Compression
+		}
+		stats["encrypted"] = formatter.Encrypted()
+	}
+	if setter, ok := db.storage.(codecSetter); ok {
+		stats["record_codec"] = setter.Codec()
+	}
+	if sizer, ok := db.storage.(storageSizer); ok {
+		stats["file_size"] = sizer.Size()
+		stats["dead_records"] = db.deadRecords(sizer)
+	}
+	if reporter, ok := db.storage.(diskUsageReporter); ok {
+		stats["disk_usage"] = diskUsageStats(reporter.DiskUsage())
+	}
+	if reporter, ok := db.storage.(recoveryReporter); ok {
+		if recovery, recovered := reporter.Recovery(); recovered {
+			stats["recovery"] = map[string]interface{}{
+				"offset":          recovery.Offset,
+				"truncated_bytes": recovery.TruncatedBytes,
+				"time":            recovery.Time.UTC().Format(time.RFC3339),
+			}
+		}
+	}
+	if reporter, ok := db.storage.(migrationReporter); ok {
+		if migration, migrated := reporter.Migration(); migrated {
+			stats["migration"] = map[string]interface{}{
+				"from":   migration.From,
+				"to":     migration.To,
+				"backup": migration.Backup,
+				"time":   migration.Time.UTC().Format(time.RFC3339),
+			}
+		}
+	}
+	if ro, ok := db.storage.(readOnlyStorage); ok && ro.ReadOnly() {
+		stats["read_only"] = true
+	}
+	if committer, ok := db.storage.(groupCommitter); ok {
+		writes, syncs := committer.SyncCounts()
+		stats["group_commit"] = map[string]interface{}{"writes": writes, "syncs": syncs}
+	}
+	if auto := db.checkpoints; auto != nil {
+		checkpoints := map[string]interface{}{
+			"runs":        auto.runs.Load(),
+			"wal_records": db.storage.(checkpointer).WALRecords(),
+		}
+		if last := auto.lastRun.Load(); last > 0 {
+			checkpoints["last_run"] = time.Unix(0, last).UTC().Format(time.RFC3339)
+		}
+		if lastErr, _ := auto.lastErr.Load().(string); lastErr != "" {
+			checkpoints["last_error"] = lastErr
+		}
+		stats["checkpoints"] = checkpoints
+	}
+	if auto := db.compaction; auto != nil {
+		compaction := map[string]interface{}{"runs": auto.runs.Load()}
+		if last := auto.lastRun.Load(); last > 0 {
+			compaction["last_run"] = time.Unix(0, last).UTC().Format(time.RFC3339)
+		}
+		if lastErr, _ := auto.lastErr.Load().(string); lastErr != "" {
+			compaction["last_error"] = lastErr
+		}
+		stats["auto_compaction"] = compaction
+	}
+
+	// Write latency percentiles are only available when tracking is enabled
+	if tracker, ok := db.storage.(latencyTracker); ok {
+		if latency, enabled := tracker.WriteLatency(); enabled {
+			stats["write_latency"] = map[string]interface{}{
+				"count":  latency.Count,
+				"p50_us": latency.P50.Microseconds(),
+				"p95_us": latency.P95.Microseconds(),
+				"p99_us": latency.P99.Microseconds(),
+				"max_us": latency.Max.Microseconds(),
+			}
+		}
+	}
 
 	return stats
 }
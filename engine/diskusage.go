@@ -0,0 +1,203 @@
+package engine
+
+import "time"
+
+// DiskUsage describes how the bytes of a storage file are spent, so tooling
+// can tell when compaction is worth running
+type DiskUsage struct {
+	FileBytes      int64                      `json:"file_bytes"`      // Size of the file, and of the snapshot file once checkpointed
+	LiveBytes      int64                      `json:"live_bytes"`      // Records compaction keeps: the latest version of each live document, index and attachment
+	DeadBytes      int64                      `json:"dead_bytes"`      // Records compaction discards: superseded versions, deletions and dropped indexes
+	Collections    map[string]CollectionUsage `json:"collections"`     // Live documents per collection
+	LastCompaction time.Time                  `json:"last_compaction"` // When compaction or a checkpoint last discarded records; zero if never
+}
+
+// CollectionUsage is the space the live documents of a collection take up
+type CollectionUsage struct {
+	Documents int   `json:"documents"` // Live documents
+	Bytes     int64 `json:"bytes"`     // Bytes of their latest records
+}
+
+// AverageDocumentBytes returns the mean record size of the live documents
+func (u CollectionUsage) AverageDocumentBytes() int64 {
+	if u.Documents == 0 {
+		return 0
+	}
+	return u.Bytes / int64(u.Documents)
+}
+
+// CompactionSavings estimates how many bytes compacting would free: the dead
+// records. Compacting into another format or compression changes the sizes
+// of the live records too, which this leaves out
+func (u DiskUsage) CompactionSavings() int64 {
+	return u.DeadBytes
+}
+
+// recordKey identifies what a record is the latest version of
+type recordKey struct {
+	collection string
+	id         string
+	index      bool // An index definition rather than a document
+}
+
+// diskUsage tracks the records of a log by size as they are loaded and
+// written, and which of them compaction would keep
+type diskUsage struct {
+	counts    map[string]int                 // Records per collection, live or superseded
+	bytes     int64                          // Bytes of every record, headers left out
+	live      map[recordKey]int64            // Size of the latest record of each live document and index
+	attached  map[recordKey]map[string]int64 // Size of the chunk records of each live document's attachments
+	liveBytes int64
+	docs      map[string]CollectionUsage // Live documents per collection
+}
+
+// newDiskUsage returns the usage of an empty log
+func newDiskUsage() *diskUsage {
+	return &diskUsage{
+		counts:   make(map[string]int),
+		live:     make(map[recordKey]int64),
+		attached: make(map[recordKey]map[string]int64),
+		docs:     make(map[string]CollectionUsage),
+	}
+}
+
+// measureUsage returns the usage of a log holding records, in log order,
+// with the given encoded sizes
+func measureUsage(records []StorageRecord, sizes []int64) *diskUsage {
+	u := newDiskUsage()
+	for i, record := range records {
+		u.add(record, sizes[i])
+	}
+	return u
+}
+
+// add accounts for a record of n bytes written after the others
+func (u *diskUsage) add(record StorageRecord, n int64) {
+	u.counts[record.Collection]++
+	u.bytes += n
+
+	key := recordKey{collection: record.Collection, id: record.ID, index: record.Index != nil}
+	if record.Attachment != nil {
+		u.attach(key, record.Attachment, n)
+		return
+	}
+	if previous, exists := u.live[key]; exists {
+		delete(u.live, key)
+		u.liveBytes -= previous
+		if !key.index {
+			u.account(record.Collection, -1, -previous)
+		}
+	}
+
+	if key.index && record.Index.Dropped {
+		return
+	}
+	if !key.index && record.Doc == nil {
+		// Attachments go with their document
+		for _, size := range u.attached[key] {
+			u.liveBytes -= size
+		}
+		delete(u.attached, key)
+		return
+	}
+	u.live[key] = n
+	u.liveBytes += n
+	if !key.index {
+		u.account(record.Collection, 1, n)
+	}
+}
+
+// attach accounts for an attachment chunk of n bytes on the document at
+// key; the first chunk of an attachment replaces its earlier version
+func (u *diskUsage) attach(key recordKey, part *AttachmentPart, n int64) {
+	named := u.attached[key]
+	if part.Part == 0 || part.Parts == 0 {
+		u.liveBytes -= named[part.Name]
+		delete(named, part.Name)
+	}
+	if part.Parts == 0 {
+		return
+	}
+	if named == nil {
+		named = make(map[string]int64)
+		u.attached[key] = named
+	}
+	named[part.Name] += n
+	u.liveBytes += n
+}
+
+// account adjusts the live documents of a collection
+func (u *diskUsage) account(collName string, documents int, bytes int64) {
+	usage := u.docs[collName]
+	usage.Documents += documents
+	usage.Bytes += bytes
+	if usage.Documents == 0 {
+		delete(u.docs, collName)
+		return
+	}
+	u.docs[collName] = usage
+}
+
+// recordCounts returns a copy of the per-collection record counts
+func (u *diskUsage) recordCounts() map[string]int {
+	counts := make(map[string]int, len(u.counts))
+	for name, n := range u.counts {
+		counts[name] = n
+	}
+	return counts
+}
+
+// report describes the usage of a file of the given size
+func (u *diskUsage) report(fileBytes int64, compacted time.Time) DiskUsage {
+	collections := make(map[string]CollectionUsage, len(u.docs))
+	for name, usage := range u.docs {
+		collections[name] = usage
+	}
+	return DiskUsage{
+		FileBytes:      fileBytes,
+		LiveBytes:      u.liveBytes,
+		DeadBytes:      u.bytes - u.liveBytes,
+		Collections:    collections,
+		LastCompaction: compacted,
+	}
+}
+
+// DiskUsage reports how much of the file compaction would free
+func (s *Storage) DiskUsage() DiskUsage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var compacted time.Time
+	if s.compacted != 0 {
+		compacted = time.Unix(0, s.compacted)
+	}
+	return s.usage.report(s.size, compacted)
+}
+
+// diskUsageStats lays out disk usage for Stats
+func diskUsageStats(usage DiskUsage) map[string]interface{} {
+	collections := make(map[string]interface{}, len(usage.Collections))
+	for name, coll := range usage.Collections {
+		collections[name] = map[string]interface{}{
+			"documents":          coll.Documents,
+			"bytes":              coll.Bytes,
+			"avg_document_bytes": coll.AverageDocumentBytes(),
+		}
+	}
+	stats := map[string]interface{}{
+		"file_bytes":         usage.FileBytes,
+		"live_bytes":         usage.LiveBytes,
+		"dead_bytes":         usage.DeadBytes,
+		"compaction_savings": usage.CompactionSavings(),
+		"fragmentation":      0.0,
+		"collections":        collections,
+	}
+	if usage.FileBytes > 0 {
+		// Share of the file compaction would free
+		stats["fragmentation"] = float64(usage.DeadBytes) / float64(usage.FileBytes)
+	}
+	if !usage.LastCompaction.IsZero() {
+		stats["last_compaction"] = usage.LastCompaction.UTC().Format(time.RFC3339)
+	}
+	return stats
+}
@@ -0,0 +1,143 @@
+package engine
+
+import (
+	"iter"
+	"sync/atomic"
+)
+
+// docShards is how many maps a collection's documents are spread over, so a
+// write after a snapshot only has to copy the one it touches
+const docShards = 256
+
+// documentStore holds a collection's documents (ID -> document) as
+// copy-on-write shards, so readers can scan a consistent snapshot without
+// holding the lock while writers carry on
+// snapshot shares the shards rather than copying them and marks them frozen;
+// a write to a frozen shard first swaps in a private copy of it, leaving the
+// original to the snapshots. Stored documents are never changed in place,
+// only replaced by new versions (see updatePlan.apply), so sharing the maps
+// is enough
+type documentStore struct {
+	shards [docShards]*docShard
+	count  int
+}
+
+// docShard is the documents whose IDs hash to one shard
+type docShard struct {
+	docs   map[string]map[string]interface{}
+	shared atomic.Bool // Part of a snapshot, so it must not be written
+}
+
+// newDocumentStore returns a store holding docs
+func newDocumentStore(docs map[string]map[string]interface{}) documentStore {
+	var s documentStore
+	for id, doc := range docs {
+		s.set(id, doc)
+	}
+	return s
+}
+
+// shardOf returns the shard an ID belongs to (FNV-1a)
+func shardOf(id string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(id); i++ {
+		h ^= uint32(id[i])
+		h *= 16777619
+	}
+	return int(h % docShards)
+}
+
+// get returns a document and whether it exists
+func (s *documentStore) get(id string) (map[string]interface{}, bool) {
+	shard := s.shards[shardOf(id)]
+	if shard == nil {
+		return nil, false
+	}
+	doc, exists := shard.docs[id]
+	return doc, exists
+}
+
+// doc returns a document, or nil if it doesn't exist
+func (s *documentStore) doc(id string) map[string]interface{} {
+	doc, _ := s.get(id)
+	return doc
+}
+
+// len returns the number of documents
+func (s *documentStore) len() int {
+	return s.count
+}
+
+// writable returns the shard of an ID ready to be changed, copying it first
+// if a snapshot shares it
+// Caller must hold the write lock
+func (s *documentStore) writable(id string) *docShard {
+	i := shardOf(id)
+	shard := s.shards[i]
+	switch {
+	case shard == nil:
+		shard = &docShard{docs: make(map[string]map[string]interface{})}
+		s.shards[i] = shard
+	case shard.shared.Load():
+		docs := make(map[string]map[string]interface{}, len(shard.docs))
+		for id, doc := range shard.docs {
+			docs[id] = doc
+		}
+		shard = &docShard{docs: docs}
+		s.shards[i] = shard
+	}
+	return shard
+}
+
+// set stores a document, replacing any with the same ID
+// Caller must hold the write lock
+func (s *documentStore) set(id string, doc map[string]interface{}) {
+	shard := s.writable(id)
+	if _, exists := shard.docs[id]; !exists {
+		s.count++
+	}
+	shard.docs[id] = doc
+}
+
+// remove deletes a document, if it exists
+// Caller must hold the write lock
+func (s *documentStore) remove(id string) {
+	if _, exists := s.get(id); !exists {
+		return
+	}
+	delete(s.writable(id).docs, id)
+	s.count--
+}
+
+// all iterates over the documents, in no particular order
+// Writing to the store while iterating it is allowed: the iteration may or
+// may not see documents changed since it started. Iterate over a snapshot to
+// see none of them
+func (s *documentStore) all() iter.Seq2[string, map[string]interface{}] {
+	return func(yield func(string, map[string]interface{}) bool) {
+		for i := range s.shards {
+			shard := s.shards[i]
+			if shard == nil {
+				continue
+			}
+			for id, doc := range shard.docs {
+				if !yield(id, doc) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// snapshot returns the documents as they are now; later writes to the store
+// don't show in it. It costs one pointer per shard, whatever the size of the
+// collection, and the snapshot must only be read
+// Safe under the read lock
+func (s *documentStore) snapshot() *documentStore {
+	for _, shard := range s.shards {
+		if shard != nil && !shard.shared.Load() {
+			shard.shared.Store(true)
+		}
+	}
+	return &documentStore{shards: s.shards, count: s.count}
+}
@@ -0,0 +1,120 @@
+package engine
+
+import (
+	"strconv"
+	"strings"
+)
+
+// copyDocument returns a deep copy of a document
+// Nested maps and arrays are copied as well, so the result shares no
+// mutable state with the original
+func copyDocument(doc map[string]interface{}) map[string]interface{} {
+	if doc == nil {
+		return nil
+	}
+
+	copied := make(map[string]interface{}, len(doc))
+	for key, value := range doc {
+		copied[key] = copyValue(value)
+	}
+	return copied
+}
+
+// detach returns stored documents as reads hand them out: deep copies, so
+// callers can't change the store through them, unless reads are zero-copy
+func (c *Collection) detach(docs []map[string]interface{}) []map[string]interface{} {
+	if c.zeroCopy {
+		return docs
+	}
+	for i, doc := range docs {
+		docs[i] = copyDocument(doc)
+	}
+	return docs
+}
+
+// detachDocument is detach for a single document
+func (c *Collection) detachDocument(doc map[string]interface{}) map[string]interface{} {
+	if c.zeroCopy {
+		return doc
+	}
+	return copyDocument(doc)
+}
+
+// copyValue deep-copies a decoded JSON value
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return copyDocument(v)
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, elem := range v {
+			copied[i] = copyValue(elem)
+		}
+		return copied
+	default:
+		return v
+	}
+}
+
+// lookupPath resolves a dot-notation path such as "address.city" in a document
+// A key that literally contains the dots takes precedence over traversal
+// Numeric segments index into arrays ("items.0.sku"); other segments applied to an
+// array are resolved against each element, and the results are collected into a
+// flat array (so "items.sku" yields every item's sku)
+// The second return value is false if the path doesn't resolve to anything
+func lookupPath(doc map[string]interface{}, path string) (interface{}, bool) {
+	if value, exists := doc[path]; exists {
+		return value, true
+	}
+	if !strings.Contains(path, ".") {
+		return nil, false
+	}
+
+	return lookupSegments(doc, strings.Split(path, "."))
+}
+
+// lookupSegments walks the remaining path segments from value
+func lookupSegments(value interface{}, segments []string) (interface{}, bool) {
+	if len(segments) == 0 {
+		return value, true
+	}
+
+	segment := segments[0]
+	switch v := value.(type) {
+	case map[string]interface{}:
+		next, exists := v[segment]
+		if !exists {
+			return nil, false
+		}
+		return lookupSegments(next, segments[1:])
+
+	case []interface{}:
+		// A numeric segment selects a single element
+		if index, err := strconv.Atoi(segment); err == nil {
+			if index < 0 || index >= len(v) {
+				return nil, false
+			}
+			return lookupSegments(v[index], segments[1:])
+		}
+
+		// Otherwise resolve the path against every element
+		var found []interface{}
+		for _, elem := range v {
+			result, ok := lookupSegments(elem, segments)
+			if !ok {
+				continue
+			}
+			if nested, isArray := result.([]interface{}); isArray {
+				found = append(found, nested...)
+			} else {
+				found = append(found, result)
+			}
+		}
+		if len(found) == 0 {
+			return nil, false
+		}
+		return found, true
+	}
+
+	return nil, false
+}
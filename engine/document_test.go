@@ -0,0 +1,135 @@
+package engine
+
+import "testing"
+
+// readers are the ways a read hands out the document with ID "doc"
+var readers = []struct {
+	name string
+	read func(t *testing.T, db *Database) map[string]interface{}
+}{
+	{"FindByID", func(t *testing.T, db *Database) map[string]interface{} {
+		return db.GetCollection("docs").FindByID("doc")
+	}},
+	{"FindAll", func(t *testing.T, db *Database) map[string]interface{} {
+		return only(t, db.GetCollection("docs").FindAll())
+	}},
+	{"Find", func(t *testing.T, db *Database) map[string]interface{} {
+		return only(t, db.GetCollection("docs").Find(map[string]interface{}{"name": "a"}))
+	}},
+	{"FindEach", func(t *testing.T, db *Database) map[string]interface{} {
+		var docs []map[string]interface{}
+		db.GetCollection("docs").FindEach(map[string]interface{}{}, func(doc map[string]interface{}) bool {
+			docs = append(docs, doc)
+			return true
+		})
+		return only(t, docs)
+	}},
+	{"FindPage", func(t *testing.T, db *Database) map[string]interface{} {
+		page, err := db.GetCollection("docs").FindPage(map[string]interface{}{}, FindOptions{Limit: 10}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return only(t, page.Documents)
+	}},
+	{"Aggregate", func(t *testing.T, db *Database) map[string]interface{} {
+		docs, err := db.GetCollection("docs").Aggregate([]map[string]interface{}{{"$match": map[string]interface{}{}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return only(t, docs)
+	}},
+	{"Sample", func(t *testing.T, db *Database) map[string]interface{} {
+		return only(t, db.GetCollection("docs").Sample(1))
+	}},
+	{"Search", func(t *testing.T, db *Database) map[string]interface{} {
+		results := db.GetCollection("docs").Search("alpha", SearchOptions{})
+		if len(results) != 1 {
+			t.Fatalf("got %d results, want 1", len(results))
+		}
+		return results[0].Document
+	}},
+	{"Snapshot", func(t *testing.T, db *Database) map[string]interface{} {
+		s, err := db.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.Collection("docs").FindByID("doc")
+	}},
+}
+
+// only returns the single document of a read's results
+func only(t *testing.T, docs []map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	if len(docs) != 1 {
+		t.Fatalf("got %d documents, want 1", len(docs))
+	}
+	return docs[0]
+}
+
+// openAliasingDatabase holds one document with a nested object and array
+func openAliasingDatabase(t *testing.T, opts ...Option) *Database {
+	t.Helper()
+	db := openTestDatabase(t, opts...)
+	_, err := db.GetCollection("docs").Insert(map[string]interface{}{
+		"id":    "doc",
+		"name":  "a",
+		"text":  "alpha",
+		"inner": map[string]interface{}{"n": 1.0},
+		"tags":  []interface{}{"x"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// mutate changes every level of a document read out of the store
+func mutate(doc map[string]interface{}) {
+	doc["name"] = "changed"
+	doc["inner"].(map[string]interface{})["n"] = 2.0
+	doc["tags"].([]interface{})[0] = "changed"
+}
+
+func TestReadsReturnCopies(t *testing.T) {
+	for _, tt := range readers {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openAliasingDatabase(t)
+			mutate(tt.read(t, db))
+
+			stored := db.GetCollection("docs").FindByID("doc")
+			if stored["name"] != "a" || stored["inner"].(map[string]interface{})["n"] != 1.0 || stored["tags"].([]interface{})[0] != "x" {
+				t.Fatalf("changing a read result changed the store: %v", stored)
+			}
+			// The query path sees the stored value too, not the change
+			if got := len(db.GetCollection("docs").Find(map[string]interface{}{"name": "changed"})); got != 0 {
+				t.Fatalf("filter matched the changed value in %d documents", got)
+			}
+		})
+	}
+}
+
+func TestInsertKeepsItsOwnCopy(t *testing.T) {
+	db := openTestDatabase(t)
+	doc := map[string]interface{}{"id": "doc", "inner": map[string]interface{}{"n": 1.0}}
+	if _, err := db.GetCollection("docs").Insert(doc); err != nil {
+		t.Fatal(err)
+	}
+	doc["inner"].(map[string]interface{})["n"] = 2.0
+
+	stored := db.GetCollection("docs").FindByID("doc")
+	if n := stored["inner"].(map[string]interface{})["n"]; n != 1.0 {
+		t.Fatalf("changing the inserted map changed the store: got n=%v", n)
+	}
+}
+
+func TestZeroCopyReads(t *testing.T) {
+	db := openAliasingDatabase(t, WithZeroCopyReads())
+	coll := db.GetCollection("docs")
+
+	// Zero-copy reads hand out the stored document itself
+	first, second := coll.FindByID("doc"), coll.FindByID("doc")
+	first["inner"].(map[string]interface{})["n"] = 2.0
+	if n := second["inner"].(map[string]interface{})["n"]; n != 2.0 {
+		t.Fatalf("zero-copy reads returned separate copies: got n=%v", n)
+	}
+}
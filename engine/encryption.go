@@ -0,0 +1,133 @@
+package engine
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+)
+
+// Key derivation parameters for new encrypted files: scrypt with N=2^15,
+// r=8 and p=1, which costs about 32 MiB and a fraction of a second. They are
+// stored in the file, so they can be raised without breaking older files
+const (
+	scryptLogN = 15
+	scryptR    = 8
+	scryptP    = 1
+)
+
+// Sizes of the parts of an encrypted file's key block
+const (
+	encryptionSaltBytes  = 16
+	encryptionNonceBytes = 12 // AES-GCM standard nonce size
+	encryptionTagBytes   = 16 // AES-GCM authentication tag size
+
+	// keyBlockBytes is the key block written after the header of an
+	// encrypted file: salt, scrypt logN/r/p, then a nonce and the tag
+	// sealing an empty message, which checks the passphrase
+	keyBlockBytes = encryptionSaltBytes + 3 + encryptionNonceBytes + encryptionTagBytes
+)
+
+// keyCheckData is authenticated by the key block's tag
+var keyCheckData = []byte("tetodb")
+
+// errWrongPassphrase reports a passphrase that doesn't unlock a file
+var errWrongPassphrase = errors.New("wrong passphrase")
+
+// fileCipher encrypts the record payloads of an encrypted storage file with
+// AES-256-GCM, under a key derived from a passphrase
+type fileCipher struct {
+	aead     cipher.AEAD
+	keyBlock []byte // Written after the file header (see keyBlockBytes)
+}
+
+// newFileCipher derives a key for a new file from the passphrase and a fresh salt
+func newFileCipher(passphrase string) (*fileCipher, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("passphrase must not be empty")
+	}
+
+	keyBlock := make([]byte, keyBlockBytes)
+	salt := keyBlock[:encryptionSaltBytes]
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	keyBlock[encryptionSaltBytes] = scryptLogN
+	keyBlock[encryptionSaltBytes+1] = scryptR
+	keyBlock[encryptionSaltBytes+2] = scryptP
+
+	aead, err := deriveAEAD(passphrase, keyBlock)
+	if err != nil {
+		return nil, err
+	}
+	nonce := keyBlock[encryptionSaltBytes+3 : encryptionSaltBytes+3+encryptionNonceBytes]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	check := aead.Seal(nil, nonce, nil, keyCheckData)
+	copy(keyBlock[encryptionSaltBytes+3+encryptionNonceBytes:], check)
+
+	return &fileCipher{aead: aead, keyBlock: keyBlock}, nil
+}
+
+// openFileCipher derives the key of an existing file from the passphrase
+// and the file's key block, failing with errWrongPassphrase if it doesn't match
+func openFileCipher(passphrase string, keyBlock []byte) (*fileCipher, error) {
+	if len(keyBlock) != keyBlockBytes {
+		return nil, fmt.Errorf("invalid encryption key block")
+	}
+	aead, err := deriveAEAD(passphrase, keyBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := keyBlock[encryptionSaltBytes+3 : encryptionSaltBytes+3+encryptionNonceBytes]
+	check := keyBlock[encryptionSaltBytes+3+encryptionNonceBytes:]
+	expected := aead.Seal(nil, nonce, nil, keyCheckData)
+	if subtle.ConstantTimeCompare(check, expected) != 1 {
+		return nil, errWrongPassphrase
+	}
+	return &fileCipher{aead: aead, keyBlock: keyBlock}, nil
+}
+
+// deriveAEAD runs scrypt with the key block's salt and parameters
+func deriveAEAD(passphrase string, keyBlock []byte) (cipher.AEAD, error) {
+	salt := keyBlock[:encryptionSaltBytes]
+	logN, r, p := keyBlock[encryptionSaltBytes], keyBlock[encryptionSaltBytes+1], keyBlock[encryptionSaltBytes+2]
+	key, err := scryptKey([]byte(passphrase), salt, logN, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return aead, nil
+}
+
+// seal encrypts a payload, prefixing it with a random nonce
+func (c *fileCipher) seal(plaintext []byte) ([]byte, error) {
+	sealed := make([]byte, encryptionNonceBytes, encryptionNonceBytes+len(plaintext)+encryptionTagBytes)
+	if _, err := rand.Read(sealed); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return c.aead.Seal(sealed, sealed, plaintext, nil), nil
+}
+
+// open decrypts a payload produced by seal
+func (c *fileCipher) open(sealed []byte) ([]byte, error) {
+	if len(sealed) < encryptionNonceBytes+encryptionTagBytes {
+		return nil, errRecordEncoding
+	}
+	plaintext, err := c.aead.Open(nil, sealed[:encryptionNonceBytes], sealed[encryptionNonceBytes:], nil)
+	if err != nil {
+		return nil, errRecordEncoding
+	}
+	return plaintext, nil
+}
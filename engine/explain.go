@@ -0,0 +1,89 @@
+package engine
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// QueryPlan describes how a query was executed, as returned by Explain
+type QueryPlan struct {
+	Collection        string          `json:"collection"`           // Collection that was queried
+	Predicates        []Predicate     `json:"predicates"`           // Top-level filter predicates that were evaluated
+	Strategy          string          `json:"strategy"`             // How documents were found ("collection_scan", "index_scan", "index_intersection" or "geo_index")
+	IndexUsed         bool            `json:"index_used"`           // Whether an index narrowed the scan
+	Index             string          `json:"index,omitempty"`      // Index used, if any; several are comma-separated
+	Candidates        []PlanCandidate `json:"candidates,omitempty"` // Indexed conditions the planner weighed, most selective first
+	Sort              []SortField     `json:"sort,omitempty"`       // Sort keys applied to the matches
+	Skip              int             `json:"skip,omitempty"`       // Documents skipped after sorting
+	Limit             int             `json:"limit,omitempty"`      // Maximum documents returned
+	DocumentsScanned  int             `json:"documents_scanned"`    // Documents the filter was evaluated against
+	DocumentsMatched  int             `json:"documents_matched"`    // Documents that matched the filter
+	DocumentsReturned int             `json:"documents_returned"`   // Documents left after skip/limit
+	Elapsed           time.Duration   `json:"elapsed_ns"`           // Wall-clock execution time
+	Error             string          `json:"error,omitempty"`      // Why the query failed, e.g. an unusable hint
+}
+
+// Predicate is a single top-level condition from a filter
+type Predicate struct {
+	Field    string      `json:"field,omitempty"` // Field path (empty for logical operators)
+	Operator string      `json:"operator"`        // "$eq" for plain values, otherwise the operator
+	Value    interface{} `json:"value"`           // Operand the field is compared against
+}
+
+// Explain runs a query like Find and reports how it was executed
+// The matching documents themselves are not returned
+func (c *Collection) Explain(filter map[string]interface{}, opts ...FindOptions) QueryPlan {
+	var options FindOptions
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+
+	plan := QueryPlan{
+		Collection: c.name,
+		Predicates: describeFilter(filter),
+		Strategy:   "collection_scan",
+		Sort:       options.Sort,
+		Skip:       options.Skip,
+		Limit:      options.Limit,
+	}
+
+	start := time.Now()
+	results, err := c.find(context.Background(), filter, options, &plan)
+	if err != nil {
+		plan.Error = err.Error()
+	}
+	plan.Elapsed = time.Since(start)
+	plan.DocumentsReturned = len(results)
+
+	return plan
+}
+
+// describeFilter lists the top-level predicates of a filter, ordered by field
+func describeFilter(filter map[string]interface{}) []Predicate {
+	predicates := make([]Predicate, 0, len(filter))
+	for key, value := range filter {
+		// Logical operators apply to the whole document
+		if len(key) > 0 && key[0] == '$' {
+			predicates = append(predicates, Predicate{Operator: key, Value: value})
+			continue
+		}
+
+		ops, isOps := operatorExpression(value)
+		if !isOps {
+			predicates = append(predicates, Predicate{Field: key, Operator: "$eq", Value: value})
+			continue
+		}
+		for op, operand := range ops {
+			predicates = append(predicates, Predicate{Field: key, Operator: op, Value: operand})
+		}
+	}
+
+	sort.Slice(predicates, func(i, j int) bool {
+		if predicates[i].Field != predicates[j].Field {
+			return predicates[i].Field < predicates[j].Field
+		}
+		return predicates[i].Operator < predicates[j].Operator
+	})
+	return predicates
+}
@@ -0,0 +1,216 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Export writes the database's live documents, indexes and attachments to w
+// as a JSON lines database file, unencrypted and uncompressed whatever the
+// storage engine writes, so it can be opened by OpenDatabase or brought into
+// a database on any engine with Import. It is a consistent copy taken like
+// a Backup; an encrypted database's export is not encrypted
+func (db *Database) Export(w io.Writer) error {
+	records, err := db.copyRecords()
+	if err != nil {
+		return err
+	}
+
+	buffered := bufio.NewWriter(w)
+	if _, _, err := writeLog(buffered, recordEncoding{format: FormatJSONLines}, backupHeader(), records); err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return fmt.Errorf("failed to write export: %w", err)
+	}
+	return nil
+}
+
+// Import replaces everything the database holds with the contents of a
+// database file read from r: an Export, a Backup or a storage file, in any
+// format. An encrypted file can only be imported into the database whose
+// key it is encrypted with
+// The replacement is written to the log as new records in a single batch, so
+// the documents from before can be brought back by restoring to a time
+// before it (see RestoreTo). Watches are told of every document it deletes
+// or writes. Collections got before the import are replaced, so must be got
+// again
+func (db *Database) Import(r io.Reader) error {
+	imported, err := db.readImport(r)
+	if err != nil {
+		return err
+	}
+	kept := make(map[string]map[string]bool)
+	for _, record := range imported {
+		if record.Index == nil && record.Attachment == nil {
+			if kept[record.Collection] == nil {
+				kept[record.Collection] = make(map[string]bool)
+			}
+			kept[record.Collection][record.ID] = true
+		}
+	}
+
+	changes := db.changeSet()
+	defer changes.deliver()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.loadPending(); err != nil {
+		return err
+	}
+
+	previous := db.collections
+	names := make([]string, 0, len(previous))
+	for name := range previous {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		previous[name].writers.Lock()
+		previous[name].mu.Lock()
+	}
+	defer func() {
+		for _, name := range names {
+			previous[name].mu.Unlock()
+			previous[name].writers.Unlock()
+		}
+	}()
+
+	// Clear out what is there now: documents the file doesn't have are
+	// deleted, and every index and attachment is removed, to be defined
+	// again from the file
+	now := recordTime()
+	var records []StorageRecord
+	for _, name := range names {
+		coll := previous[name]
+		for id := range coll.documents.all() {
+			if !kept[name][id] {
+				records = append(records, StorageRecord{Collection: name, ID: id, Time: now, Op: OpDelete})
+			}
+		}
+		dropped := coll.indexRecords()
+		for i := range dropped {
+			dropped[i].Index.Dropped = true
+			dropped[i].Time = now
+		}
+		records = append(records, dropped...)
+		for id, named := range coll.attachments {
+			for attachmentName := range named {
+				records = append(records, StorageRecord{Collection: name, ID: id, Time: now, Attachment: &AttachmentPart{Name: attachmentName}})
+			}
+		}
+	}
+	cleared := len(records)
+
+	for _, record := range imported {
+		record.Seq, record.Time = 0, now
+		if record.Index == nil && record.Attachment == nil {
+			record.Op = OpInsert
+			if existing, exists := previous[record.Collection].existingDocument(record.ID); exists {
+				record.Op = OpUpdate
+				// A new version, as RestoreTo writes, so that writers holding
+				// one from before the import see a conflict
+				if documentVersion(existing) >= documentVersion(record.Doc) {
+					record.Doc = copyDocument(record.Doc)
+					stampVersion(record.Doc, existing)
+				}
+			}
+		}
+		records = append(records, record)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	if err := db.storage.AppendBatch(records); err != nil {
+		return fmt.Errorf("failed to persist import: %w", err)
+	}
+
+	db.collections = make(map[string]*Collection)
+	db.applyRecords(records[cleared:])
+
+	if changes != nil {
+		for _, record := range records {
+			if record.Index != nil || record.Attachment != nil {
+				continue
+			}
+			coll := db.collections[record.Collection]
+			if record.Doc == nil {
+				coll = previous[record.Collection]
+			}
+			before, _ := previous[record.Collection].existingDocument(record.ID)
+			changes.changes = append(changes.changes, change{coll: coll, record: record, before: before})
+		}
+	}
+	return nil
+}
+
+// existingDocument returns a document of a collection that may not exist
+// Caller must hold the read lock of a collection that does
+func (c *Collection) existingDocument(id string) (map[string]interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	return c.documents.get(id)
+}
+
+// readImport reads a database file for Import and reduces it to its live
+// records, replaying it as loading a database would
+func (db *Database) readImport(r io.Reader) ([]StorageRecord, error) {
+	reader, err := db.importReader(r)
+	if err != nil {
+		return nil, err
+	}
+	log, err := decodeLog(reader, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVersion(log.version); err != nil {
+		return nil, err
+	}
+	if log.torn != nil {
+		return nil, fmt.Errorf("file to import is incomplete")
+	}
+	records := log.records
+	if log.version < StorageVersion {
+		if records, err = migrate(records, log.version); err != nil {
+			return nil, err
+		}
+	}
+
+	scratch := &Database{collections: make(map[string]*Collection), options: db.options, storage: NewMemoryStorage()}
+	scratch.applyRecords(records)
+	return scratch.currentRecords(), nil
+}
+
+// importReader starts reading a file to import, decrypting it with the
+// database's key if it is encrypted
+func (db *Database) importReader(r io.Reader) (*recordReader, error) {
+	s, ok := db.storage.(*Storage)
+	if !ok {
+		reader, err := newRecordReader(r)
+		if err != nil {
+			return nil, err
+		}
+		if reader.encrypted {
+			return nil, fmt.Errorf("file to import is encrypted; only the database it was encrypted for can import it")
+		}
+		return reader, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reader, err := s.reader(r)
+	if err != nil {
+		return nil, err
+	}
+	if reader.encrypted && !bytes.Equal(reader.keyBlock, s.cipher.keyBlock) {
+		return nil, fmt.Errorf("file to import is encrypted with a different key than the database")
+	}
+	return reader, nil
+}
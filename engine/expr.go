@@ -0,0 +1,337 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// evalExpression evaluates an aggregation expression against a document
+// using the default MatchOptions (see MatchOptions.evaluate)
+func evalExpression(doc map[string]interface{}, expr interface{}) interface{} {
+	return MatchOptions{}.evaluate(doc, expr)
+}
+
+// expressionArity gives the number of arguments each expression operator takes
+// -1 means any number (at least one)
+var expressionArity = map[string]int{
+	"$add": -1, "$subtract": 2, "$multiply": -1, "$divide": 2, "$mod": 2,
+	"$abs": 1, "$ceil": 1, "$floor": 1, "$round": -1,
+	"$concat": -1, "$toUpper": 1, "$toLower": 1, "$size": 1,
+	"$eq": 2, "$ne": 2, "$gt": 2, "$gte": 2, "$lt": 2, "$lte": 2,
+	"$and": -1, "$or": -1, "$not": 1,
+	"$cond": 3, "$ifNull": 2, "$literal": 1,
+}
+
+// evaluate evaluates an expression against a document:
+//
+//	"$price"                                   // Field reference (dot notation allowed)
+//	{"$multiply": ["$price", "$qty"]}          // Operator over evaluated arguments
+//	{"$cond": [{"$gte": ["$qty", 10]}, "bulk", "single"]}
+//	{"city": "$address.city", "n": 1}          // Objects are evaluated field by field
+//
+// Anything else is a literal; use {"$literal": "$not a field"} for strings
+// starting with "$". Operators:
+//
+//	Arithmetic: $add, $subtract, $multiply, $divide, $mod, $abs, $ceil, $floor, $round
+//	Strings:    $concat, $toUpper, $toLower
+//	Comparison: $eq, $ne, $gt, $gte, $lt, $lte (same type rules as filters)
+//	Logic:      $and, $or, $not, $cond ([if, then, else] or {if, then, else}), $ifNull
+//	Other:      $size, $literal
+//
+// Arithmetic and string operators yield nil if an argument is missing or has the wrong type
+func (m MatchOptions) evaluate(doc map[string]interface{}, expr interface{}) interface{} {
+	switch v := expr.(type) {
+	case string:
+		if strings.HasPrefix(v, "$") {
+			value, _ := lookupPath(doc, v[1:])
+			return value
+		}
+		return v
+	case map[string]interface{}:
+		if op, operand, isOp := expressionOperator(v); isOp {
+			return m.evalOperator(doc, op, operand)
+		}
+		out := make(map[string]interface{}, len(v))
+		for key, sub := range v {
+			out[key] = m.evaluate(doc, sub)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, sub := range v {
+			out[i] = m.evaluate(doc, sub)
+		}
+		return out
+	}
+	return expr
+}
+
+// expressionOperator reports whether an object is a single-operator expression
+func expressionOperator(expr map[string]interface{}) (string, interface{}, bool) {
+	if len(expr) != 1 {
+		return "", nil, false
+	}
+	for op, operand := range expr {
+		if _, known := expressionArity[op]; known {
+			return op, operand, true
+		}
+	}
+	return "", nil, false
+}
+
+// validateExpression checks operator names and argument counts throughout an expression
+func validateExpression(expr interface{}) error {
+	switch v := expr.(type) {
+	case map[string]interface{}:
+		if len(v) == 1 {
+			for key, operand := range v {
+				if !strings.HasPrefix(key, "$") {
+					break
+				}
+				if _, known := expressionArity[key]; !known {
+					return fmt.Errorf("unknown expression operator %s", key)
+				}
+				if key == "$literal" {
+					return nil
+				}
+				if key == "$cond" {
+					if cond, isMap := operand.(map[string]interface{}); isMap {
+						for _, part := range []string{"if", "then", "else"} {
+							if _, present := cond[part]; !present {
+								return fmt.Errorf("$cond is missing %q", part)
+							}
+						}
+						operand = []interface{}{cond["if"], cond["then"], cond["else"]}
+					}
+				}
+
+				args := expressionArgs(operand)
+				arity := expressionArity[key]
+				if (arity < 0 && len(args) == 0) || (arity >= 0 && len(args) != arity) {
+					return fmt.Errorf("%s takes %s", key, arityDescription(arity))
+				}
+				if key == "$round" && len(args) > 2 {
+					return fmt.Errorf("$round takes a number and optional decimal places")
+				}
+				for _, arg := range args {
+					if err := validateExpression(arg); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+		}
+		for _, sub := range v {
+			if err := validateExpression(sub); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, sub := range v {
+			if err := validateExpression(sub); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// arityDescription describes an argument count for error messages
+func arityDescription(arity int) string {
+	switch arity {
+	case -1:
+		return "at least one argument"
+	case 1:
+		return "one argument"
+	}
+	return fmt.Sprintf("%d arguments", arity)
+}
+
+// expressionArgs returns an operator's arguments: an array, or a single value
+func expressionArgs(operand interface{}) []interface{} {
+	if args, isArray := operand.([]interface{}); isArray {
+		return args
+	}
+	return []interface{}{operand}
+}
+
+// evalOperator evaluates a single expression operator
+func (m MatchOptions) evalOperator(doc map[string]interface{}, op string, operand interface{}) interface{} {
+	if op == "$literal" {
+		return operand
+	}
+	if cond, isMap := operand.(map[string]interface{}); isMap && op == "$cond" {
+		operand = []interface{}{cond["if"], cond["then"], cond["else"]}
+	}
+
+	raw := expressionArgs(operand)
+	if arity := expressionArity[op]; (arity < 0 && len(raw) == 0) || (arity >= 0 && len(raw) != arity) {
+		return nil
+	}
+
+	// Short-circuiting operators evaluate their arguments lazily
+	switch op {
+	case "$and":
+		for _, arg := range raw {
+			if !truthy(m.evaluate(doc, arg)) {
+				return false
+			}
+		}
+		return true
+	case "$or":
+		for _, arg := range raw {
+			if truthy(m.evaluate(doc, arg)) {
+				return true
+			}
+		}
+		return false
+	case "$cond":
+		if truthy(m.evaluate(doc, raw[0])) {
+			return m.evaluate(doc, raw[1])
+		}
+		return m.evaluate(doc, raw[2])
+	case "$ifNull":
+		if value := m.evaluate(doc, raw[0]); value != nil {
+			return value
+		}
+		return m.evaluate(doc, raw[1])
+	}
+
+	args := make([]interface{}, len(raw))
+	for i, arg := range raw {
+		args[i] = m.evaluate(doc, arg)
+	}
+
+	switch op {
+	case "$not":
+		return !truthy(args[0])
+	case "$eq":
+		return m.valuesMatch(args[0], args[1])
+	case "$ne":
+		return !m.valuesMatch(args[0], args[1])
+	case "$gt", "$gte", "$lt", "$lte":
+		cmp, ok := m.compareOrdered(args[0], args[1])
+		if !ok {
+			return false
+		}
+		switch op {
+		case "$gt":
+			return cmp > 0
+		case "$gte":
+			return cmp >= 0
+		case "$lt":
+			return cmp < 0
+		}
+		return cmp <= 0
+	case "$concat", "$toUpper", "$toLower":
+		return evalStringOperator(op, args)
+	case "$size":
+		if arr, isArray := args[0].([]interface{}); isArray {
+			return len(arr)
+		}
+		return nil
+	}
+	return evalArithmetic(op, args)
+}
+
+// evalStringOperator evaluates $concat, $toUpper and $toLower
+func evalStringOperator(op string, args []interface{}) interface{} {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		str, isStr := arg.(string)
+		if !isStr {
+			return nil
+		}
+		strs[i] = str
+	}
+
+	switch op {
+	case "$toUpper":
+		return strings.ToUpper(strs[0])
+	case "$toLower":
+		return strings.ToLower(strs[0])
+	}
+	return strings.Join(strs, "")
+}
+
+// evalArithmetic evaluates the arithmetic operators on numeric arguments
+func evalArithmetic(op string, args []interface{}) interface{} {
+	nums := make([]float64, len(args))
+	for i, arg := range args {
+		n, ok := toFloat64(arg)
+		if !ok {
+			return nil
+		}
+		nums[i] = n
+	}
+
+	switch op {
+	case "$add":
+		sum := 0.0
+		for _, n := range nums {
+			sum += n
+		}
+		return sum
+	case "$multiply":
+		product := 1.0
+		for _, n := range nums {
+			product *= n
+		}
+		return product
+	case "$subtract":
+		return nums[0] - nums[1]
+	case "$divide":
+		if nums[1] == 0 {
+			return nil
+		}
+		return nums[0] / nums[1]
+	case "$mod":
+		if nums[1] == 0 {
+			return nil
+		}
+		return math.Mod(nums[0], nums[1])
+	case "$abs":
+		return math.Abs(nums[0])
+	case "$ceil":
+		return math.Ceil(nums[0])
+	case "$floor":
+		return math.Floor(nums[0])
+	case "$round":
+		// {"$round": ["$price", 2]} rounds to decimal places (default 0)
+		if len(nums) > 2 {
+			return nil
+		}
+		scale := 1.0
+		if len(nums) == 2 {
+			scale = math.Pow(10, math.Trunc(nums[1]))
+		}
+		return math.Round(nums[0]*scale) / scale
+	}
+	return nil
+}
+
+// truthy reports whether an expression result counts as true
+// nil, false and zero are false; everything else is true
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	}
+	if n, ok := toFloat64(value); ok {
+		return n != 0
+	}
+	return true
+}
+
+// matchExpr implements the top-level $expr operator, which compares fields of
+// the same document:
+//
+//	{"$expr": {"$gt": ["$spent", "$budget"]}}
+//
+// A document matches if the expression result is truthy
+func (m MatchOptions) matchExpr(doc map[string]interface{}, operand interface{}) bool {
+	return truthy(m.evaluate(doc, operand))
+}
@@ -0,0 +1,269 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+)
+
+// parseFacets parses the sub-pipelines of a $facet stage:
+//
+//	{"$facet": {
+//		"byCategory": [{"$group": {"_id": "$category", "n": {"$sum": 1}}}],
+//		"prices":     [{"$bucket": {"groupBy": "$price", "boundaries": [0, 50, 100]}}]
+//	}}
+//
+// Every sub-pipeline runs over the same input, and the stage outputs a single
+// document holding each sub-pipeline's results under its name
+// Sub-pipelines can't contain another $facet
+func parseFacets(spec map[string]interface{}) (map[string][]pipelineStage, error) {
+	facets := make(map[string][]pipelineStage, len(spec))
+	for name, raw := range spec {
+		list, ok := raw.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("facet %s must be an array of stages", name)
+		}
+
+		pipeline := make([]map[string]interface{}, len(list))
+		for i, elem := range list {
+			stageMap, ok := elem.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("facet %s: stage %d must be an object", name, i)
+			}
+			if _, nested := stageMap["$facet"]; nested {
+				return nil, fmt.Errorf("facet %s: $facet can't be nested", name)
+			}
+			pipeline[i] = stageMap
+		}
+
+		stages, err := parsePipeline(pipeline)
+		if err != nil {
+			return nil, fmt.Errorf("facet %s: %w", name, err)
+		}
+		facets[name] = stages
+	}
+	return facets, nil
+}
+
+// runFacets runs each sub-pipeline over the same documents
+func runFacets(match MatchOptions, facets map[string][]pipelineStage, docs []map[string]interface{}) []map[string]interface{} {
+	out := make(map[string]interface{}, len(facets))
+	for name, stages := range facets {
+		// Stages may reslice their input, so give each facet its own slice
+		results := append([]map[string]interface{}(nil), docs...)
+		for _, stage := range stages {
+			results = stage.run(match, results)
+		}
+
+		list := make([]interface{}, len(results))
+		for i, doc := range results {
+			list[i] = doc
+		}
+		out[name] = list
+	}
+	return []map[string]interface{}{out}
+}
+
+// bucketSpec describes a $bucket stage, which groups documents into ranges:
+//
+//	{"$bucket": {
+//		"groupBy":    "$price",              // Expression to bucket by
+//		"boundaries": [0, 50, 100, 500],     // Ascending; bucket i holds [boundaries[i], boundaries[i+1])
+//		"default":    "other",               // Optional _id for values outside every range
+//		"output":     {"n": {"$sum": 1}}     // Optional accumulators (default: count)
+//	}}
+//
+// Each output document's _id is its bucket's lower boundary. Buckets are
+// returned in boundary order, with the default bucket last; empty buckets
+// are omitted. Without a default, documents outside the ranges are dropped
+type bucketSpec struct {
+	groupBy    interface{}   // Expression evaluated per document
+	boundaries []interface{} // Sorted bucket edges
+	def        interface{}   // Default bucket _id
+	hasDefault bool          // Whether a default bucket was given
+	group      *groupSpec    // Accumulators
+}
+
+// parseBucket parses a $bucket specification
+func parseBucket(spec map[string]interface{}) (*bucketSpec, error) {
+	groupBy, ok := spec["groupBy"]
+	if !ok {
+		return nil, fmt.Errorf("missing groupBy")
+	}
+
+	boundaries, ok := spec["boundaries"].([]interface{})
+	if !ok || len(boundaries) < 2 {
+		return nil, fmt.Errorf("boundaries must be an array of at least two values")
+	}
+	for i := 1; i < len(boundaries); i++ {
+		if compareValues(boundaries[i-1], boundaries[i]) >= 0 {
+			return nil, fmt.Errorf("boundaries must be in ascending order")
+		}
+	}
+
+	group, err := parseBucketOutput(spec, "groupBy", "boundaries", "default", "output")
+	if err != nil {
+		return nil, err
+	}
+
+	def, hasDefault := spec["default"]
+	return &bucketSpec{
+		groupBy:    groupBy,
+		boundaries: boundaries,
+		def:        def,
+		hasDefault: hasDefault,
+		group:      group,
+	}, nil
+}
+
+// parseBucketOutput checks a bucket spec's keys and parses its output accumulators
+// Without an output, each bucket counts its documents
+func parseBucketOutput(spec map[string]interface{}, allowed ...string) (*groupSpec, error) {
+	for key := range spec {
+		if !containsString(allowed, key) {
+			return nil, fmt.Errorf("unknown field %s", key)
+		}
+	}
+
+	raw, present := spec["output"]
+	if !present {
+		return &groupSpec{accumulators: []accumulator{{field: "count", op: "$sum", expr: 1.0}}}, nil
+	}
+	output, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("output must be an object of accumulators")
+	}
+	if _, hasID := output["_id"]; hasID {
+		return nil, fmt.Errorf("output can't set _id")
+	}
+	accumulators, err := parseAccumulators(output)
+	if err != nil {
+		return nil, err
+	}
+	return &groupSpec{accumulators: accumulators}, nil
+}
+
+// run groups documents into the boundary ranges
+func (b *bucketSpec) run(docs []map[string]interface{}) []map[string]interface{} {
+	results := b.group.runBy(docs, func(doc map[string]interface{}) (interface{}, bool) {
+		if i, ok := b.bucketOf(evalExpression(doc, b.groupBy)); ok {
+			return b.boundaries[i], true
+		}
+		return b.def, b.hasDefault
+	})
+
+	// Order by boundary, with the default bucket after the ranges
+	position := func(id interface{}) int {
+		for i, boundary := range b.boundaries[:len(b.boundaries)-1] {
+			if groupHash(boundary) == groupHash(id) {
+				return i
+			}
+		}
+		return len(b.boundaries)
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return position(results[i]["_id"]) < position(results[j]["_id"])
+	})
+	return results
+}
+
+// bucketOf returns the index of the range containing value
+func (b *bucketSpec) bucketOf(value interface{}) (int, bool) {
+	if value == nil {
+		return 0, false
+	}
+	for i := 0; i < len(b.boundaries)-1; i++ {
+		lower, upper := b.boundaries[i], b.boundaries[i+1]
+		if sameKind(value, lower) && compareValues(value, lower) >= 0 && compareValues(value, upper) < 0 {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// sameKind reports whether two values are both numbers or both strings
+func sameKind(a, b interface{}) bool {
+	_, aNum := toFloat64(a)
+	_, bNum := toFloat64(b)
+	if aNum || bNum {
+		return aNum && bNum
+	}
+	_, aStr := a.(string)
+	_, bStr := b.(string)
+	return aStr && bStr
+}
+
+// bucketAutoSpec describes a $bucketAuto stage, which picks its own ranges:
+//
+//	{"$bucketAuto": {"groupBy": "$price", "buckets": 4, "output": {"n": {"$sum": 1}}}}
+//
+// Documents are sorted by the groupBy value and split into at most that many
+// buckets of roughly equal size; equal values always share a bucket. Each
+// output _id is {"min": ..., "max": ...}, where max is the next bucket's min
+// (or the largest value, for the last bucket). Documents without a value are skipped
+type bucketAutoSpec struct {
+	groupBy interface{} // Expression evaluated per document
+	buckets int         // Maximum number of buckets
+	group   *groupSpec  // Accumulators
+}
+
+// parseBucketAuto parses a $bucketAuto specification
+func parseBucketAuto(spec map[string]interface{}) (*bucketAutoSpec, error) {
+	groupBy, ok := spec["groupBy"]
+	if !ok {
+		return nil, fmt.Errorf("missing groupBy")
+	}
+
+	n, ok := toFloat64(spec["buckets"])
+	if !ok || n < 1 || n != float64(int(n)) {
+		return nil, fmt.Errorf("buckets must be a positive integer")
+	}
+
+	group, err := parseBucketOutput(spec, "groupBy", "buckets", "output")
+	if err != nil {
+		return nil, err
+	}
+	return &bucketAutoSpec{groupBy: groupBy, buckets: int(n), group: group}, nil
+}
+
+// run sorts the documents by value and splits them into buckets
+func (b *bucketAutoSpec) run(docs []map[string]interface{}) []map[string]interface{} {
+	type keyed struct {
+		value interface{}
+		doc   map[string]interface{}
+	}
+	values := make([]keyed, 0, len(docs))
+	for _, doc := range docs {
+		if value := evalExpression(doc, b.groupBy); value != nil {
+			values = append(values, keyed{value: value, doc: doc})
+		}
+	}
+	sort.SliceStable(values, func(i, j int) bool {
+		return compareValues(values[i].value, values[j].value) < 0
+	})
+
+	size := (len(values) + b.buckets - 1) / b.buckets
+	results := make([]map[string]interface{}, 0, b.buckets)
+	for start := 0; start < len(values); {
+		end := min(start+size, len(values))
+		// Keep runs of equal values together
+		for end < len(values) && compareValues(values[end].value, values[end-1].value) == 0 {
+			end++
+		}
+
+		upper := values[len(values)-1].value
+		if end < len(values) {
+			upper = values[end].value
+		}
+		id := map[string]interface{}{"min": values[start].value, "max": upper}
+
+		chunk := make([]map[string]interface{}, end-start)
+		for i := range chunk {
+			chunk[i] = values[start+i].doc
+		}
+		results = append(results, b.group.runBy(chunk, func(map[string]interface{}) (interface{}, bool) {
+			return id, true
+		})...)
+		start = end
+	}
+	return results
+}
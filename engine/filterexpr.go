@@ -0,0 +1,483 @@
+package engine
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ParseFilterString parses a filter string into a filter map
+// Strings are parsed with ParseFilterExpression; if it rejects one that is in
+// the original "field1=value1,field2=value2" format, that is parsed instead,
+// with string values. Anything else it rejects is returned as an error, so a
+// malformed expression never becomes a filter matching everything
+// This is useful for converting string-based queries from the WASM layer
+func ParseFilterString(filterStr string) (map[string]interface{}, error) {
+	filter, err := ParseFilterExpression(filterStr)
+	if err == nil {
+		return filter, nil
+	}
+	if !isFilterPairs(filterStr) {
+		return nil, err
+	}
+	return parseFilterPairs(filterStr), nil
+}
+
+// isFilterPairs reports whether a string is in the "field1=value1,field2=value2"
+// format: every pair is a field without spaces or operator characters, "=",
+// and a value without operator characters or AND/OR/NOT
+func isFilterPairs(filterStr string) bool {
+	pairs := 0
+	for _, part := range strings.Split(filterStr, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		field, value, ok := strings.Cut(part, "=")
+		field = strings.TrimSpace(field)
+		if !ok || field == "" || strings.IndexFunc(field, isFilterDelimiter) >= 0 || strings.ContainsAny(value, "()=!<>\"'") {
+			return false
+		}
+		for _, word := range strings.Fields(value) {
+			if strings.EqualFold(word, "AND") || strings.EqualFold(word, "OR") || strings.EqualFold(word, "NOT") {
+				return false
+			}
+		}
+		pairs++
+	}
+	return pairs > 0
+}
+
+// parseFilterPairs parses the simple "field1=value1,field2=value2" format
+// Empty pairs are skipped
+func parseFilterPairs(filterStr string) map[string]interface{} {
+	filter := make(map[string]interface{})
+
+	if filterStr == "" {
+		return filter
+	}
+
+	// Split by comma to get individual conditions
+	parts := strings.Split(filterStr, ",")
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		// Split by = to get field and value
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		field := strings.TrimSpace(kv[0])
+		value := strings.TrimSpace(kv[1])
+
+		// Store in filter map
+		filter[field] = value
+	}
+
+	return filter
+}
+
+// ParseFilterExpression parses a human-typed query into a filter map
+// Grammar (keywords are case-insensitive):
+//
+//	expr       = term { OR term }
+//	term       = factor { (AND | ",") factor }
+//	factor     = NOT factor | "(" expr ")" | comparison
+//	comparison = field op value
+//	op         = "=" | "==" | "!=" | "<>" | ">" | ">=" | "<" | "<=" | CONTAINS | LIKE
+//	           | IN "(" value { "," value } ")"
+//
+// Values are numbers, true, false, null, quoted strings ("..." or '...', with
+// backslash escapes) or bare words, which are strings. LIKE takes a SQL
+// pattern where "%" matches any run of characters and "_" any one. For example:
+//
+//	age >= 18 AND (role = admin OR name contains "Smith")
+//
+// An empty expression yields an empty filter, which matches everything
+func ParseFilterExpression(expr string) (map[string]interface{}, error) {
+	tokens, err := tokenizeFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return make(map[string]interface{}), nil
+	}
+
+	p := &filterParser{tokens: tokens}
+	filter, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at position %d", tok, tok.pos)
+	}
+	return filter, nil
+}
+
+// filterTokenKind identifies the kind of a filter expression token
+type filterTokenKind int
+
+const (
+	tokenEOF    filterTokenKind = iota
+	tokenWord                   // Bare word: field, keyword or unquoted value
+	tokenString                 // Quoted string
+	tokenOp                     // Comparison operator
+	tokenLParen                 // (
+	tokenRParen                 // )
+	tokenComma                  // ,
+)
+
+// filterToken is a single lexical token of a filter expression
+type filterToken struct {
+	kind filterTokenKind
+	text string // Token text; unescaped contents for quoted strings
+	pos  int    // Byte offset in the expression
+}
+
+// String describes a token for error messages
+func (t filterToken) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of expression"
+	case tokenString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// isKeyword reports whether the token is the given keyword (case-insensitive)
+func (t filterToken) isKeyword(keyword string) bool {
+	return t.kind == tokenWord && strings.EqualFold(t.text, keyword)
+}
+
+// tokenizeFilter splits a filter expression into tokens
+func tokenizeFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '(':
+			tokens = append(tokens, filterToken{kind: tokenLParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, filterToken{kind: tokenRParen, text: ")", pos: i})
+			i++
+		case c == ',':
+			tokens = append(tokens, filterToken{kind: tokenComma, text: ",", pos: i})
+			i++
+
+		case c == '=' || c == '!' || c == '<' || c == '>':
+			op := string(c)
+			if i+1 < len(expr) && (expr[i+1] == '=' || (c == '<' && expr[i+1] == '>')) {
+				op += string(expr[i+1])
+			}
+			if op == "!" {
+				return nil, fmt.Errorf("unexpected '!' at position %d (did you mean '!=')", i)
+			}
+			tokens = append(tokens, filterToken{kind: tokenOp, text: op, pos: i})
+			i += len(op)
+
+		case c == '"' || c == '\'':
+			text, end, err := scanQuoted(expr, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, filterToken{kind: tokenString, text: text, pos: i})
+			i = end
+
+		default:
+			start := i
+			for i < len(expr) && !isFilterDelimiter(rune(expr[i])) {
+				i++
+			}
+			tokens = append(tokens, filterToken{kind: tokenWord, text: expr[start:i], pos: start})
+		}
+	}
+	return tokens, nil
+}
+
+// isFilterDelimiter reports whether a character ends a bare word
+func isFilterDelimiter(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune("()=!<>,\"'", r)
+}
+
+// scanQuoted reads a quoted string starting at expr[start]
+// Returns the unescaped contents and the offset just past the closing quote
+func scanQuoted(expr string, start int) (string, int, error) {
+	quote := expr[start]
+	var b strings.Builder
+	for i := start + 1; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case c == '\\' && i+1 < len(expr):
+			i++
+			b.WriteByte(expr[i])
+		case c == quote:
+			return b.String(), i + 1, nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string starting at position %d", start)
+}
+
+// filterParser is a recursive-descent parser over filter tokens
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+// peek returns the next token without consuming it
+func (p *filterParser) peek() filterToken {
+	if p.pos >= len(p.tokens) {
+		return filterToken{kind: tokenEOF, pos: -1}
+	}
+	return p.tokens[p.pos]
+}
+
+// next consumes and returns the next token
+func (p *filterParser) next() filterToken {
+	tok := p.peek()
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// parseOr parses: term { OR term }
+func (p *filterParser) parseOr() (map[string]interface{}, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	terms := []map[string]interface{}{first}
+	for p.peek().isKeyword("or") {
+		p.next()
+		term, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+	}
+
+	if len(terms) == 1 {
+		return first, nil
+	}
+	return map[string]interface{}{"$or": filterList(terms)}, nil
+}
+
+// parseAnd parses: factor { (AND | ",") factor }
+func (p *filterParser) parseAnd() (map[string]interface{}, error) {
+	first, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+
+	factors := []map[string]interface{}{first}
+	for {
+		tok := p.peek()
+		if tok.kind != tokenComma && !tok.isKeyword("and") {
+			break
+		}
+		p.next()
+		factor, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		factors = append(factors, factor)
+	}
+
+	return combineAnd(factors), nil
+}
+
+// parseFactor parses: NOT factor | "(" expr ")" | comparison
+func (p *filterParser) parseFactor() (map[string]interface{}, error) {
+	tok := p.peek()
+
+	if tok.isKeyword("not") {
+		p.next()
+		sub, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"$not": sub}, nil
+	}
+
+	if tok.kind == tokenLParen {
+		p.next()
+		sub, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenRParen {
+			return nil, fmt.Errorf("expected ')' but found %s", closing)
+		}
+		return sub, nil
+	}
+
+	return p.parseComparison()
+}
+
+// parseComparison parses: field op value
+func (p *filterParser) parseComparison() (map[string]interface{}, error) {
+	fieldTok := p.next()
+	if fieldTok.kind != tokenWord && fieldTok.kind != tokenString {
+		return nil, fmt.Errorf("expected a field name but found %s", fieldTok)
+	}
+	field := fieldTok.text
+
+	opTok := p.next()
+	var op string
+	switch {
+	case opTok.kind == tokenOp:
+		op = opTok.text
+	case opTok.isKeyword("contains"), opTok.isKeyword("like"), opTok.isKeyword("in"):
+		op = strings.ToLower(opTok.text)
+	default:
+		return nil, fmt.Errorf("expected an operator after %q but found %s", field, opTok)
+	}
+
+	if op == "in" {
+		values, err := p.parseValueList()
+		if err != nil {
+			return nil, fmt.Errorf("%s in: %w", field, err)
+		}
+		return map[string]interface{}{field: map[string]interface{}{"$in": values}}, nil
+	}
+
+	valueTok := p.next()
+	if valueTok.kind != tokenWord && valueTok.kind != tokenString {
+		return nil, fmt.Errorf("expected a value after %q %s but found %s", field, op, valueTok)
+	}
+	value := filterValue(valueTok)
+
+	switch op {
+	case "=", "==":
+		return map[string]interface{}{field: value}, nil
+	case "!=", "<>":
+		return map[string]interface{}{field: map[string]interface{}{"$ne": value}}, nil
+	case ">":
+		return map[string]interface{}{field: map[string]interface{}{"$gt": value}}, nil
+	case ">=":
+		return map[string]interface{}{field: map[string]interface{}{"$gte": value}}, nil
+	case "<":
+		return map[string]interface{}{field: map[string]interface{}{"$lt": value}}, nil
+	case "<=":
+		return map[string]interface{}{field: map[string]interface{}{"$lte": value}}, nil
+	case "like":
+		pattern, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s like: pattern must be a string", field)
+		}
+		return map[string]interface{}{field: map[string]interface{}{"$regex": likePattern(pattern)}}, nil
+	default:
+		return map[string]interface{}{field: map[string]interface{}{"$contains": value}}, nil
+	}
+}
+
+// parseValueList parses a parenthesised, comma-separated list of values: "(" value { "," value } ")"
+func (p *filterParser) parseValueList() ([]interface{}, error) {
+	if open := p.next(); open.kind != tokenLParen {
+		return nil, fmt.Errorf("expected '(' but found %s", open)
+	}
+
+	var values []interface{}
+	for {
+		valueTok := p.next()
+		if valueTok.kind != tokenWord && valueTok.kind != tokenString {
+			return nil, fmt.Errorf("expected a value but found %s", valueTok)
+		}
+		values = append(values, filterValue(valueTok))
+
+		sep := p.next()
+		if sep.kind == tokenRParen {
+			return values, nil
+		}
+		if sep.kind != tokenComma {
+			return nil, fmt.Errorf("expected ',' or ')' but found %s", sep)
+		}
+	}
+}
+
+// likePattern converts a SQL LIKE pattern into an anchored regular expression
+// "%" matches any run of characters and "_" any single character
+func likePattern(pattern string) string {
+	var b strings.Builder
+	b.WriteString("(?s)^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			b.WriteString(".*")
+		case '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// filterValue converts a value token into a typed filter value
+// Quoted strings stay strings; bare words become numbers, bools or null when they look like one
+func filterValue(tok filterToken) interface{} {
+	if tok.kind == tokenString {
+		return tok.text
+	}
+
+	switch strings.ToLower(tok.text) {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "null":
+		return nil
+	}
+
+	// Only words that start like a number are numbers (so "inf" stays a string)
+	if first := tok.text[0]; (first >= '0' && first <= '9') || first == '-' || first == '+' || first == '.' {
+		if n, err := strconv.ParseFloat(tok.text, 64); err == nil {
+			return n
+		}
+	}
+	return tok.text
+}
+
+// combineAnd merges ANDed filters into a single filter
+// Filters are merged into one map when their keys don't overlap; otherwise
+// they are wrapped in $and
+func combineAnd(filters []map[string]interface{}) map[string]interface{} {
+	if len(filters) == 1 {
+		return filters[0]
+	}
+
+	merged := make(map[string]interface{})
+	for _, filter := range filters {
+		for key, value := range filter {
+			if _, taken := merged[key]; taken {
+				return map[string]interface{}{"$and": filterList(filters)}
+			}
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+// filterList converts filters into the []interface{} form used for $and/$or operands
+func filterList(filters []map[string]interface{}) []interface{} {
+	list := make([]interface{}, len(filters))
+	for i, filter := range filters {
+		list[i] = filter
+	}
+	return list
+}
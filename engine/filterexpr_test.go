@@ -0,0 +1,48 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestParseFilterString checks that expressions and the "field=value" pairs
+// it accepted before are parsed, and that malformed expressions are errors
+// rather than an empty filter matching everything
+func TestParseFilterString(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{"Empty", "", map[string]interface{}{}, false},
+		{"Expression", "age > 18", map[string]interface{}{"age": map[string]interface{}{"$gt": float64(18)}}, false},
+		{"Pairs", "status=active,role=admin", map[string]interface{}{"status": "active", "role": "admin"}, false},
+		{"PairWithSpaces", "name=John Smith", map[string]interface{}{"name": "John Smith"}, false},
+		{"PairsWithEmptyPair", "name=John Smith,,city=New York", map[string]interface{}{"name": "John Smith", "city": "New York"}, false},
+		{"DanglingAnd", "age > 18 AND", nil, true},
+		{"UnclosedParen", "(age > 3", nil, true},
+		{"DanglingComparison", "name = John Smith AND", nil, true},
+		{"MissingValue", "age >", nil, true},
+		{"UnterminatedString", `name = "Smith`, nil, true},
+		{"LoneWord", "admin", nil, true},
+		{"Bang", "age ! 3", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseFilterString(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseFilterString(%q) = %v, want an error", tt.input, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ParseFilterString(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
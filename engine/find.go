@@ -0,0 +1,199 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// FindOptions controls how Find returns its results
+// Sorting happens first, then Skip and Limit, then Projection
+// Without Sort the order of results (and therefore of pages) is unspecified
+type FindOptions struct {
+	Sort       []SortField // Fields to sort by, in priority order
+	Skip       int         // Number of matching documents to skip
+	Limit      int         // Maximum number of documents to return (0 means no limit)
+	Projection *Projection // Fields to return (nil returns whole documents); see NewProjection
+	Collation  *Collation  // String comparison for the filter and sort; nil uses the database default
+	Hint       string      // Index choice: an index name to force, "-name" to avoid it, or "$natural" for no index (see ListIndexes)
+}
+
+// SortField is a single sort key
+type SortField struct {
+	Field     string // Field name, dot notation allowed
+	Direction string // "asc" (default) or "desc"
+	Nulls     string // Where missing and null values go: "first" or "last"; by default they sort lowest
+}
+
+// nullsFirst reports whether missing and null values sort before other values
+func (f SortField) nullsFirst() bool {
+	switch f.Nulls {
+	case "first":
+		return true
+	case "last":
+		return false
+	}
+	return f.Direction != "desc"
+}
+
+// apply sorts, paginates and projects a result set
+func (o FindOptions) apply(docs []map[string]interface{}) []map[string]interface{} {
+	if len(o.Sort) > 0 {
+		o.Collation.sortDocuments(docs, o.Sort)
+	}
+
+	// Apply skip and limit
+	if o.Skip > 0 {
+		if o.Skip >= len(docs) {
+			docs = docs[:0]
+		} else {
+			docs = docs[o.Skip:]
+		}
+	}
+	if o.Limit > 0 && len(docs) > o.Limit {
+		docs = docs[:o.Limit]
+	}
+
+	if o.Projection != nil {
+		projected := make([]map[string]interface{}, len(docs))
+		for i, doc := range docs {
+			projected[i] = o.Projection.Apply(doc)
+		}
+		docs = projected
+	}
+
+	return docs
+}
+
+// SortDocuments sorts documents in place by a field
+// direction: "asc" or "desc"
+// It is SortDocumentsBy with a single field, so the field may use dot notation
+// and missing fields sort lowest
+func SortDocuments(docs []map[string]interface{}, field string, direction string) {
+	SortDocumentsBy(docs, SortField{Field: field, Direction: direction})
+}
+
+// SortDocumentsBy sorts documents in place by several fields, in priority order
+// Fields may use dot notation. The sort is stable, so documents with equal
+// keys keep their relative order. Missing fields and nulls are equal to each
+// other and are placed according to each field's Nulls setting
+// Strings compare byte by byte; use a Collation for locale-aware ordering
+func SortDocumentsBy(docs []map[string]interface{}, fields ...SortField) {
+	(*Collation)(nil).sortDocuments(docs, fields)
+}
+
+// sortDocuments implements SortDocumentsBy; a nil collation compares bytes
+func (c *Collation) sortDocuments(docs []map[string]interface{}, fields []SortField) {
+	// Look each key up once rather than on every comparison
+	keys := make([][]interface{}, len(docs))
+	order := make([]int, len(docs))
+	for i, doc := range docs {
+		keys[i] = sortKey(doc, fields)
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return c.compareSortKeys(keys[order[a]], keys[order[b]], fields) < 0
+	})
+
+	sorted := make([]map[string]interface{}, len(docs))
+	for i, idx := range order {
+		sorted[i] = docs[idx]
+	}
+	copy(docs, sorted)
+}
+
+// sortKey returns a document's values for the sort fields (nil when missing)
+func sortKey(doc map[string]interface{}, fields []SortField) []interface{} {
+	key := make([]interface{}, len(fields))
+	for i, field := range fields {
+		key[i], _ = lookupPath(doc, field.Field)
+	}
+	return key
+}
+
+// compareSortKeys compares two sort keys field by field, honouring each field's direction
+func (c *Collation) compareSortKeys(a, b []interface{}, fields []SortField) int {
+	for i, field := range fields {
+		aNull, bNull := a[i] == nil, b[i] == nil
+		if aNull || bNull {
+			if aNull == bNull {
+				continue
+			}
+			// Null placement doesn't depend on the direction
+			if aNull == field.nullsFirst() {
+				return -1
+			}
+			return 1
+		}
+
+		cmp := c.compareValues(a[i], b[i])
+		if cmp == 0 {
+			continue
+		}
+		if field.Direction == "desc" {
+			return -cmp
+		}
+		return cmp
+	}
+	return 0
+}
+
+// ParseSort converts a loosely typed sort spec into sort fields
+// Accepted forms:
+//   "age"                                   // Ascending on one field
+//   "-age,name"                             // Leading "-" sorts descending
+//   ["-age", "name"]                        // Same, as an array
+//   [{"field": "age", "direction": "desc"}] // Explicit objects
+//   [{"field": "age", "nulls": "last"}]     // Objects can also place missing/null values
+func ParseSort(spec interface{}) ([]SortField, error) {
+	switch v := spec.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		var fields []SortField
+		for _, part := range strings.Split(v, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			fields = append(fields, parseSortToken(part))
+		}
+		return fields, nil
+	case []interface{}:
+		var fields []SortField
+		for _, elem := range v {
+			switch e := elem.(type) {
+			case string:
+				fields = append(fields, parseSortToken(e))
+			case map[string]interface{}:
+				name, _ := e["field"].(string)
+				if name == "" {
+					return nil, fmt.Errorf("sort entry is missing a field name")
+				}
+				direction, _ := e["direction"].(string)
+				direction = strings.ToLower(direction)
+				if direction != "" && direction != "asc" && direction != "desc" {
+					return nil, fmt.Errorf("invalid sort direction %q for %s", direction, name)
+				}
+				nulls, _ := e["nulls"].(string)
+				nulls = strings.ToLower(nulls)
+				if nulls != "" && nulls != "first" && nulls != "last" {
+					return nil, fmt.Errorf("invalid nulls placement %q for %s", nulls, name)
+				}
+				fields = append(fields, SortField{Field: name, Direction: direction, Nulls: nulls})
+			default:
+				return nil, fmt.Errorf("invalid sort entry: %v", elem)
+			}
+		}
+		return fields, nil
+	}
+	return nil, fmt.Errorf("invalid sort spec: %v", spec)
+}
+
+// parseSortToken parses "field" or "-field"
+func parseSortToken(token string) SortField {
+	if strings.HasPrefix(token, "-") {
+		return SortField{Field: token[1:], Direction: "desc"}
+	}
+	return SortField{Field: strings.TrimPrefix(token, "+"), Direction: "asc"}
+}
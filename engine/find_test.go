@@ -0,0 +1,95 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+)
+
+// sortFixture returns documents named a to e, with ages and cities some of
+// them lack
+func sortFixture() []map[string]interface{} {
+	return []map[string]interface{}{
+		{"name": "a", "age": 30, "address": map[string]interface{}{"city": "Lima"}},
+		{"name": "b", "age": 25},
+		{"name": "c", "age": 30, "address": map[string]interface{}{"city": "Bogota"}},
+		{"name": "d"},
+		{"name": "e", "age": nil, "address": map[string]interface{}{"city": "Quito"}},
+	}
+}
+
+// names returns the documents' names, in order
+func names(docs []map[string]interface{}) []string {
+	var out []string
+	for _, doc := range docs {
+		out = append(out, doc["name"].(string))
+	}
+	return out
+}
+
+func TestSortDocuments(t *testing.T) {
+	tests := []struct {
+		name      string
+		field     string
+		direction string
+		want      []string
+	}{
+		{"ascending, stable for equal ages", "age", "asc", []string{"d", "e", "b", "a", "c"}},
+		{"descending", "age", "desc", []string{"a", "c", "b", "d", "e"}},
+		{"direction defaults to ascending", "name", "", []string{"a", "b", "c", "d", "e"}},
+		{"dot notation", "address.city", "asc", []string{"b", "d", "c", "a", "e"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docs := sortFixture()
+			SortDocuments(docs, tt.field, tt.direction)
+			if got := names(docs); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSortDocumentsMixedTypes checks that values of different types sort by
+// type, whatever order the documents start in
+func TestSortDocumentsMixedTypes(t *testing.T) {
+	docs := []map[string]interface{}{
+		{"name": "true", "v": true},
+		{"name": "ten", "v": "10"},
+		{"name": "nine", "v": 9},
+		{"name": "list", "v": []interface{}{1}},
+		{"name": "missing"},
+		{"name": "hundred", "v": 100},
+		{"name": "abc", "v": "abc"},
+		{"name": "false", "v": false},
+	}
+	want := []string{"missing", "nine", "hundred", "ten", "abc", "false", "true", "list"}
+	for shift := range docs {
+		shifted := append(append([]map[string]interface{}{}, docs[shift:]...), docs[:shift]...)
+		SortDocuments(shifted, "v", "asc")
+		if got := names(shifted); !reflect.DeepEqual(got, want) {
+			t.Fatalf("shift %d: got %v, want %v", shift, got, want)
+		}
+	}
+}
+
+func TestSortDocumentsBy(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []SortField
+		want   []string
+	}{
+		{"no fields keeps the order", nil, []string{"a", "b", "c", "d", "e"}},
+		{"second field breaks ties", []SortField{{Field: "age", Direction: "desc"}, {Field: "name", Direction: "desc"}}, []string{"c", "a", "b", "e", "d"}},
+		{"nulls last", []SortField{{Field: "age", Nulls: "last"}}, []string{"b", "a", "c", "d", "e"}},
+		{"nulls first when descending", []SortField{{Field: "age", Direction: "desc", Nulls: "first"}}, []string{"d", "e", "a", "c", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docs := sortFixture()
+			SortDocumentsBy(docs, tt.fields...)
+			if got := names(docs); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
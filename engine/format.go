@@ -0,0 +1,326 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Storage file formats, as reported in FileReport.FormatVersion
+const (
+	// FormatJSONLines is the original log: one JSON record per line
+	FormatJSONLines = 1
+
+	// FormatBinary is a header followed by length-prefixed records, each JSON
+	// payload preceded by its length and a CRC-32C checksum. Payloads can hold
+	// any bytes, so there is no limit on line length to hit, and may be
+	// compressed (see WithCompression)
+	FormatBinary = 2
+)
+
+// Record compression algorithms (see WithCompression)
+const (
+	CompressionNone = ""     // Payloads are stored as written
+	CompressionGzip = "gzip" // Large payloads are gzip-compressed
+)
+
+// compressMinBytes is the smallest payload worth compressing; below it the
+// gzip header outweighs the savings
+const compressMinBytes = 256
+
+// frameCompressed flags a compressed payload in the top bit of a binary
+// record's length field (lengths never reach it; see maxRecordBytes)
+const frameCompressed = 1 << 31
+
+// binaryMagic opens a FormatBinary file; JSON-lines files start with '{'
+// Its seventh byte holds the file flags (see headerEncrypted and
+// headerCodecMask), the eighth the format version
+const binaryMagic = "TETODB\x00\x02"
+
+// headerEncrypted flags an encrypted file, whose header is followed by a
+// key block (see WithEncryption)
+const headerEncrypted = 0x01
+
+// binaryFrameHeader is the size of a record's length and checksum fields
+const binaryFrameHeader = 8
+
+// maxRecordBytes bounds a record's declared length, so a corrupt length
+// can't make the reader allocate without limit
+const maxRecordBytes = 1 << 30
+
+// errRecordChecksum reports a record whose payload doesn't match its checksum
+var errRecordChecksum = errors.New("record checksum mismatch")
+
+// errRecordLength reports a binary record whose declared length runs past
+// the end of the file or over maxRecordBytes: a torn write if it ends the
+// file, otherwise a corrupt length field
+var errRecordLength = errors.New("record length runs past the end of the file")
+
+// errRecordEncoding reports a record whose payload can't be decoded, e.g. a
+// compressed payload that doesn't decompress
+var errRecordEncoding = errors.New("record payload can't be decoded")
+
+// crcTable is the Castagnoli polynomial table used for record checksums
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// validFormat reports whether format is a storage format this engine writes
+func validFormat(format int) bool {
+	return format == FormatJSONLines || format == FormatBinary
+}
+
+// validCompression checks that an algorithm is one this engine implements
+func validCompression(compression string) error {
+	if compression != CompressionNone && compression != CompressionGzip {
+		return fmt.Errorf("compression %q is not supported (available: %s)", compression, CompressionGzip)
+	}
+	return nil
+}
+
+// formatHeader returns the bytes a file written with enc starts with
+// A binary file's header names its codec, and an encrypted file's carries
+// its cipher's key block
+func formatHeader(enc recordEncoding) []byte {
+	if enc.format != FormatBinary {
+		return nil
+	}
+	header := []byte(binaryMagic)
+	header[6] |= codecFlags[enc.codec]
+	if enc.cipher != nil {
+		header[6] |= headerEncrypted
+		header = append(header, enc.cipher.keyBlock...)
+	}
+	return header
+}
+
+// recordEncoding holds the settings records are written with
+type recordEncoding struct {
+	format      int         // FormatJSONLines or FormatBinary
+	codec       string      // Codec of binary payloads (see WithRecordCodec); JSON lines are always JSON
+	compression string      // Compression for binary payloads (CompressionNone or CompressionGzip)
+	cipher      *fileCipher // Encrypts binary payloads; nil for plaintext
+}
+
+// encode serializes a record
+func (e recordEncoding) encode(record StorageRecord) ([]byte, error) {
+	if e.format != FormatBinary {
+		payload, err := json.Marshal(record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal record: %w", err)
+		}
+		return append(payload, '\n'), nil
+	}
+
+	payload, err := marshalRecord(record, e.codec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	// Compression is kept only when it actually shrinks the payload
+	var length uint32
+	if e.compression == CompressionGzip && len(payload) >= compressMinBytes {
+		compressed, err := gzipBytes(payload)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(payload) {
+			payload = compressed
+			length = frameCompressed
+		}
+	}
+	if e.cipher != nil {
+		if payload, err = e.cipher.seal(payload); err != nil {
+			return nil, err
+		}
+	}
+	length |= uint32(len(payload))
+
+	frame := make([]byte, binaryFrameHeader, binaryFrameHeader+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], length)
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(payload, crcTable))
+	return append(frame, payload...), nil
+}
+
+// recordReader reads the raw record payloads of a storage file in either format
+type recordReader struct {
+	r         *bufio.Reader
+	format    int
+	codec     string      // Codec of the payloads (see WithRecordCodec)
+	encrypted bool        // The file is encrypted
+	keyBlock  []byte      // Key block of an encrypted file
+	cipher    *fileCipher // Decrypts payloads; without it encrypted payloads come back sealed
+
+	size         int64 // Length of the file, or -1 if the reader can't tell
+	offset       int64 // Bytes of the file consumed so far: the end of the last record read
+	unterminated bool  // The last line read ended the file without a newline
+}
+
+// newRecordReader detects the file's format from its header
+// An empty file reads as FormatJSONLines. r must be at the start of the
+// file; if it is a file or an in-memory reader, its size bounds the lengths
+// binary records can declare
+func newRecordReader(r io.Reader) (*recordReader, error) {
+	reader := &recordReader{r: bufio.NewReader(r), format: FormatJSONLines, codec: CodecJSON, size: readerSize(r)}
+	head, err := reader.r.Peek(len(binaryMagic))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+	if len(head) < len(binaryMagic) || !bytes.Equal(head[:6], []byte(binaryMagic[:6])) || head[7] != binaryMagic[7] {
+		return reader, nil
+	}
+
+	reader.format = FormatBinary
+	if reader.codec, err = codecFromFlags(head[6]); err != nil {
+		return nil, err
+	}
+	reader.encrypted = head[6]&headerEncrypted != 0
+	reader.r.Discard(len(binaryMagic))
+	reader.offset = int64(len(binaryMagic))
+	if reader.encrypted {
+		reader.keyBlock = make([]byte, keyBlockBytes)
+		if _, err := io.ReadFull(reader.r, reader.keyBlock); err != nil {
+			return nil, fmt.Errorf("failed to read encryption key block: %w", err)
+		}
+		reader.offset += keyBlockBytes
+	}
+	return reader, nil
+}
+
+// readerSize returns the size of a file or in-memory reader, or -1
+func readerSize(r io.Reader) int64 {
+	switch v := r.(type) {
+	case interface{ Stat() (os.FileInfo, error) }:
+		if info, err := v.Stat(); err == nil && info.Mode().IsRegular() {
+			return info.Size()
+		}
+	case interface{ Size() int64 }:
+		return v.Size()
+	}
+	return -1
+}
+
+// next returns the payload of the next record: a line without its line
+// ending, which may be empty, or a binary record's payload in the file's
+// codec (still sealed if the file is encrypted and no cipher is set)
+// It returns io.EOF after the last record, io.ErrUnexpectedEOF if the file
+// ends partway through a binary record's header (or its payload, when the
+// file's size is unknown), and errRecordChecksum, errRecordLength or
+// errRecordEncoding if a binary record is corrupt; reading can continue
+// after errRecordChecksum and errRecordEncoding, but not after
+// errRecordLength, as where the next record starts is then unknown
+func (rr *recordReader) next() ([]byte, error) {
+	if rr.format == FormatBinary {
+		return rr.nextFrame()
+	}
+
+	line, err := rr.r.ReadBytes('\n')
+	if err == io.EOF {
+		if len(line) == 0 {
+			return nil, io.EOF
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+	rr.offset += int64(len(line))
+	rr.unterminated = err == io.EOF
+
+	// Strip the trailing newline (and a stray carriage return)
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	return line, nil
+}
+
+// decode decodes a payload next returned, in the file's codec; only the
+// record's head if heads is set (see recordHead)
+func (rr *recordReader) decode(payload []byte, heads bool) (StorageRecord, error) {
+	return decodeRecord(payload, rr.codec, heads)
+}
+
+// nextFrame reads one length-prefixed record
+func (rr *recordReader) nextFrame() ([]byte, error) {
+	var header [binaryFrameHeader]byte
+	if _, err := io.ReadFull(rr.r, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	compressed := length&frameCompressed != 0
+	length &^= frameCompressed
+
+	// Check the length before allocating for it, so a corrupt one costs nothing
+	remaining := rr.size - rr.offset - binaryFrameHeader
+	if length > maxRecordBytes || (rr.size >= 0 && int64(length) > remaining) {
+		rr.offset += binaryFrameHeader
+		return nil, errRecordLength
+	}
+
+	var payload []byte
+	if rr.size >= 0 {
+		payload = make([]byte, length)
+		if _, err := io.ReadFull(rr.r, payload); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	} else {
+		// Grow the buffer as the bytes arrive rather than trusting the length
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, rr.r, int64(length)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		payload = buf.Bytes()
+	}
+	rr.offset += binaryFrameHeader + int64(length)
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return payload, errRecordChecksum
+	}
+	if rr.encrypted {
+		if rr.cipher == nil {
+			return payload, nil
+		}
+		var err error
+		if payload, err = rr.cipher.open(payload); err != nil {
+			return nil, err
+		}
+	}
+	if compressed {
+		return gunzipBytes(payload)
+	}
+	return payload, nil
+}
+
+// gzipBytes compresses a payload
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to compress record: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress record: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// gunzipBytes decompresses a payload written by gzipBytes
+func gunzipBytes(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, errRecordEncoding
+	}
+	defer reader.Close()
+	payload, err := io.ReadAll(io.LimitReader(reader, maxRecordBytes+1))
+	if err != nil || len(payload) > maxRecordBytes {
+		return nil, errRecordEncoding
+	}
+	return payload, nil
+}
@@ -0,0 +1,107 @@
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeBinaryDatabase creates a binary database holding n documents in the
+// collection "docs" and returns its path
+func writeBinaryDatabase(t *testing.T, n int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := OpenDatabase(path, WithStorageFormat(FormatBinary))
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll := db.GetCollection("docs")
+	for i := 0; i < n; i++ {
+		if _, err := coll.Insert(map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// frameOffsets returns where each record frame of a plaintext binary file
+// starts, the header record's included
+func frameOffsets(t *testing.T, data []byte) []int {
+	t.Helper()
+	var offsets []int
+	for off := len(binaryMagic); off < len(data); {
+		offsets = append(offsets, off)
+		off += binaryFrameHeader + int(binary.BigEndian.Uint32(data[off:])&^frameCompressed)
+	}
+	return offsets
+}
+
+// setFrameLength overwrites the length field of the frame at off
+func setFrameLength(data []byte, off int, length uint32) {
+	binary.BigEndian.PutUint32(data[off:], length)
+}
+
+func TestNextFrameBadLength(t *testing.T) {
+	path := writeBinaryDatabase(t, 3)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := frameOffsets(t, data)[3]
+
+	tests := []struct {
+		name   string
+		length uint32
+	}{
+		{"over the record limit", maxRecordBytes + 1},
+		{"past the end of the file", uint32(len(data))},
+		{"one byte past the end", uint32(len(data)-last-binaryFrameHeader) + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			damaged := append([]byte(nil), data...)
+			setFrameLength(damaged, last, tt.length)
+			target := filepath.Join(t.TempDir(), "test.db")
+			if err := os.WriteFile(target, damaged, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			file, err := os.Open(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			reader, err := newRecordReader(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				if _, err := reader.next(); err != nil {
+					t.Fatalf("frame %d: %v", i, err)
+				}
+			}
+			if _, err := reader.next(); !errors.Is(err, errRecordLength) {
+				t.Fatalf("got %v, want errRecordLength", err)
+			}
+
+			// The corrupt last frame is a torn write: it is dropped and the
+			// file opens with the other two documents
+			db, err := OpenDatabase(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if got := db.GetCollection("docs").Count(); got != 2 {
+				t.Fatalf("got %d documents, want 2", got)
+			}
+			if info, ok := db.storage.(*Storage).Recovery(); !ok || info.Offset != int64(last) {
+				t.Fatalf("got recovery %+v (%v), want a truncation at %d", info, ok, last)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package engine
+
+import "strings"
+
+// defaultFuzzyDistance is the edit distance allowed when $fuzzy is given a bare string
+const defaultFuzzyDistance = 2
+
+// fuzzyQuery is a parsed $fuzzy operand
+type fuzzyQuery struct {
+	value       string  // Lowercased search term
+	maxDistance int     // Maximum Levenshtein distance; used when similarity is 0
+	similarity  float64 // Minimum trigram similarity (0-1); overrides maxDistance when set
+}
+
+// parseFuzzy parses a $fuzzy operand, which is either a string or an object:
+//
+//	{"$fuzzy": "jhon"}                                  // Within 2 edits
+//	{"$fuzzy": {"value": "jhon", "maxDistance": 1}}     // Within 1 edit
+//	{"$fuzzy": {"value": "jhon smth", "similarity": 0.4}} // Trigram similarity of at least 0.4
+func parseFuzzy(operand interface{}) (fuzzyQuery, bool) {
+	if value, ok := operand.(string); ok {
+		return fuzzyQuery{value: strings.ToLower(value), maxDistance: defaultFuzzyDistance}, true
+	}
+
+	spec, ok := operand.(map[string]interface{})
+	if !ok {
+		return fuzzyQuery{}, false
+	}
+	value, ok := spec["value"].(string)
+	if !ok {
+		return fuzzyQuery{}, false
+	}
+	query := fuzzyQuery{value: strings.ToLower(value), maxDistance: defaultFuzzyDistance}
+
+	if raw, present := spec["maxDistance"]; present {
+		n, ok := toFloat64(raw)
+		if !ok || n < 0 || n != float64(int(n)) {
+			return fuzzyQuery{}, false
+		}
+		query.maxDistance = int(n)
+	}
+	if raw, present := spec["similarity"]; present {
+		s, ok := toFloat64(raw)
+		if !ok || s <= 0 || s > 1 {
+			return fuzzyQuery{}, false
+		}
+		query.similarity = s
+	}
+	return query, true
+}
+
+// matchFuzzy implements the $fuzzy operator (see parseFuzzy for the operand)
+// A string matches when the whole value, or any single word of it, is close
+// enough to the search term; comparisons ignore case. For array fields, any
+// string element may match. Non-string values never match
+func matchFuzzy(docValue interface{}, operand interface{}) bool {
+	query, ok := parseFuzzy(operand)
+	if !ok {
+		return false
+	}
+	return anyString(docValue, query.matches)
+}
+
+// matches reports whether a string is close to the search term
+func (q fuzzyQuery) matches(text string) bool {
+	text = strings.ToLower(text)
+	if q.close(text) {
+		return true
+	}
+	words := tokenize(text)
+	if len(words) < 2 {
+		return false
+	}
+	for _, word := range words {
+		if q.close(word) {
+			return true
+		}
+	}
+	return false
+}
+
+// close compares a single candidate against the search term
+func (q fuzzyQuery) close(candidate string) bool {
+	if q.similarity > 0 {
+		return trigramSimilarity(q.value, candidate) >= q.similarity
+	}
+	return levenshtein(q.value, candidate, q.maxDistance) <= q.maxDistance
+}
+
+// levenshtein returns the edit distance between two strings, counted in runes
+// Once the distance is known to exceed limit it stops early and returns limit+1
+func levenshtein(a, b string, limit int) int {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) < len(rb) {
+		ra, rb = rb, ra
+	}
+	// The length difference alone needs that many insertions
+	if len(ra)-len(rb) > limit {
+		return limit + 1
+	}
+
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		rowMin := curr[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+			rowMin = min(rowMin, curr[j])
+		}
+		if rowMin > limit {
+			return limit + 1
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+// trigramSimilarity returns the Jaccard similarity of two strings' trigram sets
+// Strings are padded so short words still produce trigrams ("go" -> "  g", " go", "go ")
+func trigramSimilarity(a, b string) float64 {
+	ta, tb := trigrams(a), trigrams(b)
+	if len(ta) == 0 || len(tb) == 0 {
+		return 0
+	}
+	shared := 0
+	for gram := range ta {
+		if tb[gram] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(ta)+len(tb)-shared)
+}
+
+// trigrams returns the set of three-rune sequences in a padded string
+func trigrams(s string) map[string]bool {
+	if s == "" {
+		return nil
+	}
+	runes := []rune("  " + s + " ")
+	grams := make(map[string]bool, len(runes))
+	for i := 0; i+3 <= len(runes); i++ {
+		grams[string(runes[i:i+3])] = true
+	}
+	return grams
+}
@@ -0,0 +1,557 @@
+package engine
+
+import (
+	"fmt"
+	"iter"
+	"math"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// earthRadius is the mean Earth radius in meters, used for distances
+const earthRadius = 6371008.8
+
+// metersPerDegree is the length of one degree of latitude
+const metersPerDegree = earthRadius * math.Pi / 180
+
+// geoHashPrecision is the number of geohash characters stored per indexed point
+const geoHashPrecision = 12
+
+// geoMaxCells bounds the number of geohash cells used to cover a query area
+const geoMaxCells = 32
+
+// geoBase32 is the geohash alphabet
+const geoBase32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geoPoint is a location in degrees
+type geoPoint struct {
+	lon, lat float64
+}
+
+// geoBox is a longitude/latitude bounding box in degrees
+type geoBox struct {
+	minLon, minLat, maxLon, maxLat float64
+}
+
+// toPoint interprets a document value as a location
+// Accepts [lon, lat] arrays and GeoJSON points ({"type": "Point", "coordinates": [lon, lat]})
+func toPoint(value interface{}) (geoPoint, bool) {
+	if geo, isMap := value.(map[string]interface{}); isMap {
+		if geo["type"] != "Point" {
+			return geoPoint{}, false
+		}
+		value = geo["coordinates"]
+	}
+
+	coords, ok := value.([]interface{})
+	if !ok || len(coords) != 2 {
+		return geoPoint{}, false
+	}
+	lon, lonOK := toFloat64(coords[0])
+	lat, latOK := toFloat64(coords[1])
+	if !lonOK || !latOK || lon < -180 || lon > 180 || lat < -90 || lat > 90 {
+		return geoPoint{}, false
+	}
+	return geoPoint{lon: lon, lat: lat}, true
+}
+
+// toPointList interprets a value as a list of at least min locations
+func toPointList(value interface{}, min int) ([]geoPoint, bool) {
+	list, ok := value.([]interface{})
+	if !ok || len(list) < min {
+		return nil, false
+	}
+	points := make([]geoPoint, 0, len(list))
+	for _, elem := range list {
+		point, ok := toPoint(elem)
+		if !ok {
+			return nil, false
+		}
+		points = append(points, point)
+	}
+	return points, true
+}
+
+// distance returns the great-circle (haversine) distance between two points in meters
+func distance(a, b geoPoint) float64 {
+	lat1, lat2 := a.lat*math.Pi/180, b.lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (b.lon - a.lon) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// nearQuery is a parsed $near condition
+type nearQuery struct {
+	point       geoPoint
+	maxDistance float64 // Meters; only applies if hasMax
+	minDistance float64 // Meters
+	hasMax      bool
+}
+
+// parseNear parses a $near operand
+// Two forms are accepted, with distances in meters:
+//
+//	{"$near": [lon, lat], "$maxDistance": 500}
+//	{"$near": {"$geometry": {"type": "Point", "coordinates": [lon, lat]}, "$maxDistance": 500}}
+//
+// $minDistance may be given alongside $maxDistance in either form
+func parseNear(operand interface{}, ops map[string]interface{}) (nearQuery, bool) {
+	var near nearQuery
+	limits := ops
+
+	if spec, isMap := operand.(map[string]interface{}); isMap && spec["$geometry"] != nil {
+		operand = spec["$geometry"]
+		limits = spec
+	}
+
+	point, ok := toPoint(operand)
+	if !ok {
+		return near, false
+	}
+	near.point = point
+
+	if raw, present := limits["$maxDistance"]; present {
+		max, ok := toFloat64(raw)
+		if !ok || max < 0 {
+			return near, false
+		}
+		near.maxDistance, near.hasMax = max, true
+	}
+	if raw, present := limits["$minDistance"]; present {
+		min, ok := toFloat64(raw)
+		if !ok || min < 0 {
+			return near, false
+		}
+		near.minDistance = min
+	}
+	return near, true
+}
+
+// within reports whether a point is inside the $near distance range
+func (n nearQuery) within(point geoPoint) bool {
+	d := distance(n.point, point)
+	return d >= n.minDistance && (!n.hasMax || d <= n.maxDistance)
+}
+
+// boxes returns bounding boxes covering the $near search circle
+// A circle crossing the antimeridian is split in two; one reaching a pole
+// spans every longitude. ok is false if there is no maximum distance
+func (n nearQuery) boxes() ([]geoBox, bool) {
+	if !n.hasMax {
+		return nil, false
+	}
+
+	dLat := n.maxDistance / metersPerDegree
+	minLat := math.Max(-90, n.point.lat-dLat)
+	maxLat := math.Min(90, n.point.lat+dLat)
+
+	// Longitude degrees shrink towards the poles, so size the box for the widest latitude
+	widest := math.Max(math.Abs(minLat), math.Abs(maxLat))
+	cos := math.Cos(widest * math.Pi / 180)
+	if cos < 1e-9 || dLat/cos >= 180 {
+		return []geoBox{{minLon: -180, minLat: minLat, maxLon: 180, maxLat: maxLat}}, true
+	}
+	return splitLon(n.point.lon-dLat/cos, n.point.lon+dLat/cos, minLat, maxLat), true
+}
+
+// splitLon builds boxes for a longitude range that may extend past ±180
+func splitLon(minLon, maxLon, minLat, maxLat float64) []geoBox {
+	switch {
+	case minLon < -180:
+		return []geoBox{
+			{minLon: -180, minLat: minLat, maxLon: maxLon, maxLat: maxLat},
+			{minLon: minLon + 360, minLat: minLat, maxLon: 180, maxLat: maxLat},
+		}
+	case maxLon > 180:
+		return []geoBox{
+			{minLon: minLon, minLat: minLat, maxLon: 180, maxLat: maxLat},
+			{minLon: -180, minLat: minLat, maxLon: maxLon - 360, maxLat: maxLat},
+		}
+	}
+	return []geoBox{{minLon: minLon, minLat: minLat, maxLon: maxLon, maxLat: maxLat}}
+}
+
+// matchNear implements the $near operator (see parseNear)
+func matchNear(docValue interface{}, operand interface{}, ops map[string]interface{}) bool {
+	near, ok := parseNear(operand, ops)
+	if !ok {
+		return false
+	}
+	point, ok := toPoint(docValue)
+	return ok && near.within(point)
+}
+
+// geoShape is a parsed $geoWithin area
+type geoShape struct {
+	box     *geoBox    // Set for $box
+	polygon []geoPoint // Set for $polygon and GeoJSON polygons (outer ring)
+}
+
+// parseGeoWithin parses a $geoWithin operand:
+//
+//	{"$box": [[minLon, minLat], [maxLon, maxLat]]}
+//	{"$polygon": [[lon, lat], [lon, lat], [lon, lat], ...]}
+//	{"$geometry": {"type": "Polygon", "coordinates": [[[lon, lat], ...]]}}
+func parseGeoWithin(operand interface{}) (geoShape, bool) {
+	spec, ok := operand.(map[string]interface{})
+	if !ok || len(spec) != 1 {
+		return geoShape{}, false
+	}
+
+	if raw, present := spec["$box"]; present {
+		corners, ok := toPointList(raw, 2)
+		if !ok || len(corners) != 2 {
+			return geoShape{}, false
+		}
+		return geoShape{box: &geoBox{
+			minLon: math.Min(corners[0].lon, corners[1].lon),
+			minLat: math.Min(corners[0].lat, corners[1].lat),
+			maxLon: math.Max(corners[0].lon, corners[1].lon),
+			maxLat: math.Max(corners[0].lat, corners[1].lat),
+		}}, true
+	}
+
+	if raw, present := spec["$polygon"]; present {
+		polygon, ok := toPointList(raw, 3)
+		return geoShape{polygon: polygon}, ok
+	}
+
+	if geometry, ok := spec["$geometry"].(map[string]interface{}); ok && geometry["type"] == "Polygon" {
+		rings, ok := geometry["coordinates"].([]interface{})
+		if !ok || len(rings) == 0 {
+			return geoShape{}, false
+		}
+		polygon, ok := toPointList(rings[0], 3)
+		return geoShape{polygon: polygon}, ok
+	}
+
+	return geoShape{}, false
+}
+
+// contains reports whether a point lies inside the shape
+// Polygon edges are treated as straight lines in longitude/latitude space
+func (s geoShape) contains(point geoPoint) bool {
+	if s.box != nil {
+		return point.lon >= s.box.minLon && point.lon <= s.box.maxLon &&
+			point.lat >= s.box.minLat && point.lat <= s.box.maxLat
+	}
+
+	// Ray casting: count edge crossings of a ray heading east from the point
+	inside := false
+	for i, j := 0, len(s.polygon)-1; i < len(s.polygon); j, i = i, i+1 {
+		a, b := s.polygon[i], s.polygon[j]
+		if (a.lat > point.lat) != (b.lat > point.lat) &&
+			point.lon < (b.lon-a.lon)*(point.lat-a.lat)/(b.lat-a.lat)+a.lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// bounds returns the bounding box of the shape
+func (s geoShape) bounds() geoBox {
+	if s.box != nil {
+		return *s.box
+	}
+	box := geoBox{minLon: 180, minLat: 90, maxLon: -180, maxLat: -90}
+	for _, p := range s.polygon {
+		box.minLon, box.maxLon = math.Min(box.minLon, p.lon), math.Max(box.maxLon, p.lon)
+		box.minLat, box.maxLat = math.Min(box.minLat, p.lat), math.Max(box.maxLat, p.lat)
+	}
+	return box
+}
+
+// matchGeoWithin implements the $geoWithin operator (see parseGeoWithin)
+func matchGeoWithin(docValue interface{}, operand interface{}) bool {
+	shape, ok := parseGeoWithin(operand)
+	if !ok {
+		return false
+	}
+	point, ok := toPoint(docValue)
+	return ok && shape.contains(point)
+}
+
+// geohash encodes a point as a geohash of the given length
+func geohash(p geoPoint, precision int) string {
+	minLon, maxLon := -180.0, 180.0
+	minLat, maxLat := -90.0, 90.0
+
+	var b strings.Builder
+	bit, ch, even := 0, 0, true
+	for b.Len() < precision {
+		if even {
+			mid := (minLon + maxLon) / 2
+			if p.lon >= mid {
+				ch |= 1 << (4 - bit)
+				minLon = mid
+			} else {
+				maxLon = mid
+			}
+		} else {
+			mid := (minLat + maxLat) / 2
+			if p.lat >= mid {
+				ch |= 1 << (4 - bit)
+				minLat = mid
+			} else {
+				maxLat = mid
+			}
+		}
+		even = !even
+
+		if bit < 4 {
+			bit++
+		} else {
+			b.WriteByte(geoBase32[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return b.String()
+}
+
+// geohashCellSize returns the width and height in degrees of a geohash cell
+func geohashCellSize(precision int) (float64, float64) {
+	bits := 5 * precision
+	lonBits := (bits + 1) / 2
+	latBits := bits / 2
+	return 360 / math.Exp2(float64(lonBits)), 180 / math.Exp2(float64(latBits))
+}
+
+// coveringCells returns geohash prefixes whose cells together cover the box
+// The longest prefix length that needs at most geoMaxCells cells is used
+func coveringCells(box geoBox) []string {
+	precision := 1
+	for p := geoHashPrecision; p >= 1; p-- {
+		w, h := geohashCellSize(p)
+		nLon := math.Floor((box.maxLon-box.minLon)/w) + 2
+		nLat := math.Floor((box.maxLat-box.minLat)/h) + 2
+		if nLon*nLat <= geoMaxCells {
+			precision = p
+			break
+		}
+	}
+
+	// Step through the box one cell at a time; steps no wider than a cell hit every cell
+	w, h := geohashCellSize(precision)
+	cells := make(map[string]bool)
+	for lat := box.minLat; ; lat += h {
+		lat = math.Min(lat, box.maxLat)
+		for lon := box.minLon; ; lon += w {
+			lon = math.Min(lon, box.maxLon)
+			cells[geohash(geoPoint{lon: lon, lat: lat}, precision)] = true
+			if lon >= box.maxLon {
+				break
+			}
+		}
+		if lat >= box.maxLat {
+			break
+		}
+	}
+
+	prefixes := make([]string, 0, len(cells))
+	for cell := range cells {
+		prefixes = append(prefixes, cell)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// geoIndex maps the points stored in one field to document IDs by geohash
+// Entries are kept sorted by geohash so a cell prefix is a contiguous range
+type geoIndex struct {
+	field   string            // Indexed field path
+	seq     uint64            // Sequence of the record defining the index
+	hits    atomic.Uint64     // Queries the index narrowed
+	entries []geoEntry        // Sorted by hash, then ID
+	hashes  map[string]string // Document ID -> geohash of its indexed point
+}
+
+// geoEntry is a single indexed point
+type geoEntry struct {
+	hash string
+	id   string
+}
+
+// newGeoIndex creates an empty index on a field
+func newGeoIndex(field string) *geoIndex {
+	return &geoIndex{field: field, hashes: make(map[string]string)}
+}
+
+// add indexes a document's point; documents without a valid point are skipped
+func (g *geoIndex) add(id string, doc map[string]interface{}) {
+	entry, ok := g.track(id, doc)
+	if !ok {
+		return
+	}
+	i := sort.Search(len(g.entries), func(i int) bool { return !g.entries[i].less(entry) })
+	g.entries = append(g.entries, geoEntry{})
+	copy(g.entries[i+1:], g.entries[i:])
+	g.entries[i] = entry
+}
+
+// build indexes every document at once, sorting the entries a single time
+func (g *geoIndex) build(docs iter.Seq2[string, map[string]interface{}]) {
+	for id, doc := range docs {
+		if entry, ok := g.track(id, doc); ok {
+			g.entries = append(g.entries, entry)
+		}
+	}
+	sort.Slice(g.entries, func(i, j int) bool { return g.entries[i].less(g.entries[j]) })
+}
+
+// track records a document's geohash and returns its entry
+func (g *geoIndex) track(id string, doc map[string]interface{}) (geoEntry, bool) {
+	value, exists := lookupPath(doc, g.field)
+	if !exists {
+		return geoEntry{}, false
+	}
+	point, ok := toPoint(value)
+	if !ok {
+		return geoEntry{}, false
+	}
+
+	entry := geoEntry{hash: geohash(point, geoHashPrecision), id: id}
+	g.hashes[id] = entry.hash
+	return entry, true
+}
+
+// remove drops a document from the index
+func (g *geoIndex) remove(id string) {
+	hash, indexed := g.hashes[id]
+	if !indexed {
+		return
+	}
+	delete(g.hashes, id)
+
+	entry := geoEntry{hash: hash, id: id}
+	i := sort.Search(len(g.entries), func(i int) bool { return !g.entries[i].less(entry) })
+	if i < len(g.entries) && g.entries[i] == entry {
+		g.entries = append(g.entries[:i], g.entries[i+1:]...)
+	}
+}
+
+// less orders entries by hash, then ID
+func (e geoEntry) less(other geoEntry) bool {
+	if e.hash != other.hash {
+		return e.hash < other.hash
+	}
+	return e.id < other.id
+}
+
+// candidates returns the IDs of documents whose point may lie inside the boxes
+func (g *geoIndex) candidates(boxes []geoBox) []string {
+	seen := make(map[string]bool)
+	var ids []string
+	for _, box := range boxes {
+		for _, prefix := range coveringCells(box) {
+			i := sort.Search(len(g.entries), func(i int) bool { return g.entries[i].hash >= prefix })
+			for ; i < len(g.entries) && strings.HasPrefix(g.entries[i].hash, prefix); i++ {
+				if id := g.entries[i].id; !seen[id] {
+					seen[id] = true
+					ids = append(ids, id)
+				}
+			}
+		}
+	}
+	return ids
+}
+
+// CreateGeoIndex indexes the points stored in a field ([lon, lat] or GeoJSON points)
+// so $near (with $maxDistance) and $geoWithin queries on it only examine
+// documents in the matching area. Like CreateIndex, the definition is stored
+// in the log and the index is rebuilt when the database is reopened
+func (c *Collection) CreateGeoIndex(field string) error {
+	if field == "" {
+		return fmt.Errorf("field name is required")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.geoIndexes[field]; exists {
+		return fmt.Errorf("geo index on %s already exists", field)
+	}
+
+	def := IndexDefinition{Kind: IndexKindGeo, Field: field}
+	seq, err := c.persistIndex(def)
+	if err != nil {
+		return err
+	}
+	c.restoreIndex(def, seq)
+	return nil
+}
+
+// geoCandidates uses a geo index to narrow a query to the documents in its area
+// It looks for a top-level $near (with $maxDistance) or $geoWithin condition on
+// an indexed field. ok is false if no index applies and a full scan is needed
+// Caller must hold the read lock
+func (c *Collection) geoCandidates(filter map[string]interface{}, hint indexHint) (ids []string, index string, ok bool) {
+	for field, condition := range filter {
+		geoIndex, indexed := c.geoIndexes[field]
+		if !indexed || !hint.allows("geo:"+field) {
+			continue
+		}
+		ops, isOps := operatorExpression(condition)
+		if !isOps {
+			continue
+		}
+
+		if operand, present := ops["$near"]; present {
+			if near, valid := parseNear(operand, ops); valid {
+				if boxes, bounded := near.boxes(); bounded {
+					geoIndex.hits.Add(1)
+					return geoIndex.candidates(boxes), "geo:" + field, true
+				}
+			}
+		}
+		if operand, present := ops["$geoWithin"]; present {
+			if shape, valid := parseGeoWithin(operand); valid {
+				geoIndex.hits.Add(1)
+				return geoIndex.candidates([]geoBox{shape.bounds()}), "geo:" + field, true
+			}
+		}
+	}
+	return nil, "", false
+}
+
+// nearOrigin finds a top-level $near condition, whose results are ordered by distance
+func nearOrigin(filter map[string]interface{}) (field string, origin geoPoint, ok bool) {
+	for key, condition := range filter {
+		ops, isOps := operatorExpression(condition)
+		if !isOps {
+			continue
+		}
+		if operand, present := ops["$near"]; present {
+			if near, valid := parseNear(operand, ops); valid {
+				return key, near.point, true
+			}
+		}
+	}
+	return "", geoPoint{}, false
+}
+
+// sortByDistance orders documents by the distance of a field's point from origin, nearest first
+func sortByDistance(docs []map[string]interface{}, field string, origin geoPoint) {
+	dist := make([]float64, len(docs))
+	for i, doc := range docs {
+		value, _ := lookupPath(doc, field)
+		if point, ok := toPoint(value); ok {
+			dist[i] = distance(origin, point)
+		} else {
+			dist[i] = math.Inf(1)
+		}
+	}
+	order := make([]int, len(docs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return dist[order[a]] < dist[order[b]] })
+
+	sorted := make([]map[string]interface{}, len(docs))
+	for i, idx := range order {
+		sorted[i] = docs[idx]
+	}
+	copy(docs, sorted)
+}
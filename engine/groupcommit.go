@@ -0,0 +1,60 @@
+package engine
+
+import "fmt"
+
+// Group commit: Append and AppendBatch write under the storage lock but sync
+// without holding it, so writers that arrive while a sync is in flight queue
+// their records behind it and the next sync makes all of them durable at
+// once. A write still returns only after a sync that began after it succeeded
+
+// durable waits until write number n is on disk, syncing the file unless a
+// sync that covers it is already running
+// A failed sync fails every write it covered and every write after it: the
+// kernel may have dropped the unsynced pages, so a later sync succeeding
+// would not mean they were saved. Reopening the database clears the error
+// Caller must hold the lock, which is released while syncing
+func (s *Storage) durable(n uint64) error {
+	for s.synced < n {
+		if s.syncErr != nil {
+			return s.syncErr
+		}
+		if s.syncing {
+			s.syncDone.Wait()
+			continue
+		}
+
+		// Lead a sync covering everything written so far
+		s.syncing = true
+		target, file := s.writes, s.file
+		s.mu.Unlock()
+		err := file.Sync()
+		s.mu.Lock()
+		s.syncing = false
+		s.syncs++
+		if err != nil {
+			s.syncErr = fmt.Errorf("failed to sync file: %w", err)
+		} else {
+			s.synced = target
+		}
+		s.syncDone.Broadcast()
+	}
+	return nil
+}
+
+// awaitSync waits for a sync in flight to finish, so the file can be closed
+// or replaced
+// Caller must hold the lock, which is released while waiting
+func (s *Storage) awaitSync() {
+	for s.syncing {
+		s.syncDone.Wait()
+	}
+}
+
+// SyncCounts returns how many writes have been made and how many syncs made
+// them durable; with concurrent writers there are fewer syncs than writes
+func (s *Storage) SyncCounts() (writes, syncs uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.writes, s.syncs
+}
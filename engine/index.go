@@ -0,0 +1,676 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"math"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// fieldIndex is an ordered index over one field's values (see CreateIndex)
+// Values are encoded as index keys whose byte order matches the filter
+// semantics: numbers numerically, strings under the collection's collation
+// An array is indexed under each of its elements. Documents whose value
+// can't be keyed (objects, nested arrays, dates held as time.Time) are kept
+// aside and returned as candidates for every lookup, so the index only ever
+// narrows a query to a superset of its matches
+type fieldIndex struct {
+	field    string                 // Indexed field path
+	seq      uint64                 // Sequence of the record defining the index
+	hits     atomic.Uint64          // Queries the index narrowed
+	filter   map[string]interface{} // Only documents matching this are indexed (nil for all; see IndexOptions)
+	match    MatchOptions           // Filter settings the keys were built with
+	entries  []indexEntry           // Sorted by key, then ID
+	distinct int                    // Distinct keys among the entries, the field's cardinality
+	keys     map[string][]string    // Document ID -> its keys, one per distinct element for arrays
+	unkeyed  map[string]bool        // Documents whose value can't be keyed
+	dateLike map[string]bool        // Documents whose string value is a date, which ranges compare chronologically
+	arrays   map[string]bool        // Documents whose value is an array, indexed under several keys
+}
+
+// indexEntry is a single indexed value
+type indexEntry struct {
+	key string
+	id  string
+}
+
+// Index key kinds; the kind byte leads every key, so kinds never interleave
+const (
+	indexKindNumber = 0x01
+	indexKindString = 0x02
+	indexKindBool   = 0x03
+)
+
+// newFieldIndex creates an empty index on a field
+func newFieldIndex(field string, match MatchOptions) *fieldIndex {
+	return &fieldIndex{
+		field:    field,
+		match:    match,
+		keys:     make(map[string][]string),
+		unkeyed:  make(map[string]bool),
+		dateLike: make(map[string]bool),
+		arrays:   make(map[string]bool),
+	}
+}
+
+// numberKey encodes a number so keys sort numerically
+func numberKey(n float64) string {
+	bits := math.Float64bits(n)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	key := make([]byte, 9)
+	key[0] = indexKindNumber
+	binary.BigEndian.PutUint64(key[1:], bits)
+	return string(key)
+}
+
+// valueKeys returns the keys a value is indexed or looked up under
+// A string that parses as a number also gets a number key, since filters
+// match it against that number unless StrictTypes is set. ok is false for
+// values that can't be keyed
+func (f *fieldIndex) valueKeys(value interface{}) (keys []string, ok bool) {
+	if n, isNum := toFloat64(value); isNum {
+		return []string{numberKey(n)}, true
+	}
+	switch v := value.(type) {
+	case string:
+		keys = []string{string(rune(indexKindString)) + f.match.Collation.Key(v)}
+		if n, numeric := numericString(v); numeric && !f.match.StrictTypes {
+			keys = append(keys, numberKey(n))
+		}
+		return keys, true
+	case bool:
+		if v {
+			return []string{string([]byte{indexKindBool, 1})}, true
+		}
+		return []string{string([]byte{indexKindBool, 0})}, true
+	}
+	return nil, false
+}
+
+// add indexes a document's value; documents without the field are skipped
+func (f *fieldIndex) add(id string, doc map[string]interface{}) {
+	for _, entry := range f.track(id, doc) {
+		i := sort.Search(len(f.entries), func(i int) bool { return !f.entries[i].less(entry) })
+		if !f.sharesKey(i-1, entry.key) && !f.sharesKey(i, entry.key) {
+			f.distinct++
+		}
+		f.entries = append(f.entries, indexEntry{})
+		copy(f.entries[i+1:], f.entries[i:])
+		f.entries[i] = entry
+	}
+}
+
+// build indexes every document at once, sorting the entries a single time
+func (f *fieldIndex) build(docs iter.Seq2[string, map[string]interface{}]) {
+	for id, doc := range docs {
+		f.entries = append(f.entries, f.track(id, doc)...)
+	}
+	sort.Slice(f.entries, func(i, j int) bool { return f.entries[i].less(f.entries[j]) })
+	f.distinct = 0
+	for i, entry := range f.entries {
+		if !f.sharesKey(i-1, entry.key) {
+			f.distinct++
+		}
+	}
+}
+
+// sharesKey reports whether the entry at position i exists and has the key
+func (f *fieldIndex) sharesKey(i int, key string) bool {
+	return i >= 0 && i < len(f.entries) && f.entries[i].key == key
+}
+
+// track records a document's keys and returns the entries to insert for it
+// An array is indexed under the keys of each element, since filters match
+// an array when any element does
+func (f *fieldIndex) track(id string, doc map[string]interface{}) []indexEntry {
+	if f.filter != nil && !f.match.Matches(doc, f.filter) {
+		return nil
+	}
+	value, exists := lookupPath(doc, f.field)
+	if !exists || value == nil {
+		return nil
+	}
+	values, isArray := value.([]interface{})
+	if !isArray {
+		values = []interface{}{value}
+	}
+
+	var keys []string
+	seen := make(map[string]bool)
+	for _, elem := range values {
+		if elem == nil {
+			continue
+		}
+		elemKeys, ok := f.valueKeys(elem)
+		if !ok {
+			// Nested arrays and objects match in ways the keys don't capture
+			f.unkeyed[id] = true
+			return nil
+		}
+		if _, isStr := elem.(string); isStr {
+			if _, isDate := f.match.toTime(elem); isDate {
+				f.dateLike[id] = true
+			}
+		}
+		for _, key := range elemKeys {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	if isArray {
+		f.arrays[id] = true
+	}
+
+	entries := make([]indexEntry, len(keys))
+	for i, key := range keys {
+		entries[i] = indexEntry{key: key, id: id}
+	}
+	f.keys[id] = keys
+	return entries
+}
+
+// remove drops a document from the index
+func (f *fieldIndex) remove(id string) {
+	delete(f.unkeyed, id)
+	delete(f.dateLike, id)
+	delete(f.arrays, id)
+	keys, indexed := f.keys[id]
+	if !indexed {
+		return
+	}
+	delete(f.keys, id)
+
+	for _, key := range keys {
+		entry := indexEntry{key: key, id: id}
+		i := sort.Search(len(f.entries), func(i int) bool { return !f.entries[i].less(entry) })
+		if i < len(f.entries) && f.entries[i] == entry {
+			f.entries = append(f.entries[:i], f.entries[i+1:]...)
+			if !f.sharesKey(i-1, key) && !f.sharesKey(i, key) {
+				f.distinct--
+			}
+		}
+	}
+}
+
+// less orders entries by key, then ID
+func (e indexEntry) less(other indexEntry) bool {
+	if e.key != other.key {
+		return e.key < other.key
+	}
+	return e.id < other.id
+}
+
+// keyRange is the span of keys with lo <= key < hi
+type keyRange struct {
+	lo, hi string
+}
+
+// indexTerm is one operator's share of a lookup: the documents with a key in
+// any of the ranges, plus the date-like documents if dates is set
+type indexTerm struct {
+	ranges []keyRange
+	dates  bool
+}
+
+// scan collects the IDs of entries within a key range
+func (f *fieldIndex) scan(r keyRange, ids map[string]bool) {
+	i := sort.Search(len(f.entries), func(i int) bool { return f.entries[i].key >= r.lo })
+	for ; i < len(f.entries) && f.entries[i].key < r.hi; i++ {
+		ids[f.entries[i].id] = true
+	}
+}
+
+// count returns the number of entries within a key range, without visiting them
+func (f *fieldIndex) count(r keyRange) int {
+	lo := sort.Search(len(f.entries), func(i int) bool { return f.entries[i].key >= r.lo })
+	hi := sort.Search(len(f.entries), func(i int) bool { return f.entries[i].key >= r.hi })
+	if hi < lo {
+		return 0
+	}
+	return hi - lo
+}
+
+// collect returns the documents matching a term
+func (f *fieldIndex) collect(term indexTerm) map[string]bool {
+	ids := make(map[string]bool)
+	for _, r := range term.ranges {
+		f.scan(r, ids)
+	}
+	if term.dates {
+		for id := range f.dateLike {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// resolve returns the documents matching every term, plus the unkeyed ones
+func (f *fieldIndex) resolve(terms []indexTerm) map[string]bool {
+	ids := f.collect(terms[0])
+	for _, term := range terms[1:] {
+		ids = intersectIDs(ids, f.collect(term))
+	}
+	for id := range f.unkeyed {
+		ids[id] = true
+	}
+	return ids
+}
+
+// estimate returns an upper bound on the documents resolve would return,
+// from the entry counts of the terms' key ranges
+func (f *fieldIndex) estimate(terms []indexTerm) int {
+	best := -1
+	for _, term := range terms {
+		n := 0
+		for _, r := range term.ranges {
+			n += f.count(r)
+		}
+		if term.dates {
+			n += len(f.dateLike)
+		}
+		if best < 0 || n < best {
+			best = n
+		}
+	}
+	return best + len(f.unkeyed)
+}
+
+// terms translates a field condition into index terms: a plain value, or
+// an operator expression with $eq, $in or range operators. Other operators
+// are left to the filter. Every term must match, so a document is a candidate
+// if it is in all of them. ok is false if the index can't answer the condition
+func (f *fieldIndex) terms(condition interface{}, match MatchOptions) (terms []indexTerm, ok bool) {
+	ops, isOps := operatorExpression(condition)
+	if !isOps {
+		ops = map[string]interface{}{"$eq": condition}
+	}
+
+	// String keys depend on the collation, so a query using another one can't use them
+	sameCollation := match.Collation == f.match.Collation ||
+		(match.Collation != nil && f.match.Collation != nil && *match.Collation == *f.match.Collation)
+
+	if operand, present := ops["$eq"]; present {
+		term, valid := f.equal([]interface{}{operand}, sameCollation)
+		if !valid {
+			return nil, false
+		}
+		terms = append(terms, term)
+	}
+	if operand, present := ops["$in"]; present {
+		list, isList := operand.([]interface{})
+		if !isList {
+			return nil, false
+		}
+		term, valid := f.equal(list, sameCollation)
+		if !valid {
+			return nil, false
+		}
+		terms = append(terms, term)
+	}
+	if rangeTerms, valid, present := f.between(ops, sameCollation); present {
+		if !valid {
+			return nil, false
+		}
+		terms = append(terms, rangeTerms...)
+	}
+	return terms, len(terms) > 0
+}
+
+// equal returns the term for documents holding any of the values
+func (f *fieldIndex) equal(values []interface{}, sameCollation bool) (indexTerm, bool) {
+	var term indexTerm
+	for _, value := range values {
+		if _, isStr := value.(string); isStr && !sameCollation {
+			return indexTerm{}, false
+		}
+		keys, ok := f.valueKeys(value)
+		if !ok {
+			return indexTerm{}, false
+		}
+		for _, key := range keys {
+			term.ranges = append(term.ranges, keyRange{key, key + "\x00"})
+		}
+	}
+	return term, true
+}
+
+// between returns the terms for documents within the bounds of $gt, $gte,
+// $lt and $lte. The bounds are inclusive; the filter applies the exact
+// comparison. present is false if there are no range operators
+func (f *fieldIndex) between(ops map[string]interface{}, sameCollation bool) (terms []indexTerm, ok, present bool) {
+	var lower, upper interface{}
+	kind := -1
+	for op, operand := range ops {
+		switch op {
+		case "$gt", "$gte":
+			lower = operand
+		case "$lt", "$lte":
+			upper = operand
+		default:
+			continue
+		}
+		present = true
+
+		// Dates compare chronologically, against numbers as well as strings,
+		// which doesn't follow the key order
+		if _, isDate := f.match.toTime(operand); isDate {
+			if _, isNum := toFloat64(operand); !isNum {
+				return nil, false, true
+			}
+		}
+
+		operandKind := -1
+		if _, isNum := toFloat64(operand); isNum {
+			operandKind = indexKindNumber
+		} else if _, isStr := operand.(string); isStr && sameCollation {
+			operandKind = indexKindString
+		}
+		if operandKind < 0 || (kind >= 0 && kind != operandKind) {
+			return nil, false, true
+		}
+		kind = operandKind
+	}
+	if !present {
+		return nil, false, false
+	}
+
+	// Without a bound the range runs to the end of the kind
+	// A number is also compared against dates, as an epoch timestamp
+	lo, hi := string(rune(kind)), string(rune(kind+1))
+	dates := kind == indexKindNumber
+	if lower != nil {
+		lo = f.rangeKey(lower)
+	}
+	if upper != nil {
+		hi = f.rangeKey(upper) + "\x00"
+	}
+	if lower != nil && upper != nil && len(f.arrays) > 0 {
+		// Each bound may be met by a different element of an array, so
+		// match each side separately rather than just the keys in between
+		return []indexTerm{
+			{ranges: []keyRange{{lo, string(rune(kind + 1))}}, dates: dates},
+			{ranges: []keyRange{{string(rune(kind)), hi}}, dates: dates},
+		}, true, true
+	}
+	return []indexTerm{{ranges: []keyRange{{lo, hi}}, dates: dates}}, true, true
+}
+
+// rangeKey returns the key of a range bound (a number or a string)
+func (f *fieldIndex) rangeKey(value interface{}) string {
+	if n, isNum := toFloat64(value); isNum {
+		return numberKey(n)
+	}
+	return string(rune(indexKindString)) + f.match.Collation.Key(value.(string))
+}
+
+// intersectIDs returns the IDs present in both sets
+func intersectIDs(a, b map[string]bool) map[string]bool {
+	if len(b) < len(a) {
+		a, b = b, a
+	}
+	both := make(map[string]bool, len(a))
+	for id := range a {
+		if b[id] {
+			both[id] = true
+		}
+	}
+	return both
+}
+
+// IndexOptions configures an index created with CreateIndex
+type IndexOptions struct {
+	// Filter makes the index partial: only documents matching it are indexed,
+	// e.g. {"status": "active"}. A partial index is only used by queries that
+	// repeat each of its conditions exactly, at the top level or in a
+	// top-level $and, since other queries may match documents it left out
+	Filter map[string]interface{}
+}
+
+// CreateIndex indexes the values of a field (dot notation allowed) so Find
+// only examines matching documents for equality ($eq, $in and plain values)
+// and range ($gt, $gte, $lt, $lte) conditions on it. Numbers, strings and
+// booleans are indexed, strings under the database collation; documents with
+// other values are still found, just without the index's help. The index is
+// maintained on every write. An array field is indexed under each element, so
+// {"tags": "go"} finds documents whose tags contain "go". Its definition is stored in the log, and the
+// index is rebuilt when the database is reopened
+// An optional IndexOptions can restrict the index to some documents
+func (c *Collection) CreateIndex(field string, opts ...IndexOptions) error {
+	if field == "" {
+		return fmt.Errorf("field name is required")
+	}
+	var options IndexOptions
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+	if len(options.Filter) == 0 {
+		options.Filter = nil
+	} else {
+		options.Filter = copyDocument(options.Filter)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.indexes[field]; exists {
+		return fmt.Errorf("index on %s already exists", field)
+	}
+
+	def := IndexDefinition{Kind: IndexKindField, Field: field, Filter: options.Filter}
+	seq, err := c.persistIndex(def)
+	if err != nil {
+		return err
+	}
+	c.restoreIndex(def, seq)
+	return nil
+}
+
+// Index kinds, as stored in IndexDefinition.Kind
+const (
+	IndexKindField = "field" // Value index (see CreateIndex)
+	IndexKindGeo   = "geo"   // Geohash index (see CreateGeoIndex)
+	IndexKindText  = "text"  // Inverted index for Search (see CreateTextIndex)
+)
+
+// IndexDefinition describes an index in a StorageRecord, so indexes are
+// recreated when the log is replayed
+type IndexDefinition struct {
+	Kind    string                 `json:"kind"`              // IndexKindField, IndexKindGeo or IndexKindText
+	Field   string                 `json:"field,omitempty"`   // Indexed field path (field and geo indexes)
+	Fields  []string               `json:"fields,omitempty"`  // Indexed fields, sorted (text indexes; empty means all)
+	Filter  map[string]interface{} `json:"filter,omitempty"`  // Partial index filter (field indexes; see IndexOptions)
+	Dropped bool                   `json:"dropped,omitempty"` // The index was removed; cancels the earlier definition
+}
+
+// recordID is the ID of the record defining the index, unique per collection
+// A collection has a single text index, so it isn't named by its fields
+func (d IndexDefinition) recordID() string {
+	if d.Kind == IndexKindText {
+		return "index:" + d.Kind
+	}
+	return "index:" + d.Kind + ":" + d.Field
+}
+
+// persistIndex stores an index definition in the log and returns its sequence
+// Caller must hold the write lock
+func (c *Collection) persistIndex(def IndexDefinition) (uint64, error) {
+	seq, err := c.storage.Append(StorageRecord{Collection: c.name, ID: def.recordID(), Index: &def, Time: recordTime()})
+	if err != nil {
+		return 0, fmt.Errorf("failed to persist index: %w", err)
+	}
+	return seq, nil
+}
+
+// restoreIndex builds an index over the current documents and registers it
+// Unknown kinds, from newer versions of the engine, are ignored
+// Caller must hold the write lock
+func (c *Collection) restoreIndex(def IndexDefinition, seq uint64) {
+	switch def.Kind {
+	case IndexKindField:
+		index := newFieldIndex(def.Field, c.match)
+		index.seq = seq
+		index.filter = def.Filter
+		index.build(c.documents.all())
+		if c.indexes == nil {
+			c.indexes = make(map[string]*fieldIndex)
+		}
+		c.indexes[def.Field] = index
+	case IndexKindGeo:
+		index := newGeoIndex(def.Field)
+		index.seq = seq
+		index.build(c.documents.all())
+		if c.geoIndexes == nil {
+			c.geoIndexes = make(map[string]*geoIndex)
+		}
+		c.geoIndexes[def.Field] = index
+	case IndexKindText:
+		index := newTextIndex(def.Fields)
+		index.seq = seq
+		for id, doc := range c.documents.all() {
+			index.add(id, doc)
+		}
+		c.textIndex = index
+	}
+}
+
+// dropIndexRecords persists the removal of every index, so a dropped
+// collection's indexes aren't recreated on reopen
+// Caller must hold the write lock
+func (c *Collection) dropIndexRecords() error {
+	records := c.indexRecords()
+	now := recordTime()
+	for i := range records {
+		records[i].Index.Dropped = true
+		records[i].Time = now
+	}
+	if err := c.storage.AppendBatch(records); err != nil {
+		return fmt.Errorf("failed to persist index removal: %w", err)
+	}
+	c.indexes = nil
+	c.geoIndexes = nil
+	c.textIndex = nil
+	return nil
+}
+
+// indexRecords returns the records defining the collection's indexes, for compaction
+// Caller must hold the read lock
+func (c *Collection) indexRecords() []StorageRecord {
+	var records []StorageRecord
+	for field, index := range c.indexes {
+		def := IndexDefinition{Kind: IndexKindField, Field: field, Filter: index.filter}
+		records = append(records, StorageRecord{Collection: c.name, ID: def.recordID(), Index: &def, Seq: index.seq})
+	}
+	for field, index := range c.geoIndexes {
+		def := IndexDefinition{Kind: IndexKindGeo, Field: field}
+		records = append(records, StorageRecord{Collection: c.name, ID: def.recordID(), Index: &def, Seq: index.seq})
+	}
+	if c.textIndex != nil {
+		def := c.textIndex.definition()
+		records = append(records, StorageRecord{Collection: c.name, ID: def.recordID(), Index: &def, Seq: c.textIndex.seq})
+	}
+	return records
+}
+
+// indexHint restricts the indexes a query may use (see FindOptions.Hint)
+type indexHint struct {
+	only  string // Use this index and no other
+	avoid string // Never use this index
+	none  bool   // Use no index at all
+}
+
+// parseHint parses FindOptions.Hint; the named index must exist
+// Caller must hold the read lock
+func (c *Collection) parseHint(hint string) (indexHint, error) {
+	if hint == "" {
+		return indexHint{}, nil
+	}
+	if hint == "$natural" {
+		return indexHint{none: true}, nil
+	}
+
+	var parsed indexHint
+	name := hint
+	if name[0] == '-' {
+		name = name[1:]
+		parsed.avoid = name
+	} else {
+		parsed.only = name
+	}
+	_, isField := c.indexes[name]
+	_, isGeo := c.geoIndexes[strings.TrimPrefix(name, "geo:")]
+	if !isField && !(isGeo && strings.HasPrefix(name, "geo:")) {
+		return indexHint{}, fmt.Errorf("hint: no index named %s", name)
+	}
+	return parsed, nil
+}
+
+// allows reports whether the hint lets a query use the named index
+func (h indexHint) allows(name string) bool {
+	return !h.none && name != h.avoid && (h.only == "" || name == h.only)
+}
+
+// covers reports whether a partial index holds every document that can
+// satisfy the query conditions: each condition of the index filter must be
+// among them. Full indexes cover every query
+func (f *fieldIndex) covers(conds []fieldCondition) bool {
+	for _, required := range indexableConditions(f.filter) {
+		found := false
+		for _, cond := range conds {
+			if cond.field == required.field && sameJSON(cond.value, required.value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// sameJSON reports whether two values have the same JSON encoding, so 1 and
+// 1.0, or a filter and its copy read back from the log, compare equal
+func sameJSON(a, b interface{}) bool {
+	aJSON, aErr := json.Marshal(a)
+	bJSON, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && bytes.Equal(aJSON, bJSON)
+}
+
+// fieldCondition is a condition that must hold for a document to match:
+// a field condition, or a logical operator such as $or with its operand
+type fieldCondition struct {
+	field string
+	value interface{}
+}
+
+// indexableConditions lists the conditions every match must satisfy: the
+// top-level keys, and those of filters inside a top-level $and
+func indexableConditions(filter map[string]interface{}) []fieldCondition {
+	var conds []fieldCondition
+	for key, value := range filter {
+		if key == "$and" {
+			if list, ok := toFilterList(value); ok {
+				for _, sub := range list {
+					conds = append(conds, indexableConditions(sub)...)
+				}
+			}
+			continue
+		}
+		conds = append(conds, fieldCondition{field: key, value: value})
+	}
+	return conds
+}
@@ -0,0 +1,155 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// IndexInfo describes an index, as returned by ListIndexes
+type IndexInfo struct {
+	Name        string                 `json:"name"`               // Name to pass to DropIndex: the field, "geo:<field>" or "text"
+	Kind        string                 `json:"kind"`               // IndexKindField, IndexKindGeo or IndexKindText
+	Field       string                 `json:"field,omitempty"`    // Indexed field (field and geo indexes)
+	Fields      []string               `json:"fields,omitempty"`   // Indexed fields (text indexes; empty means all)
+	Filter      map[string]interface{} `json:"filter,omitempty"`   // Partial index filter, if any
+	Entries     int                    `json:"entries"`            // Indexed values (words for text indexes)
+	Distinct    int                    `json:"distinct,omitempty"` // Distinct indexed values, the field's cardinality (field indexes)
+	MemoryBytes int                    `json:"memory_bytes"`       // Rough estimate of the memory the index holds
+	Hits        uint64                 `json:"hits"`               // Queries the index has narrowed since the database was opened
+}
+
+// Approximate per-item overheads used by the memory estimates: a string
+// header, and a map slot with its key and value headers
+const (
+	stringHeaderBytes = 16
+	mapSlotBytes      = 48
+)
+
+// ListIndexes describes the collection's indexes, ordered by name
+func (c *Collection) ListIndexes() []IndexInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	infos := make([]IndexInfo, 0, len(c.indexes)+len(c.geoIndexes)+1)
+	for field, index := range c.indexes {
+		infos = append(infos, index.info(field))
+	}
+	for field, index := range c.geoIndexes {
+		infos = append(infos, index.info(field))
+	}
+	if c.textIndex != nil {
+		infos = append(infos, c.textIndex.info())
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// DropIndex removes an index by the name ListIndexes reports
+// The removal is stored in the log, so the index isn't rebuilt on reopen
+func (c *Collection) DropIndex(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var def IndexDefinition
+	switch {
+	case name == IndexKindText:
+		if c.textIndex == nil {
+			return fmt.Errorf("collection %s has no text index", c.name)
+		}
+		def = c.textIndex.definition()
+	case strings.HasPrefix(name, "geo:"):
+		field := strings.TrimPrefix(name, "geo:")
+		if _, exists := c.geoIndexes[field]; !exists {
+			return fmt.Errorf("index %s not found", name)
+		}
+		def = IndexDefinition{Kind: IndexKindGeo, Field: field}
+	default:
+		if _, exists := c.indexes[name]; !exists {
+			return fmt.Errorf("index %s not found", name)
+		}
+		def = IndexDefinition{Kind: IndexKindField, Field: name}
+	}
+
+	def.Dropped = true
+	if _, err := c.persistIndex(def); err != nil {
+		return err
+	}
+
+	switch def.Kind {
+	case IndexKindText:
+		c.textIndex = nil
+	case IndexKindGeo:
+		delete(c.geoIndexes, def.Field)
+	default:
+		delete(c.indexes, def.Field)
+	}
+	return nil
+}
+
+// info describes a field index
+func (f *fieldIndex) info(field string) IndexInfo {
+	bytes := 0
+	for _, entry := range f.entries {
+		bytes += len(entry.key) + len(entry.id) + 2*stringHeaderBytes
+	}
+	for id, keys := range f.keys {
+		bytes += mapSlotBytes + len(id) + len(keys)*stringHeaderBytes
+	}
+	bytes += (len(f.unkeyed) + len(f.dateLike) + len(f.arrays)) * mapSlotBytes
+
+	return IndexInfo{
+		Name:        field,
+		Kind:        IndexKindField,
+		Field:       field,
+		Filter:      f.filter,
+		Entries:     len(f.entries),
+		Distinct:    f.distinct,
+		MemoryBytes: bytes,
+		Hits:        f.hits.Load(),
+	}
+}
+
+// info describes a geo index
+func (g *geoIndex) info(field string) IndexInfo {
+	bytes := 0
+	for _, entry := range g.entries {
+		bytes += len(entry.hash) + len(entry.id) + 2*stringHeaderBytes
+	}
+	for id, hash := range g.hashes {
+		bytes += mapSlotBytes + len(id) + len(hash)
+	}
+
+	return IndexInfo{
+		Name:        "geo:" + field,
+		Kind:        IndexKindGeo,
+		Field:       field,
+		Entries:     len(g.entries),
+		MemoryBytes: bytes,
+		Hits:        g.hits.Load(),
+	}
+}
+
+// info describes a text index
+func (t *textIndex) info() IndexInfo {
+	bytes := 0
+	for word, docs := range t.postings {
+		bytes += mapSlotBytes + len(word)
+		for id := range docs {
+			bytes += mapSlotBytes + len(id)
+		}
+	}
+	for id, words := range t.terms {
+		bytes += mapSlotBytes + len(id) + len(words)*stringHeaderBytes
+	}
+
+	return IndexInfo{
+		Name:        IndexKindText,
+		Kind:        IndexKindText,
+		Fields:      t.fields,
+		Entries:     len(t.postings),
+		MemoryBytes: bytes,
+		Hits:        t.hits.Load(),
+	}
+}
@@ -0,0 +1,82 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+)
+
+// IsolationLevel sets what the reads of a transaction see of the writes
+// other transactions and callers commit while it runs (see WithIsolation)
+// Reads outside transactions aren't affected: each Find or Aggregate always
+// sees the collection as it was when it started
+type IsolationLevel int
+
+const (
+	// IsolationReadCommitted, the default, makes each read of a transaction
+	// see everything committed before it runs. Reads aren't repeatable: the
+	// same FindByID can return a newer document the second time, and the same
+	// Find more or fewer documents (phantoms). An update worked out from a
+	// value a transaction read can overwrite a change committed after that
+	// read (a lost update); operator updates such as $inc don't, as they
+	// apply to the document as it is when the transaction commits
+	IsolationReadCommitted IsolationLevel = iota
+
+	// IsolationSnapshot makes every read of a transaction see the database as
+	// it was at its first read or write, plus its own writes, so its reads
+	// are repeatable and free of phantoms. Commit fails with ErrWriteConflict
+	// if a document the transaction writes was changed by someone else after
+	// that point (the first to commit wins), which rules out lost updates; the
+	// caller retries the transaction. Write skew is still possible: two
+	// transactions can each read what the other writes and both commit, e.g.
+	// both check that two people are on call and each takes one of them off
+	IsolationSnapshot
+)
+
+// String returns the name of the isolation level
+func (l IsolationLevel) String() string {
+	switch l {
+	case IsolationReadCommitted:
+		return "read_committed"
+	case IsolationSnapshot:
+		return "snapshot"
+	}
+	return fmt.Sprintf("IsolationLevel(%d)", int(l))
+}
+
+// ErrWriteConflict matches (with errors.Is) the WriteConflictError returned
+// when a snapshot isolation transaction can't commit
+var ErrWriteConflict = errors.New("transaction write conflict")
+
+// WriteConflictError reports a transaction under IsolationSnapshot refused
+// because a document it writes changed after its snapshot was taken
+type WriteConflictError struct {
+	Collection string // Collection of the document
+	ID         string // Document changed by someone else
+}
+
+func (e *WriteConflictError) Error() string {
+	return fmt.Sprintf("document %s in collection %s changed since the transaction started", e.ID, e.Collection)
+}
+
+// Is makes errors.Is(err, ErrWriteConflict) match
+func (e *WriteConflictError) Is(target error) bool {
+	return target == ErrWriteConflict
+}
+
+// checkConflicts makes sure none of the documents the writes change has
+// changed since the snapshot s was taken: one still there must not have
+// been written after the snapshot's sequence, and one in the snapshot must
+// still be there. Sequences, unlike versions, keep counting across a delete
+// and a re-insert, which starts the version again from 1
+// Caller must lock the collections (see lockAll)
+func checkConflicts(s *Snapshot, colls map[string]*Collection, writes []txWrite) error {
+	for _, w := range writes {
+		_, existed := s.Collection(w.collection).coll.documents.get(w.id)
+		coll := colls[w.collection]
+		_, exists := coll.documents.get(w.id)
+		if existed != exists || (exists && coll.seqs[w.id] > s.seq) {
+			return &WriteConflictError{Collection: w.collection, ID: w.id}
+		}
+	}
+	return nil
+}
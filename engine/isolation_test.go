@@ -0,0 +1,158 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+)
+
+// openAccount opens a database at the isolation level holding the document
+// {id: "acct", bal: 10} in "accounts"
+func openAccount(t *testing.T, level IsolationLevel) *Database {
+	t.Helper()
+	db := openTestDatabase(t, WithIsolation(level))
+	if _, err := db.GetCollection("accounts").Insert(map[string]interface{}{"id": "acct", "bal": 10}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// balance returns the stored balance of "acct"
+func balance(t *testing.T, db *Database) float64 {
+	t.Helper()
+	bal, _ := toFloat64(db.GetCollection("accounts").FindByID("acct")["bal"])
+	return bal
+}
+
+// TestIsolationAnomalies runs each anomaly under both levels: read committed
+// shows it, snapshot isolation doesn't
+func TestIsolationAnomalies(t *testing.T) {
+	tests := []struct {
+		name string
+		// run plays the anomaly with outside changing the database partway
+		// through tx, and reports whether the anomaly showed
+		run func(t *testing.T, db *Database, tx *Tx) bool
+	}{
+		{
+			name: "non-repeatable read",
+			run: func(t *testing.T, db *Database, tx *Tx) bool {
+				first, err := tx.FindByID("accounts", "acct")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := db.GetCollection("accounts").Update("acct", map[string]interface{}{"bal": 20}); err != nil {
+					t.Fatal(err)
+				}
+				second, err := tx.FindByID("accounts", "acct")
+				if err != nil {
+					t.Fatal(err)
+				}
+				return first["bal"] != second["bal"]
+			},
+		},
+		{
+			name: "phantom",
+			run: func(t *testing.T, db *Database, tx *Tx) bool {
+				filter := map[string]interface{}{"bal": map[string]interface{}{"$gte": 0}}
+				first, err := tx.Find("accounts", filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := db.GetCollection("accounts").Insert(map[string]interface{}{"bal": 1}); err != nil {
+					t.Fatal(err)
+				}
+				second, err := tx.Find("accounts", filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return len(first) != len(second)
+			},
+		},
+		{
+			name: "lost update",
+			run: func(t *testing.T, db *Database, tx *Tx) bool {
+				doc, err := tx.FindByID("accounts", "acct")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := db.GetCollection("accounts").Update("acct", map[string]interface{}{"$inc": map[string]interface{}{"bal": 5}}); err != nil {
+					t.Fatal(err)
+				}
+				bal, _ := toFloat64(doc["bal"])
+				if err := tx.Update("accounts", "acct", map[string]interface{}{"$set": map[string]interface{}{"bal": bal + 1}}); err != nil {
+					t.Fatal(err)
+				}
+				err = tx.Commit()
+				if err != nil && !errors.Is(err, ErrWriteConflict) {
+					t.Fatal(err)
+				}
+				return balance(t, db) == 11 // The $inc to 15 was overwritten
+			},
+		},
+		{
+			name: "delete and re-insert (ABA)",
+			run: func(t *testing.T, db *Database, tx *Tx) bool {
+				if _, err := tx.FindByID("accounts", "acct"); err != nil {
+					t.Fatal(err)
+				}
+				// The re-inserted document starts again at version 1, as the
+				// one the transaction read
+				coll := db.GetCollection("accounts")
+				if err := coll.Delete("acct"); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := coll.Insert(map[string]interface{}{"id": "acct", "bal": 5}); err != nil {
+					t.Fatal(err)
+				}
+				if err := tx.Update("accounts", "acct", map[string]interface{}{"$set": map[string]interface{}{"bal": 100}}); err != nil {
+					t.Fatal(err)
+				}
+				err := tx.Commit()
+				if err != nil && !errors.Is(err, ErrWriteConflict) {
+					t.Fatal(err)
+				}
+				return balance(t, db) == 100 // The re-inserted 5 was overwritten
+			},
+		},
+	}
+	levels := []struct {
+		level IsolationLevel
+		shows bool
+	}{
+		{IsolationReadCommitted, true},
+		{IsolationSnapshot, false},
+	}
+	for _, tt := range tests {
+		for _, l := range levels {
+			t.Run(tt.name+"/"+l.level.String(), func(t *testing.T) {
+				db := openAccount(t, l.level)
+				tx := db.Begin()
+				if got := tt.run(t, db, tx); got != l.shows {
+					t.Fatalf("anomaly showed: %v, want %v", got, l.shows)
+				}
+			})
+		}
+	}
+}
+
+// TestSnapshotFirstCommitterWins checks that of two snapshot transactions
+// writing the same document, the second to commit fails
+func TestSnapshotFirstCommitterWins(t *testing.T) {
+	db := openAccount(t, IsolationSnapshot)
+	first, second := db.Begin(), db.Begin()
+	for i, tx := range []*Tx{first, second} {
+		if err := tx.Update("accounts", "acct", map[string]interface{}{"$set": map[string]interface{}{"bal": i + 1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := first.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	err := second.Commit()
+	var conflict *WriteConflictError
+	if !errors.As(err, &conflict) || conflict.ID != "acct" || !errors.Is(err, ErrWriteConflict) {
+		t.Fatalf("got %v, want a WriteConflictError for acct", err)
+	}
+	if got := balance(t, db); got != 1 {
+		t.Fatalf("got balance %v, want 1", got)
+	}
+}
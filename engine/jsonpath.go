@@ -0,0 +1,648 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// JSONPath is a compiled JSONPath expression (see CompileJSONPath)
+type JSONPath struct {
+	expr  string     // Source expression
+	steps []pathStep // Steps applied from the root, in order
+}
+
+// pathStepKind identifies what a path step selects
+type pathStepKind int
+
+const (
+	stepField    pathStepKind = iota // .name or ['name', ...]
+	stepWildcard                     // .* or [*]
+	stepIndex                        // [0], [-1] or [0, 2]
+	stepSlice                        // [start:end:step]
+	stepFilter                       // [?(predicate)]
+)
+
+// pathStep is one segment of a JSONPath expression
+type pathStep struct {
+	kind      pathStepKind
+	recursive bool          // Preceded by "..": applies to the node and all its descendants
+	names     []string      // stepField
+	indexes   []int         // stepIndex
+	slice     [3]*int       // stepSlice: start, end, step (nil when omitted)
+	filter    pathPredicate // stepFilter
+}
+
+// pathPredicate is a compiled [?(...)] condition
+type pathPredicate interface {
+	eval(m MatchOptions, root, node interface{}) bool
+}
+
+// CompileJSONPath parses a JSONPath expression:
+//
+//	$.items[0].sku               // Child fields and array indexes (negative counts from the end)
+//	$['first name']              // Bracketed names, for keys with special characters
+//	$.items[*].sku, $.address.*  // Every element or value
+//	$..sku                       // Recursive descent: sku at any depth
+//	$.items[1:3], $.items[::2]   // Array slices
+//	$.items[?(@.price > 10 && @.tags)].sku // Filters
+//
+// Filter predicates compare @ (the current element) or $ (the document) paths
+// with ==, !=, <, <=, > and >=, combined with &&, || and ! and parentheses
+// A bare path tests that it selects something. Comparisons follow the same
+// type rules as filters (see MatchOptions)
+func CompileJSONPath(expr string) (*JSONPath, error) {
+	p := &jsonPathParser{expr: strings.TrimSpace(expr)}
+	if !p.consume("$") {
+		return nil, fmt.Errorf("JSONPath must start with $")
+	}
+
+	steps, err := p.parseSteps(false)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.expr) {
+		return nil, p.errorf("unexpected %q", p.expr[p.pos:])
+	}
+	return &JSONPath{expr: expr, steps: steps}, nil
+}
+
+// String returns the source expression
+func (p *JSONPath) String() string {
+	return p.expr
+}
+
+// Select returns every value the path selects from a document, in document order
+// Object wildcards visit keys in sorted order so results are deterministic
+func (p *JSONPath) Select(doc map[string]interface{}) []interface{} {
+	return p.selectFrom(MatchOptions{}, doc, doc)
+}
+
+// selectFrom applies the path's steps starting at node
+func (p *JSONPath) selectFrom(m MatchOptions, root, node interface{}) []interface{} {
+	return selectSteps(m, root, []interface{}{node}, p.steps)
+}
+
+// selectSteps applies steps to a set of nodes
+func selectSteps(m MatchOptions, root interface{}, nodes []interface{}, steps []pathStep) []interface{} {
+	for _, step := range steps {
+		if step.recursive {
+			var all []interface{}
+			for _, node := range nodes {
+				all = appendDescendants(all, node)
+			}
+			nodes = all
+		}
+
+		next := make([]interface{}, 0, len(nodes))
+		for _, node := range nodes {
+			next = step.apply(m, root, node, next)
+		}
+		nodes = next
+	}
+	return nodes
+}
+
+// appendDescendants appends a node and every value nested in it, depth first
+func appendDescendants(out []interface{}, node interface{}) []interface{} {
+	out = append(out, node)
+	for _, child := range children(node) {
+		out = appendDescendants(out, child)
+	}
+	return out
+}
+
+// children returns the values of an object (sorted by key) or the elements of an array
+func children(node interface{}) []interface{} {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		values := make([]interface{}, len(keys))
+		for i, key := range keys {
+			values[i] = v[key]
+		}
+		return values
+	case []interface{}:
+		return v
+	}
+	return nil
+}
+
+// apply appends the values a step selects from one node
+func (s pathStep) apply(m MatchOptions, root, node interface{}, out []interface{}) []interface{} {
+	switch s.kind {
+	case stepField:
+		if obj, isMap := node.(map[string]interface{}); isMap {
+			for _, name := range s.names {
+				if value, exists := obj[name]; exists {
+					out = append(out, value)
+				}
+			}
+		}
+
+	case stepWildcard:
+		out = append(out, children(node)...)
+
+	case stepIndex:
+		if arr, isArray := node.([]interface{}); isArray {
+			for _, i := range s.indexes {
+				if i < 0 {
+					i += len(arr)
+				}
+				if i >= 0 && i < len(arr) {
+					out = append(out, arr[i])
+				}
+			}
+		}
+
+	case stepSlice:
+		if arr, isArray := node.([]interface{}); isArray {
+			start, end, step := sliceBounds(s.slice, len(arr))
+			for i := start; i < end; i += step {
+				out = append(out, arr[i])
+			}
+		}
+
+	case stepFilter:
+		for _, child := range children(node) {
+			if s.filter.eval(m, root, child) {
+				out = append(out, child)
+			}
+		}
+	}
+	return out
+}
+
+// sliceBounds resolves [start:end:step] against an array length, Python style
+func sliceBounds(slice [3]*int, n int) (int, int, int) {
+	resolve := func(bound *int, def int) int {
+		if bound == nil {
+			return def
+		}
+		i := *bound
+		if i < 0 {
+			i += n
+		}
+		return min(max(i, 0), n)
+	}
+
+	step := 1
+	if slice[2] != nil {
+		step = *slice[2]
+	}
+	return resolve(slice[0], 0), resolve(slice[1], n), step
+}
+
+// pathOrPredicate is a || b
+type pathOrPredicate struct{ left, right pathPredicate }
+
+func (p pathOrPredicate) eval(m MatchOptions, root, node interface{}) bool {
+	return p.left.eval(m, root, node) || p.right.eval(m, root, node)
+}
+
+// pathAndPredicate is a && b
+type pathAndPredicate struct{ left, right pathPredicate }
+
+func (p pathAndPredicate) eval(m MatchOptions, root, node interface{}) bool {
+	return p.left.eval(m, root, node) && p.right.eval(m, root, node)
+}
+
+// pathNotPredicate is !a
+type pathNotPredicate struct{ inner pathPredicate }
+
+func (p pathNotPredicate) eval(m MatchOptions, root, node interface{}) bool {
+	return !p.inner.eval(m, root, node)
+}
+
+// pathOperand is one side of a comparison: a literal or a path from @ or $
+type pathOperand struct {
+	literal  interface{}
+	steps    []pathStep
+	isPath   bool
+	fromRoot bool // Path starts at $ rather than @
+}
+
+// value resolves the operand; paths yield their first selected value
+func (o pathOperand) value(m MatchOptions, root, node interface{}) (interface{}, bool) {
+	if !o.isPath {
+		return o.literal, true
+	}
+	start := node
+	if o.fromRoot {
+		start = root
+	}
+	values := selectSteps(m, root, []interface{}{start}, o.steps)
+	if len(values) == 0 {
+		return nil, false
+	}
+	return values[0], true
+}
+
+// pathComparison compares two operands; without an operator it tests existence
+type pathComparison struct {
+	left, right pathOperand
+	op          string // "", "==", "!=", "<", "<=", ">" or ">="
+}
+
+func (p pathComparison) eval(m MatchOptions, root, node interface{}) bool {
+	left, leftOK := p.left.value(m, root, node)
+	if p.op == "" {
+		return leftOK
+	}
+	right, rightOK := p.right.value(m, root, node)
+
+	switch p.op {
+	case "==":
+		return leftOK && rightOK && m.valuesMatch(left, right)
+	case "!=":
+		return !(leftOK && rightOK && m.valuesMatch(left, right))
+	}
+
+	if !leftOK || !rightOK {
+		return false
+	}
+	cmp, ok := m.compareOrdered(left, right)
+	if !ok {
+		return false
+	}
+	switch p.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+// jsonPathParser is a recursive-descent parser over a JSONPath expression
+type jsonPathParser struct {
+	expr string
+	pos  int
+}
+
+// errorf reports a syntax error at the current position
+func (p *jsonPathParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("JSONPath %q: %s at position %d", p.expr, fmt.Sprintf(format, args...), p.pos)
+}
+
+// skipSpace skips whitespace (only meaningful inside brackets and filters)
+func (p *jsonPathParser) skipSpace() {
+	for p.pos < len(p.expr) && strings.ContainsRune(" \t\n\r", rune(p.expr[p.pos])) {
+		p.pos++
+	}
+}
+
+// consume advances past s if the expression continues with it
+func (p *jsonPathParser) consume(s string) bool {
+	if strings.HasPrefix(p.expr[p.pos:], s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+// parseSteps parses steps until the expression ends or, inside a filter,
+// something other than a step follows
+func (p *jsonPathParser) parseSteps(inFilter bool) ([]pathStep, error) {
+	var steps []pathStep
+	for p.pos < len(p.expr) {
+		var step pathStep
+		var err error
+
+		switch {
+		case p.consume(".."):
+			if p.consume("[") {
+				step, err = p.parseBracket()
+			} else {
+				step, err = p.parseDotted()
+			}
+			step.recursive = true
+		case p.consume("."):
+			step, err = p.parseDotted()
+		case p.consume("["):
+			step, err = p.parseBracket()
+		default:
+			if inFilter {
+				return steps, nil
+			}
+			return nil, p.errorf("expected '.' or '['")
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// parseDotted parses the name or * after a dot
+func (p *jsonPathParser) parseDotted() (pathStep, error) {
+	if p.consume("*") {
+		return pathStep{kind: stepWildcard}, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.expr) && !strings.ContainsRune(".[]()!=<>&|, \t\n\r", rune(p.expr[p.pos])) {
+		p.pos++
+	}
+	if p.pos == start {
+		return pathStep{}, p.errorf("expected a field name")
+	}
+	return pathStep{kind: stepField, names: []string{p.expr[start:p.pos]}}, nil
+}
+
+// parseBracket parses the contents of [...] after the opening bracket
+func (p *jsonPathParser) parseBracket() (pathStep, error) {
+	p.skipSpace()
+	var step pathStep
+
+	switch {
+	case p.consume("*"):
+		step = pathStep{kind: stepWildcard}
+
+	case p.consume("?("):
+		filter, err := p.parseOr()
+		if err != nil {
+			return step, err
+		}
+		p.skipSpace()
+		if !p.consume(")") {
+			return step, p.errorf("expected ')' to close the filter")
+		}
+		step = pathStep{kind: stepFilter, filter: filter}
+
+	case p.pos < len(p.expr) && (p.expr[p.pos] == '\'' || p.expr[p.pos] == '"'):
+		step = pathStep{kind: stepField}
+		for {
+			name, end, err := scanQuoted(p.expr, p.pos)
+			if err != nil {
+				return step, err
+			}
+			p.pos = end
+			step.names = append(step.names, name)
+
+			p.skipSpace()
+			if !p.consume(",") {
+				break
+			}
+			p.skipSpace()
+		}
+
+	default:
+		var err error
+		if step, err = p.parseIndexes(); err != nil {
+			return step, err
+		}
+	}
+
+	p.skipSpace()
+	if !p.consume("]") {
+		return step, p.errorf("expected ']'")
+	}
+	return step, nil
+}
+
+// parseIndexes parses "n", "n, m, ..." or "start:end:step"
+func (p *jsonPathParser) parseIndexes() (pathStep, error) {
+	var parts [3]*int
+	part := 0
+	for {
+		p.skipSpace()
+		if n, ok := p.parseInt(); ok {
+			parts[part] = &n
+		}
+		p.skipSpace()
+
+		if !p.consume(":") {
+			break
+		}
+		if part++; part > 2 {
+			return pathStep{}, p.errorf("too many ':' in slice")
+		}
+	}
+
+	if part > 0 {
+		if parts[2] != nil && *parts[2] <= 0 {
+			return pathStep{}, p.errorf("slice step must be positive")
+		}
+		return pathStep{kind: stepSlice, slice: parts}, nil
+	}
+
+	if parts[0] == nil {
+		return pathStep{}, p.errorf("expected an index, name, * or filter")
+	}
+	step := pathStep{kind: stepIndex, indexes: []int{*parts[0]}}
+	for p.consume(",") {
+		p.skipSpace()
+		n, ok := p.parseInt()
+		if !ok {
+			return step, p.errorf("expected an index")
+		}
+		step.indexes = append(step.indexes, n)
+		p.skipSpace()
+	}
+	return step, nil
+}
+
+// parseInt parses an optionally negative integer
+func (p *jsonPathParser) parseInt() (int, bool) {
+	start := p.pos
+	if p.pos < len(p.expr) && p.expr[p.pos] == '-' {
+		p.pos++
+	}
+	for p.pos < len(p.expr) && p.expr[p.pos] >= '0' && p.expr[p.pos] <= '9' {
+		p.pos++
+	}
+	n, err := strconv.Atoi(p.expr[start:p.pos])
+	if err != nil {
+		p.pos = start
+		return 0, false
+	}
+	return n, true
+}
+
+// parseOr parses: and { "||" and }
+func (p *jsonPathParser) parseOr() (pathPredicate, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.skipSpace(); p.consume("||"); p.skipSpace() {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = pathOrPredicate{left: left, right: right}
+	}
+	return left, nil
+}
+
+// parseAnd parses: unary { "&&" unary }
+func (p *jsonPathParser) parseAnd() (pathPredicate, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.skipSpace(); p.consume("&&"); p.skipSpace() {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = pathAndPredicate{left: left, right: right}
+	}
+	return left, nil
+}
+
+// parseUnary parses: "!" unary | "(" or ")" | comparison
+func (p *jsonPathParser) parseUnary() (pathPredicate, error) {
+	p.skipSpace()
+	if strings.HasPrefix(p.expr[p.pos:], "!") && !strings.HasPrefix(p.expr[p.pos:], "!=") {
+		p.pos++
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return pathNotPredicate{inner: inner}, nil
+	}
+
+	if p.consume("(") {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if !p.consume(")") {
+			return nil, p.errorf("expected ')'")
+		}
+		return inner, nil
+	}
+
+	return p.parseComparison()
+}
+
+// parseComparison parses: operand [op operand]
+func (p *jsonPathParser) parseComparison() (pathPredicate, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpace()
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">", "="} {
+		if !p.consume(op) {
+			continue
+		}
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if op == "=" {
+			op = "=="
+		}
+		return pathComparison{left: left, right: right, op: op}, nil
+	}
+
+	if !left.isPath {
+		return nil, p.errorf("expected a comparison")
+	}
+	return pathComparison{left: left}, nil
+}
+
+// parseOperand parses @path, $path or a literal (string, number, true, false, null)
+func (p *jsonPathParser) parseOperand() (pathOperand, error) {
+	p.skipSpace()
+	if p.pos >= len(p.expr) {
+		return pathOperand{}, p.errorf("expected a value")
+	}
+
+	c := p.expr[p.pos]
+	switch {
+	case c == '@' || c == '$':
+		p.pos++
+		steps, err := p.parseSteps(true)
+		if err != nil {
+			return pathOperand{}, err
+		}
+		return pathOperand{steps: steps, isPath: true, fromRoot: c == '$'}, nil
+
+	case c == '\'' || c == '"':
+		text, end, err := scanQuoted(p.expr, p.pos)
+		if err != nil {
+			return pathOperand{}, err
+		}
+		p.pos = end
+		return pathOperand{literal: text}, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.expr) && !strings.ContainsRune("()!=<>&|, \t\n\r]", rune(p.expr[p.pos])) {
+		p.pos++
+	}
+	if p.pos == start {
+		return pathOperand{}, p.errorf("expected a value")
+	}
+	word := p.expr[start:p.pos]
+	value := filterValue(filterToken{kind: tokenWord, text: word})
+	if _, isStr := value.(string); isStr {
+		p.pos = start
+		return pathOperand{}, p.errorf("unquoted string %q", word)
+	}
+	return pathOperand{literal: value}, nil
+}
+
+// jsonPathCacheSize bounds the number of compiled expressions kept by cachedJSONPath
+const jsonPathCacheSize = 256
+
+// jsonPathCache holds compiled $jsonPath expressions so repeated scans don't reparse them
+var jsonPathCache = struct {
+	sync.Mutex
+	paths map[string]*JSONPath
+}{paths: make(map[string]*JSONPath)}
+
+// cachedJSONPath compiles an expression, reusing a previous compilation if possible
+func cachedJSONPath(expr string) (*JSONPath, error) {
+	jsonPathCache.Lock()
+	defer jsonPathCache.Unlock()
+
+	if path, ok := jsonPathCache.paths[expr]; ok {
+		return path, nil
+	}
+
+	path, err := CompileJSONPath(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(jsonPathCache.paths) >= jsonPathCacheSize {
+		jsonPathCache.paths = make(map[string]*JSONPath)
+	}
+	jsonPathCache.paths[expr] = path
+	return path, nil
+}
+
+// matchJSONPath implements the top-level $jsonPath operator:
+//
+//	{"$jsonPath": "$.items[?(@.price > 10)]"}
+//
+// A document matches if the path selects at least one value; invalid paths never match
+func (m MatchOptions) matchJSONPath(doc map[string]interface{}, operand interface{}) bool {
+	expr, ok := operand.(string)
+	if !ok {
+		return false
+	}
+	path, err := cachedJSONPath(expr)
+	if err != nil {
+		return false
+	}
+	return len(path.selectFrom(m, doc, doc)) > 0
+}
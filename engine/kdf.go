@@ -0,0 +1,149 @@
+package engine
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// Limits on the scrypt parameters, which encrypted files store and so are
+// read from untrusted input: N=2^20 with r=8 already takes 1 GiB and seconds
+// of work, and a crafted file must not make opening it exhaust memory or run
+// for minutes
+const (
+	maxScryptLogN   = 20
+	maxScryptMemory = 1 << 30 // 128*r*N bytes of working memory
+	maxScryptP      = 16
+)
+
+// scryptKey derives a key from a passphrase with scrypt (RFC 7914)
+// N = 2^logN is the CPU/memory cost, r the block size and p the parallelism
+// Parameters over the limits above are rejected before any work is done
+func scryptKey(passphrase, salt []byte, logN, r, p uint8, keyLen int) ([]byte, error) {
+	if logN == 0 || r == 0 || p == 0 {
+		return nil, fmt.Errorf("invalid scrypt parameters N=2^%d r=%d p=%d", logN, r, p)
+	}
+	if logN > maxScryptLogN || 128*int64(r)<<logN > maxScryptMemory || p > maxScryptP {
+		return nil, fmt.Errorf("scrypt parameters N=2^%d r=%d p=%d are over the supported maximum (N=2^%d, %d MiB, p=%d)",
+			logN, r, p, maxScryptLogN, maxScryptMemory>>20, maxScryptP)
+	}
+	n := 1 << logN
+	blockWords := 32 * int(r) // 128*r bytes as little-endian uint32 words
+
+	b := pbkdf2SHA256(passphrase, salt, 1, int(p)*128*int(r))
+	x := make([]uint32, blockWords)
+	scratch := make([]uint32, blockWords)
+	v := make([]uint32, n*blockWords)
+	for i := 0; i < int(p); i++ {
+		block := b[i*128*int(r) : (i+1)*128*int(r)]
+		for j := range x {
+			x[j] = binary.LittleEndian.Uint32(block[j*4:])
+		}
+		scryptROMix(x, v, scratch, n, int(r))
+		for j, word := range x {
+			binary.LittleEndian.PutUint32(block[j*4:], word)
+		}
+	}
+	return pbkdf2SHA256(passphrase, b, 1, keyLen), nil
+}
+
+// scryptROMix mixes one block in place, using v as its n-block memory
+func scryptROMix(x, v, scratch []uint32, n, r int) {
+	blockWords := len(x)
+	for i := 0; i < n; i++ {
+		copy(v[i*blockWords:], x)
+		scryptBlockMix(x, scratch, r)
+	}
+	for i := 0; i < n; i++ {
+		j := int(x[(2*r-1)*16] & uint32(n-1))
+		for k := range x {
+			x[k] ^= v[j*blockWords+k]
+		}
+		scryptBlockMix(x, scratch, r)
+	}
+}
+
+// scryptBlockMix applies BlockMix with Salsa20/8 to a block in place
+func scryptBlockMix(b, scratch []uint32, r int) {
+	var t [16]uint32
+	copy(t[:], b[(2*r-1)*16:])
+	for i := 0; i < 2*r; i++ {
+		for k := range t {
+			t[k] ^= b[i*16+k]
+		}
+		salsa208(&t)
+		// Even sub-blocks go to the first half of the output, odd ones to the second
+		copy(scratch[((i%2)*r+i/2)*16:], t[:])
+	}
+	copy(b, scratch)
+}
+
+// salsa208 applies the Salsa20/8 core to a 64-byte block
+func salsa208(b *[16]uint32) {
+	x := *b
+	for i := 0; i < 8; i += 2 {
+		x[4] ^= bits.RotateLeft32(x[0]+x[12], 7)
+		x[8] ^= bits.RotateLeft32(x[4]+x[0], 9)
+		x[12] ^= bits.RotateLeft32(x[8]+x[4], 13)
+		x[0] ^= bits.RotateLeft32(x[12]+x[8], 18)
+		x[9] ^= bits.RotateLeft32(x[5]+x[1], 7)
+		x[13] ^= bits.RotateLeft32(x[9]+x[5], 9)
+		x[1] ^= bits.RotateLeft32(x[13]+x[9], 13)
+		x[5] ^= bits.RotateLeft32(x[1]+x[13], 18)
+		x[14] ^= bits.RotateLeft32(x[10]+x[6], 7)
+		x[2] ^= bits.RotateLeft32(x[14]+x[10], 9)
+		x[6] ^= bits.RotateLeft32(x[2]+x[14], 13)
+		x[10] ^= bits.RotateLeft32(x[6]+x[2], 18)
+		x[3] ^= bits.RotateLeft32(x[15]+x[11], 7)
+		x[7] ^= bits.RotateLeft32(x[3]+x[15], 9)
+		x[11] ^= bits.RotateLeft32(x[7]+x[3], 13)
+		x[15] ^= bits.RotateLeft32(x[11]+x[7], 18)
+
+		x[1] ^= bits.RotateLeft32(x[0]+x[3], 7)
+		x[2] ^= bits.RotateLeft32(x[1]+x[0], 9)
+		x[3] ^= bits.RotateLeft32(x[2]+x[1], 13)
+		x[0] ^= bits.RotateLeft32(x[3]+x[2], 18)
+		x[6] ^= bits.RotateLeft32(x[5]+x[4], 7)
+		x[7] ^= bits.RotateLeft32(x[6]+x[5], 9)
+		x[4] ^= bits.RotateLeft32(x[7]+x[6], 13)
+		x[5] ^= bits.RotateLeft32(x[4]+x[7], 18)
+		x[11] ^= bits.RotateLeft32(x[10]+x[9], 7)
+		x[8] ^= bits.RotateLeft32(x[11]+x[10], 9)
+		x[9] ^= bits.RotateLeft32(x[8]+x[11], 13)
+		x[10] ^= bits.RotateLeft32(x[9]+x[8], 18)
+		x[12] ^= bits.RotateLeft32(x[15]+x[14], 7)
+		x[13] ^= bits.RotateLeft32(x[12]+x[15], 9)
+		x[14] ^= bits.RotateLeft32(x[13]+x[12], 13)
+		x[15] ^= bits.RotateLeft32(x[14]+x[13], 18)
+	}
+	for i := range b {
+		b[i] += x[i]
+	}
+}
+
+// pbkdf2SHA256 derives keyLen bytes with PBKDF2-HMAC-SHA256 (RFC 8018)
+func pbkdf2SHA256(passphrase, salt []byte, iterations, keyLen int) []byte {
+	mac := hmac.New(sha256.New, passphrase)
+	key := make([]byte, 0, keyLen+sha256.Size)
+	var counter [4]byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		binary.BigEndian.PutUint32(counter[:], block)
+		mac.Reset()
+		mac.Write(salt)
+		mac.Write(counter[:])
+		u := mac.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			mac.Reset()
+			mac.Write(u)
+			u = mac.Sum(u[:0])
+			for k := range t {
+				t[k] ^= u[k]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
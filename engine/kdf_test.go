@@ -0,0 +1,87 @@
+package engine
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScryptKey(t *testing.T) {
+	// Test vectors from RFC 7914, section 12
+	tests := []struct {
+		name             string
+		passphrase, salt string
+		logN, r, p       uint8
+		want             string
+	}{
+		{"empty", "", "", 4, 1, 1, "77d6576238657b203b19ca42c18a0497f16b4844e3074ae8dfdffa3fede21442fcd0069ded0948f8326a753a0fc81f17e8d3e0fb2e0d3628cf35e20c38d18906"},
+		{"password", "password", "NaCl", 10, 8, 16, "fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b3731622eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := scryptKey([]byte(tt.passphrase), []byte(tt.salt), tt.logN, tt.r, tt.p, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(key); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScryptKeyRejectsParameters(t *testing.T) {
+	tests := []struct {
+		name       string
+		logN, r, p uint8
+		want       string
+	}{
+		{"zero N", 0, 8, 1, "invalid"},
+		{"zero r", 15, 0, 1, "invalid"},
+		{"zero p", 15, 8, 0, "invalid"},
+		{"N over the cap", maxScryptLogN + 1, 1, 1, "over the supported maximum"},
+		{"N far over the cap", 24, 8, 1, "over the supported maximum"},
+		{"memory over the cap", maxScryptLogN, 16, 1, "over the supported maximum"},
+		{"p over the cap", 10, 8, maxScryptP + 1, "over the supported maximum"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Rejected before any work, so even the huge ones return at once
+			_, err := scryptKey([]byte("passphrase"), []byte("salt"), tt.logN, tt.r, tt.p, 32)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenRejectsCostlyKeyDerivation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := OpenDatabase(path, WithEncryption("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetCollection("docs").Insert(map[string]interface{}{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Raise the logN stored in the key block, as a crafted file could
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(binaryMagic)+encryptionSaltBytes] = 24
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenDatabase(path, WithEncryption("secret"))
+	if err == nil || !strings.Contains(err.Error(), "over the supported maximum") {
+		t.Fatalf("got %v, want the scrypt parameters refused", err)
+	}
+}
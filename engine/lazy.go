@@ -0,0 +1,336 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// Lazy loading (see WithLazyLoading): opening reads the file once to index
+// where each collection's records are, decoding only their heads, and a
+// collection's documents are read from those offsets when it is first used.
+// Anything that rewrites the file, such as Compact or Checkpoint, loads
+// every collection first, since the offsets don't survive the rewrite
+
+// errNotLoaded is returned by storage rewrites while lazy loading has
+// collections left to read from the current file
+var errNotLoaded = errors.New("storage still has collections to load lazily; load them before rewriting the file")
+
+// recordHead is the part of a record lazy loading indexes it by; decoding
+// into it skips the document, noting only whether there is one
+type recordHead struct {
+	Collection string           `json:"collection"`
+	ID         string           `json:"id"`
+	Doc        presence         `json:"doc"`
+	Seq        uint64           `json:"seq"`
+	Index      *IndexDefinition `json:"index"`
+	Attachment *attachmentHead  `json:"attachment"`
+	Header     *FileHeader      `json:"header"`
+}
+
+// attachmentHead is an AttachmentPart without its data
+type attachmentHead struct {
+	Name  string `json:"name"`
+	Part  int    `json:"part"`
+	Parts int    `json:"parts"`
+}
+
+// presence decodes only whether a JSON value is there and not null
+type presence bool
+
+func (p *presence) UnmarshalJSON(data []byte) error {
+	*p = string(data) != "null"
+	return nil
+}
+
+// headDoc stands in for the document of a head whose record has one, so
+// the head tells a write from a deletion (see diskUsage). It is never
+// handed out as a document
+var headDoc = map[string]interface{}{}
+
+// decodeRecord decodes a record payload in the given codec, only its head
+// if heads is set
+func decodeRecord(payload []byte, codec string, heads bool) (StorageRecord, error) {
+	if codec != CodecJSON {
+		return unmarshalRecord(payload, codec, heads)
+	}
+	if !heads {
+		var record StorageRecord
+		err := json.Unmarshal(payload, &record)
+		return record, err
+	}
+	var head recordHead
+	if err := json.Unmarshal(payload, &head); err != nil {
+		return StorageRecord{}, err
+	}
+	record := StorageRecord{Collection: head.Collection, ID: head.ID, Seq: head.Seq, Index: head.Index, Header: head.Header}
+	if head.Doc {
+		record.Doc = headDoc
+	}
+	if head.Attachment != nil {
+		record.Attachment = &AttachmentPart{Name: head.Attachment.Name, Part: head.Attachment.Part, Parts: head.Attachment.Parts}
+	}
+	return record, nil
+}
+
+// recordExtent is where a record is stored
+type recordExtent struct {
+	snapshot bool   // In the snapshot file rather than the log
+	offset   int64  // Where the record starts
+	seq      uint64 // Its sequence number, which legacy records only get by position
+}
+
+// lazyIndex holds where the records of the collections not loaded yet are
+type lazyIndex struct {
+	extents        map[string][]recordExtent // Collection -> its records, in log order
+	format         int                       // Format of the log
+	codec          string                    // Codec of its records
+	snapshotFormat int                       // Format of the snapshot file
+	snapshotCodec  string                    // Codec of the snapshot's records
+}
+
+// add indexes the records decoded from the log or the snapshot file
+func (x *lazyIndex) add(log decodedLog, snapshot bool) {
+	for i, record := range log.records {
+		extent := recordExtent{snapshot: snapshot, offset: log.offsets[i], seq: record.Seq}
+		x.extents[record.Collection] = append(x.extents[record.Collection], extent)
+	}
+}
+
+// LoadCollections is the LoadAll of lazy loading: it reads the file the
+// same way, repairing and upgrading it as needed, but keeps only where each
+// collection's records are, for LoadCollection to read them later
+// It returns the names of the collections with records, sorted
+func (s *Storage) LoadCollections() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index := &lazyIndex{extents: make(map[string][]recordExtent)}
+	log, err := s.readRecords(index)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.recoverTorn(log.torn); err != nil {
+		return nil, err
+	}
+
+	// Upgrading rewrites every record, so they are read in full for it and
+	// the new file indexed after
+	if s.version < StorageVersion && !s.readOnly {
+		full, err := s.readRecords(nil)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := s.upgrade(full.records); err != nil {
+			return nil, fmt.Errorf("failed to upgrade storage file: %w", err)
+		}
+		index = &lazyIndex{extents: make(map[string][]recordExtent)}
+		if log, err = s.readRecords(index); err != nil {
+			return nil, err
+		}
+	}
+
+	heads := log.records
+	s.usage = measureUsage(heads, log.sizes)
+	s.resume(heads)
+	if len(heads) > 0 {
+		// Compaction may need the newest record whole
+		last := heads[len(heads)-1]
+		extents := index.extents[last.Collection]
+		tail, err := s.readExtents(index, extents[len(extents)-1:])
+		if err != nil {
+			return nil, err
+		}
+		s.tail = tail[0]
+	}
+	if len(index.extents) > 0 {
+		s.lazy = index
+	}
+
+	names := make([]string, 0, len(index.extents))
+	for name := range index.extents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// LoadCollection reads the records of a collection LoadCollections indexed,
+// in log order; each collection can be loaded once
+func (s *Storage) LoadCollection(name string) ([]StorageRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lazy == nil {
+		return nil, nil
+	}
+	records, err := s.readExtents(s.lazy, s.lazy.extents[name])
+	if err != nil {
+		return nil, fmt.Errorf("failed to load collection %s: %w", name, err)
+	}
+	delete(s.lazy.extents, name)
+	if len(s.lazy.extents) == 0 {
+		s.lazy = nil
+	}
+	return records, nil
+}
+
+// readExtents decodes the records at the given extents, which are in log
+// order: the snapshot's, if any, before the log's
+// Caller must hold the lock
+func (s *Storage) readExtents(index *lazyIndex, extents []recordExtent) ([]StorageRecord, error) {
+	split := sort.Search(len(extents), func(i int) bool { return !extents[i].snapshot })
+	records := make([]StorageRecord, 0, len(extents))
+	if split > 0 {
+		file, err := os.Open(snapshotPath(s.filePath))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open snapshot file: %w", err)
+		}
+		defer file.Close()
+		if records, err = s.readAt(file, index.snapshotFormat, index.snapshotCodec, extents[:split], records); err != nil {
+			return nil, err
+		}
+	}
+	return s.readAt(s.file, index.format, index.codec, extents[split:], records)
+}
+
+// readAt decodes the records at the given extents of a file in the given
+// format and codec, appending them to records
+// Nearby records are read through one buffer; a new read starts at records
+// too far ahead of it
+// Caller must hold the lock
+func (s *Storage) readAt(file io.ReaderAt, format int, codec string, extents []recordExtent, records []StorageRecord) ([]StorageRecord, error) {
+	var reader *recordReader
+	for _, extent := range extents {
+		if reader == nil || extent.offset < reader.offset || extent.offset-reader.offset > int64(reader.r.Buffered()) {
+			section := io.NewSectionReader(file, extent.offset, math.MaxInt64-extent.offset)
+			reader = &recordReader{r: bufio.NewReader(section), format: format, codec: codec, offset: extent.offset}
+			if s.cipher != nil && format == FormatBinary {
+				reader.encrypted, reader.cipher = true, s.cipher
+			}
+		} else {
+			reader.r.Discard(int(extent.offset - reader.offset))
+			reader.offset = extent.offset
+		}
+
+		payload, err := reader.next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read record at byte %d: %w", extent.offset, err)
+		}
+		record, err := reader.decode(payload, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse record at byte %d: %w", extent.offset, err)
+		}
+		record.Seq = extent.seq
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// unloadedStorage stands in for the storage of a collection that failed to
+// load lazily, failing its writes so nothing is written over documents that
+// were never read
+type unloadedStorage struct {
+	StorageEngine
+	err error
+}
+
+func (u unloadedStorage) Append(StorageRecord) (uint64, error) {
+	return 0, u.err
+}
+
+func (u unloadedStorage) AppendBatch([]StorageRecord) error {
+	return u.err
+}
+
+// LoadCollection returns a collection by name like GetCollection, but with
+// lazy loading (see WithLazyLoading) it also reports a failure to read the
+// collection from disk
+func (db *Database) LoadCollection(name string) (*Collection, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.pending[name] {
+		if err := db.loadCollection(name); err != nil {
+			return nil, err
+		}
+	}
+	if coll, exists := db.collections[name]; exists {
+		return coll, nil
+	}
+
+	coll := db.newCollection(name)
+	db.collections[name] = coll
+	return coll, nil
+}
+
+// existingCollection returns a collection without creating it, loading it
+// first if lazy loading left it on disk; nil if there is none
+func (db *Database) existingCollection(name string) (*Collection, error) {
+	db.mu.RLock()
+	coll, pending := db.collections[name], db.pending[name]
+	db.mu.RUnlock()
+	if !pending {
+		return coll, nil
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.pending[name] {
+		if err := db.loadCollection(name); err != nil {
+			return nil, err
+		}
+	}
+	return db.collections[name], nil
+}
+
+// loadCollection reads a collection lazy loading left on disk
+// Caller must hold the write lock
+func (db *Database) loadCollection(name string) error {
+	records, err := db.storage.(lazyLoader).LoadCollection(name)
+	if err != nil {
+		return err
+	}
+	if !db.options.asOf.IsZero() {
+		records = recordsAt(records, db.options.asOf)
+	}
+	db.applyRecords(records)
+	delete(db.pending, name)
+	return nil
+}
+
+// loadPending reads every collection lazy loading left on disk
+// Caller must hold the write lock
+func (db *Database) loadPending() error {
+	names := make([]string, 0, len(db.pending))
+	for name := range db.pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := db.loadCollection(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadAll reads every collection lazy loading left on disk, for operations
+// over the whole database
+func (db *Database) loadAll() error {
+	db.mu.RLock()
+	pending := len(db.pending)
+	db.mu.RUnlock()
+	if pending == 0 {
+		return nil
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.loadPending()
+}
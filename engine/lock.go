@@ -0,0 +1,78 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrLocked matches (with errors.Is) the LockError returned when another
+// process, or another open in this one, holds a conflicting lock
+var ErrLocked = errors.New("database is locked")
+
+// errLockHeld is returned by lockFile when the lock is taken
+var errLockHeld = errors.New("lock is held")
+
+// LockError reports a database file that is open elsewhere
+// Writers hold an exclusive lock and read-only opens (WithReadOnly) a shared
+// one, so any number of readers can open a file nobody is writing to
+type LockError struct {
+	Path     string // Database file
+	ReadOnly bool   // The failed open was read-only
+}
+
+func (e *LockError) Error() string {
+	if e.ReadOnly {
+		return fmt.Sprintf("database %s is open for writing in another process", e.Path)
+	}
+	return fmt.Sprintf("database %s is open in another process", e.Path)
+}
+
+// Is makes errors.Is(err, ErrLocked) match
+func (e *LockError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// lockPath returns the lock file of the database at path
+// The lock is taken on a file of its own because compaction renames a new
+// file over the database, which would drop a lock held on the old one
+func lockPath(path string) string {
+	return path + ".lock"
+}
+
+// lockDatabase takes the advisory lock of the database at path, shared for
+// read-only opens and exclusive otherwise, and returns the open lock file;
+// closing it releases the lock
+// A read-only open of a database whose lock file can't be created (e.g. on a
+// read-only filesystem, where nobody can be writing) goes ahead unlocked
+func lockDatabase(path string, shared bool) (*os.File, error) {
+	flags := os.O_RDWR | os.O_CREATE
+	if shared {
+		flags = os.O_RDONLY | os.O_CREATE
+	}
+	file, err := os.OpenFile(lockPath(path), flags, 0644)
+	if err != nil && shared {
+		if file, err = os.Open(lockPath(path)); err != nil {
+			return nil, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	if err := lockFile(file, shared); err != nil {
+		file.Close()
+		if errors.Is(err, errLockHeld) {
+			return nil, &LockError{Path: path, ReadOnly: shared}
+		}
+		return nil, fmt.Errorf("failed to lock database: %w", err)
+	}
+	return file, nil
+}
+
+// closeLock releases a lock taken by lockDatabase
+func closeLock(lock *os.File) {
+	if lock != nil {
+		lock.Close()
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package engine
+
+import "os"
+
+// lockFile does nothing where there is no advisory locking to use, e.g.
+// under js/wasm
+func lockFile(file *os.File, shared bool) error {
+	return nil
+}
@@ -0,0 +1,34 @@
+//go:build windows
+
+package engine
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+	errorLockViolation      = syscall.Errno(33)
+)
+
+// lockFile locks the first byte of file with LockFileEx without waiting for it
+func lockFile(file *os.File, shared bool) error {
+	flags := uintptr(lockfileFailImmediately)
+	if !shared {
+		flags |= lockfileExclusiveLock
+	}
+	var overlapped syscall.Overlapped
+	ok, _, err := procLockFileEx.Call(file.Fd(), flags, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if ok != 0 {
+		return nil
+	}
+	if err == errorLockViolation {
+		return errLockHeld
+	}
+	return err
+}
@@ -0,0 +1,73 @@
+package engine
+
+// lockStripes is how many locks the document writes of a collection are
+// spread over, by ID
+const lockStripes = 64
+
+// A collection has three levels of locking:
+//
+//   - mu protects the in-memory state (documents, indexes, seqs, ...). Reads
+//     take it shared, and writes only take it exclusively to install records
+//     that have already been persisted (see install), never while writing
+//     to storage, so a slow or long write doesn't stall readers
+//   - writers is shared by single-document writes and exclusive for writes
+//     over several documents (see lockAll), which need the collection to
+//     themselves
+//   - stripes serialize the single-document writes of documents whose IDs
+//     share a stripe (see lockDocument), so each document is read, checked
+//     and written atomically while writes to other documents go ahead
+
+// lockDocument locks a document to write it, and returns the function that
+// unlocks it. The caller reads what it needs under the read lock and then
+// persists and installs its records
+func (c *Collection) lockDocument(id string) func() {
+	c.writers.RLock()
+	stripe := &c.stripes[shardOf(id)%lockStripes]
+	stripe.Lock()
+	return func() {
+		stripe.Unlock()
+		c.writers.RUnlock()
+	}
+}
+
+// lockInsert locks a document to insert it. With a document limit, inserts
+// are made one at a time, so each is checked against an exact count
+func (c *Collection) lockInsert(id string) func() {
+	if c.limits.MaxDocuments > 0 {
+		return c.lockAll()
+	}
+	return c.lockDocument(id)
+}
+
+// lockAll locks the collection for a write over several documents, waiting
+// for the single-document writes in progress, and returns the function that
+// unlocks it. The holder is the only writer, so it may read the in-memory
+// state without the read lock, but still installs what it writes
+func (c *Collection) lockAll() func() {
+	c.writers.Lock()
+	return c.writers.Unlock
+}
+
+// stored returns a stored document, under the read lock
+func (c *Collection) stored(id string) (map[string]interface{}, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.documents.get(id)
+}
+
+// install applies document records that have been persisted to memory, all
+// at once as far as readers can tell, adding them to changes for the watches
+// (see Watch)
+// Caller must have locked the documents (see lockDocument and lockAll), and
+// delivers changes once it has unlocked them, so watches may read and
+// snapshot the database
+func (c *Collection) install(changes *changeSet, records ...StorageRecord) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, record := range records {
+		changes.add(c, record)
+		c.applyRecord(record)
+	}
+}
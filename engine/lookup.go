@@ -0,0 +1,126 @@
+package engine
+
+import "fmt"
+
+// lookupSpec describes a $lookup stage, which joins documents from another collection:
+//
+//	{"$lookup": {"from": "orders", "localField": "id", "foreignField": "userId", "as": "orders"}}
+//
+// Each input document gets an "as" array holding every document in "from"
+// whose foreignField equals its localField. Array values on either side match
+// if any element does, and documents without localField get an empty array
+// Fields may use dot notation; a missing "from" collection joins nothing
+type lookupSpec struct {
+	from         string      // Collection to join
+	localField   string      // Field of the input documents
+	foreignField string      // Field of the joined documents
+	as           string      // Output array field
+	foreign      *Collection // Resolved "from" collection (nil if it doesn't exist)
+}
+
+// parseLookup parses a $lookup specification
+func parseLookup(spec map[string]interface{}) (*lookupSpec, error) {
+	lookup := &lookupSpec{}
+	for _, field := range []struct {
+		name string
+		dst  *string
+	}{
+		{"from", &lookup.from},
+		{"localField", &lookup.localField},
+		{"foreignField", &lookup.foreignField},
+		{"as", &lookup.as},
+	} {
+		value, ok := spec[field.name].(string)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("%s must be a non-empty string", field.name)
+		}
+		*field.dst = value
+	}
+
+	for key := range spec {
+		switch key {
+		case "from", "localField", "foreignField", "as":
+		default:
+			return nil, fmt.Errorf("unknown field %s", key)
+		}
+	}
+	return lookup, nil
+}
+
+// collectionSource looks up the collections a $lookup joins: a Database, or
+// the Snapshot a frozen collection was taken in
+type collectionSource interface {
+	existingCollection(name string) (*Collection, error)
+}
+
+// resolve finds the joined collection without creating it
+func (l *lookupSpec) resolve(source collectionSource) error {
+	if source == nil {
+		return fmt.Errorf("the collection doesn't belong to a database")
+	}
+
+	foreign, err := source.existingCollection(l.from)
+	if err != nil {
+		return err
+	}
+	l.foreign = foreign
+	return nil
+}
+
+// run joins the foreign documents onto each input document
+// The foreign collection is scanned once and indexed by foreignField, so the
+// join costs one pass over each side rather than one scan per document
+func (l *lookupSpec) run(docs []map[string]interface{}) []map[string]interface{} {
+	var foreignDocs []map[string]interface{}
+	byKey := make(map[string][]int) // Join key -> positions in foreignDocs
+	if l.foreign != nil {
+		for _, doc := range l.foreign.snapshot().all() {
+			value, exists := lookupPath(doc, l.foreignField)
+			if !exists {
+				continue
+			}
+			for _, key := range lookupKeys(value) {
+				byKey[key] = append(byKey[key], len(foreignDocs))
+			}
+			foreignDocs = append(foreignDocs, doc)
+		}
+	}
+
+	joined := make([]map[string]interface{}, len(docs))
+	for i, doc := range docs {
+		matches := make([]interface{}, 0)
+		if value, exists := lookupPath(doc, l.localField); exists {
+			seen := make(map[int]bool)
+			for _, key := range lookupKeys(value) {
+				for _, pos := range byKey[key] {
+					// Array values can share several keys; join each document once
+					if !seen[pos] {
+						seen[pos] = true
+						matches = append(matches, foreignDocs[pos])
+					}
+				}
+			}
+		}
+
+		// Join onto a shallow copy so stored documents are left untouched
+		out := make(map[string]interface{}, len(doc)+1)
+		for k, v := range doc {
+			out[k] = v
+		}
+		out[l.as] = matches
+		joined[i] = out
+	}
+	return joined
+}
+
+// lookupKeys returns the join keys for a value: one per element for arrays
+func lookupKeys(value interface{}) []string {
+	if arr, isArray := value.([]interface{}); isArray {
+		keys := make([]string, len(arr))
+		for i, elem := range arr {
+			keys[i] = groupHash(elem)
+		}
+		return keys
+	}
+	return []string{groupHash(value)}
+}
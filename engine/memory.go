@@ -0,0 +1,256 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryPath opens an in-memory database with OpenDatabase, the same as
+// WithEphemeral
+const MemoryPath = ":memory:"
+
+// MemoryStorage is a StorageEngine that keeps the log in memory and never
+// touches the filesystem; everything is lost when the database is closed
+// Records are held encoded, as the file would hold them, so later changes
+// to a document never rewrite the history ReadSince returns
+type MemoryStorage struct {
+	mu      sync.Mutex
+	log     [][]byte         // Encoded records in log order
+	seq     uint64           // Sequence number of the latest record
+	tail    StorageRecord    // Latest record, kept so compaction never loses the sequence
+	size    int64            // Bytes in the log
+	maxSize int64            // Writes that would grow the log past this are refused (see SetMaxSize); 0 means no limit
+	usage   *diskUsage       // Sizes of the records in the log, live or superseded
+	onWrite func(size int64) // Called after every successful write with the new size
+
+	compacted time.Time // When Compact last discarded superseded records
+}
+
+// NewMemoryStorage creates an empty in-memory log
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{usage: newDiskUsage()}
+}
+
+// NewMemoryStorageFrom creates an in-memory log holding records that were
+// persisted elsewhere, e.g. by a backend that keeps a copy of the log in
+// memory. The records keep their sequence numbers, and sequencing resumes
+// after the newest
+func NewMemoryStorageFrom(records []StorageRecord) (*MemoryStorage, error) {
+	m := NewMemoryStorage()
+	sorted := append([]StorageRecord(nil), records...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Seq < sorted[j].Seq })
+	for _, record := range sorted {
+		if err := m.add(record); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Append adds a record to the log and returns its sequence number
+func (m *MemoryStorage) Append(record StorageRecord) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	record.Seq = m.seq + 1
+	data, err := json.Marshal(record)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal record: %w", err)
+	}
+	if err := CheckFileSize([]StorageRecord{record}, m.size, int64(len(data)), m.maxSize); err != nil {
+		return 0, err
+	}
+	m.push(data, record)
+	m.notify()
+	return record.Seq, nil
+}
+
+// AppendBatch adds several records to the log
+// Each record's Seq field is set in place to the sequence number it was assigned
+func (m *MemoryStorage) AppendBatch(records []StorageRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Encode everything up front so a marshal failure adds nothing
+	encoded := make([][]byte, len(records))
+	var written int64
+	for i := range records {
+		records[i].Seq = m.seq + uint64(i) + 1
+		data, err := json.Marshal(records[i])
+		if err != nil {
+			return fmt.Errorf("failed to marshal record: %w", err)
+		}
+		encoded[i] = data
+		written += int64(len(data))
+	}
+	if err := CheckFileSize(records, m.size, written, m.maxSize); err != nil {
+		return err
+	}
+	for i, data := range encoded {
+		m.push(data, records[i])
+	}
+	m.notify()
+	return nil
+}
+
+// add encodes a record and appends it to the log
+// Caller must hold the lock
+func (m *MemoryStorage) add(record StorageRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+	m.push(data, record)
+	return nil
+}
+
+// push appends an encoded record and accounts for it
+// Caller must hold the lock
+func (m *MemoryStorage) push(data []byte, record StorageRecord) {
+	m.log = append(m.log, data)
+	m.size += int64(len(data))
+	m.usage.add(record, int64(len(data)))
+	m.seq = record.Seq
+	m.tail = record
+}
+
+// notify reports the new size to the write hook
+// Caller must hold the lock
+func (m *MemoryStorage) notify() {
+	if m.onWrite != nil {
+		m.onWrite(m.size)
+	}
+}
+
+// LoadAll returns every record in the log
+func (m *MemoryStorage) LoadAll() ([]StorageRecord, error) {
+	return m.ReadSince(0)
+}
+
+// ReadSince returns every record with a sequence number greater than seq
+func (m *MemoryStorage) ReadSince(seq uint64) ([]StorageRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var records []StorageRecord
+	for _, data := range m.log {
+		var record StorageRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, fmt.Errorf("failed to parse record: %w", err)
+		}
+		if record.Seq > seq {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// CurrentSequence returns the sequence number of the latest record
+func (m *MemoryStorage) CurrentSequence() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.seq
+}
+
+// Compact replaces the log with the given records, in sequence order
+func (m *MemoryStorage) Compact(records []StorageRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Seq < records[j].Seq })
+
+	// If the newest record is a deletion, keep it so the sequence carries on
+	if m.tail.Seq > 0 && (len(records) == 0 || records[len(records)-1].Seq < m.tail.Seq) {
+		records = append(records, m.tail)
+	}
+
+	log := make([][]byte, 0, len(records))
+	var size int64
+	usage := newDiskUsage()
+	for _, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to marshal record: %w", err)
+		}
+		log = append(log, data)
+		size += int64(len(data))
+		usage.add(record, int64(len(data)))
+	}
+	m.log, m.size, m.usage = log, size, usage
+	m.compacted = time.Now()
+	return nil
+}
+
+// CompactedAt returns when Compact last discarded superseded records, or
+// the zero time if the log holds its whole history
+func (m *MemoryStorage) CompactedAt() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.compacted
+}
+
+// Sync does nothing: there is nothing durable to flush to
+func (m *MemoryStorage) Sync() error {
+	return nil
+}
+
+// Close discards the log
+func (m *MemoryStorage) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.log, m.size, m.usage = nil, 0, newDiskUsage()
+	return nil
+}
+
+// SetWriteHook installs a function called after every successful write with
+// the new size of the log, while the storage lock is held
+func (m *MemoryStorage) SetWriteHook(hook func(size int64)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.onWrite = hook
+}
+
+// SetMaxSize makes writes that would grow the log past max bytes fail with
+// a LimitError (see Limits.MaxFileBytes); 0 removes the limit
+func (m *MemoryStorage) SetMaxSize(max int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.maxSize = max
+}
+
+// Size returns the bytes the log takes up, encoded
+func (m *MemoryStorage) Size() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.size
+}
+
+// RecordCounts returns how many records each collection has in the log,
+// counting superseded versions and deletions as well as live documents
+func (m *MemoryStorage) RecordCounts() map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.usage.recordCounts()
+}
+
+// DiskUsage reports how much of the log compaction would free
+func (m *MemoryStorage) DiskUsage() DiskUsage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.usage.report(m.size, m.compacted)
+}
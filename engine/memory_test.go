@@ -0,0 +1,157 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenInMemory(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		path string
+		opts []Option
+	}{
+		{"memory path", MemoryPath, nil},
+		{"ephemeral option", filepath.Join(dir, "ignored.db"), []Option{WithEphemeral()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := OpenDatabase(tt.path, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := db.storage.(*MemoryStorage); !ok {
+				t.Fatalf("got storage %T, want *MemoryStorage", db.storage)
+			}
+
+			coll := db.GetCollection("docs")
+			id, err := coll.Insert(map[string]interface{}{"n": 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := coll.Insert(map[string]interface{}{"n": 2}); err != nil {
+				t.Fatal(err)
+			}
+			if err := coll.Update(id, map[string]interface{}{"n": 10}); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Compact(); err != nil {
+				t.Fatal(err)
+			}
+			if got := len(coll.Find(map[string]interface{}{"n": 10})); got != 1 {
+				t.Fatalf("got %d updated documents, want 1", got)
+			}
+			if got := coll.Count(); got != 2 {
+				t.Fatalf("got %d documents, want 2", got)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Nothing reached the disk, so opening again starts empty
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Fatalf("in-memory database wrote %v", entries)
+			}
+			if _, err := os.Stat(MemoryPath); !os.IsNotExist(err) {
+				t.Fatalf("in-memory database created %q", MemoryPath)
+			}
+			db, err = OpenDatabase(tt.path, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if got := db.GetCollection("docs").Count(); got != 0 {
+				t.Fatalf("reopened database has %d documents, want 0", got)
+			}
+		})
+	}
+}
+
+func TestOpenInMemoryRejectsFileOptions(t *testing.T) {
+	if db, err := OpenDatabase(MemoryPath, WithStorageFormat(FormatBinary)); err == nil {
+		db.Close()
+		t.Fatal("expected an error for a storage format the memory backend can't honour")
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	m := NewMemoryStorage()
+	var sizes []int64
+	m.SetWriteHook(func(size int64) { sizes = append(sizes, size) })
+
+	doc := map[string]interface{}{"n": 1}
+	for _, id := range []string{"a", "b"} {
+		if _, err := m.Append(StorageRecord{Collection: "c", ID: id, Doc: doc}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batch := []StorageRecord{{Collection: "c", ID: "a", Op: OpDelete}, {Collection: "d", ID: "x", Doc: doc}}
+	if err := m.AppendBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	if batch[0].Seq != 3 || batch[1].Seq != 4 {
+		t.Fatalf("got batch sequences %d and %d, want 3 and 4", batch[0].Seq, batch[1].Seq)
+	}
+
+	// A stored record is a copy: changing the document afterwards leaves the
+	// history alone
+	doc["n"] = 99
+
+	tests := []struct {
+		name  string
+		since uint64
+		want  []string
+	}{
+		{"everything", 0, []string{"a", "b", "a", "x"}},
+		{"after the first", 1, []string{"b", "a", "x"}},
+		{"after the last", 4, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := m.ReadSince(tt.since)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != len(tt.want) {
+				t.Fatalf("got %d records, want %d", len(records), len(tt.want))
+			}
+			for i, record := range records {
+				if record.ID != tt.want[i] || record.Seq != tt.since+uint64(i)+1 {
+					t.Errorf("record %d: got %s at %d, want %s at %d", i, record.ID, record.Seq, tt.want[i], tt.since+uint64(i)+1)
+				}
+				if n, _ := toFloat64(record.Doc["n"]); record.Doc != nil && n != 1 {
+					t.Errorf("record %d: got n=%v, want the value when it was written", i, record.Doc["n"])
+				}
+			}
+		})
+	}
+
+	if len(sizes) != 3 || sizes[2] != m.Size() {
+		t.Fatalf("write hook saw sizes %v, want three ending at %d", sizes, m.Size())
+	}
+	if counts := m.RecordCounts(); counts["c"] != 3 || counts["d"] != 1 {
+		t.Fatalf("got record counts %v", counts)
+	}
+
+	// Compacting to the live records keeps the sequence going even though
+	// the newest live record is older than the log's tail
+	if err := m.Compact([]StorageRecord{{Collection: "c", ID: "b", Seq: 2, Doc: doc}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.CurrentSequence(); got != 4 {
+		t.Fatalf("got sequence %d after compaction, want 4", got)
+	}
+	seq, err := m.Append(StorageRecord{Collection: "c", ID: "c", Doc: doc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 5 {
+		t.Fatalf("got sequence %d after compaction, want 5", seq)
+	}
+}
@@ -0,0 +1,98 @@
+package engine
+
+import "sort"
+
+// MemoryUsage estimates the memory a database's loaded collections hold, so
+// an application on a constrained device can watch or cap its footprint
+type MemoryUsage struct {
+	Documents   int                         `json:"documents"`                      // Live documents in the loaded collections
+	Bytes       int64                       `json:"bytes"`                          // Estimated total of the collections below
+	Collections map[string]CollectionMemory `json:"collections"`                    // Estimates per loaded collection
+	Unloaded    []string                    `json:"unloaded_collections,omitempty"` // Collections lazy loading left on disk, which hold none
+}
+
+// CollectionMemory is the memory a collection is estimated to hold
+type CollectionMemory struct {
+	Documents       int   `json:"documents"`        // Live documents
+	DocumentBytes   int64 `json:"document_bytes"`   // Their fields and values, and their IDs and bookkeeping
+	IndexBytes      int64 `json:"index_bytes"`      // Its indexes, as ListIndexes reports them
+	AttachmentBytes int64 `json:"attachment_bytes"` // The chunks of its documents' attachments
+	Bytes           int64 `json:"bytes"`            // The sum of the above
+}
+
+// Approximate sizes of a value held in an interface (its header and a word
+// of data) and of a slice header, for the document estimates
+const (
+	valueBytes       = 16
+	sliceHeaderBytes = 24
+)
+
+// MemoryUsage estimates the memory each loaded collection holds by walking
+// its documents, so it takes time in proportion to the data; the estimates
+// are rough, like those of ListIndexes, and leave out the runtime's own
+// overhead (see runtime.ReadMemStats for the heap as a whole)
+func (db *Database) MemoryUsage() MemoryUsage {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	usage := MemoryUsage{Collections: make(map[string]CollectionMemory, len(db.collections))}
+	for name, coll := range db.collections {
+		memory := coll.memoryUsage()
+		usage.Collections[name] = memory
+		usage.Documents += memory.Documents
+		usage.Bytes += memory.Bytes
+	}
+	for name := range db.pending {
+		usage.Unloaded = append(usage.Unloaded, name)
+	}
+	sort.Strings(usage.Unloaded)
+	return usage
+}
+
+// memoryUsage estimates the memory the collection holds
+func (c *Collection) memoryUsage() CollectionMemory {
+	indexes := c.ListIndexes()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	memory := CollectionMemory{Documents: c.documents.len()}
+	for id, doc := range c.documents.all() {
+		// The document's slot in the store and in the seqs and times maps
+		memory.DocumentBytes += 3*mapSlotBytes + int64(len(id)) + estimateBytes(doc)
+	}
+	for _, index := range indexes {
+		memory.IndexBytes += int64(index.MemoryBytes)
+	}
+	for id, named := range c.attachments {
+		memory.AttachmentBytes += mapSlotBytes + int64(len(id))
+		for name, a := range named {
+			memory.AttachmentBytes += mapSlotBytes + int64(len(name)) + a.size + int64(len(a.parts))*sliceHeaderBytes
+		}
+	}
+	memory.Bytes = memory.DocumentBytes + memory.IndexBytes + memory.AttachmentBytes
+	return memory
+}
+
+// estimateBytes estimates the memory a document value holds, walking into
+// objects and arrays
+func estimateBytes(value interface{}) int64 {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		bytes := int64(valueBytes)
+		for key, field := range v {
+			bytes += mapSlotBytes + int64(len(key)) + estimateBytes(field)
+		}
+		return bytes
+	case []interface{}:
+		bytes := int64(valueBytes + sliceHeaderBytes)
+		for _, element := range v {
+			bytes += estimateBytes(element)
+		}
+		return bytes
+	case string:
+		return stringHeaderBytes + int64(len(v))
+	default:
+		return valueBytes
+	}
+}
@@ -0,0 +1,96 @@
+package engine
+
+import "time"
+
+// latencyBucketCount is the number of fixed histogram buckets
+// Bucket i covers durations up to 1µs * 2^i, so the last bucket tops out around 16s
+// Anything slower lands in the overflow bucket
+const latencyBucketCount = 25
+
+// latencyHistogram is a fixed-bucket histogram of operation durations
+// It uses a fixed-size array so recording a sample never allocates
+// It is not safe for concurrent use; callers must hold their own lock
+type latencyHistogram struct {
+	buckets [latencyBucketCount + 1]uint64 // Last slot is the overflow bucket
+	count   uint64                         // Total number of samples
+	max     time.Duration                  // Slowest sample seen, used for the overflow bucket
+}
+
+// LatencySnapshot is a point-in-time summary of a latency histogram
+type LatencySnapshot struct {
+	Count uint64        // Number of recorded samples
+	P50   time.Duration // Median latency
+	P95   time.Duration // 95th percentile latency
+	P99   time.Duration // 99th percentile latency
+	Max   time.Duration // Slowest recorded latency
+}
+
+// latencyBucketBound returns the inclusive upper bound of bucket i
+func latencyBucketBound(i int) time.Duration {
+	return time.Microsecond << uint(i)
+}
+
+// Observe records a single duration
+func (h *latencyHistogram) Observe(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+
+	idx := latencyBucketCount // Overflow by default
+	for i := 0; i < latencyBucketCount; i++ {
+		if d <= latencyBucketBound(i) {
+			idx = i
+			break
+		}
+	}
+
+	h.buckets[idx]++
+	h.count++
+	if d > h.max {
+		h.max = d
+	}
+}
+
+// Percentile returns the upper bound of the bucket containing the p-th percentile
+// p is a fraction between 0 and 1 (e.g. 0.95). Returns 0 if nothing was recorded
+func (h *latencyHistogram) Percentile(p float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+
+	// Rank of the sample we are looking for (1-based, rounded up)
+	rank := uint64(p * float64(h.count))
+	if float64(rank) < p*float64(h.count) {
+		rank++
+	}
+	if rank < 1 {
+		rank = 1
+	}
+
+	var cumulative uint64
+	for i := 0; i < latencyBucketCount; i++ {
+		cumulative += h.buckets[i]
+		if cumulative >= rank {
+			bound := latencyBucketBound(i)
+			// Never report more than the slowest sample actually seen
+			if bound > h.max {
+				return h.max
+			}
+			return bound
+		}
+	}
+
+	// The percentile falls into the overflow bucket
+	return h.max
+}
+
+// Snapshot summarizes the histogram
+func (h *latencyHistogram) Snapshot() LatencySnapshot {
+	return LatencySnapshot{
+		Count: h.count,
+		P50:   h.Percentile(0.50),
+		P95:   h.Percentile(0.95),
+		P99:   h.Percentile(0.99),
+		Max:   h.max,
+	}
+}
@@ -0,0 +1,146 @@
+package engine
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogramPercentiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples map[time.Duration]int // Duration -> how many times it is observed
+		want    LatencySnapshot
+	}{
+		{
+			name: "empty",
+			want: LatencySnapshot{},
+		},
+		{
+			name:    "single sample reports it, not its bucket bound",
+			samples: map[time.Duration]int{3 * time.Microsecond: 1},
+			want:    LatencySnapshot{Count: 1, P50: 3 * time.Microsecond, P95: 3 * time.Microsecond, P99: 3 * time.Microsecond, Max: 3 * time.Microsecond},
+		},
+		{
+			name: "bucket bounds",
+			samples: map[time.Duration]int{
+				time.Microsecond:       50, // Bucket 0, up to 1µs
+				100 * time.Microsecond: 45, // Bucket 7, up to 128µs
+				time.Millisecond:       4,  // Bucket 10, up to 1024µs
+				10 * time.Millisecond:  1,  // Bucket 14, up to 16384µs
+			},
+			want: LatencySnapshot{Count: 100, P50: time.Microsecond, P95: 128 * time.Microsecond, P99: 1024 * time.Microsecond, Max: 10 * time.Millisecond},
+		},
+		{
+			name:    "overflow reports the slowest sample",
+			samples: map[time.Duration]int{time.Minute: 2, time.Microsecond: 98},
+			want:    LatencySnapshot{Count: 100, P50: time.Microsecond, P95: time.Microsecond, P99: time.Minute, Max: time.Minute},
+		},
+		{
+			name:    "negative durations count as zero",
+			samples: map[time.Duration]int{-time.Second: 1},
+			want:    LatencySnapshot{Count: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h latencyHistogram
+			for d, n := range tt.samples {
+				for i := 0; i < n; i++ {
+					h.Observe(d)
+				}
+			}
+			if got := h.Snapshot(); got != tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLatencyHistogramObserveDoesNotAllocate(t *testing.T) {
+	var h latencyHistogram
+	if allocs := testing.AllocsPerRun(100, func() { h.Observe(time.Millisecond) }); allocs != 0 {
+		t.Fatalf("Observe allocated %v times per call", allocs)
+	}
+}
+
+// stepClock times the Appends of a Storage: every second reading advances
+// it by the next of durations, so each Append takes exactly that long
+type stepClock struct {
+	now       time.Time
+	durations []time.Duration
+	readings  int
+}
+
+func (c *stepClock) read() time.Time {
+	if c.readings%2 == 1 && len(c.durations) > 0 {
+		c.now = c.now.Add(c.durations[0])
+		c.durations = c.durations[1:]
+	}
+	c.readings++
+	return c.now
+}
+
+func TestStorageWriteLatency(t *testing.T) {
+	s, err := NewStorage(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, enabled := s.WriteLatency(); enabled {
+		t.Fatal("latency tracking is enabled before EnableLatencyTracking")
+	}
+	s.EnableLatencyTracking()
+
+	var durations []time.Duration
+	for i := 0; i < 90; i++ {
+		durations = append(durations, 10*time.Microsecond)
+	}
+	for i := 0; i < 9; i++ {
+		durations = append(durations, 2*time.Millisecond)
+	}
+	durations = append(durations, 50*time.Millisecond)
+	clock := &stepClock{now: time.Unix(0, 0), durations: durations}
+	s.now = clock.read
+
+	for i := 0; i < 99; i++ {
+		if _, err := s.Append(StorageRecord{Collection: "c", ID: "x", Doc: map[string]interface{}{"i": i}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The last write goes through AppendBatch, which is timed the same way
+	if err := s.AppendBatch([]StorageRecord{{Collection: "c", ID: "y", Doc: map[string]interface{}{}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, enabled := s.WriteLatency()
+	want := LatencySnapshot{Count: 100, P50: 16 * time.Microsecond, P95: 2048 * time.Microsecond, P99: 2048 * time.Microsecond, Max: 50 * time.Millisecond}
+	if !enabled || got != want {
+		t.Fatalf("got %+v (enabled %v), want %+v", got, enabled, want)
+	}
+}
+
+func TestStatsWriteLatency(t *testing.T) {
+	db := openTestDatabase(t, WithWriteLatencyTracking())
+	clock := &stepClock{now: time.Unix(0, 0), durations: []time.Duration{
+		5 * time.Microsecond, 5 * time.Microsecond, 5 * time.Microsecond, 300 * time.Microsecond,
+	}}
+	db.storage.(*Storage).now = clock.read
+
+	coll := db.GetCollection("docs")
+	for i := 0; i < 4; i++ {
+		if _, err := coll.Insert(map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, ok := db.Stats()["write_latency"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("Stats has no write_latency: %v", db.Stats())
+	}
+	want := map[string]interface{}{"count": uint64(4), "p50_us": int64(8), "p95_us": int64(300), "p99_us": int64(300), "max_us": int64(300)}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s: got %v (%T), want %v", key, got[key], got[key], value)
+		}
+	}
+}
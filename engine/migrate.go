@@ -0,0 +1,147 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// StorageVersion is the version of the storage file layout this engine
+// writes, recorded in the header record that opens every file
+// Version 1 files, written before versions existed, have no header record
+const StorageVersion = 2
+
+// FileHeader is the content of the header record that opens a storage file
+type FileHeader struct {
+	Version   int   `json:"version"`             // Storage version of the file (see StorageVersion)
+	Compacted int64 `json:"compacted,omitempty"` // When superseded records were last discarded, in Unix nanoseconds; the history before is incomplete
+}
+
+// MigrationInfo describes an upgrade of an older storage file that was made
+// when the file was loaded
+type MigrationInfo struct {
+	From   int       `json:"from"`   // Storage version the file had
+	To     int       `json:"to"`     // Storage version it was upgraded to
+	Backup string    `json:"backup"` // Copy of the file as it was before the upgrade
+	Time   time.Time `json:"time"`   // When the upgrade happened
+}
+
+// migration upgrades the records of a file from the storage version before
+// to, to to. Files are rewritten after migrating, with the new header record
+type migration struct {
+	to    int
+	apply func(records []StorageRecord) ([]StorageRecord, error) // nil if the records are unchanged
+}
+
+// migrations are the upgrades between storage versions, in order
+// A change to the file layout bumps StorageVersion and adds one here, so
+// files written by older engines are upgraded rather than stranded
+var migrations = []migration{
+	// Version 2 adds the header record, which the rewrite writes
+	{to: 2},
+}
+
+// migrate upgrades records from storage version from to StorageVersion
+func migrate(records []StorageRecord, from int) ([]StorageRecord, error) {
+	for _, m := range migrations {
+		if m.to <= from || m.apply == nil {
+			continue
+		}
+		var err error
+		if records, err = m.apply(records); err != nil {
+			return nil, fmt.Errorf("failed to migrate records to storage version %d: %w", m.to, err)
+		}
+	}
+	return records, nil
+}
+
+// checkVersion refuses files written by a newer engine
+func checkVersion(version int) error {
+	if version > StorageVersion {
+		return fmt.Errorf("storage file has version %d, newer than version %d this engine reads; upgrade tetodb to open it", version, StorageVersion)
+	}
+	return nil
+}
+
+// headerRecord returns the record that opens files this engine writes
+func headerRecord(header FileHeader) StorageRecord {
+	return StorageRecord{Header: &header}
+}
+
+// backupPath returns where a file is copied before being upgraded from version
+func backupPath(path string, version int) string {
+	return fmt.Sprintf("%s.v%d.bak", path, version)
+}
+
+// backupFile copies the file at path to backup and syncs the copy
+func backupFile(path, backup string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open file to back up: %w", err)
+	}
+	defer src.Close()
+
+	dst, err := os.Create(backup)
+	if err != nil {
+		return fmt.Errorf("failed to create backup file: %w", err)
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return fmt.Errorf("failed to write backup file: %w", err)
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return fmt.Errorf("failed to sync backup file: %w", err)
+	}
+	return dst.Close()
+}
+
+// upgrade migrates the records loaded from an older file and rewrites the
+// file (and snapshot) in the current version, after backing them up
+// Records keep their sequence numbers, superseded versions included, so the
+// history ReadSince returns survives
+// Caller must hold the lock
+func (s *Storage) upgrade(records []StorageRecord) ([]StorageRecord, error) {
+	from := s.version
+	migrated, err := migrate(records, from)
+	if err != nil {
+		return nil, err
+	}
+
+	backup := backupPath(s.filePath, from)
+	if err := backupFile(s.filePath, backup); err != nil {
+		return nil, err
+	}
+	if s.snapshotted {
+		if err := backupFile(snapshotPath(s.filePath), backupPath(snapshotPath(s.filePath), from)); err != nil {
+			return nil, err
+		}
+		// The snapshot and log are rewritten together as a checkpoint
+		if err := s.checkpoint(migrated); err != nil {
+			return nil, err
+		}
+	} else {
+		size, usage, err := s.rewriteLog(s.withTail(migrated))
+		if err != nil {
+			return nil, err
+		}
+		s.size, s.usage, s.walRecords = size, usage, len(migrated)
+	}
+
+	s.version = StorageVersion
+	s.migration = &MigrationInfo{From: from, To: StorageVersion, Backup: backup, Time: time.Now()}
+	fmt.Printf("Migrated %s from storage version %d to %d (backup at %s)\n", s.filePath, from, StorageVersion, backup)
+	return migrated, nil
+}
+
+// Migration reports the upgrade LoadAll made to an older file, if any
+func (s *Storage) Migration() (MigrationInfo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.migration == nil {
+		return MigrationInfo{}, false
+	}
+	return *s.migration, true
+}
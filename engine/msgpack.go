@@ -0,0 +1,316 @@
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// MessagePack encoding of record payloads (see CodecMessagePack), covering
+// the types records hold; extension types are refused
+
+// msgpackEncoder builds a MessagePack payload
+type msgpackEncoder struct {
+	buf []byte
+}
+
+func (e *msgpackEncoder) bytes() []byte { return e.buf }
+
+func (e *msgpackEncoder) null() { e.buf = append(e.buf, 0xc0) }
+
+func (e *msgpackEncoder) boolean(b bool) {
+	if b {
+		e.buf = append(e.buf, 0xc3)
+	} else {
+		e.buf = append(e.buf, 0xc2)
+	}
+}
+
+func (e *msgpackEncoder) integer(n int64) {
+	switch {
+	case n >= 0 && n < 128:
+		e.buf = append(e.buf, byte(n)) // Positive fixint
+	case n < 0 && n >= -32:
+		e.buf = append(e.buf, byte(n)) // Negative fixint
+	case n > 0 && n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xcc, byte(n))
+	case n > 0 && n <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, 0xcd), uint16(n))
+	case n > 0 && n <= math.MaxUint32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xce), uint32(n))
+	case n > 0:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xcf), uint64(n))
+	case n >= math.MinInt8:
+		e.buf = append(e.buf, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, 0xd1), uint16(n))
+	case n >= math.MinInt32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xd2), uint32(n))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xd3), uint64(n))
+	}
+}
+
+func (e *msgpackEncoder) float(f float64) {
+	e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xcb), math.Float64bits(f))
+}
+
+func (e *msgpackEncoder) text(s string) {
+	if len(s) < 32 {
+		e.buf = append(e.buf, 0xa0|byte(len(s))) // Fixstr
+	} else {
+		e.sized(len(s), 0xd9, 0xda, 0xdb)
+	}
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) blob(b []byte) {
+	e.sized(len(b), 0xc4, 0xc5, 0xc6)
+	e.buf = append(e.buf, b...)
+}
+
+func (e *msgpackEncoder) arrayHeader(n int) {
+	if n < 16 {
+		e.buf = append(e.buf, 0x90|byte(n)) // Fixarray
+		return
+	}
+	e.sized(n, 0, 0xdc, 0xdd)
+}
+
+func (e *msgpackEncoder) mapHeader(n int) {
+	if n < 16 {
+		e.buf = append(e.buf, 0x80|byte(n)) // Fixmap
+		return
+	}
+	e.sized(n, 0, 0xde, 0xdf)
+}
+
+// sized writes the type byte and length of a string, binary data, array or
+// map, in its 8-, 16- or 32-bit form; arrays and maps have no 8-bit form
+func (e *msgpackEncoder) sized(n int, t8, t16, t32 byte) {
+	switch {
+	case n <= math.MaxUint8 && t8 != 0:
+		e.buf = append(e.buf, t8, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, t16), uint16(n))
+	default:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, t32), uint32(n))
+	}
+}
+
+// msgpackDecoder reads a MessagePack payload
+type msgpackDecoder struct {
+	payloadCursor
+}
+
+func (d *msgpackDecoder) isNull() bool {
+	b, err := d.peek()
+	return err == nil && b == 0xc0
+}
+
+// head reads a type byte and, for strings, binary data, arrays and maps,
+// their length; other types come back with their value still unread
+func (d *msgpackDecoder) head() (byte, uint64, error) {
+	b, err := d.take(1)
+	if err != nil {
+		return 0, 0, err
+	}
+	t := b[0]
+	var size uint64 // Bytes of the length field that follows the type
+	switch {
+	case t <= 0x7f || t >= 0xe0:
+		return t, 0, nil
+	case t >= 0x80 && t <= 0x8f, t >= 0x90 && t <= 0x9f:
+		return t, uint64(t & 0x0f), nil
+	case t >= 0xa0 && t <= 0xbf:
+		return t, uint64(t & 0x1f), nil
+	case t == 0xc4, t == 0xd9:
+		size = 1
+	case t == 0xc5, t == 0xda, t == 0xdc, t == 0xde:
+		size = 2
+	case t == 0xc6, t == 0xdb, t == 0xdd, t == 0xdf:
+		size = 4
+	default:
+		return t, 0, nil
+	}
+	field, err := d.take(size)
+	if err != nil {
+		return 0, 0, err
+	}
+	var n uint64
+	for _, b := range field {
+		n = n<<8 | uint64(b)
+	}
+	return t, n, nil
+}
+
+func (d *msgpackDecoder) mapHeader() (int, error) {
+	t, n, err := d.head()
+	if err != nil {
+		return 0, err
+	}
+	if !(t >= 0x80 && t <= 0x8f) && t != 0xde && t != 0xdf {
+		return 0, fmt.Errorf("expected a map, found type %#x", t)
+	}
+	return d.checkLength(n)
+}
+
+func (d *msgpackDecoder) text() (string, error) {
+	t, n, err := d.head()
+	if err != nil {
+		return "", err
+	}
+	if t == 0xc0 {
+		return "", nil
+	}
+	if !(t >= 0xa0 && t <= 0xbf) && t != 0xd9 && t != 0xda && t != 0xdb {
+		return "", fmt.Errorf("expected a string, found type %#x", t)
+	}
+	b, err := d.take(n)
+	return string(b), err
+}
+
+func (d *msgpackDecoder) blob() ([]byte, error) {
+	t, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	if t != 0xc4 && t != 0xc5 && t != 0xc6 {
+		return nil, fmt.Errorf("expected binary data, found type %#x", t)
+	}
+	return d.take(n)
+}
+
+func (d *msgpackDecoder) integer() (int64, error) {
+	v, err := d.number()
+	if err != nil {
+		return 0, err
+	}
+	switch v := v.(type) {
+	case int64:
+		return v, nil
+	case uint64:
+		if v <= math.MaxInt64 {
+			return int64(v), nil
+		}
+	}
+	return 0, fmt.Errorf("expected an integer, found %v", v)
+}
+
+// msgpackNumberSizes are the bytes that follow each number type
+var msgpackNumberSizes = map[byte]uint64{0xca: 4, 0xcb: 8, 0xcc: 1, 0xcd: 2, 0xce: 4, 0xcf: 8, 0xd0: 1, 0xd1: 2, 0xd2: 4, 0xd3: 8}
+
+// number reads an integer, exactly as int64 (or uint64 above its range), or a float
+func (d *msgpackDecoder) number() (interface{}, error) {
+	t, _, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	if t <= 0x7f {
+		return int64(t), nil
+	}
+	if t >= 0xe0 {
+		return int64(int8(t)), nil
+	}
+
+	size, ok := msgpackNumberSizes[t]
+	if !ok {
+		return nil, fmt.Errorf("expected a number, found type %#x", t)
+	}
+	b, err := d.take(size)
+	if err != nil {
+		return nil, err
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	switch t {
+	case 0xca:
+		return float64(math.Float32frombits(uint32(n))), nil
+	case 0xcb:
+		return math.Float64frombits(n), nil
+	case 0xcf:
+		if n > math.MaxInt64 {
+			return n, nil
+		}
+		return int64(n), nil
+	case 0xd0:
+		return int64(int8(n)), nil
+	case 0xd1:
+		return int64(int16(n)), nil
+	case 0xd2:
+		return int64(int32(n)), nil
+	case 0xd3:
+		return int64(n), nil
+	}
+	return int64(n), nil
+}
+
+func (d *msgpackDecoder) value(depth int) (interface{}, error) {
+	if depth > maxValueDepth {
+		return nil, fmt.Errorf("payload nests more than %d levels deep", maxValueDepth)
+	}
+	t, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case t == 0xc0:
+		d.take(1)
+		return nil, nil
+	case t == 0xc2, t == 0xc3:
+		d.take(1)
+		return t == 0xc3, nil
+	case t <= 0x7f, t >= 0xe0, t >= 0xca && t <= 0xd3:
+		n, err := d.number()
+		if err != nil {
+			return nil, err
+		}
+		switch n := n.(type) {
+		case int64:
+			return float64(n), nil
+		case uint64:
+			return float64(n), nil
+		}
+		return n, nil
+	case t >= 0xa0 && t <= 0xbf, t == 0xd9, t == 0xda, t == 0xdb:
+		return d.text()
+	case t == 0xc4, t == 0xc5, t == 0xc6:
+		// Appears only in embedded fields; kept as bytes for a field this engine doesn't know
+		return d.blob()
+	case t >= 0x90 && t <= 0x9f, t == 0xdc, t == 0xdd:
+		_, n, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+		count, err := d.checkLength(n)
+		if err != nil {
+			return nil, err
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = d.value(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	case t >= 0x80 && t <= 0x8f, t == 0xde, t == 0xdf:
+		count, err := d.mapHeader()
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[string]interface{}, count)
+		for i := 0; i < count; i++ {
+			key, err := d.text()
+			if err != nil {
+				return nil, err
+			}
+			if m[key], err = d.value(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("unsupported MessagePack type %#x", t)
+}
@@ -0,0 +1,90 @@
+package engine
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrQueueClosed is returned when submitting to a closed OpQueue
+var ErrQueueClosed = errors.New("operation queue is closed")
+
+// OpQueue serializes operations so they run one at a time, in submission order
+// A single worker goroutine drains the queue, so an operation always observes
+// the effects of every operation submitted before it (read-your-writes)
+//
+// Operations must not submit to the same queue they are running on;
+// doing so would wait on itself and deadlock
+type OpQueue struct {
+	ops    chan queuedOp // Pending operations, drained by the worker
+	mu     sync.RWMutex  // Guards closed against concurrent Submit/Close
+	closed bool          // Set once Close has been called
+	done   chan struct{} // Closed when the worker has exited
+}
+
+// queuedOp is a single operation waiting in the queue
+type queuedOp struct {
+	fn   func()        // The operation to run
+	done chan struct{} // Closed after fn returns
+}
+
+// NewOpQueue creates a queue and starts its worker
+// size is the number of operations that can be pending before Submit blocks
+func NewOpQueue(size int) *OpQueue {
+	if size < 0 {
+		size = 0
+	}
+
+	q := &OpQueue{
+		ops:  make(chan queuedOp, size),
+		done: make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// run executes queued operations until the queue is closed
+func (q *OpQueue) run() {
+	defer close(q.done)
+
+	for op := range q.ops {
+		op.fn()
+		close(op.done)
+	}
+}
+
+// Submit enqueues an operation and returns a channel closed once it has run
+func (q *OpQueue) Submit(fn func()) (<-chan struct{}, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return nil, ErrQueueClosed
+	}
+
+	op := queuedOp{fn: fn, done: make(chan struct{})}
+	q.ops <- op
+	return op.done, nil
+}
+
+// Do enqueues an operation and waits for it to finish
+func (q *OpQueue) Do(fn func()) error {
+	done, err := q.Submit(fn)
+	if err != nil {
+		return err
+	}
+
+	<-done
+	return nil
+}
+
+// Close stops accepting operations and waits for pending ones to finish
+func (q *OpQueue) Close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.ops)
+	}
+	q.mu.Unlock()
+
+	<-q.done
+}
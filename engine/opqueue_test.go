@@ -0,0 +1,163 @@
+package engine
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOpQueueRunsInSubmissionOrder(t *testing.T) {
+	q := NewOpQueue(16)
+	defer q.Close()
+
+	// Each goroutine submits its ops in order; the queue must run every
+	// goroutine's ops in that order, one at a time
+	const goroutines, perGoroutine = 8, 200
+	var ran [goroutines][]int
+	var running, overlaps int
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < perGoroutine; i++ {
+				i := i
+				submit := q.Do
+				if i%2 == 0 {
+					submit = func(fn func()) error { _, err := q.Submit(fn); return err }
+				}
+				err := submit(func() {
+					running++
+					if running != 1 {
+						overlaps++
+					}
+					ran[g] = append(ran[g], i)
+					running--
+				})
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	// A last Do runs after every op submitted before it
+	if err := q.Do(func() {}); err != nil {
+		t.Fatal(err)
+	}
+
+	if overlaps != 0 {
+		t.Fatalf("%d operations overlapped", overlaps)
+	}
+	for g, order := range ran {
+		if len(order) != perGoroutine {
+			t.Fatalf("goroutine %d: %d of %d operations ran", g, len(order), perGoroutine)
+		}
+		for i, n := range order {
+			if n != i {
+				t.Fatalf("goroutine %d: operation %d ran in position %d", g, n, i)
+			}
+		}
+	}
+}
+
+func TestOpQueueReadsSeeEarlierWrites(t *testing.T) {
+	q := NewOpQueue(0)
+	defer q.Close()
+	db := openTestDatabase(t)
+	coll := db.GetCollection("docs")
+
+	for i := 0; i < 50; i++ {
+		// A write submitted without waiting is visible to the read after it
+		var id string
+		if _, err := q.Submit(func() {
+			var err error
+			if id, err = coll.Insert(map[string]interface{}{"i": i}); err != nil {
+				t.Error(err)
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+		var found map[string]interface{}
+		var count int
+		if err := q.Do(func() {
+			found = coll.FindByID(id)
+			count = coll.Count()
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if found == nil || count != i+1 {
+			t.Fatalf("write %d: read found %v with %d documents, want the write and %d", i, found, count, i+1)
+		}
+	}
+}
+
+func TestOpQueueClose(t *testing.T) {
+	q := NewOpQueue(8)
+
+	// Hold the worker so the next ops wait in the queue
+	release := make(chan struct{})
+	started := make(chan struct{})
+	if _, err := q.Submit(func() { close(started); <-release }); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	var ran []int
+	var dones []<-chan struct{}
+	for i := 0; i < 5; i++ {
+		i := i
+		done, err := q.Submit(func() { ran = append(ran, i) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		dones = append(dones, done)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		q.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close returned before the queued operations ran")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	<-closed
+
+	// Close drained what was already queued, in order
+	for _, done := range dones {
+		select {
+		case <-done:
+		default:
+			t.Fatal("a queued operation didn't run before Close returned")
+		}
+	}
+	if len(ran) != 5 {
+		t.Fatalf("got %v, want all 5 queued operations", ran)
+	}
+	for i, n := range ran {
+		if n != i {
+			t.Fatalf("got %v, want them in submission order", ran)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		submit func() error
+	}{
+		{"Submit", func() error { _, err := q.Submit(func() {}); return err }},
+		{"Do", func() error { return q.Do(func() {}) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.submit(); !errors.Is(err, ErrQueueClosed) {
+				t.Fatalf("got %v, want ErrQueueClosed", err)
+			}
+		})
+	}
+	// Closing again does nothing
+	q.Close()
+}
@@ -0,0 +1,220 @@
+package engine
+
+import "time"
+
+// Options holds the configuration used when opening a database
+// Build it with the With* helpers rather than filling it in directly
+type Options struct {
+	TrackWriteLatency bool          // Record storage Append durations into a latency histogram
+	StrictTypes       bool          // Evaluate filters without cross-kind coercion (see MatchOptions)
+	DateLayouts       []string      // Layouts recognised as dates in filters (see MatchOptions)
+	EpochUnit         time.Duration // Unit of numeric timestamps compared against dates (see MatchOptions)
+	Collation         *Collation    // Default string comparison for filters and sorts (see Collation)
+	StorageFormat     int           // File format to write (FormatJSONLines or FormatBinary); 0 keeps the file's own
+	Compression       string        // Record compression (CompressionGzip); implies FormatBinary
+	Codec             string        // Record codec (CodecMessagePack, CodecCBOR, CodecJSON); "" keeps the file's own, others imply FormatBinary
+	Passphrase        string        // Encrypts the file under a key derived from it (see WithEncryption); implies FormatBinary
+
+	Compaction *CompactionPolicy // When to compact automatically (see WithAutoCompaction); nil only compacts on request
+	Limits     Limits            // Caps on file size, documents and document size (see WithLimits); zero fields are unlimited
+	Ephemeral  bool              // Keep everything in memory and ignore the path (see WithEphemeral)
+	ReadOnly   bool              // Open the file for reading only, sharing it with other readers (see WithReadOnly)
+
+	CheckpointEvery int  // Checkpoint after this many writes to the log (see WithCheckpoints); 0 never does
+	LazyLoading     bool // Read each collection from disk when it is first used (see WithLazyLoading)
+	ZeroCopyReads   bool // Reads return the stored documents rather than copies (see WithZeroCopyReads)
+
+	Isolation IsolationLevel // What the reads of transactions see (see WithIsolation)
+
+	encrypt bool      // WithEncryption was given, so an empty Passphrase is an error rather than no encryption
+	asOf    time.Time // Load only the records written up to this time (see OpenDatabaseAt)
+}
+
+// Option configures a Database when it is opened
+type Option func(*Options)
+
+// WithWriteLatencyTracking enables the storage write latency histogram
+// Percentiles are reported under "write_latency" in Database.Stats()
+func WithWriteLatencyTracking() Option {
+	return func(o *Options) {
+		o.TrackWriteLatency = true
+	}
+}
+
+// WithStrictTypes makes filters match values of the same kind only,
+// so a number never matches a numeric string
+func WithStrictTypes() Option {
+	return func(o *Options) {
+		o.StrictTypes = true
+	}
+}
+
+// WithDateLayouts sets the time.Parse layouts that filters recognise as dates,
+// replacing the defaults (RFC3339 and 2006-01-02)
+func WithDateLayouts(layouts ...string) Option {
+	return func(o *Options) {
+		o.DateLayouts = append([]string(nil), layouts...)
+	}
+}
+
+// WithEpochUnit sets the unit of numeric timestamps, e.g. time.Millisecond for
+// values from JavaScript's Date.now(); the default is seconds
+func WithEpochUnit(unit time.Duration) Option {
+	return func(o *Options) {
+		o.EpochUnit = unit
+	}
+}
+
+// WithCollation sets the default collation used by filters and sorts
+// Individual queries can override it with FindOptions.Collation
+func WithCollation(collation Collation) Option {
+	return func(o *Options) {
+		o.Collation = &collation
+	}
+}
+
+// WithCheckpoints snapshots the database to a separate file once every
+// writes writes have gone to the log since the last snapshot, then restarts
+// the log, so opening it reads the snapshot and a short log rather than the
+// whole history. Checkpoints run in the background; Database.Checkpoint
+// takes one on request
+func WithCheckpoints(writes int) Option {
+	return func(o *Options) {
+		o.CheckpointEvery = writes
+	}
+}
+
+// WithLazyLoading reads only where each collection's records are when the
+// database is opened, and a collection's documents when it is first used,
+// so opening a large file costs one pass and memory for the collections in
+// use only. Compact, Checkpoint, Backup and RestoreTo load every collection
+// first, and Stats counts the documents of loaded collections only
+func WithLazyLoading() Option {
+	return func(o *Options) {
+		o.LazyLoading = true
+	}
+}
+
+// WithZeroCopyReads makes reads (FindByID, Find, Aggregate, Search, ...)
+// return the stored documents themselves instead of deep copies of them,
+// saving the copy for callers that only read the results, e.g. to encode
+// them. Changing such a document changes the store without persisting
+// anything, and can be seen by concurrent readers, so results must be
+// treated as read-only
+func WithZeroCopyReads() Option {
+	return func(o *Options) {
+		o.ZeroCopyReads = true
+	}
+}
+
+// WithIsolation sets the isolation level of transactions: what their reads
+// (Tx.FindByID, Tx.Find) see of other writes, and whether Commit checks for
+// conflicting ones. The default is IsolationReadCommitted; see
+// IsolationLevel for the anomalies each level allows
+func WithIsolation(level IsolationLevel) Option {
+	return func(o *Options) {
+		o.Isolation = level
+	}
+}
+
+// WithEphemeral keeps the database in memory, ignoring the path given to
+// OpenDatabase: nothing is read from or written to disk, and the data is
+// gone once the database is closed. Opening MemoryPath does the same
+func WithEphemeral() Option {
+	return func(o *Options) {
+		o.Ephemeral = true
+	}
+}
+
+// WithReadOnly opens an existing database file for reading only, under a
+// shared lock: any number of processes can read it at once, but none can
+// open it for writing until they have all closed it. Writes fail with
+// ErrReadOnly, and automatic compaction and checkpoints can't be enabled
+func WithReadOnly() Option {
+	return func(o *Options) {
+		o.ReadOnly = true
+	}
+}
+
+// WithStorageFormat selects the storage file format. A new file is created in
+// it; an existing file in the other format is still read, and is converted
+// the next time the database is compacted
+func WithStorageFormat(format int) Option {
+	return func(o *Options) {
+		o.StorageFormat = format
+	}
+}
+
+// WithCompression compresses large records with the given algorithm
+// (CompressionGzip) to shrink text-heavy databases. Only the binary format
+// can hold compressed records, so it is selected too; an existing JSON-lines
+// file is converted, and compressed, the next time it is compacted
+func WithCompression(compression string) Option {
+	return func(o *Options) {
+		o.Compression = compression
+	}
+}
+
+// WithRecordCodec serializes records with the given codec (CodecMessagePack
+// or CodecCBOR) instead of JSON, which is smaller and faster to decode for
+// numeric-heavy documents. The codec is recorded in the file header, so the
+// file opens without the option; only the binary format names one, so it is
+// selected too. An existing file is converted the next time it is compacted,
+// and CodecJSON converts it back the same way
+func WithRecordCodec(codec string) Option {
+	return func(o *Options) {
+		o.Codec = codec
+	}
+}
+
+// WithEncryption encrypts the storage file with AES-256-GCM under a key
+// derived from the passphrase with scrypt. An encrypted file can only be
+// opened with its passphrase; a plaintext one is encrypted straight away if
+// it is empty, otherwise the next time it is compacted. Encryption implies
+// the binary format
+func WithEncryption(passphrase string) Option {
+	return func(o *Options) {
+		o.Passphrase = passphrase
+		o.encrypt = true
+	}
+}
+
+// WithAutoCompaction compacts the database in the background whenever the
+// policy's dead-record ratio or file size limit is exceeded, checked on open
+// and periodically as records are written. DefaultCompactionPolicy is a
+// reasonable start
+func WithAutoCompaction(policy CompactionPolicy) Option {
+	return func(o *Options) {
+		o.Compaction = &policy
+	}
+}
+
+// WithLimits refuses writes that would take the database over the given
+// limits, with a *LimitError matching ErrLimitExceeded, so a database can't
+// silently fill the disk or a browser's storage quota
+func WithLimits(limits Limits) Option {
+	return func(o *Options) {
+		o.Limits = limits
+	}
+}
+
+// matchOptions returns the filter evaluation settings for collections
+func (o Options) matchOptions() MatchOptions {
+	return MatchOptions{
+		StrictTypes: o.StrictTypes,
+		DateLayouts: o.DateLayouts,
+		EpochUnit:   o.EpochUnit,
+		Collation:   o.Collation,
+	}
+}
+
+// buildOptions applies the given options on top of the defaults
+func buildOptions(opts []Option) Options {
+	var options Options
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&options)
+		}
+	}
+	return options
+}
@@ -0,0 +1,153 @@
+package engine
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Page is one page of results from FindPage
+type Page struct {
+	Documents []map[string]interface{} `json:"documents"`           // Documents on this page
+	NextToken string                   `json:"nextToken,omitempty"` // Token for the following page; "" on the last page
+}
+
+// pageCursor is the decoded form of a page token
+type pageCursor struct {
+	Sort  string        `json:"s"` // Sort order the token was issued for (see pageSortSpec)
+	After []interface{} `json:"a"` // Sort key of the last document returned
+}
+
+// FindPage returns one page of documents matching the filter, plus a token
+// for the page after it. Pass "" as the token for the first page
+//
+// Pages are keyset-based: results are ordered by options.Sort with the
+// document ID as a final tie-breaker, and each page starts after the sort key
+// of the previous page's last document. Paging is therefore deterministic and
+// documents inserted or deleted between calls don't shift later pages
+// options.Limit sets the page size (0 returns all remaining documents); Skip
+// skips documents after the token's position. A token must be used with the
+// same sort order and collation it was issued for
+func (c *Collection) FindPage(filter map[string]interface{}, options FindOptions, token string) (Page, error) {
+	return c.FindPageContext(context.Background(), filter, options, token)
+}
+
+// FindPageContext is FindPage with cancellation (see FindContext)
+func (c *Collection) FindPageContext(ctx context.Context, filter map[string]interface{}, options FindOptions, token string) (Page, error) {
+	collation := options.Collation
+	if collation == nil {
+		collation = c.match.Collation
+	}
+	fields := pageSortFields(options.Sort)
+	spec := pageSortSpec(fields, collation)
+
+	var after []interface{}
+	if token != "" {
+		cursor, err := decodePageToken(token)
+		if err != nil {
+			return Page{}, err
+		}
+		if cursor.Sort != spec || len(cursor.After) != len(fields) {
+			return Page{}, fmt.Errorf("page token was issued for a different sort order or collation")
+		}
+		after = cursor.After
+	}
+
+	docs, err := c.find(ctx, filter, FindOptions{Collation: collation, Hint: options.Hint}, nil)
+	if err != nil {
+		return Page{}, err
+	}
+
+	collation.sortDocuments(docs, fields)
+
+	// Resume after the previous page's last sort key
+	if after != nil {
+		start := sort.Search(len(docs), func(i int) bool {
+			return collation.compareSortKeys(sortKey(docs[i], fields), after, fields) > 0
+		})
+		docs = docs[start:]
+	}
+
+	pageDocs := FindOptions{Skip: options.Skip, Limit: options.Limit}.apply(docs)
+	page := Page{Documents: c.detach(pageDocs)}
+
+	// More documents remain past this page, so hand out a token for them
+	if len(pageDocs) > 0 && options.Skip+len(pageDocs) < len(docs) {
+		next, err := encodePageToken(pageCursor{
+			Sort:  spec,
+			After: sortKey(pageDocs[len(pageDocs)-1], fields),
+		})
+		if err != nil {
+			return Page{}, err
+		}
+		page.NextToken = next
+	}
+
+	if options.Projection != nil {
+		page.Documents = FindOptions{Projection: options.Projection}.apply(pageDocs)
+	}
+	return page, nil
+}
+
+// pageSortFields appends the document ID to a sort so every key is unique
+func pageSortFields(sortFields []SortField) []SortField {
+	fields := make([]SortField, 0, len(sortFields)+1)
+	for _, field := range sortFields {
+		if field.Direction != "desc" {
+			field.Direction = "asc"
+		}
+		fields = append(fields, field)
+		if field.Field == "id" {
+			return fields
+		}
+	}
+	return append(fields, SortField{Field: "id", Direction: "asc"})
+}
+
+// pageSortSpec describes a sort order, e.g. "age:desc:last,id:asc"
+// A collation is appended after a semicolon, e.g. ";de:i:n"
+func pageSortSpec(fields []SortField, collation *Collation) string {
+	parts := make([]string, len(fields))
+	for i, field := range fields {
+		parts[i] = field.Field + ":" + field.Direction
+		if field.Nulls != "" {
+			parts[i] += ":" + field.Nulls
+		}
+	}
+	spec := strings.Join(parts, ",")
+	if collation != nil {
+		spec += ";" + collation.Locale
+		if collation.CaseInsensitive {
+			spec += ":i"
+		}
+		if collation.Numeric {
+			spec += ":n"
+		}
+	}
+	return spec
+}
+
+// encodePageToken serializes a cursor as an opaque URL-safe string
+func encodePageToken(cursor pageCursor) (string, error) {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode page token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodePageToken parses a token produced by encodePageToken
+func decodePageToken(token string) (pageCursor, error) {
+	var cursor pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return cursor, fmt.Errorf("invalid page token")
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return cursor, fmt.Errorf("invalid page token")
+	}
+	return cursor, nil
+}
@@ -0,0 +1,123 @@
+package engine
+
+import (
+	"math"
+	"sort"
+)
+
+// entryCost is the planner's cost of reading one index entry into a candidate
+// set, relative to evaluating the filter against one document
+const entryCost = 0.5
+
+// PlanCandidate is an indexed condition the query planner considered
+type PlanCandidate struct {
+	Index     string `json:"index"`     // Index that can answer the condition
+	Estimated int    `json:"estimated"` // Upper bound on the documents the condition leaves
+	Used      bool   `json:"used"`      // Whether the chosen plan looks it up
+}
+
+// indexProbe is a query condition an index can answer
+type indexProbe struct {
+	field    string
+	index    *fieldIndex
+	terms    []indexTerm
+	estimate int
+}
+
+// indexCandidates uses field indexes to narrow a query to the documents that
+// may match it. Every top-level condition on an indexed field, including those
+// inside a top-level $and, is a candidate; its selectivity is estimated from
+// the index's entry counts and the cheapest plan wins: a single index, an
+// intersection of several, or a collection scan when the conditions are too
+// unselective to pay for the lookups. The full filter is still applied to
+// each candidate document
+// indexes lists the indexes used, in name order, and considered describes
+// every candidate condition. ok is false if no index is used
+// Caller must hold the read lock
+func (c *Collection) indexCandidates(filter map[string]interface{}, match MatchOptions, hint indexHint) (ids []string, indexes []string, considered []PlanCandidate, ok bool) {
+	var probes []indexProbe
+	conds := indexableConditions(filter)
+	for _, cond := range conds {
+		index, indexed := c.indexes[cond.field]
+		if !indexed || !hint.allows(cond.field) || !index.covers(conds) {
+			continue
+		}
+		terms, valid := index.terms(cond.value, match)
+		if !valid {
+			continue
+		}
+		probes = append(probes, indexProbe{field: cond.field, index: index, terms: terms, estimate: index.estimate(terms)})
+	}
+	if len(probes) == 0 {
+		return nil, nil, nil, false
+	}
+
+	// Most selective first
+	sort.SliceStable(probes, func(i, j int) bool {
+		if probes[i].estimate != probes[j].estimate {
+			return probes[i].estimate < probes[j].estimate
+		}
+		return probes[i].field < probes[j].field
+	})
+	used := c.choosePlan(probes, hint.only != "")
+
+	considered = make([]PlanCandidate, len(probes))
+	for i, probe := range probes {
+		considered[i] = PlanCandidate{Index: probe.field, Estimated: probe.estimate, Used: i < used}
+	}
+	if used == 0 {
+		return nil, nil, considered, false
+	}
+
+	candidates := probes[0].index.resolve(probes[0].terms)
+	seen := map[string]bool{probes[0].field: true}
+	indexes = []string{probes[0].field}
+	for _, probe := range probes[1:used] {
+		candidates = intersectIDs(candidates, probe.index.resolve(probe.terms))
+		if !seen[probe.field] {
+			seen[probe.field] = true
+			indexes = append(indexes, probe.field)
+		}
+	}
+	for _, name := range indexes {
+		c.indexes[name].hits.Add(1)
+	}
+
+	ids = make([]string, 0, len(candidates))
+	for id := range candidates {
+		ids = append(ids, id)
+	}
+	sort.Strings(indexes)
+	return ids, indexes, considered, true
+}
+
+// choosePlan returns how many of the probes, sorted most selective first, the
+// cheapest plan looks up; 0 means a collection scan
+// Each further probe is intersected while the filter evaluations it saves
+// outweigh its lookup, assuming conditions are independent. forced keeps at
+// least one probe, for a hinted index
+func (c *Collection) choosePlan(probes []indexProbe, forced bool) int {
+	total := float64(c.documents.len())
+	remaining := float64(probes[0].estimate)
+	cost := remaining*entryCost + remaining
+	used := 1
+
+	for _, probe := range probes[1:] {
+		selectivity := 1.0
+		if total > 0 {
+			selectivity = math.Min(float64(probe.estimate)/total, 1)
+		}
+		narrowed := remaining * selectivity
+		next := cost + float64(probe.estimate)*entryCost - (remaining - narrowed)
+		if next >= cost {
+			break
+		}
+		cost, remaining = next, narrowed
+		used++
+	}
+
+	if !forced && cost >= total {
+		return 0
+	}
+	return used
+}
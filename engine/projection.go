@@ -0,0 +1,235 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Projection selects which fields of a document are returned
+// It is built from a MongoDB-style spec with NewProjection:
+//   {"name": 1, "address.city": 1} // Include mode: only these fields (plus id)
+//   {"password": 0}                // Exclude mode: everything but these fields
+//   {"skus": "$.items[*].sku"}     // JSONPath field: an array of what the path selects (include mode)
+//   {"total": {"$multiply": ["$price", "$qty"]}, "city": "$address.city"}
+//                                  // Computed fields (include mode; see MatchOptions.evaluate)
+// Both modes accept dot-notation paths; "id" may be excluded in either mode
+type Projection struct {
+	include   bool                   // True for include mode, false for exclude mode
+	fields    projectionTree         // Selected paths, nested by segment
+	paths     map[string]*JSONPath   // Output field -> JSONPath whose selections it holds
+	computed  map[string]interface{} // Output field -> expression
+	excludeID bool                   // Drop the id field even in include mode
+}
+
+// projectionTree is a set of paths split into nested segments
+// A nil subtree marks the end of a path (the whole value is selected)
+type projectionTree map[string]projectionTree
+
+// NewProjection parses a projection spec
+// Values must be 1/0 or true/false, and include and exclude can't be mixed
+// (except for "id", which can always be excluded)
+func NewProjection(spec map[string]interface{}) (*Projection, error) {
+	if len(spec) == 0 {
+		return nil, nil // No projection: whole documents
+	}
+
+	p := &Projection{include: true, fields: make(projectionTree)}
+
+	sawInclude, sawExclude := false, false
+	for path, value := range spec {
+		if isComputedProjection(value) {
+			if err := validateExpression(value); err != nil {
+				return nil, fmt.Errorf("invalid projection for %q: %w", path, err)
+			}
+			if p.computed == nil {
+				p.computed = make(map[string]interface{})
+			}
+			p.computed[path] = value
+			sawInclude = true
+			continue
+		}
+
+		if expr, isStr := value.(string); isStr && strings.HasPrefix(expr, "$") {
+			jsonPath, err := CompileJSONPath(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid projection for %q: %w", path, err)
+			}
+			if p.paths == nil {
+				p.paths = make(map[string]*JSONPath)
+			}
+			p.paths[path] = jsonPath
+			sawInclude = true
+			continue
+		}
+
+		include, err := projectionFlag(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid projection for %q: %w", path, err)
+		}
+
+		if path == "id" {
+			p.excludeID = !include
+			if include {
+				sawInclude = true
+			}
+			continue
+		}
+
+		if include {
+			sawInclude = true
+		} else {
+			sawExclude = true
+		}
+		p.fields.add(strings.Split(path, "."))
+	}
+
+	if sawInclude && sawExclude {
+		return nil, fmt.Errorf("projection cannot mix included and excluded fields")
+	}
+
+	// A projection that only excludes (possibly just "id") is exclude mode
+	p.include = sawInclude
+	if !p.include && p.excludeID {
+		p.fields.add([]string{"id"})
+	}
+	return p, nil
+}
+
+// isComputedProjection reports whether a projection value is an expression:
+// an object, or a "$field" reference (as opposed to a "$." or "$[" JSONPath)
+func isComputedProjection(value interface{}) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return true
+	case string:
+		return len(v) > 1 && v[0] == '$' && v[1] != '.' && v[1] != '['
+	}
+	return false
+}
+
+// projectionFlag interprets a projection value as include (true) or exclude (false)
+func projectionFlag(value interface{}) (bool, error) {
+	if b, ok := value.(bool); ok {
+		return b, nil
+	}
+	if n, ok := toFloat64(value); ok {
+		return n != 0, nil
+	}
+	return false, fmt.Errorf("expected 1, 0, true, false, a JSONPath or an expression")
+}
+
+// add inserts a path into the tree
+// A shorter path selecting a whole value wins over longer paths beneath it
+func (t projectionTree) add(segments []string) {
+	head := segments[0]
+	sub, exists := t[head]
+	if len(segments) == 1 {
+		t[head] = nil
+		return
+	}
+	if exists && sub == nil {
+		return // Parent already selected in full
+	}
+	if sub == nil {
+		sub = make(projectionTree)
+		t[head] = sub
+	}
+	sub.add(segments[1:])
+}
+
+// Apply returns a new document containing only the projected fields
+// The input document is never modified; selected values are deep copies
+func (p *Projection) Apply(doc map[string]interface{}) map[string]interface{} {
+	if p == nil {
+		return doc
+	}
+
+	if !p.include {
+		return excludeFields(doc, p.fields)
+	}
+
+	result := includeFields(doc, p.fields)
+	for field, path := range p.paths {
+		selected := path.Select(doc)
+		values := make([]interface{}, len(selected))
+		for i, value := range selected {
+			values[i] = copyValue(value)
+		}
+		result[field] = values
+	}
+	for field, expr := range p.computed {
+		result[field] = copyValue(evalExpression(doc, expr))
+	}
+	if id, exists := doc["id"]; exists && !p.excludeID {
+		result["id"] = id
+	}
+	return result
+}
+
+// includeFields copies only the paths in tree from doc
+func includeFields(doc map[string]interface{}, tree projectionTree) map[string]interface{} {
+	result := make(map[string]interface{})
+	for key, sub := range tree {
+		value, exists := doc[key]
+		if !exists {
+			continue
+		}
+		if sub == nil {
+			result[key] = copyValue(value)
+			continue
+		}
+		if projected, ok := includeNested(value, sub); ok {
+			result[key] = projected
+		}
+	}
+	return result
+}
+
+// includeNested applies an include subtree to a nested object or array of objects
+func includeNested(value interface{}, tree projectionTree) (interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return includeFields(v, tree), true
+	case []interface{}:
+		projected := make([]interface{}, 0, len(v))
+		for _, elem := range v {
+			if elemDoc, isDoc := elem.(map[string]interface{}); isDoc {
+				projected = append(projected, includeFields(elemDoc, tree))
+			}
+		}
+		return projected, true
+	}
+	return nil, false
+}
+
+// excludeFields copies doc without the paths in tree
+func excludeFields(doc map[string]interface{}, tree projectionTree) map[string]interface{} {
+	result := make(map[string]interface{}, len(doc))
+	for key, value := range doc {
+		sub, selected := tree[key]
+		if !selected {
+			result[key] = copyValue(value)
+			continue
+		}
+		if sub == nil {
+			continue // Excluded entirely
+		}
+		result[key] = excludeNested(value, sub)
+	}
+	return result
+}
+
+// excludeNested applies an exclude subtree to a nested object or array of objects
+func excludeNested(value interface{}, tree projectionTree) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return excludeFields(v, tree)
+	case []interface{}:
+		projected := make([]interface{}, len(v))
+		for i, elem := range v {
+			projected[i] = excludeNested(elem, tree)
+		}
+		return projected
+	}
+	return copyValue(value)
+}
@@ -1,9 +1,14 @@
 package engine
 
 import (
+	"encoding/json"
 	"fmt"
 	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // MatchesFilter checks if a document matches the given filter
@@ -13,10 +18,38 @@ import (
 //   {"name": "John"}                    // Exact match
 //   {"age": 25}                         // Numeric match
 //   {"status": "active", "role": "admin"} // AND condition (all must match)
+//   {"roles": {"$in": ["admin", "owner"]}} // Membership (see matchIn, matchNotIn for $nin)
+//   {"age": {"$gte": 18, "$lt": 65}}      // Range (see matchComparison)
+//   {"createdAt": {"$gte": "2024-01-01"}} // Date range (see MatchOptions.toTime)
+//   {"$or": [{"role": "admin"}, {"level": {"$gte": 5}}]} // Logical (see matchLogical)
+//   {"email": {"$exists": true}, "score": {"$type": "number"}} // Presence and type
+//   {"name": {"$regex": "^al", "$options": "i"}} // Pattern (see matchRegex, matchAffix)
+//   {"address.city": "Berlin"}          // Nested field (see lookupPath)
+//   {"tags": {"$all": ["go", "db"]}, "scores": {"$size": 3}} // Arrays (see matchAll, matchSize, matchElemMatch)
+//   {"location": {"$near": [13.4, 52.5], "$maxDistance": 1000}} // Geospatial (see matchNear, matchGeoWithin)
+//   {"name": {"$fuzzy": {"value": "jhon", "maxDistance": 2}}} // Typo-tolerant (see parseFuzzy)
+//   {"$jsonPath": "$.items[?(@.price > 10)]"} // JSONPath selects something (see CompileJSONPath)
+//   {"$expr": {"$gt": ["$spent", "$budget"]}} // Expression over the document (see MatchOptions.evaluate)
+//
+// Equality follows the default MatchOptions; see valuesMatch for the type rules
 //
 // Note: This is a simple implementation for demonstration purposes
-// A production system would support more complex queries ($gt, $lt, $in, etc.)
 func MatchesFilter(doc map[string]interface{}, filter map[string]interface{}) bool {
+	return MatchOptions{}.Matches(doc, filter)
+}
+
+// MatchOptions configures how filters are evaluated
+// The zero value gives the default behaviour used by MatchesFilter
+type MatchOptions struct {
+	StrictTypes bool          // Never coerce between kinds, so 25 doesn't match "25"
+	DateLayouts []string      // time.Parse layouts recognised as dates; defaults to RFC3339 and 2006-01-02
+	EpochUnit   time.Duration // Unit of numeric timestamps compared against dates; defaults to seconds
+	Collation   *Collation    // How strings compare in equality and ranges; nil compares bytes
+}
+
+// Matches checks if a document matches the given filter using these options
+// Filters have the same format as for MatchesFilter
+func (m MatchOptions) Matches(doc map[string]interface{}, filter map[string]interface{}) bool {
 	// Empty filter matches everything
 	if len(filter) == 0 {
 		return true
@@ -24,155 +57,722 @@ func MatchesFilter(doc map[string]interface{}, filter map[string]interface{}) bo
 
 	// All filter conditions must match (AND logic)
 	for key, filterValue := range filter {
-		docValue, exists := doc[key]
+		// Top-level keys like "$or" combine nested filters
+		if strings.HasPrefix(key, "$") {
+			if !m.matchLogical(doc, key, filterValue) {
+				return false
+			}
+			continue
+		}
 
-		// If field doesn't exist in document, no match
-		if !exists {
+		// Field conditions are either operator expressions or plain values
+		// Keys may use dot notation to reach into nested documents
+		docValue, exists := lookupPath(doc, key)
+		if !m.matchFieldCondition(docValue, exists, filterValue) {
 			return false
 		}
+	}
+
+	return true
+}
 
-		// Check if values match
-		if !valuesMatch(docValue, filterValue) {
+// operatorExpression reports whether a filter value is an operator expression
+// An operator expression is a non-empty map whose keys all start with "$"
+func operatorExpression(filterValue interface{}) (map[string]interface{}, bool) {
+	ops, ok := filterValue.(map[string]interface{})
+	if !ok || len(ops) == 0 {
+		return nil, false
+	}
+
+	for key := range ops {
+		if !strings.HasPrefix(key, "$") {
+			return nil, false
+		}
+	}
+	return ops, true
+}
+
+// matchLogical evaluates a top-level logical operator against a document
+// $and, $or and $nor take an array of filters; $not takes a single filter
+// Filters can nest arbitrarily. Unknown or malformed operators never match
+func (m MatchOptions) matchLogical(doc map[string]interface{}, op string, operand interface{}) bool {
+	if op == "$jsonPath" {
+		return m.matchJSONPath(doc, operand)
+	}
+	if op == "$expr" {
+		return m.matchExpr(doc, operand)
+	}
+
+	if op == "$not" {
+		subFilter, ok := operand.(map[string]interface{})
+		if !ok {
 			return false
 		}
+		return !m.Matches(doc, subFilter)
 	}
 
-	return true
+	subFilters, ok := toFilterList(operand)
+	if !ok {
+		return false
+	}
+
+	switch op {
+	case "$and":
+		for _, subFilter := range subFilters {
+			if !m.Matches(doc, subFilter) {
+				return false
+			}
+		}
+		return true
+	case "$or":
+		for _, subFilter := range subFilters {
+			if m.Matches(doc, subFilter) {
+				return true
+			}
+		}
+		return false
+	case "$nor":
+		for _, subFilter := range subFilters {
+			if m.Matches(doc, subFilter) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// toFilterList converts a logical operator operand into a list of filters
+// The operand must be a non-empty array whose elements are all filter objects
+func toFilterList(operand interface{}) ([]map[string]interface{}, bool) {
+	switch v := operand.(type) {
+	case []map[string]interface{}:
+		return v, len(v) > 0
+	case []interface{}:
+		if len(v) == 0 {
+			return nil, false
+		}
+		filters := make([]map[string]interface{}, 0, len(v))
+		for _, elem := range v {
+			subFilter, ok := elem.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			filters = append(filters, subFilter)
+		}
+		return filters, true
+	}
+	return nil, false
+}
+
+// matchFieldCondition evaluates a single field condition, which is either
+// an operator expression or a plain value compared for equality
+// A plain value also matches an array field containing that value
+func (m MatchOptions) matchFieldCondition(docValue interface{}, exists bool, condition interface{}) bool {
+	if ops, isOps := operatorExpression(condition); isOps {
+		return m.matchOperators(docValue, exists, ops)
+	}
+	return exists && m.matchEquals(docValue, condition)
 }
 
-// valuesMatch compares two values for equality
-// Handles different types and attempts to do smart comparison
-func valuesMatch(docValue, filterValue interface{}) bool {
-	// Direct equality check
-	if reflect.DeepEqual(docValue, filterValue) {
+// matchEquals implements plain equality ($eq)
+// The value matches the field itself or, for array fields, any of its elements
+func (m MatchOptions) matchEquals(docValue interface{}, value interface{}) bool {
+	if m.valuesMatch(docValue, value) {
 		return true
 	}
+	if docArray, isArray := docValue.([]interface{}); isArray {
+		return m.containsValue(docArray, value)
+	}
+	return false
+}
+
+// matchContains implements the $contains operator
+// String fields match when they contain the operand as a substring;
+// array fields match when an element equals the operand
+func (m MatchOptions) matchContains(docValue interface{}, operand interface{}) bool {
+	if str, isStr := docValue.(string); isStr {
+		sub, ok := operand.(string)
+		return ok && strings.Contains(str, sub)
+	}
+	if docArray, isArray := docValue.([]interface{}); isArray {
+		return m.containsValue(docArray, operand)
+	}
+	return false
+}
 
-	// Convert both to strings for comparison if types differ
-	docStr := fmt.Sprintf("%v", docValue)
-	filterStr := fmt.Sprintf("%v", filterValue)
+// matchOperators evaluates every operator in the expression against a document value
+// All operators must match (AND logic). Unknown operators never match
+func (m MatchOptions) matchOperators(docValue interface{}, exists bool, ops map[string]interface{}) bool {
+	for op, operand := range ops {
+		var matched bool
+		switch op {
+		case "$eq":
+			matched = exists && m.matchEquals(docValue, operand)
+		case "$ne":
+			matched = !exists || !m.matchEquals(docValue, operand)
+		case "$in":
+			matched = exists && m.matchIn(docValue, operand)
+		case "$nin":
+			matched = m.matchNotIn(docValue, exists, operand)
+		case "$gt", "$gte", "$lt", "$lte":
+			matched = exists && m.matchComparison(docValue, op, operand)
+		case "$not":
+			matched = !m.matchFieldCondition(docValue, exists, operand)
+		case "$exists":
+			want, ok := operand.(bool)
+			matched = ok && exists == want
+		case "$type":
+			matched = exists && matchType(docValue, operand)
+		case "$regex":
+			matched = exists && matchRegex(docValue, operand, ops["$options"])
+		case "$startsWith", "$endsWith":
+			matched = exists && matchAffix(docValue, op, operand, ops["$options"])
+		case "$options":
+			matched = true // Modifier for $regex/$startsWith/$endsWith, evaluated there
+		case "$elemMatch":
+			matched = exists && m.matchElemMatch(docValue, operand)
+		case "$all":
+			matched = exists && m.matchAll(docValue, operand)
+		case "$size":
+			matched = exists && matchSize(docValue, operand)
+		case "$contains":
+			matched = exists && m.matchContains(docValue, operand)
+		case "$near":
+			matched = exists && matchNear(docValue, operand, ops)
+		case "$maxDistance", "$minDistance":
+			matched = true // Modifiers for $near, evaluated there
+		case "$geoWithin":
+			matched = exists && matchGeoWithin(docValue, operand)
+		case "$fuzzy":
+			matched = exists && matchFuzzy(docValue, operand)
+		default:
+			matched = false
+		}
 
-	return docStr == filterStr
+		if !matched {
+			return false
+		}
+	}
+	return true
 }
 
-// QueryBuilder provides a fluent API for building queries (future enhancement)
-// This is a placeholder for more advanced query functionality
-type QueryBuilder struct {
-	filter map[string]interface{}
+// matchIn implements the $in operator
+// If the document value is a scalar, it matches when it equals any list element
+// If the document value is an array, it matches when the two arrays share
+// at least one element (non-empty intersection)
+func (m MatchOptions) matchIn(docValue interface{}, operand interface{}) bool {
+	list, ok := operand.([]interface{})
+	if !ok {
+		return false
+	}
+
+	// Array field: any document element may match any list element
+	if docArray, isArray := docValue.([]interface{}); isArray {
+		for _, elem := range docArray {
+			if m.containsValue(list, elem) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return m.containsValue(list, docValue)
 }
 
-// NewQuery creates a new QueryBuilder
-func NewQuery() *QueryBuilder {
-	return &QueryBuilder{
-		filter: make(map[string]interface{}),
+// matchComparison implements $gt, $gte, $lt and $lte
+// Only values of the same kind are compared (numbers, dates or strings);
+// anything else never matches. For array fields, any element may match
+func (m MatchOptions) matchComparison(docValue interface{}, op string, operand interface{}) bool {
+	if docArray, isArray := docValue.([]interface{}); isArray {
+		for _, elem := range docArray {
+			if m.matchComparison(elem, op, operand) {
+				return true
+			}
+		}
+		return false
 	}
+
+	cmp, ok := m.compareOrdered(docValue, operand)
+	if !ok {
+		return false
+	}
+
+	switch op {
+	case "$gt":
+		return cmp > 0
+	case "$gte":
+		return cmp >= 0
+	case "$lt":
+		return cmp < 0
+	case "$lte":
+		return cmp <= 0
+	}
+	return false
 }
 
-// Where adds an equality condition to the query
-func (q *QueryBuilder) Where(field string, value interface{}) *QueryBuilder {
-	q.filter[field] = value
-	return q
+// compareOrdered compares two values of the same kind
+// Numbers compare numerically, dates chronologically and other strings
+// lexically (under the Collation, if any)
+// A date is a time.Time or a string in one of the date layouts; a number
+// compared against a date is read as an epoch timestamp (see toTime)
+// The second return value is false if the values can't be ordered
+func (m MatchOptions) compareOrdered(a, b interface{}) (int, bool) {
+	// Numeric comparison
+	aFloat, aNum := toFloat64(a)
+	bFloat, bNum := toFloat64(b)
+	if aNum && bNum {
+		return compareFloats(aFloat, bFloat), true
+	}
+
+	// Chronological comparison, including dates against epoch numbers
+	aTime, aDate := m.toTime(a)
+	bTime, bDate := m.toTime(b)
+	if aDate && bDate {
+		return aTime.Compare(bTime), true
+	}
+	if aNum || bNum {
+		return 0, false
+	}
+
+	// Lexical comparison
+	aStr, aIsStr := a.(string)
+	bStr, bIsStr := b.(string)
+	if aIsStr && bIsStr {
+		return m.Collation.Compare(aStr, bStr), true
+	}
+
+	return 0, false
 }
 
-// Build returns the constructed filter
-func (q *QueryBuilder) Build() map[string]interface{} {
-	return q.filter
+// compareFloats returns -1, 0 or 1 depending on how a orders against b
+func compareFloats(a, b float64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
 }
 
-// ParseFilterString parses a simple filter string into a filter map
-// Format: "field1=value1,field2=value2"
-// This is useful for converting string-based queries from the WASM layer
-func ParseFilterString(filterStr string) map[string]interface{} {
-	filter := make(map[string]interface{})
+// defaultDateLayouts are the string formats recognised as dates unless
+// MatchOptions.DateLayouts says otherwise
+var defaultDateLayouts = []string{time.RFC3339Nano, time.DateOnly}
 
-	if filterStr == "" {
-		return filter
+// toTime attempts to interpret a value as a point in time
+// Accepts time.Time values, strings in one of the date layouts (tried in
+// order) and numbers, which count EpochUnits since the Unix epoch
+// Layouts without a time zone are read as UTC
+func (m MatchOptions) toTime(val interface{}) (time.Time, bool) {
+	switch v := val.(type) {
+	case time.Time:
+		return v, true
+	case string:
+		layouts := m.DateLayouts
+		if len(layouts) == 0 {
+			layouts = defaultDateLayouts
+		}
+		for _, layout := range layouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, true
+			}
+		}
+		return time.Time{}, false
 	}
 
-	// Split by comma to get individual conditions
-	parts := strings.Split(filterStr, ",")
-	for _, part := range parts {
-		part = strings.TrimSpace(part)
-		if part == "" {
-			continue
+	if n, isNum := toFloat64(val); isNum {
+		unit := m.EpochUnit
+		if unit <= 0 {
+			unit = time.Second
 		}
+		return time.Unix(0, int64(n*float64(unit))), true
+	}
+	return time.Time{}, false
+}
 
-		// Split by = to get field and value
-		kv := strings.SplitN(part, "=", 2)
-		if len(kv) != 2 {
-			continue
+// matchNotIn implements the $nin operator
+// It matches when the field is missing or none of its values are in the list
+// A malformed (non-array) operand never matches
+func (m MatchOptions) matchNotIn(docValue interface{}, exists bool, operand interface{}) bool {
+	if _, ok := operand.([]interface{}); !ok {
+		return false
+	}
+	if !exists {
+		return true
+	}
+	return !m.matchIn(docValue, operand)
+}
+
+// matchType implements the $type operator
+// The operand is a type name or an array of type names (any may match)
+// Supported names: "string", "number", "bool"/"boolean", "object", "array", "null"
+func matchType(docValue interface{}, operand interface{}) bool {
+	switch v := operand.(type) {
+	case string:
+		return valueType(docValue) == normalizeTypeName(v)
+	case []interface{}:
+		for _, elem := range v {
+			if name, ok := elem.(string); ok && valueType(docValue) == normalizeTypeName(name) {
+				return true
+			}
 		}
+	}
+	return false
+}
 
-		field := strings.TrimSpace(kv[0])
-		value := strings.TrimSpace(kv[1])
+// normalizeTypeName maps type name aliases onto the names used by valueType
+func normalizeTypeName(name string) string {
+	if name == "boolean" {
+		return "bool"
+	}
+	return name
+}
 
-		// Store in filter map
-		filter[field] = value
+// valueType returns the $type name of a decoded document value
+func valueType(value interface{}) string {
+	if value == nil {
+		return "null"
+	}
+	if _, isNum := toFloat64(value); isNum {
+		return "number"
 	}
 
-	return filter
+	switch value.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	return "unknown"
 }
 
-// SortDocuments sorts documents by a field (simple implementation)
-// direction: "asc" or "desc"
-// Note: This modifies the slice in place
-func SortDocuments(docs []map[string]interface{}, field string, direction string) {
-	// For simplicity, we'll use a basic bubble sort
-	// A production system would use a more efficient algorithm
-	n := len(docs)
-	for i := 0; i < n-1; i++ {
-		for j := 0; j < n-i-1; j++ {
-			val1, exists1 := docs[j][field]
-			val2, exists2 := docs[j+1][field]
+// regexCacheSize bounds the number of compiled patterns kept by cachedRegex
+const regexCacheSize = 256
 
-			// Handle missing fields
-			if !exists1 || !exists2 {
-				continue
+// regexCache holds compiled $regex patterns so repeated scans don't recompile them
+var regexCache = struct {
+	sync.Mutex
+	patterns map[string]*regexp.Regexp
+}{patterns: make(map[string]*regexp.Regexp)}
+
+// cachedRegex compiles a pattern, reusing a previous compilation when possible
+func cachedRegex(pattern string) (*regexp.Regexp, error) {
+	regexCache.Lock()
+	defer regexCache.Unlock()
+
+	if re, ok := regexCache.patterns[pattern]; ok {
+		return re, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep memory bounded; a full cache is simply dropped and refilled
+	if len(regexCache.patterns) >= regexCacheSize {
+		regexCache.patterns = make(map[string]*regexp.Regexp)
+	}
+	regexCache.patterns[pattern] = re
+	return re, nil
+}
+
+// caseInsensitive reports whether a $options value contains the "i" flag
+func caseInsensitive(options interface{}) bool {
+	flags, ok := options.(string)
+	return ok && strings.Contains(flags, "i")
+}
+
+// matchRegex implements the $regex operator
+// The operand is a pattern string (RE2 syntax) or a compiled *regexp.Regexp
+// A "$options" value containing "i" makes a string pattern case-insensitive
+// Only string values match; for array fields, any string element may match
+func matchRegex(docValue interface{}, operand interface{}, options interface{}) bool {
+	var re *regexp.Regexp
+	switch v := operand.(type) {
+	case *regexp.Regexp:
+		re = v
+	case string:
+		pattern := v
+		if caseInsensitive(options) {
+			pattern = "(?i)" + pattern
+		}
+		compiled, err := cachedRegex(pattern)
+		if err != nil {
+			return false
+		}
+		re = compiled
+	default:
+		return false
+	}
+
+	return anyString(docValue, re.MatchString)
+}
+
+// matchAffix implements the $startsWith and $endsWith operators
+// A "$options" value containing "i" makes the comparison case-insensitive
+func matchAffix(docValue interface{}, op string, operand interface{}, options interface{}) bool {
+	affix, ok := operand.(string)
+	if !ok {
+		return false
+	}
+
+	fold := caseInsensitive(options)
+	if fold {
+		affix = strings.ToLower(affix)
+	}
+
+	return anyString(docValue, func(value string) bool {
+		if fold {
+			value = strings.ToLower(value)
+		}
+		if op == "$startsWith" {
+			return strings.HasPrefix(value, affix)
+		}
+		return strings.HasSuffix(value, affix)
+	})
+}
+
+// anyString applies a string predicate to a value, or to each element of an array
+// Non-string values never match
+func anyString(value interface{}, match func(string) bool) bool {
+	switch v := value.(type) {
+	case string:
+		return match(v)
+	case []interface{}:
+		for _, elem := range v {
+			if str, ok := elem.(string); ok && match(str) {
+				return true
 			}
+		}
+	}
+	return false
+}
+
+// matchElemMatch implements the $elemMatch operator
+// It matches when at least one array element satisfies every condition in the operand
+// The operand is either a filter applied to object elements ({"sku": "A1", "qty": {"$gt": 2}})
+// or an operator expression applied to scalar elements ({"$gte": 80, "$lt": 85})
+func (m MatchOptions) matchElemMatch(docValue interface{}, operand interface{}) bool {
+	docArray, isArray := docValue.([]interface{})
+	if !isArray {
+		return false
+	}
+
+	condition, ok := operand.(map[string]interface{})
+	if !ok || len(condition) == 0 {
+		return false
+	}
 
-			// Compare values
-			shouldSwap := false
-			if direction == "desc" {
-				shouldSwap = compareValues(val1, val2) < 0
-			} else {
-				shouldSwap = compareValues(val1, val2) > 0
+	ops, isOps := operatorExpression(condition)
+	for _, elem := range docArray {
+		if isOps {
+			if m.matchOperators(elem, true, ops) {
+				return true
 			}
+			continue
+		}
+		if elemDoc, isDoc := elem.(map[string]interface{}); isDoc && m.Matches(elemDoc, condition) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAll implements the $all operator
+// It matches when the array field contains every listed value (in any order)
+// A scalar field matches only if every listed value equals it
+func (m MatchOptions) matchAll(docValue interface{}, operand interface{}) bool {
+	list, ok := operand.([]interface{})
+	if !ok || len(list) == 0 {
+		return false
+	}
+
+	docArray, isArray := docValue.([]interface{})
+	if !isArray {
+		docArray = []interface{}{docValue}
+	}
+
+	for _, want := range list {
+		if !m.containsValue(docArray, want) {
+			return false
+		}
+	}
+	return true
+}
 
-			if shouldSwap {
-				docs[j], docs[j+1] = docs[j+1], docs[j]
+// matchSize implements the $size operator
+// It matches arrays with exactly the given number of elements
+func matchSize(docValue interface{}, operand interface{}) bool {
+	docArray, isArray := docValue.([]interface{})
+	if !isArray {
+		return false
+	}
+
+	size, ok := toFloat64(operand)
+	return ok && float64(len(docArray)) == size
+}
+
+// containsValue reports whether any element of list matches value
+func (m MatchOptions) containsValue(list []interface{}, value interface{}) bool {
+	for _, candidate := range list {
+		if m.valuesMatch(value, candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// valuesMatch compares two values for equality with explicit type rules:
+//   - Numbers compare numerically whatever their Go type (25 == 25.0)
+//   - Strings, bools and null only match values of the same kind; strings
+//     are equal when the Collation (if any) says so
+//   - Arrays match element by element, objects key by key, with these same rules
+//   - Unless StrictTypes is set, a string that parses as a number also
+//     matches that number (filters parsed from strings, e.g. "age=25")
+func (m MatchOptions) valuesMatch(docValue, filterValue interface{}) bool {
+	// Numbers, possibly of different Go types
+	docNum, docIsNum := toFloat64(docValue)
+	filterNum, filterIsNum := toFloat64(filterValue)
+	if docIsNum && filterIsNum {
+		return docNum == filterNum
+	}
+	if docIsNum || filterIsNum {
+		if m.StrictTypes {
+			return false
+		}
+		if docIsNum {
+			n, ok := numericString(filterValue)
+			return ok && n == docNum
+		}
+		n, ok := numericString(docValue)
+		return ok && n == filterNum
+	}
+
+	switch dv := docValue.(type) {
+	case nil:
+		return filterValue == nil
+	case string:
+		fv, ok := filterValue.(string)
+		if ok && m.Collation != nil {
+			return m.Collation.Compare(dv, fv) == 0
+		}
+		return ok && dv == fv
+	case bool:
+		fv, ok := filterValue.(bool)
+		return ok && dv == fv
+	case []interface{}:
+		fv, ok := filterValue.([]interface{})
+		if !ok || len(dv) != len(fv) {
+			return false
+		}
+		for i := range dv {
+			if !m.valuesMatch(dv[i], fv[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		fv, ok := filterValue.(map[string]interface{})
+		if !ok || len(dv) != len(fv) {
+			return false
+		}
+		for key, value := range dv {
+			other, exists := fv[key]
+			if !exists || !m.valuesMatch(value, other) {
+				return false
 			}
 		}
+		return true
+	}
+
+	// Other Go types (e.g. time.Time) must be identical
+	return reflect.DeepEqual(docValue, filterValue)
+}
+
+// numericString parses a string holding a number, such as "25" or "-1.5"
+func numericString(value interface{}) (float64, bool) {
+	str, ok := value.(string)
+	if !ok {
+		return 0, false
 	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	return n, err == nil
 }
 
 // compareValues compares two values and returns:
 //   -1 if a < b
 //    0 if a == b
 //    1 if a > b
+//
+// Values of different types are ordered by type, nulls first, then numbers,
+// strings, booleans and last objects, arrays and any other type (see
+// valueRank), so the order is the same whichever values are compared.
+// Values of the same type compare by value; objects and arrays by their
+// printed form
 func compareValues(a, b interface{}) int {
-	// Try numeric comparison first
-	aFloat, aOk := toFloat64(a)
-	bFloat, bOk := toFloat64(b)
+	aRank, bRank := valueRank(a), valueRank(b)
+	if aRank != bRank {
+		if aRank < bRank {
+			return -1
+		}
+		return 1
+	}
 
-	if aOk && bOk {
+	switch aRank {
+	case rankNull:
+		return 0
+	case rankNumber:
+		aFloat, _ := toFloat64(a)
+		bFloat, _ := toFloat64(b)
 		if aFloat < bFloat {
 			return -1
 		} else if aFloat > bFloat {
 			return 1
 		}
 		return 0
+	case rankString:
+		return strings.Compare(a.(string), b.(string))
+	case rankBool:
+		if a.(bool) == b.(bool) {
+			return 0
+		} else if b.(bool) {
+			return -1
+		}
+		return 1
 	}
 
-	// Fall back to string comparison
-	aStr := fmt.Sprintf("%v", a)
-	bStr := fmt.Sprintf("%v", b)
+	return strings.Compare(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b))
+}
 
-	if aStr < bStr {
-		return -1
-	} else if aStr > bStr {
-		return 1
+// Ranks of the types compareValues orders values by
+const (
+	rankNull = iota
+	rankNumber
+	rankString
+	rankBool
+	rankOther // Objects, arrays and any other type
+)
+
+// valueRank returns the rank of a value's type, for compareValues
+func valueRank(value interface{}) int {
+	if value == nil {
+		return rankNull
 	}
-	return 0
+	if _, ok := toFloat64(value); ok {
+		return rankNumber
+	}
+	switch value.(type) {
+	case string:
+		return rankString
+	case bool:
+		return rankBool
+	}
+	return rankOther
 }
 
 // toFloat64 attempts to convert a value to float64
@@ -188,6 +788,15 @@ func toFloat64(val interface{}) (float64, bool) {
 		return float64(v), true
 	case int64:
 		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
 	default:
 		return 0, false
 	}
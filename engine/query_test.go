@@ -0,0 +1,189 @@
+package engine
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMatchInAndNotIn(t *testing.T) {
+	docs := map[string]string{
+		"scalar":       `{"role": "admin"}`,
+		"number":       `{"role": 1}`,
+		"array":        `{"role": ["admin", "editor"]}`,
+		"empty array":  `{"role": []}`,
+		"mixed array":  `{"role": ["1", 2, true, null]}`,
+		"nested array": `{"role": [["admin"], "viewer"]}`,
+		"null":         `{"role": null}`,
+		"missing":      `{}`,
+	}
+
+	tests := []struct {
+		name   string
+		list   string   // The $in / $nin operand, as JSON
+		strict bool     // Match with StrictTypes, so strings never equal numbers
+		in     []string // Documents $in matches; $nin matches every other one
+	}{
+		{"scalar in list", `["admin", "owner"]`, false, []string{"scalar", "array"}},
+		{"array and list intersect", `["editor"]`, false, []string{"array"}},
+		{"no overlap", `["owner", "guest"]`, false, nil},
+		{"empty list", `[]`, false, nil},
+		{"numbers compare by value", `[1.0, 2]`, false, []string{"number", "mixed array"}},
+		{"numeric strings match numbers", `["2"]`, false, []string{"mixed array"}},
+		{"strict strings never equal numbers", `["2"]`, true, nil},
+		{"strict string digits match strings only", `["1"]`, true, []string{"mixed array"}},
+		{"booleans", `[true]`, false, []string{"mixed array"}},
+		{"null matches null values, not missing fields", `[null]`, false, []string{"mixed array", "null"}},
+		{"only one level of array is searched", `["admin"]`, true, []string{"scalar", "array"}},
+		{"a list element that is an array matches a whole array element", `[["admin"]]`, false, []string{"nested array"}},
+		{"mixed list", `["viewer", 1, false]`, true, []string{"number", "nested array"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var list []interface{}
+			if err := json.Unmarshal([]byte(tt.list), &list); err != nil {
+				t.Fatal(err)
+			}
+			in := make(map[string]bool)
+			for _, name := range tt.in {
+				in[name] = true
+			}
+			match := MatchOptions{StrictTypes: tt.strict}
+			for name, source := range docs {
+				var doc map[string]interface{}
+				if err := json.Unmarshal([]byte(source), &doc); err != nil {
+					t.Fatal(err)
+				}
+				if got := match.Matches(doc, map[string]interface{}{"role": map[string]interface{}{"$in": list}}); got != in[name] {
+					t.Errorf("$in %s on %s: got %v, want %v", tt.list, name, got, in[name])
+				}
+				if got := match.Matches(doc, map[string]interface{}{"role": map[string]interface{}{"$nin": list}}); got != !in[name] {
+					t.Errorf("$nin %s on %s: got %v, want %v", tt.list, name, got, !in[name])
+				}
+			}
+		})
+	}
+}
+
+func TestMatchInMalformedOperand(t *testing.T) {
+	doc := map[string]interface{}{"role": "admin"}
+	for _, operand := range []interface{}{"admin", nil, map[string]interface{}{"admin": true}} {
+		for _, op := range []string{"$in", "$nin"} {
+			if MatchesFilter(doc, map[string]interface{}{"role": map[string]interface{}{op: operand}}) {
+				t.Errorf("%s with operand %v matched", op, operand)
+			}
+		}
+	}
+}
+
+func TestFindIn(t *testing.T) {
+	db := openTestDatabase(t)
+	coll := db.GetCollection("users")
+	for _, doc := range []map[string]interface{}{
+		{"id": "alice", "roles": []interface{}{"admin", "editor"}},
+		{"id": "bob", "roles": []interface{}{"viewer"}},
+		{"id": "carol", "roles": "owner"},
+		{"id": "dave"},
+	} {
+		if _, err := coll.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter map[string]interface{}
+		want   []string
+	}{
+		{"$in over arrays and scalars", map[string]interface{}{"roles": map[string]interface{}{"$in": []interface{}{"admin", "owner"}}}, []string{"alice", "carol"}},
+		{"$nin includes missing fields", map[string]interface{}{"roles": map[string]interface{}{"$nin": []interface{}{"admin", "owner"}}}, []string{"bob", "dave"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make(map[string]bool)
+			for _, doc := range coll.Find(tt.filter) {
+				got[doc["id"].(string)] = true
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for _, id := range tt.want {
+				if !got[id] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// TestCompareValues checks that values of different types are ordered by
+// type, so the order is transitive, and values of a type by value
+func TestCompareValues(t *testing.T) {
+	// Each value sorts before the ones after it, so every pair must compare so
+	ordered := []interface{}{
+		nil,
+		-1.5, 2, int64(10), json.Number("25"),
+		"", "10", "9", "apple",
+		false, true,
+		[]interface{}{1}, map[string]interface{}{"a": 1},
+	}
+	for i, a := range ordered {
+		for j, b := range ordered {
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			if got := compareValues(a, b); got != want {
+				t.Errorf("compareValues(%#v, %#v) = %d, want %d", a, b, got, want)
+			}
+		}
+	}
+
+	equal := [][2]interface{}{
+		{2, 2.0},
+		{int64(3), json.Number("3")},
+		{"x", "x"},
+		{true, true},
+		{[]interface{}{1, "a"}, []interface{}{1, "a"}},
+	}
+	for _, pair := range equal {
+		if got := compareValues(pair[0], pair[1]); got != 0 {
+			t.Errorf("compareValues(%#v, %#v) = %d, want 0", pair[0], pair[1], got)
+		}
+	}
+}
+
+// TestAggregateMinMaxMixedTypes checks that $min and $max pick the same
+// values whatever order the documents come in
+func TestAggregateMinMaxMixedTypes(t *testing.T) {
+	values := []interface{}{"10", 9, true, "abc", 100, false}
+	pipeline := []map[string]interface{}{{"$group": map[string]interface{}{
+		"_id": nil,
+		"min": map[string]interface{}{"$min": "$v"},
+		"max": map[string]interface{}{"$max": "$v"},
+	}}}
+	for shift := range values {
+		db := openTestDatabase(t)
+		coll := db.GetCollection("docs")
+		for i := range values {
+			if _, err := coll.Insert(map[string]interface{}{"v": values[(i+shift)%len(values)]}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		got, err := coll.Aggregate(pipeline)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 {
+			t.Fatalf("got %d groups, want 1", len(got))
+		}
+		if min, _ := toFloat64(got[0]["min"]); min != 9 {
+			t.Fatalf("shift %d: $min is %v, want 9", shift, got[0]["min"])
+		}
+		if got[0]["max"] != true {
+			t.Fatalf("shift %d: $max is %v, want true", shift, got[0]["max"])
+		}
+	}
+}
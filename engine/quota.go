@@ -0,0 +1,113 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Limit names, as reported in LimitError.Limit
+const (
+	LimitFileBytes     = "file_bytes"     // Limits.MaxFileBytes
+	LimitDocuments     = "documents"      // Limits.MaxDocuments
+	LimitDocumentBytes = "document_bytes" // Limits.MaxDocumentBytes
+)
+
+// ErrLimitExceeded matches (with errors.Is) the LimitError returned when a
+// write would take the database over one of its limits (see WithLimits)
+var ErrLimitExceeded = errors.New("database limit exceeded")
+
+// Limits caps how large a database may grow; a zero field means no limit
+// Writes are checked before they are made, so one that would cross a limit
+// is refused whole and changes nothing. Deletions, compaction and index
+// changes are never refused, so a database at its limit can be trimmed
+type Limits struct {
+	MaxFileBytes     int64 `json:"maxFileBytes"`     // Size of the storage file, counting the records a write appends as the engine encodes them
+	MaxDocuments     int   `json:"maxDocuments"`     // Documents in each collection
+	MaxDocumentBytes int   `json:"maxDocumentBytes"` // Size of a single document, encoded as JSON
+}
+
+// LimitError reports a write refused because it would exceed a limit
+type LimitError struct {
+	Limit      string // Which limit: LimitFileBytes, LimitDocuments or LimitDocumentBytes
+	Collection string // Collection written to
+	ID         string // Document over LimitDocumentBytes; empty for the other limits
+	Max        int64  // The configured limit
+	Size       int64  // What the write would have made it
+}
+
+func (e *LimitError) Error() string {
+	switch e.Limit {
+	case LimitDocuments:
+		return fmt.Sprintf("collection %s would hold %d documents, over its limit of %d", e.Collection, e.Size, e.Max)
+	case LimitDocumentBytes:
+		return fmt.Sprintf("document %s in collection %s is %d bytes, over the limit of %d", e.ID, e.Collection, e.Size, e.Max)
+	}
+	return fmt.Sprintf("database file would grow to %d bytes, over its limit of %d", e.Size, e.Max)
+}
+
+// Is makes errors.Is(err, ErrLimitExceeded) match
+func (e *LimitError) Is(target error) bool {
+	return target == ErrLimitExceeded
+}
+
+// validLimits checks that no limit is negative
+func validLimits(limits Limits) error {
+	if limits.MaxFileBytes < 0 || limits.MaxDocuments < 0 || limits.MaxDocumentBytes < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	return nil
+}
+
+// checkLimits makes sure writing records, which add added new documents to
+// the collection, keeps within its document limits; the file size limit is
+// checked by the storage engine as it writes (see CheckFileSize)
+// Caller must have locked the documents written (see lockInsert and lockAll)
+func (c *Collection) checkLimits(records []StorageRecord, added int) error {
+	limits := c.limits
+	if limits.MaxDocuments == 0 && limits.MaxDocumentBytes == 0 {
+		return nil
+	}
+
+	c.mu.RLock()
+	count := c.documents.len()
+	c.mu.RUnlock()
+	if limits.MaxDocuments > 0 && added > 0 && count+added > limits.MaxDocuments {
+		return &LimitError{Limit: LimitDocuments, Collection: c.name, Max: int64(limits.MaxDocuments), Size: int64(count + added)}
+	}
+
+	if limits.MaxDocumentBytes == 0 {
+		return nil
+	}
+	for _, record := range records {
+		if record.Doc == nil {
+			continue
+		}
+		data, err := json.Marshal(record.Doc)
+		if err != nil {
+			return fmt.Errorf("failed to marshal document %s: %w", record.ID, err)
+		}
+		if len(data) > limits.MaxDocumentBytes {
+			return &LimitError{Limit: LimitDocumentBytes, Collection: c.name, ID: record.ID, Max: int64(limits.MaxDocumentBytes), Size: int64(len(data))}
+		}
+	}
+	return nil
+}
+
+// CheckFileSize makes sure appending records, written bytes once encoded,
+// keeps a file of size bytes within max; 0 means no limit
+// Only writes that store document or attachment data are refused, so
+// deletions and index changes still go through. A storage engine enforcing
+// Limits.MaxFileBytes (through a SetMaxSize(max int64) method) calls it under
+// its write lock, so concurrent writers can't all squeeze under the limit
+func CheckFileSize(records []StorageRecord, size, written, max int64) error {
+	if max <= 0 || size+written <= max {
+		return nil
+	}
+	for _, record := range records {
+		if record.Doc != nil || (record.Attachment != nil && len(record.Attachment.Data) > 0) {
+			return &LimitError{Limit: LimitFileBytes, Collection: record.Collection, Max: max, Size: size + written}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFileLimitUsesEncodedSize(t *testing.T) {
+	// A highly compressible document: its JSON is far larger than the limit
+	// headroom, but its gzip frame is not
+	text := strings.Repeat("tetodb ", 2000)
+
+	tests := []struct {
+		name string
+		opts []Option
+		fits bool
+	}{
+		{"json lines", nil, false},
+		{"binary", []Option{WithStorageFormat(FormatBinary)}, false},
+		{"compressed", []Option{WithCompression(CompressionGzip)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			limit := int64(4096)
+			db, err := OpenDatabase(path, append(tt.opts, WithLimits(Limits{MaxFileBytes: limit}))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			_, err = db.GetCollection("docs").Insert(map[string]interface{}{"text": text})
+			if tt.fits && err != nil {
+				t.Fatalf("compressed insert refused: %v", err)
+			}
+			var limitErr *LimitError
+			if !tt.fits && (!errors.As(err, &limitErr) || limitErr.Limit != LimitFileBytes || limitErr.Collection != "docs") {
+				t.Fatalf("got %v, want a file size LimitError", err)
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() > limit {
+				t.Fatalf("file grew to %d bytes, over its limit of %d", info.Size(), limit)
+			}
+		})
+	}
+}
+
+func TestFileLimitIsExact(t *testing.T) {
+	for _, backend := range []string{"file", "memory"} {
+		t.Run(backend, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			if backend == "memory" {
+				path = MemoryPath
+			}
+			// Find out how large two inserts make the file
+			db, err := OpenDatabase(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizer := db.storage.(storageSizer)
+			doc := map[string]interface{}{"id": "a", "n": 1}
+			if _, err := db.GetCollection("docs").Insert(doc); err != nil {
+				t.Fatal(err)
+			}
+			doc["id"] = "b"
+			if _, err := db.GetCollection("docs").Insert(doc); err != nil {
+				t.Fatal(err)
+			}
+			limit := sizer.Size()
+			db.Close()
+			if backend == "file" {
+				os.Remove(path)
+			}
+
+			// A limit of exactly that size takes the two, and refuses a third
+			db, err = OpenDatabase(path, WithLimits(Limits{MaxFileBytes: limit}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			coll := db.GetCollection("docs")
+			for _, id := range []string{"a", "b"} {
+				doc["id"] = id
+				if _, err := coll.Insert(doc); err != nil {
+					t.Fatalf("insert %s: %v", id, err)
+				}
+			}
+			doc["id"] = "c"
+			if _, err := coll.Insert(doc); !errors.Is(err, ErrLimitExceeded) {
+				t.Fatalf("got %v, want ErrLimitExceeded", err)
+			}
+			if got := coll.Count(); got != 2 {
+				t.Fatalf("got %d documents, want 2", got)
+			}
+
+			// Deletions and index changes still go through at the limit
+			if err := coll.Delete("a"); err != nil {
+				t.Fatalf("delete at the limit: %v", err)
+			}
+			if err := coll.CreateIndex("n"); err != nil {
+				t.Fatalf("index at the limit: %v", err)
+			}
+		})
+	}
+}
+
+func TestFileLimitConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	limit := int64(8192)
+	db, err := OpenDatabase(path, WithLimits(Limits{MaxFileBytes: limit}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Every writer checks against the size the others have reached, so
+	// together they can't go past the limit, even in separate collections
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			coll := db.GetCollection(fmt.Sprintf("docs%d", w))
+			for i := 0; i < 50; i++ {
+				if _, err := coll.Insert(map[string]interface{}{"pad": strings.Repeat("x", 100)}); err != nil {
+					if !errors.Is(err, ErrLimitExceeded) {
+						t.Error(err)
+					}
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if size := db.storage.(storageSizer).Size(); size > limit {
+		t.Fatalf("file grew to %d bytes, over its limit of %d", size, limit)
+	}
+}
+
+func TestDocumentLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		docs   []map[string]interface{}
+		limit  string // Limit the last insert crosses
+	}{
+		{
+			name:   "documents",
+			limits: Limits{MaxDocuments: 2},
+			docs:   []map[string]interface{}{{"n": 1}, {"n": 2}, {"n": 3}},
+			limit:  LimitDocuments,
+		},
+		{
+			name:   "document bytes",
+			limits: Limits{MaxDocumentBytes: 64},
+			docs:   []map[string]interface{}{{"n": 1}, {"text": strings.Repeat("x", 64)}},
+			limit:  LimitDocumentBytes,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDatabase(t, WithLimits(tt.limits))
+			coll := db.GetCollection("docs")
+			last := len(tt.docs) - 1
+			for _, doc := range tt.docs[:last] {
+				if _, err := coll.Insert(doc); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var limitErr *LimitError
+			if _, err := coll.Insert(tt.docs[last]); !errors.As(err, &limitErr) || limitErr.Limit != tt.limit {
+				t.Fatalf("got %v, want a %s LimitError", err, tt.limit)
+			}
+			if got := coll.Count(); got != last {
+				t.Fatalf("got %d documents, want %d", got, last)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+// DamagedRecord describes a stretch of a storage file that Repair could not
+// read, from where it starts to the next readable record
+type DamagedRecord struct {
+	Offset  int64  `json:"offset"`  // Byte offset in the file where the damage starts
+	Length  int64  `json:"length"`  // Bytes skipped to reach the next readable record
+	Message string `json:"message"` // What went wrong
+}
+
+// RepairReport is the result of repairing a storage file with Repair
+type RepairReport struct {
+	Path          string          `json:"path"`           // File that was repaired; it is left as it was
+	Output        string          `json:"output"`         // Fresh file holding every record that could be read
+	FormatVersion int             `json:"format_version"` // Storage format of both files (FormatJSONLines or FormatBinary)
+	Encrypted     bool            `json:"encrypted"`      // Both files are encrypted under the same passphrase
+	Records       int             `json:"records"`        // Records recovered into the output
+	Damaged       []DamagedRecord `json:"damaged"`        // Every unreadable stretch, in file order
+	LostBytes     int64           `json:"lost_bytes"`     // Total length of the damaged stretches
+	Collections   map[string]int  `json:"collections"`    // Live documents per collection in the output
+	Documents     int             `json:"documents"`      // Total live documents in the output
+}
+
+// Summary describes the repair in one line
+func (r *RepairReport) Summary() string {
+	return fmt.Sprintf("recovered %d records (%d documents in %d collections) from %s into %s; %d damaged, %d bytes lost",
+		r.Records, r.Documents, len(r.Collections), r.Path, r.Output, len(r.Damaged), r.LostBytes)
+}
+
+// repairPath returns where Repair writes the repaired copy of a file
+func repairPath(path string) string {
+	return path + ".repaired"
+}
+
+// Repair scans a damaged storage file, reports every unreadable record with
+// its byte offset, and writes the records it could read to a fresh file
+// beside it (see RepairReport.Output), in the same format and encryption
+// The original is not changed: check the output, e.g. with ValidateFile or
+// OpenDatabaseAt, then move it over the original yourself. A lost update or
+// delete leaves its document as the record before it had it
+// In the binary format, reading resumes at the next intact frame after a
+// damaged one, so a corrupt length doesn't lose the rest of the file
+// Encrypted files need their passphrase, given with WithEncryption. The
+// file is locked as by WithReadOnly while it is read, so it can't be
+// repaired while a database has it open for writing; a checkpointed
+// database's snapshot file is repaired separately
+func Repair(path string, opts ...Option) (RepairReport, error) {
+	options := buildOptions(opts)
+	report := RepairReport{
+		Path:        path,
+		Output:      repairPath(path),
+		Collections: make(map[string]int),
+	}
+
+	lock, err := lockDatabase(path, true)
+	if err != nil {
+		return report, err
+	}
+	defer closeLock(lock)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return report, fmt.Errorf("failed to read file: %w", err)
+	}
+	reader, err := newRecordReader(bytes.NewReader(data))
+	if err != nil {
+		return report, err
+	}
+	report.FormatVersion = reader.format
+	report.Encrypted = reader.encrypted
+
+	r := &repairer{report: &report, version: 1}
+	r.codec = reader.codec
+	enc := recordEncoding{format: reader.format, codec: reader.codec}
+	if reader.encrypted {
+		if options.Passphrase == "" {
+			return report, fmt.Errorf("storage file is encrypted; a passphrase is required")
+		}
+		if r.cipher, err = openFileCipher(options.Passphrase, reader.keyBlock); err != nil {
+			return report, err
+		}
+		enc.cipher = r.cipher
+	}
+	if reader.format == FormatBinary {
+		r.scanFrames(data, int(reader.offset))
+		if r.compressed {
+			enc.compression = CompressionGzip
+		}
+	} else {
+		r.scanLines(data)
+	}
+
+	if err := checkVersion(r.version); err != nil {
+		return report, err
+	}
+	records, err := migrate(r.records, r.version)
+	if err != nil {
+		return report, err
+	}
+	if err := writeRepaired(report.Output, enc, FileHeader{Version: StorageVersion, Compacted: r.compacted}, records); err != nil {
+		return report, err
+	}
+
+	report.Records = len(records)
+	for collName, ids := range liveDocuments(records) {
+		report.Collections[collName] = ids
+		report.Documents += ids
+	}
+	return report, nil
+}
+
+// repairer collects the readable records of a file for Repair
+type repairer struct {
+	report     *RepairReport
+	cipher     *fileCipher // Decrypts payloads of an encrypted file
+	codec      string      // Codec of the payloads
+	records    []StorageRecord
+	version    int   // Storage version from the header record; 1 if the file has none
+	compacted  int64 // FileHeader.Compacted from the header record
+	lastSeq    uint64
+	compressed bool // Some payloads were compressed, so the output compresses too
+}
+
+// damage records an unreadable stretch of the file
+func (r *repairer) damage(start, end int, message string) {
+	r.report.Damaged = append(r.report.Damaged, DamagedRecord{Offset: int64(start), Length: int64(end - start), Message: message})
+	r.report.LostBytes += int64(end - start)
+}
+
+// add decodes the payload of the record spanning start to end, reporting
+// it as damaged if it isn't a well-formed record
+func (r *repairer) add(payload []byte, start, end int) {
+	record, err := decodeRecord(payload, r.codec, false)
+	if err != nil {
+		r.damage(start, end, err.Error())
+		return
+	}
+	if record.Header != nil {
+		r.version, r.compacted = record.Header.Version, record.Header.Compacted
+		return
+	}
+	if record.Collection == "" || record.ID == "" {
+		r.damage(start, end, "record is missing collection or id")
+		return
+	}
+
+	// Legacy records have no sequence number, give them the next one
+	if record.Seq == 0 {
+		record.Seq = r.lastSeq + 1
+	}
+	if record.Seq > r.lastSeq {
+		r.lastSeq = record.Seq
+	}
+	r.records = append(r.records, record)
+}
+
+// scanLines reads the records of a JSON-lines file
+func (r *repairer) scanLines(data []byte) {
+	for start := 0; start < len(data); {
+		end := len(data)
+		if i := bytes.IndexByte(data[start:], '\n'); i >= 0 {
+			end = start + i + 1
+		}
+		line := bytes.TrimSuffix(bytes.TrimSuffix(data[start:end], []byte("\n")), []byte("\r"))
+		if len(line) > 0 {
+			if data[end-1] != '\n' && !json.Valid(line) {
+				r.damage(start, end, "file ends partway through a record")
+			} else {
+				r.add(line, start, end)
+			}
+		}
+		start = end
+	}
+}
+
+// scanFrames reads the records of a binary file from offset start, the end
+// of its header. After a damaged frame it scans byte by byte for the next
+// intact one, since the damage may have hit the length that leads to it
+func (r *repairer) scanFrames(data []byte, start int) {
+	for off := start; off < len(data); {
+		if !frameAt(data, off) {
+			next := resyncFrame(data, off)
+			r.damage(off, next, frameDamage(data, off))
+			off = next
+			continue
+		}
+
+		length := binary.BigEndian.Uint32(data[off:])
+		end := off + binaryFrameHeader + int(length&^frameCompressed)
+		payload := data[off+binaryFrameHeader : end]
+		var err error
+		if r.cipher != nil {
+			payload, err = r.cipher.open(payload)
+		}
+		if err == nil && length&frameCompressed != 0 {
+			r.compressed = true
+			payload, err = gunzipBytes(payload)
+		}
+		if err != nil {
+			r.damage(off, end, errRecordEncoding.Error())
+		} else {
+			r.add(payload, off, end)
+		}
+		off = end
+	}
+}
+
+// frameAt reports whether an intact binary record frame starts at off: a
+// non-empty payload within the file that matches its checksum
+func frameAt(data []byte, off int) bool {
+	if len(data)-off < binaryFrameHeader {
+		return false
+	}
+	length := binary.BigEndian.Uint32(data[off:]) &^ frameCompressed
+	if length == 0 || length > maxRecordBytes || int64(length) > int64(len(data)-off-binaryFrameHeader) {
+		return false
+	}
+	payload := data[off+binaryFrameHeader : off+binaryFrameHeader+int(length)]
+	return crc32.Checksum(payload, crcTable) == binary.BigEndian.Uint32(data[off+4:])
+}
+
+// resyncFrame finds where reading resumes after the damaged frame at off:
+// where its length says it ends if an intact frame (or the end of the file)
+// is there, since usually only the payload was hit, otherwise the next
+// intact frame
+func resyncFrame(data []byte, off int) int {
+	if len(data)-off >= binaryFrameHeader {
+		length := int64(binary.BigEndian.Uint32(data[off:]) &^ frameCompressed)
+		if end := int64(off) + binaryFrameHeader + length; length > 0 && end <= int64(len(data)) {
+			if end == int64(len(data)) || frameAt(data, int(end)) {
+				return int(end)
+			}
+		}
+	}
+	next := off + 1
+	for next < len(data) && !frameAt(data, next) {
+		next++
+	}
+	return next
+}
+
+// frameDamage explains why no intact frame starts at off
+func frameDamage(data []byte, off int) string {
+	if len(data)-off < binaryFrameHeader {
+		return "file ends partway through a record"
+	}
+	length := binary.BigEndian.Uint32(data[off:]) &^ frameCompressed
+	switch {
+	case length > maxRecordBytes:
+		return fmt.Sprintf("record length %d exceeds the %d byte limit", length, maxRecordBytes)
+	case int64(length) > int64(len(data)-off-binaryFrameHeader):
+		return fmt.Sprintf("record length %d runs past the end of the file", length)
+	case length == 0:
+		return "record is empty"
+	}
+	return errRecordChecksum.Error()
+}
+
+// writeRepaired writes a repaired file through a temporary file
+func writeRepaired(path string, enc recordEncoding, header FileHeader, records []StorageRecord) error {
+	tempPath := path + ".tmp"
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("failed to create repaired file: %w", err)
+	}
+	fail := func(err error) error {
+		file.Close()
+		os.Remove(tempPath)
+		return err
+	}
+
+	buffered := bufio.NewWriter(file)
+	if _, _, err := writeLog(buffered, enc, header, records); err != nil {
+		return fail(err)
+	}
+	if err := buffered.Flush(); err != nil {
+		return fail(fmt.Errorf("failed to write repaired file: %w", err))
+	}
+	if err := file.Sync(); err != nil {
+		return fail(fmt.Errorf("failed to sync repaired file: %w", err))
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to close repaired file: %w", err)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return fmt.Errorf("failed to rename repaired file: %w", err)
+	}
+	return nil
+}
+
+// liveDocuments counts the documents per collection left after replaying
+// records, leaving out collections that end up empty
+func liveDocuments(records []StorageRecord) map[string]int {
+	live := make(map[string]map[string]bool)
+	for _, record := range records {
+		if record.Index != nil || record.Attachment != nil {
+			continue
+		}
+		if live[record.Collection] == nil {
+			live[record.Collection] = make(map[string]bool)
+		}
+		if record.Doc == nil {
+			delete(live[record.Collection], record.ID)
+		} else {
+			live[record.Collection][record.ID] = true
+		}
+	}
+
+	counts := make(map[string]int)
+	for collName, ids := range live {
+		if len(ids) > 0 {
+			counts[collName] = len(ids)
+		}
+	}
+	return counts
+}
@@ -0,0 +1,180 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ErrHistoryDiscarded is returned when restoring to a time whose records
+// compaction (or a checkpoint) has already discarded
+var ErrHistoryDiscarded = errors.New("history before this time was discarded by compaction")
+
+// historyKeeper backends keep superseded records until compaction and
+// report when it last discarded them (see RestoreTo)
+type historyKeeper interface {
+	CompactedAt() time.Time
+}
+
+// recordTime returns the time to stamp a record written now with
+func recordTime() int64 {
+	return time.Now().UnixNano()
+}
+
+// recordsAt returns the records written up to at, in log order
+// Records from files written before records were timestamped have no time
+// and are always kept
+func recordsAt(records []StorageRecord, at time.Time) []StorageRecord {
+	limit := at.UnixNano()
+	kept := make([]StorageRecord, 0, len(records))
+	for _, record := range records {
+		if record.Time == 0 || record.Time <= limit {
+			kept = append(kept, record)
+		}
+	}
+	return kept
+}
+
+// checkHistory makes sure the storage still holds every record written up
+// to at, so the state then can be rebuilt from them
+func (db *Database) checkHistory(at time.Time) error {
+	keeper, ok := db.storage.(historyKeeper)
+	if !ok {
+		return fmt.Errorf("point-in-time restore is not supported by this storage engine")
+	}
+	if compacted := keeper.CompactedAt(); !compacted.IsZero() && at.Before(compacted) {
+		return fmt.Errorf("cannot restore to %s: %w at %s", at.Format(time.RFC3339Nano), ErrHistoryDiscarded, compacted.Format(time.RFC3339Nano))
+	}
+	return nil
+}
+
+// OpenDatabaseAt opens the database at path read-only, as it was at the
+// given time: records written after it are ignored. The file is not changed,
+// so this is the way to look at a past state before deciding to restore it
+// It takes a shared lock like WithReadOnly, so it cannot open a database
+// another process has open for writing; use RestoreTo on that one instead
+func OpenDatabaseAt(path string, at time.Time, opts ...Option) (*Database, error) {
+	opts = append(opts, WithReadOnly(), func(o *Options) {
+		o.asOf = at
+	})
+	return OpenDatabase(path, opts...)
+}
+
+// RestoreTo rolls every collection back to its documents at the given time,
+// undoing the writes made since, such as an accidental mass delete
+// The rollback is written to the log as new records, one per document that
+// changed, in a single batch; the history is kept, so a restore can itself
+// be undone by restoring to a time after it. Index definitions and
+// attachments are left as they are now, except that documents the restore
+// deletes lose theirs
+// Fails with ErrHistoryDiscarded if compaction has discarded the records the
+// state at that time is built from
+func (db *Database) RestoreTo(at time.Time) error {
+	changes := db.changeSet()
+	defer changes.deliver()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.checkHistory(at); err != nil {
+		return err
+	}
+	if err := db.loadPending(); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(db.collections))
+	for name := range db.collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		db.collections[name].writers.Lock()
+		db.collections[name].mu.Lock()
+	}
+	defer func() {
+		for _, name := range names {
+			db.collections[name].mu.Unlock()
+			db.collections[name].writers.Unlock()
+		}
+	}()
+
+	history, err := db.storage.ReadSince(0)
+	if err != nil {
+		return fmt.Errorf("failed to read history: %w", err)
+	}
+
+	// Replay the documents as they were at that time
+	past := make(map[string]map[string]map[string]interface{})
+	for _, record := range recordsAt(history, at) {
+		if record.Index != nil || record.Attachment != nil || record.Header != nil {
+			continue
+		}
+		if past[record.Collection] == nil {
+			past[record.Collection] = make(map[string]map[string]interface{})
+		}
+		if record.Doc == nil {
+			delete(past[record.Collection], record.ID)
+		} else {
+			past[record.Collection][record.ID] = record.Doc
+		}
+	}
+
+	// Write back what differs from now: documents added since are deleted,
+	// changed or deleted ones get their old version again
+	now := recordTime()
+	var records []StorageRecord
+	for collName, coll := range db.collections {
+		for id := range coll.documents.all() {
+			if _, existed := past[collName][id]; !existed {
+				records = append(records, StorageRecord{Collection: collName, ID: id, Time: now, Op: OpDelete})
+			}
+		}
+	}
+	for collName, docs := range past {
+		current := &documentStore{}
+		if coll, exists := db.collections[collName]; exists {
+			current = coll.documents.snapshot()
+		}
+		for id, doc := range docs {
+			existing, exists := current.get(id)
+			if exists && sameJSON(existing, doc) {
+				continue
+			}
+
+			// A new version, even of a document that was deleted: writers
+			// holding a version from before the restore must see a conflict
+			restored := copyDocument(doc)
+			if documentVersion(existing) > documentVersion(doc) {
+				stampVersion(restored, existing)
+			} else {
+				stampVersion(restored, doc)
+			}
+			op := OpUpdate
+			if !exists {
+				op = OpInsert
+			}
+			records = append(records, StorageRecord{Collection: collName, ID: id, Doc: restored, Time: now, Op: op})
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	if err := db.storage.AppendBatch(records); err != nil {
+		return fmt.Errorf("failed to persist restore: %w", err)
+	}
+
+	for _, record := range records {
+		coll, exists := db.collections[record.Collection]
+		if !exists {
+			// Nobody else can reach it yet: db.mu is held
+			coll = db.newCollection(record.Collection)
+			db.collections[record.Collection] = coll
+		}
+		changes.add(coll, record)
+		coll.applyRecord(record)
+	}
+	return nil
+}
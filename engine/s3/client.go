@@ -0,0 +1,260 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// errNotFound reports a missing object
+var errNotFound = errors.New("object not found")
+
+// client is a minimal S3 client: path-style requests (endpoint/bucket/key)
+// signed with AWS Signature Version 4, which S3-compatible stores accept too
+type client struct {
+	endpoint     *url.URL
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	http         *http.Client
+	now          func() time.Time // Clock used to sign requests (overridable for tests)
+}
+
+// put uploads an object
+func (c *client) put(ctx context.Context, bucket, key string, body []byte) error {
+	_, err := c.do(ctx, http.MethodPut, bucket, key, nil, body)
+	return err
+}
+
+// get downloads an object, failing with errNotFound if it doesn't exist
+func (c *client) get(ctx context.Context, bucket, key string) ([]byte, error) {
+	return c.do(ctx, http.MethodGet, bucket, key, nil, nil)
+}
+
+// delete removes an object; deleting a missing object succeeds
+func (c *client) delete(ctx context.Context, bucket, key string) error {
+	_, err := c.do(ctx, http.MethodDelete, bucket, key, nil, nil)
+	if errors.Is(err, errNotFound) {
+		return nil
+	}
+	return err
+}
+
+// listResult is the part of a ListObjectsV2 response the client reads
+type listResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// list returns the keys of every object whose key starts with prefix
+func (c *client) list(ctx context.Context, bucket, prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		body, err := c.do(ctx, http.MethodGet, bucket, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result listResult
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("invalid list response: %w", err)
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// errorResponse is the body of a failed S3 request
+type errorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do sends a signed request and returns the response body
+func (c *client) do(ctx context.Context, method, bucket, key string, query url.Values, body []byte) ([]byte, error) {
+	target := *c.endpoint
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + bucket
+	if key != "" {
+		target.Path += "/" + key
+	}
+	target.RawPath = uriEncode(target.Path, false) // Sent as signed
+	target.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	c.sign(req, body)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound && key != "" {
+		return nil, errNotFound
+	}
+	if resp.StatusCode >= 300 {
+		var failure errorResponse
+		if xml.Unmarshal(data, &failure) == nil && failure.Code != "" {
+			return nil, fmt.Errorf("%s %s: %s: %s", method, target.Path, failure.Code, failure.Message)
+		}
+		return nil, fmt.Errorf("%s %s: %s", method, target.Path, resp.Status)
+	}
+	return data, nil
+}
+
+// sign adds the Signature Version 4 headers to a request
+func (c *client) sign(req *http.Request, body []byte) {
+	now := c.now().UTC()
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" || lower == "content-type" {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	authorization := signature{
+		method:      req.Method,
+		path:        req.URL.Path,
+		query:       req.URL.RawQuery,
+		headers:     headers,
+		payloadHash: payloadHash,
+		time:        now,
+		region:      c.region,
+		accessKey:   c.accessKey,
+		secretKey:   c.secretKey,
+	}.authorization()
+	req.Header.Set("Authorization", authorization)
+}
+
+// signature holds what a Signature Version 4 signature covers
+type signature struct {
+	method      string
+	path        string            // Unescaped request path
+	query       string            // Canonical query string (see canonicalQuery)
+	headers     map[string]string // Signed headers, by lowercase name
+	payloadHash string
+	time        time.Time
+	region      string
+	accessKey   string
+	secretKey   string
+}
+
+// authorization returns the Authorization header value
+func (s signature) authorization() string {
+	names := make([]string, 0, len(s.headers))
+	for name := range s.headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonical strings.Builder
+	canonical.WriteString(s.method + "\n")
+	canonical.WriteString(uriEncode(s.path, false) + "\n")
+	canonical.WriteString(s.query + "\n")
+	for _, name := range names {
+		canonical.WriteString(name + ":" + s.headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonical.WriteString("\n" + signedHeaders + "\n" + s.payloadHash)
+
+	date := s.time.Format("20060102")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + s.time.Format("20060102T150405Z") + "\n" + scope + "\n" + sha256Hex([]byte(canonical.String()))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	return "AWS4-HMAC-SHA256 Credential=" + s.accessKey + "/" + scope + ", SignedHeaders=" + signedHeaders + ", Signature=" + sig
+}
+
+// canonicalQuery encodes query parameters sorted by name, as signing requires
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes everything but unreserved characters (and
+// slashes, unless encodeSlash is set), the way S3 signs paths and queries
+func uriEncode(s string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case 'A' <= ch && ch <= 'Z', 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9',
+			ch == '-', ch == '_', ch == '.', ch == '~':
+			encoded.WriteByte(ch)
+		case ch == '/' && !encodeSlash:
+			encoded.WriteByte(ch)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", ch)
+		}
+	}
+	return encoded.String()
+}
+
+// sha256Hex returns the hex-encoded SHA-256 of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data under key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,495 @@
+// Package s3 provides a TetoDB storage engine that persists the log to S3 or
+// an S3-compatible object store (MinIO, R2, ...). Importing it registers the
+// "s3" scheme, so a database can be opened with
+//
+//	engine.OpenDatabase("s3://bucket/prefix")
+//
+// taking credentials from the standard AWS environment variables, or with
+// engine.OpenDatabaseWithStorage(s3.Open(options))
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/malazaysc/tetodb/engine"
+)
+
+// DefaultFlushInterval is how often buffered records are uploaded by default
+const DefaultFlushInterval = 10 * time.Second
+
+// Options configures the S3 storage engine
+type Options struct {
+	Endpoint        string        // Base URL, e.g. "http://localhost:9000"; defaults to AWS S3 in Region
+	Region          string        // Signing region; defaults to "us-east-1"
+	Bucket          string        // Bucket holding the database
+	Prefix          string        // Key prefix the database's segments are stored under, e.g. "apps/notes/"
+	AccessKeyID     string        // Credentials the requests are signed with
+	SecretAccessKey string        // Credentials the requests are signed with
+	SessionToken    string        // Temporary credentials' session token, if any
+	BufferPath      string        // Local file writes are buffered in until uploaded (required)
+	FlushInterval   time.Duration // How often buffered writes are uploaded; defaults to DefaultFlushInterval
+	HTTPClient      *http.Client  // Client requests are sent with; defaults to one with a 30 second timeout
+}
+
+// Storage is a storage engine that keeps the log in memory, appends writes to
+// a local buffer file, and uploads the buffered records to the object store
+// as a new segment every FlushInterval, on Sync and on Close. Compact uploads
+// the whole compacted log as one segment and deletes the ones it replaces
+//
+// Segments are named by the sequence numbers they cover
+// ("<prefix><first>-<last>.log", JSON lines), so the log is rebuilt by
+// chaining them from sequence 1; a segment that starts at 1 and reaches
+// further supersedes the ones it overlaps. Writes are durable locally as
+// soon as Append returns and in the object store after the next upload
+type Storage struct {
+	*engine.MemoryStorage
+	client *client
+	bucket string
+	prefix string
+
+	mu       sync.Mutex // Protects the fields below and orders appends with uploads
+	buffer   *os.File   // Local buffer of records not yet uploaded
+	pending  []engine.StorageRecord
+	uploaded uint64   // Last sequence number in the object store
+	segments []string // Keys of the segments in the object store, live or superseded
+	lastErr  error    // Error of the last failed background upload
+
+	uploading sync.Mutex    // Serializes uploads
+	stop      chan struct{} // Closed by Close to stop the background uploads
+	done      chan struct{} // Closed when background uploads have stopped
+	closed    bool
+}
+
+func init() {
+	engine.RegisterStorageEngine("s3", func(location string, options engine.Options) (engine.StorageEngine, error) {
+		return Open(envOptions(location))
+	})
+}
+
+// envOptions builds options for "s3://bucket/prefix" from the standard AWS
+// environment variables; TETODB_S3_BUFFER overrides where writes are buffered
+func envOptions(location string) Options {
+	bucket, prefix, _ := strings.Cut(location, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	buffer := os.Getenv("TETODB_S3_BUFFER")
+	if buffer == "" {
+		buffer = filepath.Join(os.TempDir(), "tetodb-s3", bucket, filepath.FromSlash(prefix), "buffer.log")
+	}
+	return Options{
+		Endpoint:        os.Getenv("AWS_ENDPOINT_URL"),
+		Region:          region,
+		Bucket:          bucket,
+		Prefix:          prefix,
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		BufferPath:      buffer,
+	}
+}
+
+// Open downloads a database's segments, replays the local buffer on top of
+// them and starts uploading in the background
+func Open(options Options) (*Storage, error) {
+	if options.Bucket == "" {
+		return nil, fmt.Errorf("s3: bucket is required")
+	}
+	if options.BufferPath == "" {
+		return nil, fmt.Errorf("s3: BufferPath is required")
+	}
+	if options.Region == "" {
+		options.Region = "us-east-1"
+	}
+	if options.Endpoint == "" {
+		options.Endpoint = "https://s3." + options.Region + ".amazonaws.com"
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = DefaultFlushInterval
+	}
+	if options.HTTPClient == nil {
+		options.HTTPClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	endpoint, err := url.Parse(options.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3: invalid endpoint: %w", err)
+	}
+
+	s := &Storage{
+		client: &client{
+			endpoint:     endpoint,
+			region:       options.Region,
+			accessKey:    options.AccessKeyID,
+			secretKey:    options.SecretAccessKey,
+			sessionToken: options.SessionToken,
+			http:         options.HTTPClient,
+			now:          time.Now,
+		},
+		bucket: options.Bucket,
+		prefix: options.Prefix,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	records, err := s.download()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.openBuffer(options.BufferPath); err != nil {
+		return nil, err
+	}
+	records = append(records, s.pending...)
+	if s.MemoryStorage, err = engine.NewMemoryStorageFrom(records); err != nil {
+		s.buffer.Close()
+		return nil, err
+	}
+
+	go s.uploadEvery(options.FlushInterval)
+	return s, nil
+}
+
+// segmentKey names the segment holding sequence numbers first to last
+func (s *Storage) segmentKey(first, last uint64) string {
+	return fmt.Sprintf("%s%020d-%020d.log", s.prefix, first, last)
+}
+
+// parseSegmentKey returns the sequence numbers a segment key covers
+func (s *Storage) parseSegmentKey(key string) (first, last uint64, ok bool) {
+	name, found := strings.CutPrefix(key, s.prefix)
+	if !found || strings.Contains(name, "/") {
+		return 0, 0, false
+	}
+	if _, err := fmt.Sscanf(name, "%020d-%020d.log", &first, &last); err != nil || first == 0 || last < first {
+		return 0, 0, false
+	}
+	return first, last, true
+}
+
+// download lists the segments and reads the chain that makes up the log
+func (s *Storage) download() ([]engine.StorageRecord, error) {
+	ctx := context.Background()
+	keys, err := s.client.list(ctx, s.bucket, s.prefix)
+	if err != nil {
+		return nil, fmt.Errorf("s3: failed to list segments: %w", err)
+	}
+
+	type segment struct {
+		key         string
+		first, last uint64
+	}
+	var segments []segment
+	for _, key := range keys {
+		if first, last, ok := s.parseSegmentKey(key); ok {
+			segments = append(segments, segment{key, first, last})
+			s.segments = append(s.segments, key)
+		}
+	}
+	// From each starting point, the segment reaching furthest wins
+	sort.Slice(segments, func(i, j int) bool {
+		if segments[i].first != segments[j].first {
+			return segments[i].first < segments[j].first
+		}
+		return segments[i].last > segments[j].last
+	})
+
+	var records []engine.StorageRecord
+	for _, seg := range segments {
+		if seg.first <= s.uploaded {
+			continue // Superseded by a compacted segment
+		}
+		if seg.first != s.uploaded+1 {
+			return nil, fmt.Errorf("s3: segment for sequence %d is missing", s.uploaded+1)
+		}
+		data, err := s.client.get(ctx, s.bucket, seg.key)
+		if err != nil {
+			return nil, fmt.Errorf("s3: failed to download segment %s: %w", seg.key, err)
+		}
+		segmentRecords, err := decodeRecords(data)
+		if err != nil {
+			return nil, fmt.Errorf("s3: segment %s: %w", seg.key, err)
+		}
+		records = append(records, segmentRecords...)
+		s.uploaded = seg.last
+	}
+	return records, nil
+}
+
+// openBuffer opens the local buffer and keeps the records in it that are
+// newer than the object store, i.e. were written but not yet uploaded
+func (s *Storage) openBuffer(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("s3: failed to create buffer directory: %w", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("s3: failed to read buffer: %w", err)
+	}
+	records, err := decodeRecords(data)
+	if err != nil {
+		return fmt.Errorf("s3: buffer: %w", err)
+	}
+	for _, record := range records {
+		if record.Seq > s.uploaded {
+			s.pending = append(s.pending, record)
+		}
+	}
+
+	if s.buffer, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+		return fmt.Errorf("s3: failed to open buffer: %w", err)
+	}
+	return s.rewriteBuffer()
+}
+
+// Append adds a record to the log and the local buffer
+func (s *Storage) Append(record engine.StorageRecord) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seq, err := s.MemoryStorage.Append(record)
+	if err != nil {
+		return 0, err
+	}
+	record.Seq = seq
+	if err := s.bufferRecords(record); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// AppendBatch adds several records to the log and the local buffer
+func (s *Storage) AppendBatch(records []engine.StorageRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.MemoryStorage.AppendBatch(records); err != nil {
+		return err
+	}
+	return s.bufferRecords(records...)
+}
+
+// bufferRecords appends records to the local buffer and syncs it
+// Caller must hold the lock
+func (s *Storage) bufferRecords(records ...engine.StorageRecord) error {
+	data, err := encodeRecords(records)
+	if err != nil {
+		return err
+	}
+	if _, err := s.buffer.Write(data); err != nil {
+		return fmt.Errorf("s3: failed to write buffer: %w", err)
+	}
+	if err := s.buffer.Sync(); err != nil {
+		return fmt.Errorf("s3: failed to sync buffer: %w", err)
+	}
+	s.pending = append(s.pending, records...)
+	return nil
+}
+
+// rewriteBuffer replaces the buffer's contents with the pending records
+// Caller must hold the lock
+func (s *Storage) rewriteBuffer() error {
+	data, err := encodeRecords(s.pending)
+	if err != nil {
+		return err
+	}
+	if err := s.buffer.Truncate(0); err != nil {
+		return fmt.Errorf("s3: failed to truncate buffer: %w", err)
+	}
+	if _, err := s.buffer.Write(data); err != nil {
+		return fmt.Errorf("s3: failed to write buffer: %w", err)
+	}
+	return s.buffer.Sync()
+}
+
+// upload sends the pending records to the object store as a new segment
+func (s *Storage) upload() error {
+	s.uploading.Lock()
+	defer s.uploading.Unlock()
+
+	s.mu.Lock()
+	records := append([]engine.StorageRecord(nil), s.pending...)
+	first := s.uploaded + 1
+	s.mu.Unlock()
+	if len(records) == 0 {
+		return nil
+	}
+
+	data, err := encodeRecords(records)
+	if err != nil {
+		return err
+	}
+	last := records[len(records)-1].Seq
+	key := s.segmentKey(first, last)
+	if err := s.client.put(context.Background(), s.bucket, key, data); err != nil {
+		return fmt.Errorf("s3: failed to upload segment: %w", err)
+	}
+
+	// Records appended during the upload stay pending for the next one
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append([]engine.StorageRecord(nil), s.pending[len(records):]...)
+	s.uploaded = last
+	s.segments = append(s.segments, key)
+	return s.rewriteBuffer()
+}
+
+// uploadEvery uploads pending records on a timer until Close
+func (s *Storage) uploadEvery(interval time.Duration) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			err := s.upload()
+			s.mu.Lock()
+			s.lastErr = err
+			s.mu.Unlock()
+			if err != nil {
+				fmt.Printf("Warning: %v\n", err)
+			}
+		}
+	}
+}
+
+// Compact replaces the log with the given records and uploads it as a single
+// segment, then deletes the segments it supersedes
+func (s *Storage) Compact(records []engine.StorageRecord) error {
+	s.uploading.Lock()
+	defer s.uploading.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.MemoryStorage.Compact(records); err != nil {
+		return err
+	}
+	log, err := s.MemoryStorage.LoadAll()
+	if err != nil {
+		return err
+	}
+	last := s.MemoryStorage.CurrentSequence()
+	if last == 0 {
+		return nil
+	}
+
+	data, err := encodeRecords(log)
+	if err != nil {
+		return err
+	}
+	key := s.segmentKey(1, last)
+	ctx := context.Background()
+	if err := s.client.put(ctx, s.bucket, key, data); err != nil {
+		return fmt.Errorf("s3: failed to upload compacted segment: %w", err)
+	}
+
+	// The new segment is live; leftovers of a failed delete are superseded
+	// and get another try at the next compaction
+	s.pending, s.uploaded = nil, last
+	remaining := []string{key}
+	for _, old := range s.segments {
+		if old == key {
+			continue
+		}
+		if err := s.client.delete(ctx, s.bucket, old); err != nil {
+			remaining = append(remaining, old)
+		}
+	}
+	s.segments = remaining
+	return s.rewriteBuffer()
+}
+
+// Sync uploads the pending records now
+func (s *Storage) Sync() error {
+	return s.upload()
+}
+
+// Close stops the background uploads, uploads what is pending and closes the
+// buffer. If the final upload fails the records stay in the buffer, and are
+// uploaded after the database is next opened
+func (s *Storage) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	close(s.stop)
+	<-s.done
+	err := s.upload()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if closeErr := s.buffer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Pending returns how many records are waiting to be uploaded
+func (s *Storage) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.pending)
+}
+
+// LastError returns the error of the last background upload, nil if it succeeded
+func (s *Storage) LastError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lastErr
+}
+
+// encodeRecords serializes records as JSON lines
+func encodeRecords(records []engine.StorageRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal record: %w", err)
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeRecords parses JSON lines, ignoring a torn last line
+func decodeRecords(data []byte) ([]engine.StorageRecord, error) {
+	var records []engine.StorageRecord
+	reader := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && err == nil {
+			var record engine.StorageRecord
+			if err := json.Unmarshal(line, &record); err != nil {
+				return nil, fmt.Errorf("failed to parse record: %w", err)
+			}
+			records = append(records, record)
+		}
+		if err != nil {
+			return records, nil
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package engine
+
+import "math/rand"
+
+// Sample returns up to n documents chosen uniformly at random
+// The collection is scanned once with reservoir sampling, so only n documents
+// are held at a time however large the collection is. If the collection has
+// n or fewer documents, all of them are returned (in random order)
+func (c *Collection) Sample(n int) []map[string]interface{} {
+	r := newReservoir(n)
+
+	for _, doc := range c.snapshot().all() {
+		r.add(doc)
+	}
+
+	return c.detach(r.result())
+}
+
+// reservoir keeps a uniform random sample of the documents added to it (Algorithm R)
+type reservoir struct {
+	size  int                      // Sample size
+	seen  int                      // Documents offered so far
+	items []map[string]interface{} // Current sample
+}
+
+// newReservoir creates a reservoir holding up to size documents
+func newReservoir(size int) *reservoir {
+	if size < 0 {
+		size = 0
+	}
+	return &reservoir{size: size, items: make([]map[string]interface{}, 0, min(size, 1024))}
+}
+
+// add offers a document to the sample
+// The i-th document replaces a random slot with probability size/i
+func (r *reservoir) add(doc map[string]interface{}) {
+	r.seen++
+	if len(r.items) < r.size {
+		r.items = append(r.items, doc)
+		return
+	}
+	if j := rand.Intn(r.seen); j < r.size {
+		r.items[j] = doc
+	}
+}
+
+// result returns the sample in random order
+// Until the reservoir fills its order follows the input, so shuffle it
+func (r *reservoir) result() []map[string]interface{} {
+	rand.Shuffle(len(r.items), func(i, j int) {
+		r.items[i], r.items[j] = r.items[j], r.items[i]
+	})
+	return r.items
+}
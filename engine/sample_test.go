@@ -0,0 +1,183 @@
+package engine
+
+import "testing"
+
+// sampledNumbers returns the "n" field of each sampled document, failing the
+// test if a document is sampled twice
+func sampledNumbers(t *testing.T, docs []map[string]interface{}) map[int]bool {
+	t.Helper()
+	seen := make(map[int]bool, len(docs))
+	for _, doc := range docs {
+		n, ok := toFloat64(doc["n"])
+		if !ok {
+			t.Fatalf("sampled document without n: %v", doc)
+		}
+		if seen[int(n)] {
+			t.Fatalf("document %v sampled twice", n)
+		}
+		seen[int(n)] = true
+	}
+	return seen
+}
+
+func TestSample(t *testing.T) {
+	db := openTestDatabase(t)
+	coll := db.GetCollection("docs")
+	for i := 0; i < 10; i++ {
+		if _, err := coll.Insert(map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		n    int
+		want int
+	}{
+		{"none", 0, 0},
+		{"negative", -1, 0},
+		{"some", 3, 3},
+		{"all", 10, 10},
+		{"more than the collection", 25, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := coll.Sample(tt.n)
+			if len(got) != tt.want {
+				t.Fatalf("got %d documents, want %d", len(got), tt.want)
+			}
+			sampledNumbers(t, got)
+		})
+	}
+}
+
+func TestSampleIsUniform(t *testing.T) {
+	db := openTestDatabase(t)
+	coll := db.GetCollection("docs")
+	for i := 0; i < 10; i++ {
+		if _, err := coll.Insert(map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each document is expected 900 times; the standard deviation is about
+	// 25, so the bounds below are far outside what chance produces
+	const runs = 3000
+	counts := make(map[int]int)
+	firsts := make(map[int]int)
+	for i := 0; i < runs; i++ {
+		docs := coll.Sample(3)
+		for n := range sampledNumbers(t, docs) {
+			counts[n]++
+		}
+		n, _ := toFloat64(docs[0]["n"])
+		firsts[int(n)]++
+	}
+	for n := 0; n < 10; n++ {
+		if counts[n] < 700 || counts[n] > 1100 {
+			t.Errorf("document %d sampled %d times in %d runs, want about 900", n, counts[n], runs)
+		}
+		// The sample is shuffled, so any document may come first
+		if firsts[n] < 200 || firsts[n] > 400 {
+			t.Errorf("document %d came first %d times in %d runs, want about 300", n, firsts[n], runs)
+		}
+	}
+}
+
+func TestAggregateSample(t *testing.T) {
+	db := openTestDatabase(t)
+	coll := db.GetCollection("docs")
+	for i := 0; i < 20; i++ {
+		if _, err := coll.Insert(map[string]interface{}{"n": i, "even": i%2 == 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		pipeline []map[string]interface{}
+		want     int
+		check    func(doc map[string]interface{}) bool
+	}{
+		{
+			name:     "alone",
+			pipeline: []map[string]interface{}{{"$sample": map[string]interface{}{"size": 5}}},
+			want:     5,
+		},
+		{
+			name: "after a match, sampled during the scan",
+			pipeline: []map[string]interface{}{
+				{"$match": map[string]interface{}{"even": true}},
+				{"$sample": map[string]interface{}{"size": 4}},
+			},
+			want:  4,
+			check: func(doc map[string]interface{}) bool { return doc["even"] == true },
+		},
+		{
+			name: "larger than the matches",
+			pipeline: []map[string]interface{}{
+				{"$match": map[string]interface{}{"n": map[string]interface{}{"$lt": 3}}},
+				{"$sample": map[string]interface{}{"size": 10}},
+			},
+			want: 3,
+		},
+		{
+			name: "later in the pipeline",
+			pipeline: []map[string]interface{}{
+				{"$sort": map[string]interface{}{"n": -1}},
+				{"$limit": 6},
+				{"$sample": map[string]interface{}{"size": 2}},
+			},
+			want:  2,
+			check: func(doc map[string]interface{}) bool { n, _ := toFloat64(doc["n"]); return n >= 14 },
+		},
+		{
+			name: "size zero",
+			pipeline: []map[string]interface{}{
+				{"$sample": map[string]interface{}{"size": 0}},
+			},
+			want: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := coll.Aggregate(tt.pipeline)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != tt.want {
+				t.Fatalf("got %d documents, want %d", len(got), tt.want)
+			}
+			sampledNumbers(t, got)
+			for _, doc := range got {
+				if tt.check != nil && !tt.check(doc) {
+					t.Errorf("document %v should not be in the sample", doc)
+				}
+			}
+		})
+	}
+}
+
+func TestAggregateSampleInvalidSize(t *testing.T) {
+	db := openTestDatabase(t)
+	coll := db.GetCollection("docs")
+
+	tests := []struct {
+		name string
+		spec interface{}
+	}{
+		{"not an object", 5},
+		{"missing size", map[string]interface{}{}},
+		{"extra key", map[string]interface{}{"size": 1, "seed": 2}},
+		{"negative", map[string]interface{}{"size": -1}},
+		{"fractional", map[string]interface{}{"size": 1.5}},
+		{"string", map[string]interface{}{"size": "3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := coll.Aggregate([]map[string]interface{}{{"$sample": tt.spec}}); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
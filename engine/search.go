@@ -0,0 +1,187 @@
+package engine
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// SearchOptions controls a full-text search
+type SearchOptions struct {
+	Fields   []string               // Fields to search (dot notation allowed); empty means every string field
+	Filter   map[string]interface{} // Optional filter documents must also match
+	MatchAll bool                   // Require every query term instead of any
+	Limit    int                    // Maximum number of results (0 means no limit)
+}
+
+// SearchResult is a single document returned by Search
+type SearchResult struct {
+	ID       string                 `json:"id"`       // ID of the matching document
+	Document map[string]interface{} `json:"document"` // The matching document
+	Score    float64                `json:"score"`    // Relevance score, higher is better
+}
+
+// Search finds documents whose string fields contain the query terms
+// Text is split into lowercase words on anything that isn't a letter or digit
+// Results are ranked by TF-IDF: terms that are frequent in a document but
+// rare across the collection count the most. Ties are broken by document ID
+// A text index over the same fields (see CreateTextIndex) answers the search
+// without reading every document; it ignores stop words in the query
+func (c *Collection) Search(query string, opts SearchOptions) []SearchResult {
+	terms := uniqueTokens(query)
+	if len(terms) == 0 {
+		return []SearchResult{}
+	}
+
+	// The index is read under the lock, the documents from a snapshot after it
+	c.mu.RLock()
+	docs := c.documents.snapshot()
+	var indexed map[string]map[string]int
+	if c.textIndex != nil && c.textIndex.covers(opts.Fields) {
+		c.textIndex.hits.Add(1)
+		kept := make([]string, 0, len(terms))
+		for _, term := range terms {
+			if !stopWords[term] {
+				kept = append(kept, term)
+			}
+		}
+		terms = kept
+		indexed = c.textIndex.frequencies(terms)
+	}
+	c.mu.RUnlock()
+
+	// Count term occurrences per document, and how many documents contain each term
+	type candidate struct {
+		id   string
+		doc  map[string]interface{}
+		freq map[string]int
+	}
+	var candidates []candidate
+	docFreq := make(map[string]int, len(terms))
+
+	consider := func(id string, doc map[string]interface{}, freq map[string]int) {
+		if len(freq) == 0 || (opts.MatchAll && len(freq) < len(terms)) {
+			return
+		}
+		if len(opts.Filter) > 0 && !c.match.Matches(doc, opts.Filter) {
+			return
+		}
+		for term := range freq {
+			docFreq[term]++
+		}
+		candidates = append(candidates, candidate{id: id, doc: doc, freq: freq})
+	}
+
+	if indexed != nil {
+		for id, freq := range indexed {
+			consider(id, docs.doc(id), freq)
+		}
+	} else {
+		for id, doc := range docs.all() {
+			consider(id, doc, termFrequencies(doc, opts.Fields, terms))
+		}
+	}
+
+	// Score candidates
+	total := float64(docs.len())
+	results := make([]SearchResult, 0, len(candidates))
+	for _, cand := range candidates {
+		score := 0.0
+		// Sum in query order so equal documents always get identical scores
+		for _, term := range terms {
+			count, found := cand.freq[term]
+			if !found {
+				continue
+			}
+			idf := math.Log(1 + total/float64(docFreq[term]))
+			score += (1 + math.Log(float64(count))) * idf
+		}
+		results = append(results, SearchResult{ID: cand.id, Document: cand.doc, Score: score})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].ID < results[j].ID
+	})
+
+	if opts.Limit > 0 && len(results) > opts.Limit {
+		results = results[:opts.Limit]
+	}
+	for i := range results {
+		results[i].Document = c.detachDocument(results[i].Document)
+	}
+	return results
+}
+
+// termFrequencies counts how often each of the wanted terms appears in a document
+func termFrequencies(doc map[string]interface{}, fields []string, terms []string) map[string]int {
+	wanted := make(map[string]bool, len(terms))
+	for _, term := range terms {
+		wanted[term] = true
+	}
+
+	freq := make(map[string]int)
+	count := func(text string) {
+		for _, token := range tokenize(text) {
+			if wanted[token] {
+				freq[token]++
+			}
+		}
+	}
+
+	if len(fields) == 0 {
+		forEachString(doc, count)
+		return freq
+	}
+
+	for _, field := range fields {
+		if value, exists := lookupPath(doc, field); exists {
+			forEachString(value, count)
+		}
+	}
+	return freq
+}
+
+// forEachString calls fn for every string found in a value, recursing into
+// nested objects and arrays
+func forEachString(value interface{}, fn func(string)) {
+	switch v := value.(type) {
+	case string:
+		fn(v)
+	case map[string]interface{}:
+		for key, sub := range v {
+			if key == "id" {
+				continue // IDs are identifiers, not text
+			}
+			forEachString(sub, fn)
+		}
+	case []interface{}:
+		for _, elem := range v {
+			forEachString(elem, fn)
+		}
+	}
+}
+
+// tokenize splits text into lowercase words
+// Anything that isn't a letter or digit separates words
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// uniqueTokens tokenizes text and drops duplicate words, keeping first-seen order
+func uniqueTokens(text string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, token := range tokenize(text) {
+		if !seen[token] {
+			seen[token] = true
+			unique = append(unique, token)
+		}
+	}
+	return unique
+}
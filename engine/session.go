@@ -0,0 +1,139 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrStaleRead is returned by a Session read when the database hasn't yet
+// caught up with the writes the session has made or seen, e.g. a read-only
+// copy of a file that is still being written elsewhere
+var ErrStaleRead = errors.New("database hasn't caught up with the session")
+
+// Session is a unit of work with causal consistency: it tracks the sequence
+// of the latest write it has made or seen, and its reads only run once the
+// database has caught up with it, so a session always reads its own writes
+// and never goes back in time. Sequence and Advance hand that position from
+// one session to another, e.g. between the requests of one client
+// A Session is safe for concurrent use
+type Session struct {
+	db  *Database
+	seq atomic.Uint64 // Sequence the session's reads must observe
+}
+
+// StartSession starts a session at the database's current sequence
+func (db *Database) StartSession() *Session {
+	s := &Session{db: db}
+	s.seq.Store(db.CurrentSequence())
+	return s
+}
+
+// Sequence returns the sequence the session's reads observe at least: its
+// latest write, or the latest one it has seen
+func (s *Session) Sequence() uint64 {
+	return s.seq.Load()
+}
+
+// Advance makes the session's reads observe at least the given sequence,
+// e.g. one returned by another session's Sequence
+func (s *Session) Advance(seq uint64) {
+	for {
+		current := s.seq.Load()
+		if seq <= current || s.seq.CompareAndSwap(current, seq) {
+			return
+		}
+	}
+}
+
+// Insert inserts a document into a collection, as Collection.Insert does
+func (s *Session) Insert(collName string, doc map[string]interface{}) (string, error) {
+	coll, err := s.db.LoadCollection(collName)
+	if err != nil {
+		return "", err
+	}
+	id, err := coll.Insert(doc)
+	if err != nil {
+		return "", err
+	}
+	s.observe()
+	return id, nil
+}
+
+// Update updates a document, as Collection.Update does
+func (s *Session) Update(collName, id string, update map[string]interface{}) error {
+	coll, err := s.db.LoadCollection(collName)
+	if err != nil {
+		return err
+	}
+	if err := coll.Update(id, update); err != nil {
+		return err
+	}
+	s.observe()
+	return nil
+}
+
+// Replace overwrites a document, as Collection.Replace does
+func (s *Session) Replace(collName, id string, doc map[string]interface{}) error {
+	coll, err := s.db.LoadCollection(collName)
+	if err != nil {
+		return err
+	}
+	if err := coll.Replace(id, doc); err != nil {
+		return err
+	}
+	s.observe()
+	return nil
+}
+
+// Delete removes a document, as Collection.Delete does
+func (s *Session) Delete(collName, id string) error {
+	coll, err := s.db.LoadCollection(collName)
+	if err != nil {
+		return err
+	}
+	if err := coll.Delete(id); err != nil {
+		return err
+	}
+	s.observe()
+	return nil
+}
+
+// FindByID retrieves a document by its ID, as Collection.FindByID does
+// Returns nil if it doesn't exist
+func (s *Session) FindByID(collName, id string) (map[string]interface{}, error) {
+	coll, err := s.readable(collName)
+	if err != nil {
+		return nil, err
+	}
+	doc := coll.FindByID(id)
+	s.observe()
+	return doc, nil
+}
+
+// Find searches a collection, as Collection.Find does
+func (s *Session) Find(collName string, filter map[string]interface{}, opts ...FindOptions) ([]map[string]interface{}, error) {
+	coll, err := s.readable(collName)
+	if err != nil {
+		return nil, err
+	}
+	docs := coll.Find(filter, opts...)
+	s.observe()
+	return docs, nil
+}
+
+// readable returns a collection to read once the database has caught up
+// with the session
+func (s *Session) readable(collName string) (*Collection, error) {
+	if current, want := s.db.CurrentSequence(), s.seq.Load(); current < want {
+		return nil, fmt.Errorf("%w: at sequence %d, session needs %d", ErrStaleRead, current, want)
+	}
+	return s.db.LoadCollection(collName)
+}
+
+// observe moves the session up to the database's current sequence after a
+// read or write, which it has seen all of. That is at least the sequence of
+// the write just made, possibly more if others wrote meanwhile
+func (s *Session) observe() {
+	s.Advance(s.db.CurrentSequence())
+}
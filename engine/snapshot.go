@@ -0,0 +1,168 @@
+package engine
+
+import (
+	"context"
+	"sort"
+)
+
+// Snapshot is a frozen view of every collection of a database as it was
+// when Database.Snapshot was called. Later writes don't show in it, and it
+// has no methods that write, so it can be queried at leisure, e.g. for an
+// export or a report, without holding up writers or seeing their changes
+// A Snapshot is safe for concurrent use
+type Snapshot struct {
+	seq         uint64                 // Sequence of the latest write it holds
+	zeroCopy    bool                   // Reads return the frozen documents rather than copies (see WithZeroCopyReads)
+	collections map[string]*Collection // Frozen copies of the collections
+}
+
+// SnapshotCollection is a collection as a Snapshot holds it: its read
+// methods work as the Collection ones, over the frozen documents
+// A snapshot has no indexes, so its queries scan the documents and hints
+// naming an index fail
+type SnapshotCollection struct {
+	coll *Collection
+}
+
+// Snapshot captures every collection of the database, under the collection
+// locks, so it is consistent across collections. It doesn't copy the
+// documents, only shares them (see documentStore), so it costs the same
+// however large the database is; the first write to each part of a
+// collection afterwards copies that part
+// With lazy loading, collections still on disk are loaded first
+func (db *Database) Snapshot() (*Snapshot, error) {
+	if err := db.loadAll(); err != nil {
+		return nil, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	defer db.lockCollections()()
+
+	s := &Snapshot{seq: db.storage.CurrentSequence(), zeroCopy: db.options.ZeroCopyReads, collections: make(map[string]*Collection, len(db.collections))}
+	for name, coll := range db.collections {
+		s.collections[name] = coll.freeze(s)
+	}
+	return s, nil
+}
+
+// freeze returns a read-only copy of the collection in s
+// Caller must hold the read lock
+func (c *Collection) freeze(s *Snapshot) *Collection {
+	return &Collection{
+		name:      c.name,
+		documents: *c.documents.snapshot(),
+		match:     c.match,
+		zeroCopy:  c.zeroCopy,
+		frozen:    s,
+	}
+}
+
+// source returns where stages like $lookup find other collections; nil
+// for a standalone collection
+func (c *Collection) source() collectionSource {
+	if c.frozen != nil {
+		return c.frozen
+	}
+	if c.db != nil {
+		return c.db
+	}
+	return nil
+}
+
+// Sequence returns the sequence number of the latest write the snapshot
+// holds, so e.g. an export can carry on from it with Database.ReadSince
+func (s *Snapshot) Sequence() uint64 {
+	return s.seq
+}
+
+// ListCollections returns the names of the collections in the snapshot, sorted
+func (s *Snapshot) ListCollections() []string {
+	names := make([]string, 0, len(s.collections))
+	for name := range s.collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Collection returns a collection of the snapshot; one that didn't exist
+// when it was taken is returned empty
+func (s *Snapshot) Collection(name string) *SnapshotCollection {
+	coll, exists := s.collections[name]
+	if !exists {
+		coll = &Collection{name: name, zeroCopy: s.zeroCopy, frozen: s}
+	}
+	return &SnapshotCollection{coll: coll}
+}
+
+// existingCollection returns a collection of the snapshot; nil if there is none
+func (s *Snapshot) existingCollection(name string) (*Collection, error) {
+	return s.collections[name], nil
+}
+
+// Name returns the name of the collection
+func (sc *SnapshotCollection) Name() string {
+	return sc.coll.name
+}
+
+// FindByID retrieves a single document by its ID; nil if it doesn't exist
+func (sc *SnapshotCollection) FindByID(id string) map[string]interface{} {
+	return sc.coll.FindByID(id)
+}
+
+// FindAll returns all documents in the collection
+func (sc *SnapshotCollection) FindAll() []map[string]interface{} {
+	return sc.coll.FindAll()
+}
+
+// Find searches for documents matching the filter, as Collection.Find does
+func (sc *SnapshotCollection) Find(filter map[string]interface{}, opts ...FindOptions) []map[string]interface{} {
+	return sc.coll.Find(filter, opts...)
+}
+
+// FindContext is Find with cancellation, as Collection.FindContext
+func (sc *SnapshotCollection) FindContext(ctx context.Context, filter map[string]interface{}, opts ...FindOptions) ([]map[string]interface{}, error) {
+	return sc.coll.FindContext(ctx, filter, opts...)
+}
+
+// FindEach calls fn with a copy of each matching document until fn returns
+// false, as Collection.FindEach does
+func (sc *SnapshotCollection) FindEach(filter map[string]interface{}, fn func(doc map[string]interface{}) bool) {
+	sc.coll.FindEach(filter, fn)
+}
+
+// FindPage returns a page of matching documents, as Collection.FindPage does
+func (sc *SnapshotCollection) FindPage(filter map[string]interface{}, options FindOptions, token string) (Page, error) {
+	return sc.coll.FindPage(filter, options, token)
+}
+
+// Count returns the number of documents in the collection
+func (sc *SnapshotCollection) Count() int {
+	return sc.coll.Count()
+}
+
+// CountWhere returns the number of documents matching the filter
+func (sc *SnapshotCollection) CountWhere(filter map[string]interface{}) int {
+	return sc.coll.CountWhere(filter)
+}
+
+// Aggregate runs a pipeline over the collection, as Collection.Aggregate
+// does; $lookup stages join collections of the same snapshot
+func (sc *SnapshotCollection) Aggregate(pipeline []map[string]interface{}) ([]map[string]interface{}, error) {
+	return sc.coll.Aggregate(pipeline)
+}
+
+// AggregateContext is Aggregate with cancellation
+func (sc *SnapshotCollection) AggregateContext(ctx context.Context, pipeline []map[string]interface{}) ([]map[string]interface{}, error) {
+	return sc.coll.AggregateContext(ctx, pipeline)
+}
+
+// Search finds documents containing the query terms, as Collection.Search does
+func (sc *SnapshotCollection) Search(query string, opts SearchOptions) []SearchResult {
+	return sc.coll.Search(query, opts)
+}
+
+// Sample returns up to n documents chosen uniformly at random
+func (sc *SnapshotCollection) Sample(n int) []map[string]interface{} {
+	return sc.coll.Sample(n)
+}
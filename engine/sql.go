@@ -0,0 +1,220 @@
+package engine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SQLQuery is a parsed SQL-like SELECT statement (see ParseSQL)
+type SQLQuery struct {
+	Collection string                 // Collection named in FROM
+	Fields     []string               // Selected fields; empty for SELECT *
+	Count      bool                   // SELECT COUNT(*): return the number of matches instead of documents
+	Filter     map[string]interface{} // WHERE clause as a filter
+	Options    FindOptions            // ORDER BY, LIMIT, OFFSET and the field projection
+}
+
+// ParseSQL parses a restricted SELECT statement:
+//
+//	SELECT * | COUNT(*) | field [, field ...]
+//	FROM collection
+//	[WHERE condition]
+//	[ORDER BY field [ASC | DESC] [NULLS FIRST | LAST] [, ...]]
+//	[LIMIT n [OFFSET m]]
+//
+// The WHERE condition uses the ParseFilterExpression grammar, which covers
+// =, != / <>, <, <=, >, >=, LIKE, IN (...), AND, OR, NOT and parentheses
+// Keywords are case-insensitive and fields may use dot notation
+func ParseSQL(sql string) (*SQLQuery, error) {
+	sql = strings.TrimSuffix(strings.TrimSpace(sql), ";")
+	tokens, err := tokenizeFilter(sql)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens}
+	query := &SQLQuery{}
+
+	if err := p.expectKeyword("select"); err != nil {
+		return nil, err
+	}
+	if err := query.parseSelectList(p); err != nil {
+		return nil, err
+	}
+
+	if err := p.expectKeyword("from"); err != nil {
+		return nil, err
+	}
+	collTok := p.next()
+	if collTok.kind != tokenWord && collTok.kind != tokenString {
+		return nil, fmt.Errorf("expected a collection name but found %s", collTok)
+	}
+	query.Collection = collTok.text
+
+	if p.peek().isKeyword("where") {
+		p.next()
+		filter, err := p.parseOr()
+		if err != nil {
+			return nil, fmt.Errorf("WHERE: %w", err)
+		}
+		query.Filter = filter
+	}
+
+	if p.peek().isKeyword("order") {
+		p.next()
+		if err := p.expectKeyword("by"); err != nil {
+			return nil, err
+		}
+		if err := query.parseOrderBy(p); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.peek().isKeyword("limit") {
+		p.next()
+		n, err := p.parseCount("LIMIT")
+		if err != nil {
+			return nil, err
+		}
+		query.Options.Limit = n
+
+		if p.peek().isKeyword("offset") {
+			p.next()
+			n, err := p.parseCount("OFFSET")
+			if err != nil {
+				return nil, err
+			}
+			query.Options.Skip = n
+		}
+	}
+
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at position %d", tok, tok.pos)
+	}
+
+	if len(query.Fields) > 0 {
+		spec := make(map[string]interface{}, len(query.Fields))
+		for _, field := range query.Fields {
+			spec[field] = 1
+		}
+		projection, err := NewProjection(spec)
+		if err != nil {
+			return nil, err
+		}
+		query.Options.Projection = projection
+	}
+	return query, nil
+}
+
+// parseSelectList parses: "*" | COUNT(*) | field { "," field }
+func (q *SQLQuery) parseSelectList(p *filterParser) error {
+	tok := p.peek()
+	if tok.kind == tokenWord && tok.text == "*" {
+		p.next()
+		return nil
+	}
+
+	if tok.isKeyword("count") {
+		p.next()
+		for _, want := range []filterTokenKind{tokenLParen, tokenWord, tokenRParen} {
+			got := p.next()
+			if got.kind != want || (want == tokenWord && got.text != "*") {
+				return fmt.Errorf("expected COUNT(*) but found %s", got)
+			}
+		}
+		q.Count = true
+		return nil
+	}
+
+	for {
+		fieldTok := p.next()
+		if fieldTok.kind != tokenWord && fieldTok.kind != tokenString {
+			return fmt.Errorf("expected a field name but found %s", fieldTok)
+		}
+		q.Fields = append(q.Fields, fieldTok.text)
+
+		if p.peek().kind != tokenComma {
+			return nil
+		}
+		p.next()
+	}
+}
+
+// parseOrderBy parses: field [ASC | DESC] [NULLS FIRST | LAST] { "," ... }
+func (q *SQLQuery) parseOrderBy(p *filterParser) error {
+	for {
+		fieldTok := p.next()
+		if fieldTok.kind != tokenWord && fieldTok.kind != tokenString {
+			return fmt.Errorf("ORDER BY: expected a field name but found %s", fieldTok)
+		}
+
+		sortField := SortField{Field: fieldTok.text, Direction: "asc"}
+		if next := p.peek(); next.isKeyword("asc") || next.isKeyword("desc") {
+			p.next()
+			sortField.Direction = strings.ToLower(next.text)
+		}
+		if p.peek().isKeyword("nulls") {
+			p.next()
+			placement := p.next()
+			if !placement.isKeyword("first") && !placement.isKeyword("last") {
+				return fmt.Errorf("ORDER BY: expected FIRST or LAST after NULLS but found %s", placement)
+			}
+			sortField.Nulls = strings.ToLower(placement.text)
+		}
+		q.Options.Sort = append(q.Options.Sort, sortField)
+
+		if p.peek().kind != tokenComma {
+			return nil
+		}
+		p.next()
+	}
+}
+
+// expectKeyword consumes the next token, which must be the given keyword
+func (p *filterParser) expectKeyword(keyword string) error {
+	tok := p.next()
+	if !tok.isKeyword(keyword) {
+		return fmt.Errorf("expected %s but found %s", strings.ToUpper(keyword), tok)
+	}
+	return nil
+}
+
+// parseCount parses a non-negative integer, as used by LIMIT and OFFSET
+func (p *filterParser) parseCount(clause string) (int, error) {
+	tok := p.next()
+	n, err := strconv.Atoi(tok.text)
+	if tok.kind != tokenWord || err != nil || n < 0 {
+		return 0, fmt.Errorf("%s: expected a non-negative integer but found %s", clause, tok)
+	}
+	return n, nil
+}
+
+// Query runs a SQL-like SELECT statement (see ParseSQL)
+// SELECT COUNT(*) returns a single {"count": n} row
+// Querying a collection that doesn't exist returns no rows rather than creating it
+func (db *Database) Query(sql string) ([]map[string]interface{}, error) {
+	query, err := ParseSQL(sql)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query: %w", err)
+	}
+
+	coll, err := db.existingCollection(query.Collection)
+	if err != nil {
+		return nil, err
+	}
+	exists := coll != nil
+
+	if query.Count {
+		count := 0
+		if exists {
+			count = coll.CountWhere(query.Filter)
+		}
+		return []map[string]interface{}{{"count": count}}, nil
+	}
+
+	if !exists {
+		return []map[string]interface{}{}, nil
+	}
+	return coll.Find(query.Filter, query.Options), nil
+}
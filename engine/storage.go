@@ -1,171 +1,1196 @@
 package engine
 
 import (
-	"bufio"
-	"encoding/json"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sort"
 	"sync"
+	"time"
 )
 
 // StorageRecord represents a single record in the storage file
-// Each line in the file is a JSON-encoded StorageRecord
+// Each record is stored as JSON, one per line or length-prefixed depending
+// on the file format (see FormatJSONLines and FormatBinary)
+// A record with Index set defines an index of the collection rather than
+// holding a document; its ID is derived from the index (see IndexDefinition)
 type StorageRecord struct {
-	Collection string                 `json:"collection"` // Name of the collection
-	ID         string                 `json:"id"`         // Unique document ID
-	Doc        map[string]interface{} `json:"doc"`        // The actual document data
+	Collection string                 `json:"collection"`           // Name of the collection
+	ID         string                 `json:"id"`                   // Unique document ID
+	Doc        map[string]interface{} `json:"doc"`                  // The actual document data
+	Seq        uint64                 `json:"seq,omitempty"`        // Database-wide sequence number of this write
+	Index      *IndexDefinition       `json:"index,omitempty"`      // Index definition, for index records
+	Attachment *AttachmentPart        `json:"attachment,omitempty"` // Chunk of an attachment of document ID, for attachment records
+	Header     *FileHeader            `json:"header,omitempty"`     // File header, for the record opening a file
+	Time       int64                  `json:"time,omitempty"`       // When the record was written, in Unix nanoseconds; 0 in older files (see RestoreTo)
+	Op         string                 `json:"op,omitempty"`         // Write that made a document record: OpInsert, OpUpdate or OpDelete; "" in older files
 }
 
-// Storage handles the file-based persistence layer
-// It uses a simple append-only log format where each line is a JSON record
+// Record operations, as held in StorageRecord.Op
+// The records compaction and checkpoints rewrite are each document's first in
+// the new file, so are inserts; index, attachment and header records have none
+const (
+	OpInsert = "insert" // A new document
+	OpUpdate = "update" // A new version of an existing document
+	OpDelete = "delete" // A deletion; Doc is nil
+)
+
+// Storage handles the file-based persistence layer, the default StorageEngine
+// It uses a simple append-only log of JSON records
 type Storage struct {
-	filePath string      // Path to the database file
-	file     *os.File    // Open file handle
-	mu       sync.Mutex  // Protects concurrent access to the file
+	filePath string     // Path to the database file
+	file     *os.File   // Open file handle
+	lock     *os.File   // Lock file holding the advisory lock, nil if locking was impossible
+	readOnly bool       // Opened with NewReadOnlyStorage; every write fails with ErrReadOnly
+	mu       sync.Mutex // Protects concurrent access to the file
+	format   int        // Format of the file (FormatJSONLines or FormatBinary)
+	target   int        // Format the next Compact writes (see SetFormat)
+
+	codec        string      // Codec of the file's binary records (see SetCodec)
+	targetCodec  string      // Codec the next Compact writes
+	compression  string      // Compression for binary records (see SetCompression)
+	cipher       *fileCipher // Encryption of the file, nil if it is plaintext or still locked
+	targetCipher *fileCipher // Encryption the next Compact writes (see SetPassphrase)
+	keyBlock     []byte      // Key block read from an encrypted file's header
+
+	latency *latencyHistogram // Append duration histogram, nil unless tracking is enabled
+	now     func() time.Time  // Clock used to time Appends (overridable for tests)
+
+	seq  uint64        // Sequence number of the latest record written or loaded
+	tail StorageRecord // Latest record, kept so compaction never loses the sequence
+
+	size    int64            // Bytes in the file
+	maxSize int64            // Writes that would grow the file past this are refused (see SetMaxSize); 0 means no limit
+	usage   *diskUsage       // Sizes of the records in the file, live or superseded
+	onWrite func(size int64) // Called after every successful write with the new file size
+
+	recovery  *RecoveryInfo  // Torn write repaired by LoadAll, if any
+	version   int            // Storage version of the file (see StorageVersion), known once loaded
+	compacted int64          // When superseded records were last discarded (see FileHeader.Compacted)
+	migration *MigrationInfo // Upgrade LoadAll made to an older file, if any
+
+	snapshotted bool // A snapshot file holds the records up to the last Checkpoint
+	walRecords  int  // Records in the main file, which is the write-ahead log once snapshotted
+
+	lazy *lazyIndex // Where the collections not loaded yet are, with lazy loading (see LoadCollections)
+
+	writes   uint64     // Appends and batches written, numbering them for group commit
+	synced   uint64     // Writes known to be on disk
+	syncs    uint64     // Syncs made by group commit
+	syncing  bool       // A writer is syncing the file without holding the lock
+	syncDone *sync.Cond // Signalled when a sync finishes
+	syncErr  error      // First failed sync; every later write fails with it
 }
 
+// RecoveryInfo describes a torn write, left by a crash partway through an
+// Append, that was repaired when the storage file was loaded
+type RecoveryInfo struct {
+	Offset         int64     `json:"offset"`          // Where the incomplete record started, i.e. the file's new end
+	TruncatedBytes int64     `json:"truncated_bytes"` // Bytes of the incomplete record that were removed
+	Time           time.Time `json:"time"`            // When the repair happened
+}
+
+// tornWrite locates a record an interrupted write left incomplete at the
+// end of the file
+type tornWrite struct {
+	offset       int64 // Where the incomplete record starts
+	unterminated bool  // The last line holds a whole record but lacks its newline
+}
+
+// ErrReadOnly is returned by writes to a database opened read-only
+var ErrReadOnly = errors.New("database is read-only")
+
 // NewStorage creates a new Storage instance
-// It opens (or creates) the file at the given path
+// It opens (or creates) the file at the given path and detects its format
+// New files use FormatJSONLines unless SetFormat is called before writing
+// The file is locked for as long as it is open; if another process has it
+// open the error is a *LockError
 func NewStorage(path string) (*Storage, error) {
+	return newStorage(path, false)
+}
+
+// NewReadOnlyStorage opens an existing storage file for reading only
+// It takes a shared lock, so several processes can read the file at once
+// but none can open it for writing meanwhile; writes fail with ErrReadOnly
+// and a torn write at the end is skipped rather than repaired
+func NewReadOnlyStorage(path string) (*Storage, error) {
+	return newStorage(path, true)
+}
+
+// newStorage locks and opens the file at path
+func newStorage(path string, readOnly bool) (*Storage, error) {
+	lock, err := lockDatabase(path, readOnly)
+	if err != nil {
+		return nil, err
+	}
+
 	// Open file in read-write mode, create if doesn't exist
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	flags := os.O_RDWR | os.O_CREATE | os.O_APPEND
+	if readOnly {
+		flags = os.O_RDONLY
+	}
+	file, err := os.OpenFile(path, flags, 0644)
 	if err != nil {
+		closeLock(lock)
 		return nil, fmt.Errorf("failed to open storage file: %w", err)
 	}
 
-	return &Storage{
-		filePath: path,
-		file:     file,
-	}, nil
+	reader, err := newRecordReader(file)
+	if err != nil {
+		file.Close()
+		closeLock(lock)
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		closeLock(lock)
+		return nil, fmt.Errorf("failed to stat storage file: %w", err)
+	}
+
+	size := info.Size()
+	snapshot, err := os.Stat(snapshotPath(path))
+	if err != nil && !os.IsNotExist(err) {
+		file.Close()
+		closeLock(lock)
+		return nil, fmt.Errorf("failed to stat snapshot file: %w", err)
+	}
+	if snapshot != nil {
+		size += snapshot.Size()
+	}
+
+	s := &Storage{
+		filePath:    path,
+		file:        file,
+		lock:        lock,
+		readOnly:    readOnly,
+		format:      reader.format,
+		target:      reader.format,
+		codec:       reader.codec,
+		targetCodec: reader.codec,
+		keyBlock:    reader.keyBlock,
+		now:         time.Now,
+		size:        size,
+		usage:       newDiskUsage(),
+		snapshotted: snapshot != nil,
+	}
+	s.syncDone = sync.NewCond(&s.mu)
+
+	// A new file starts with its header record
+	if info.Size() == 0 && !readOnly {
+		if err := s.writeHeader(); err != nil {
+			file.Close()
+			closeLock(lock)
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// writeHeader writes the format header and header record to an empty file
+// in the target format and encryption, which become the file's
+// Caller must hold the lock (or own the storage exclusively)
+func (s *Storage) writeHeader() error {
+	header := formatHeader(s.targetEncoding())
+	record, err := s.targetEncoding().encode(headerRecord(s.fileHeader()))
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(header, record...)); err != nil {
+		return fmt.Errorf("failed to write file header: %w", err)
+	}
+	s.format, s.codec, s.cipher, s.keyBlock = s.target, s.targetCodec, s.targetCipher, nil
+	s.version = StorageVersion
+	s.size += int64(len(header) + len(record))
+	return nil
+}
+
+// snapshotPath returns where the snapshot of the database at path is kept
+func snapshotPath(path string) string {
+	return path + ".snapshot"
+}
+
+// SetFormat selects the file format to write
+// An empty file switches to it straight away; a file holding records keeps
+// its format until the next Compact rewrites it in the new one
+func (s *Storage) SetFormat(format int) error {
+	if !validFormat(format) {
+		return fmt.Errorf("unknown storage format %d", format)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if format != FormatBinary && s.targetCipher != nil {
+		return fmt.Errorf("encryption requires the binary storage format")
+	}
+	s.target = format
+	return s.adoptTarget()
+}
+
+// SetPassphrase unlocks an encrypted file, failing if the passphrase is
+// wrong, or encrypts a plaintext one under a key derived from it: an empty
+// file straight away, others when the next Compact rewrites them (in the
+// binary format, which encryption requires)
+func (s *Storage) SetPassphrase(passphrase string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.keyBlock != nil {
+		fc, err := openFileCipher(passphrase, s.keyBlock)
+		if err != nil {
+			return err
+		}
+		s.cipher, s.targetCipher = fc, fc
+		return nil
+	}
+
+	fc, err := newFileCipher(passphrase)
+	if err != nil {
+		return err
+	}
+	s.target, s.targetCipher = FormatBinary, fc
+	return s.adoptTarget()
+}
+
+// ChangePassphrase checks the passphrase a file is encrypted under and
+// derives a key from next, with a fresh salt, for the next Compact to
+// rewrite the file under; records written until then keep the current key
+func (s *Storage) ChangePassphrase(current, next string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if s.targetCipher == nil {
+		return fmt.Errorf("database is not encrypted; open it with WithEncryption to encrypt it")
+	}
+	if _, err := openFileCipher(current, s.targetCipher.keyBlock); err != nil {
+		return err
+	}
+	fc, err := newFileCipher(next)
+	if err != nil {
+		return err
+	}
+	s.targetCipher = fc
+	return nil
+}
+
+// Encrypted reports whether the storage file is encrypted
+func (s *Storage) Encrypted() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.keyBlock != nil || s.cipher != nil
+}
+
+// adoptTarget switches a file holding no records to the target format,
+// codec and encryption by rewriting its header; files with records, or a
+// snapshot, keep theirs until Compact, so old and new records never mix
+// Caller must hold the lock
+func (s *Storage) adoptTarget() error {
+	if s.format == s.target && s.codec == s.targetCodec && s.cipher == s.targetCipher {
+		return nil
+	}
+	if s.readOnly {
+		return nil // Only Compact would convert the file, and it can't run
+	}
+	if s.snapshotted {
+		return nil // The snapshot is converted, with the log, at the next Checkpoint
+	}
+	if s.holdsRecords() {
+		return nil
+	}
+
+	info, err := s.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat storage file: %w", err)
+	}
+	if err := s.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate storage file: %w", err)
+	}
+	s.size -= info.Size()
+	return s.writeHeader()
+}
+
+// fileHeader returns the header record content for files written now
+// Caller must hold the lock
+func (s *Storage) fileHeader() FileHeader {
+	return FileHeader{Version: StorageVersion, Compacted: s.compacted}
+}
+
+// CompactedAt returns when compaction (or a checkpoint) last discarded
+// superseded records, so the history ReadSince returns starts there; the
+// zero time if the file holds its whole history
+func (s *Storage) CompactedAt() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.compacted == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, s.compacted)
+}
+
+// holdsRecords reports whether the file has any records after its header
+// A file that can't be read counts as holding some, so it is left alone
+// Caller must hold the lock
+func (s *Storage) holdsRecords() bool {
+	if _, err := s.file.Seek(0, 0); err != nil {
+		return true
+	}
+	reader, err := s.reader(s.file)
+	if err != nil {
+		return true
+	}
+	for {
+		payload, err := reader.next()
+		if err == io.EOF {
+			return false
+		}
+		if err != nil {
+			return true
+		}
+		if len(payload) == 0 {
+			continue
+		}
+		record, err := reader.decode(payload, true)
+		if err != nil || record.Header == nil {
+			return true
+		}
+	}
+}
+
+// SetCompression selects how binary records are compressed from now on
+// Records already written keep their encoding, and JSON-lines files are
+// never compressed
+func (s *Storage) SetCompression(compression string) error {
+	if err := validCompression(compression); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.compression = compression
+	return nil
+}
+
+// SetCodec selects the codec binary records are serialized with (see
+// WithRecordCodec)
+// An empty file switches to it straight away; a file holding records keeps
+// its codec until the next Compact rewrites it in the new one. JSON-lines
+// files always hold JSON
+func (s *Storage) SetCodec(codec string) error {
+	if err := validCodec(codec); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.targetCodec = codec
+	return s.adoptTarget()
+}
+
+// Codec returns the codec of the storage file's records
+func (s *Storage) Codec() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.format != FormatBinary {
+		return CodecJSON
+	}
+	return s.codec
+}
+
+// encoding returns the settings for appending records to the file
+// Caller must hold the lock
+func (s *Storage) encoding() recordEncoding {
+	return recordEncoding{format: s.format, codec: s.codec, compression: s.compression, cipher: s.cipher}
+}
+
+// targetEncoding returns the settings Compact rewrites the file with
+// Caller must hold the lock
+func (s *Storage) targetEncoding() recordEncoding {
+	return recordEncoding{format: s.target, codec: s.targetCodec, compression: s.compression, cipher: s.targetCipher}
+}
+
+// Format returns the format of the storage file
+func (s *Storage) Format() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.format
+}
+
+// EnableLatencyTracking starts recording Append durations into a histogram
+func (s *Storage) EnableLatencyTracking() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.latency == nil {
+		s.latency = &latencyHistogram{}
+	}
+}
+
+// WriteLatency returns a summary of recorded Append durations
+// The second return value is false if latency tracking is not enabled
+func (s *Storage) WriteLatency() (LatencySnapshot, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.latency == nil {
+		return LatencySnapshot{}, false
+	}
+	return s.latency.Snapshot(), true
 }
 
 // LoadAll reads all records from the storage file
 // Returns a slice of StorageRecords
+// It also restores the current sequence number from the records it reads
 func (s *Storage) LoadAll() ([]StorageRecord, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	log, err := s.readRecords(nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.recoverTorn(log.torn); err != nil {
+		return nil, err
+	}
+
+	// Files written by an older engine are upgraded to the current version
+	records := log.records
+	if s.version < StorageVersion && !s.readOnly {
+		if records, err = s.upgrade(records); err != nil {
+			return nil, fmt.Errorf("failed to upgrade storage file: %w", err)
+		}
+	} else {
+		s.usage = measureUsage(records, log.sizes)
+	}
+
+	s.resume(records)
+	if len(records) > 0 {
+		s.tail = records[len(records)-1]
+	}
+	return records, nil
+}
+
+// recoverTorn repairs a torn write found while loading, or just warns about
+// it in a read-only file
+// Caller must hold the lock
+func (s *Storage) recoverTorn(torn *tornWrite) error {
+	if torn == nil {
+		return nil
+	}
+	if err := s.checkTorn(*torn); err != nil {
+		return err
+	}
+	if s.readOnly {
+		fmt.Printf("Warning: skipping an incomplete record at offset %d of read-only %s\n", torn.offset, s.filePath)
+		return nil
+	}
+	return s.repair(*torn)
+}
+
+// checkTorn makes sure the damage decodeLog took for a torn write ends the
+// file: a binary frame whose length runs past the end, or frames failing
+// their checksums, can also be a corrupt length in the middle of the file,
+// and truncating there would lose every record after it. If an intact
+// frame follows, loading fails rather than discard it
+// Caller must hold the lock
+func (s *Storage) checkTorn(torn tornWrite) error {
+	if torn.unterminated || s.format != FormatBinary {
+		return nil
+	}
+
+	info, err := s.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat storage file: %w", err)
+	}
+	tail := make([]byte, info.Size()-torn.offset)
+	if _, err := s.file.ReadAt(tail, torn.offset); err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read storage file: %w", err)
+	}
+	for off := 1; off < len(tail); off++ {
+		if frameAt(tail, off) {
+			return fmt.Errorf("storage file is damaged at byte %d, but intact records follow at byte %d; recover them with Repair",
+				torn.offset, torn.offset+int64(off))
+		}
+	}
+	return nil
+}
+
+// resume resumes sequencing after the newest of the loaded records
+// Caller must hold the lock
+func (s *Storage) resume(records []StorageRecord) {
+	if len(records) > 0 {
+		s.seq = records[len(records)-1].Seq
+	}
+}
+
+// ReadSince returns every record in the file with a sequence number greater than seq
+// Records are returned in log order. Superseded records removed by compaction
+// are no longer available, so consumers should keep up between compactions
+func (s *Storage) ReadSince(seq uint64) ([]StorageRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log, err := s.readRecords(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var newer []StorageRecord
+	for _, record := range log.records {
+		if record.Seq > seq {
+			newer = append(newer, record)
+		}
+	}
+	return newer, nil
+}
+
+// CurrentSequence returns the sequence number of the latest record
+func (s *Storage) CurrentSequence() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.seq
+}
+
+// readRecords reads and decodes every record in the snapshot, if there is
+// one, and the file
+// Records written before sequence numbers existed are numbered by their position
+// An incomplete record at the end of the file is left out and reported as a tornWrite
+// Given an index, only the record heads are decoded (see recordHead) and
+// where each record is goes into the index, for lazy loading
+// The result holds the records of both files, with their sizes
+// Caller must hold the lock
+func (s *Storage) readRecords(index *lazyIndex) (decodedLog, error) {
+	var records []StorageRecord
+	var sizes []int64
+	var floor uint64
+	if s.snapshotted {
+		snapshot, err := s.readSnapshot(index != nil)
+		if err != nil {
+			return decodedLog{}, err
+		}
+		records, sizes = snapshot.records, snapshot.sizes
+		if len(records) > 0 {
+			floor = records[len(records)-1].Seq
+		}
+		if index != nil {
+			index.snapshotFormat, index.snapshotCodec = snapshot.format, snapshot.codec
+			index.add(snapshot, true)
+		}
+	}
+
 	// Seek to beginning of file
 	if _, err := s.file.Seek(0, 0); err != nil {
-		return nil, fmt.Errorf("failed to seek to beginning: %w", err)
+		return decodedLog{}, fmt.Errorf("failed to seek to beginning: %w", err)
+	}
+	reader, err := s.reader(s.file)
+	if err != nil {
+		return decodedLog{}, err
 	}
+	log, err := decodeLog(reader, floor, index != nil)
+	if err != nil {
+		return decodedLog{}, err
+	}
+	if index != nil {
+		index.format, index.codec = log.format, log.codec
+		index.add(log, false)
+	}
+	if err := checkVersion(log.version); err != nil {
+		return decodedLog{}, err
+	}
+	// A crash during a checkpoint leaves the older log header beside the new snapshot
+	s.version, s.compacted = log.version, max(s.compacted, log.compacted)
+	s.walRecords = len(log.records)
+	log.records, log.sizes = append(records, log.records...), append(sizes, log.sizes...)
+	return log, nil
+}
 
-	var records []StorageRecord
-	scanner := bufio.NewScanner(s.file)
+// readSnapshot reads the records of the snapshot file, only their heads if
+// heads is set
+// Caller must hold the lock
+func (s *Storage) readSnapshot(heads bool) (decodedLog, error) {
+	file, err := os.Open(snapshotPath(s.filePath))
+	if err != nil {
+		return decodedLog{}, fmt.Errorf("failed to open snapshot file: %w", err)
+	}
+	defer file.Close()
+
+	reader, err := s.reader(file)
+	if err != nil {
+		return decodedLog{}, err
+	}
+	if reader.encrypted && !bytes.Equal(reader.keyBlock, s.cipher.keyBlock) {
+		return decodedLog{}, fmt.Errorf("snapshot file is encrypted with a different key than the database file")
+	}
+	snapshot, err := decodeLog(reader, 0, heads)
+	if err != nil {
+		return decodedLog{}, err
+	}
+	if err := checkVersion(snapshot.version); err != nil {
+		return decodedLog{}, err
+	}
+	if snapshot.torn != nil {
+		return decodedLog{}, fmt.Errorf("snapshot file is incomplete")
+	}
+	s.compacted = snapshot.compacted
+	return snapshot, nil
+}
 
-	// Read line by line
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
+// reader starts reading a storage file, unlocking it if it is encrypted
+// Caller must hold the lock
+func (s *Storage) reader(file io.Reader) (*recordReader, error) {
+	reader, err := newRecordReader(file)
+	if err != nil {
+		return nil, err
+	}
+	if reader.encrypted {
+		if s.cipher == nil {
+			return nil, fmt.Errorf("storage file is encrypted; a passphrase is required")
+		}
+		reader.cipher = s.cipher
+	}
+	return reader, nil
+}
+
+// decodedLog is what decodeLog read from a storage file
+type decodedLog struct {
+	records   []StorageRecord
+	offsets   []int64    // Where each record starts in the file
+	sizes     []int64    // How many bytes each record takes up there
+	format    int        // Format of the file (FormatJSONLines or FormatBinary)
+	codec     string     // Codec of its records
+	version   int        // Storage version from the header record; 1 if the file has none
+	compacted int64      // FileHeader.Compacted from the header record
+	torn      *tornWrite // Incomplete record ending the file, if any
+}
+
+// decodeLog decodes the records after floor, the last sequence number
+// already read from a snapshot; log records at or below it were already
+// checkpointed when the log was last reset
+// An incomplete record at the end is left out and reported as a tornWrite
+// With heads set, records hold only their heads (see recordHead)
+func decodeLog(reader *recordReader, floor uint64, heads bool) (decodedLog, error) {
+	var records []StorageRecord
+	var offsets, sizes []int64
+	lastSeq := floor
+	version := 1
+	var compacted int64
+	var torn *tornWrite
+	corruptTail := int64(-1) // Start of the run of corrupt records ending the file so far
+	for {
+		start := reader.offset
+		payload, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF || err == errRecordLength {
+			// The file ends partway through a record, or it can't be told where
+			// the record ends; either is taken for a torn write, which the
+			// storage checks really ends the file (see checkTorn)
+			if corruptTail < 0 {
+				corruptTail = start
+			}
+			torn = &tornWrite{offset: corruptTail}
+			break
+		}
+		if err == errRecordChecksum {
+			fmt.Printf("Warning: skipping corrupt record at byte %d: %v (see Repair)\n", start, err)
+			if corruptTail < 0 {
+				corruptTail = start
+			}
+			continue
+		}
+		corruptTail = -1
+		if err == errRecordEncoding {
+			fmt.Printf("Warning: skipping corrupt record at byte %d: %v (see Repair)\n", start, err)
+			continue
+		}
+		if err != nil {
+			return decodedLog{}, err
+		}
+		if len(payload) == 0 {
 			continue // Skip empty lines
 		}
 
-		var record StorageRecord
-		if err := json.Unmarshal([]byte(line), &record); err != nil {
+		record, err := reader.decode(payload, heads)
+		if err != nil {
+			if reader.unterminated {
+				torn = &tornWrite{offset: start}
+				break
+			}
 			// Log error but continue - don't let one corrupt record break everything
-			fmt.Printf("Warning: failed to parse record: %v\n", err)
+			fmt.Printf("Warning: failed to parse record at byte %d: %v (see Repair)\n", start, err)
+			continue
+		}
+		if reader.unterminated {
+			torn = &tornWrite{offset: reader.offset, unterminated: true}
+		}
+		if record.Header != nil {
+			version, compacted = record.Header.Version, record.Header.Compacted
+			continue
+		}
+
+		// Legacy records have no sequence number, give them the next one
+		if record.Seq == 0 {
+			record.Seq = lastSeq + 1
+		}
+		if record.Seq <= floor {
 			continue
 		}
+		if record.Seq > lastSeq {
+			lastSeq = record.Seq
+		}
 
 		records = append(records, record)
+		offsets = append(offsets, start)
+		sizes = append(sizes, reader.offset-start)
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("error reading file: %w", err)
+	// A torn binary write can leave a frame of the right length whose
+	// contents never reached the disk; corrupt frames at the very end are
+	// treated as one
+	if torn == nil && corruptTail >= 0 {
+		torn = &tornWrite{offset: corruptTail}
 	}
+	return decodedLog{records: records, offsets: offsets, sizes: sizes, format: reader.format, codec: reader.codec, version: version, compacted: compacted, torn: torn}, nil
+}
 
-	return records, nil
+// repair truncates the file to the end of its last complete record, or
+// terminates a last line that is only missing its newline, so new records
+// are never appended onto the remains of an interrupted write
+// Caller must hold the lock
+func (s *Storage) repair(torn tornWrite) error {
+	if torn.unterminated {
+		if _, err := s.file.Write([]byte("\n")); err != nil {
+			return fmt.Errorf("failed to repair storage file: %w", err)
+		}
+		s.size++
+		return nil
+	}
+
+	info, err := s.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat storage file: %w", err)
+	}
+	truncated := info.Size() - torn.offset
+	if err := s.file.Truncate(torn.offset); err != nil {
+		return fmt.Errorf("failed to truncate torn write: %w", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	fmt.Printf("Warning: recovered from a torn write: removed %d bytes at offset %d\n", truncated, torn.offset)
+	s.size -= truncated
+	s.recovery = &RecoveryInfo{Offset: torn.offset, TruncatedBytes: truncated, Time: s.now()}
+	return nil
 }
 
-// Append writes a new record to the end of the storage file
-// Each record is written as a single JSON line
-func (s *Storage) Append(record StorageRecord) error {
+// Recovery reports the torn write repaired when the file was loaded
+// The second return value is false if the file was intact
+func (s *Storage) Recovery() (RecoveryInfo, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Serialize record to JSON
-	data, err := json.Marshal(record)
+	if s.recovery == nil {
+		return RecoveryInfo{}, false
+	}
+	return *s.recovery, true
+}
+
+// Append writes a new record to the end of the storage file and waits for
+// it to be synced, sharing the sync with concurrent writers (see durable)
+// Returns the sequence number assigned to the record
+func (s *Storage) Append(record StorageRecord) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return 0, ErrReadOnly
+	}
+	if s.syncErr != nil {
+		return 0, s.syncErr
+	}
+
+	// Stamp the record with the next sequence number
+	record.Seq = s.seq + 1
+
+	data, err := s.encoding().encode(record)
 	if err != nil {
-		return fmt.Errorf("failed to marshal record: %w", err)
+		return 0, err
+	}
+	if err := CheckFileSize([]StorageRecord{record}, s.size, int64(len(data)), s.maxSize); err != nil {
+		return 0, err
 	}
 
-	// Append newline-delimited JSON
-	data = append(data, '\n')
+	// Time the write and sync when latency tracking is enabled
+	if s.latency != nil {
+		start := s.now()
+		defer func() { s.latency.Observe(s.now().Sub(start)) }()
+	}
 
 	// Write to file
 	if _, err := s.file.Write(data); err != nil {
-		return fmt.Errorf("failed to write to file: %w", err)
+		return 0, fmt.Errorf("failed to write to file: %w", err)
 	}
 
+	s.seq = record.Seq
+	s.tail = record
+	n := s.wrote(data, []StorageRecord{record}, []int64{int64(len(data))})
+
 	// Ensure data is flushed to disk
-	if err := s.file.Sync(); err != nil {
-		return fmt.Errorf("failed to sync file: %w", err)
+	if err := s.durable(n); err != nil {
+		return 0, err
+	}
+	return record.Seq, nil
+}
+
+// AppendBatch writes several records to the end of the storage file
+// All records are written with a single write call and flushed with one sync,
+// which concurrent writers may share
+// Each record's Seq field is set in place to the sequence number it was assigned
+func (s *Storage) AppendBatch(records []StorageRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if s.syncErr != nil {
+		return s.syncErr
+	}
+
+	// Stamp consecutive sequence numbers and serialize all records up front
+	// so a marshal failure writes nothing
+	var data []byte
+	sizes := make([]int64, len(records))
+	for i := range records {
+		records[i].Seq = s.seq + uint64(i) + 1
+		encoded, err := s.encoding().encode(records[i])
+		if err != nil {
+			return err
+		}
+		data = append(data, encoded...)
+		sizes[i] = int64(len(encoded))
+	}
+	if err := CheckFileSize(records, s.size, int64(len(data)), s.maxSize); err != nil {
+		return err
+	}
+
+	// Time the write and sync when latency tracking is enabled
+	if s.latency != nil {
+		start := s.now()
+		defer func() { s.latency.Observe(s.now().Sub(start)) }()
+	}
+
+	if _, err := s.file.Write(data); err != nil {
+		return fmt.Errorf("failed to write to file: %w", err)
 	}
 
+	s.tail = records[len(records)-1]
+	s.seq = s.tail.Seq
+	return s.durable(s.wrote(data, records, sizes))
+}
+
+// wrote accounts for records appended to the file, encoded into data with
+// the given sizes, notifies onWrite and returns the write's number for durable
+// Caller must hold the lock
+func (s *Storage) wrote(data []byte, records []StorageRecord, sizes []int64) uint64 {
+	s.writes++
+	s.size += int64(len(data))
+	s.walRecords += len(records)
+	for i, record := range records {
+		s.usage.add(record, sizes[i])
+	}
+	if s.onWrite != nil {
+		s.onWrite(s.size)
+	}
+	return s.writes
+}
+
+// SetWriteHook installs a function called after every successful write with
+// the new file size, while the storage lock is held
+func (s *Storage) SetWriteHook(hook func(size int64)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.onWrite = hook
+}
+
+// SetMaxSize makes writes that would grow the file past max bytes fail
+// with a LimitError (see Limits.MaxFileBytes); 0 removes the limit
+func (s *Storage) SetMaxSize(max int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maxSize = max
+}
+
+// Size returns the size of the storage file in bytes
+func (s *Storage) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size
+}
+
+// RecordCounts returns how many records each collection has in the file,
+// counting superseded versions and deletions as well as live documents
+func (s *Storage) RecordCounts() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.usage.recordCounts()
+}
+
+// Sync flushes the storage file to disk
+// Appends already sync before returning, so this only matters for writes
+// made outside them
+func (s *Storage) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return nil // Nothing was written
+	}
+	if s.syncErr != nil {
+		return s.syncErr
+	}
+	s.awaitSync()
+	if err := s.file.Sync(); err != nil {
+		s.syncErr = fmt.Errorf("failed to sync file: %w", err)
+		return s.syncErr
+	}
+	s.synced = s.writes
 	return nil
 }
 
-// Close closes the storage file
+// Close syncs writes still waiting on group commit and closes the storage file
 func (s *Storage) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	err := s.durable(s.writes)
+	s.awaitSync()
 	if s.file != nil {
-		return s.file.Close()
+		if closeErr := s.file.Close(); closeErr != nil {
+			return closeErr
+		}
 	}
-	return nil
+	closeLock(s.lock)
+	s.lock = nil
+	return err
 }
 
 // Compact rebuilds the storage file by removing deleted/updated records
 // This helps reclaim disk space from the append-only log
+// Records keep their sequence numbers and are written in sequence order,
+// in the format chosen with SetFormat
+// Once the database has been checkpointed, compaction is a checkpoint
 func (s *Storage) Compact(records []StorageRecord) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Close current file
-	if err := s.file.Close(); err != nil {
-		return fmt.Errorf("failed to close file: %w", err)
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	return s.discarding(func() error {
+		if s.snapshotted {
+			return s.checkpoint(records)
+		}
+
+		records = s.withTail(records)
+		size, usage, err := s.rewriteLog(records)
+		if err != nil {
+			return err
+		}
+		s.size, s.usage, s.walRecords = size, usage, len(records)
+		return nil
+	})
+}
+
+// discarding runs a rewrite that keeps only the live records, first marking
+// the history before now as incomplete; the mark is undone if it fails
+// Caller must hold the lock
+func (s *Storage) discarding(rewrite func() error) error {
+	if s.lazy != nil {
+		return errNotLoaded
+	}
+	previous := s.compacted
+	s.compacted = recordTime()
+	if err := rewrite(); err != nil {
+		s.compacted = previous
+		return err
+	}
+	return nil
+}
+
+// Checkpoint writes the given records, the live state of the database, to
+// the snapshot file and empties the main file, which from then on holds only
+// the writes since. Loading reads the snapshot and replays that short log
+// instead of the whole history
+// Records keep their sequence numbers and are written in the format chosen
+// with SetFormat
+func (s *Storage) Checkpoint(records []StorageRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	return s.discarding(func() error { return s.checkpoint(records) })
+}
+
+// checkpoint writes the snapshot and then resets the log
+// A crash in between leaves log records the snapshot already holds, which
+// loading skips by sequence number
+// Caller must hold the lock
+func (s *Storage) checkpoint(records []StorageRecord) error {
+	records = s.withTail(records)
+	size, usage, err := s.rewrite(snapshotPath(s.filePath), records)
+	if err != nil {
+		return err
 	}
+	s.snapshotted = true
 
+	logSize, _, err := s.rewriteLog(nil)
+	if err != nil {
+		return err
+	}
+	s.size, s.usage, s.walRecords = size+logSize, usage, 0
+	return nil
+}
+
+// ReadOnly reports whether the storage was opened with NewReadOnlyStorage
+func (s *Storage) ReadOnly() bool {
+	return s.readOnly
+}
+
+// WALRecords returns how many records have been written since the last
+// checkpoint, or in total if the database was never checkpointed
+func (s *Storage) WALRecords() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.walRecords
+}
+
+// withTail sorts records into log order, so sequence numbers stay ascending,
+// and keeps the newest record if it was a deletion, so the sequence survives
+// a reopen
+// Caller must hold the lock
+func (s *Storage) withTail(records []StorageRecord) []StorageRecord {
+	sort.Slice(records, func(i, j int) bool { return records[i].Seq < records[j].Seq })
+	if s.tail.Seq > 0 && (len(records) == 0 || records[len(records)-1].Seq < s.tail.Seq) {
+		records = append(records, s.tail)
+	}
+	return records
+}
+
+// rewrite replaces the file at path with the target format's header and the
+// given records, through a temporary file, and returns the new file's size
+// and the usage of its records
+// Caller must hold the lock
+func (s *Storage) rewrite(path string, records []StorageRecord) (int64, *diskUsage, error) {
 	// Create a temporary file
-	tempPath := s.filePath + ".tmp"
+	tempPath := path + ".tmp"
 	tempFile, err := os.Create(tempPath)
 	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
+		return 0, nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	fail := func(err error) (int64, *diskUsage, error) {
+		tempFile.Close()
+		os.Remove(tempPath)
+		return 0, nil, err
 	}
 
-	// Write all current records to temp file
-	for _, record := range records {
-		data, err := json.Marshal(record)
-		if err != nil {
-			tempFile.Close()
-			os.Remove(tempPath)
-			return fmt.Errorf("failed to marshal record: %w", err)
-		}
-		data = append(data, '\n')
-		if _, err := tempFile.Write(data); err != nil {
-			tempFile.Close()
-			os.Remove(tempPath)
-			return fmt.Errorf("failed to write record: %w", err)
-		}
+	// Write the headers and all current records to temp file
+	size, usage, err := writeLog(tempFile, s.targetEncoding(), s.fileHeader(), records)
+	if err != nil {
+		return fail(err)
 	}
 
+	if err := tempFile.Sync(); err != nil {
+		return fail(fmt.Errorf("failed to sync temp file: %w", err))
+	}
 	if err := tempFile.Close(); err != nil {
 		os.Remove(tempPath)
-		return fmt.Errorf("failed to close temp file: %w", err)
+		return 0, nil, fmt.Errorf("failed to close temp file: %w", err)
 	}
 
 	// Replace old file with new file
-	if err := os.Rename(tempPath, s.filePath); err != nil {
-		return fmt.Errorf("failed to rename temp file: %w", err)
+	if err := os.Rename(tempPath, path); err != nil {
+		return 0, nil, fmt.Errorf("failed to rename temp file: %w", err)
 	}
+	return size, usage, nil
+}
 
-	// Reopen the file
-	file, err := os.OpenFile(s.filePath, os.O_RDWR|os.O_APPEND, 0644)
+// writeLog writes a whole storage file, its format header, header record
+// and the given records, to w in the given encoding, and returns the bytes
+// written and the usage of the records
+func writeLog(w io.Writer, enc recordEncoding, fileHeader FileHeader, records []StorageRecord) (int64, *diskUsage, error) {
+	header := formatHeader(enc)
+	opening, err := enc.encode(headerRecord(fileHeader))
 	if err != nil {
-		return fmt.Errorf("failed to reopen file: %w", err)
+		return 0, nil, err
+	}
+	header = append(header, opening...)
+	if _, err := w.Write(header); err != nil {
+		return 0, nil, fmt.Errorf("failed to write file header: %w", err)
+	}
+
+	size := int64(len(header))
+	usage := newDiskUsage()
+	for _, record := range records {
+		data, err := enc.encode(record)
+		if err != nil {
+			return 0, nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return 0, nil, fmt.Errorf("failed to write record: %w", err)
+		}
+		size += int64(len(data))
+		usage.add(record, int64(len(data)))
+	}
+	return size, usage, nil
+}
+
+// rewriteLog replaces the main file with the given records (see rewrite) and
+// reopens it in the target format and encryption; if that fails the old
+// file stays in use
+// Caller must hold the lock
+func (s *Storage) rewriteLog(records []StorageRecord) (int64, *diskUsage, error) {
+	// Close current file
+	s.awaitSync()
+	if err := s.file.Close(); err != nil {
+		return 0, nil, fmt.Errorf("failed to close file: %w", err)
 	}
+	size, usage, err := s.rewrite(s.filePath, records)
 
+	// Reopen the file
+	file, openErr := os.OpenFile(s.filePath, os.O_RDWR|os.O_APPEND, 0644)
+	if openErr != nil {
+		return 0, nil, fmt.Errorf("failed to reopen file: %w", openErr)
+	}
 	s.file = file
-	return nil
+	if err != nil {
+		return 0, nil, err
+	}
+	s.synced = s.writes // The rewrite was synced
+	s.format, s.codec, s.cipher, s.keyBlock = s.target, s.targetCodec, s.targetCipher, nil
+	return size, usage, nil
 }
@@ -0,0 +1,230 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestLoadDamagedBinaryLog(t *testing.T) {
+	path := writeBinaryDatabase(t, 100)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := frameOffsets(t, data)
+	eleventh := frames[11] // frames[0] is the header record
+
+	tests := []struct {
+		name    string
+		damage  func(data []byte) []byte
+		wantErr bool // Intact records follow the damage, so the open fails
+		docs    int  // Documents after opening, if it succeeds
+	}{
+		{
+			name: "length bit flipped past the end",
+			damage: func(data []byte) []byte {
+				data[eleventh+1] ^= 0x40
+				return data
+			},
+			wantErr: true,
+		},
+		{
+			name: "length bit flipped within the file",
+			damage: func(data []byte) []byte {
+				data[eleventh+3] ^= 0x08
+				return data
+			},
+			wantErr: true,
+		},
+		{
+			name: "payload byte flipped",
+			damage: func(data []byte) []byte {
+				data[eleventh+binaryFrameHeader+2] ^= 0x01
+				return data
+			},
+			docs: 99,
+		},
+		{
+			name: "last frame cut short",
+			damage: func(data []byte) []byte {
+				return data[:len(data)-5]
+			},
+			docs: 99,
+		},
+		{
+			name: "last frame header cut short",
+			damage: func(data []byte) []byte {
+				return data[:frames[len(frames)-1]+3]
+			},
+			docs: 99,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			damaged := tt.damage(append([]byte(nil), data...))
+			target := filepath.Join(t.TempDir(), "test.db")
+			if err := os.WriteFile(target, damaged, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err := OpenDatabase(target)
+			if tt.wantErr {
+				if err == nil {
+					db.Close()
+					t.Fatal("open succeeded, want an error")
+				}
+				if !strings.Contains(err.Error(), "Repair") {
+					t.Fatalf("error %q doesn't mention Repair", err)
+				}
+				info, statErr := os.Stat(target)
+				if statErr != nil {
+					t.Fatal(statErr)
+				}
+				if info.Size() != int64(len(damaged)) {
+					t.Fatalf("file changed size from %d to %d", len(damaged), info.Size())
+				}
+
+				// Repair resyncs past the damaged frame and keeps the rest
+				report, err := Repair(target)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if report.Documents != 99 {
+					t.Fatalf("repair kept %d documents, want 99", report.Documents)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if got := db.GetCollection("docs").Count(); got != tt.docs {
+				t.Fatalf("got %d documents, want %d", got, tt.docs)
+			}
+		})
+	}
+}
+
+// TestCurrentSequence checks that the sequence rises by one for every
+// record written, batches counting each of their records, that it survives
+// reopening, compaction and checkpoints, and that ReadSince returns the
+// records after it
+func TestCurrentSequence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := OpenDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+	coll := db.GetCollection("docs")
+
+	start := db.CurrentSequence()
+	steps := []struct {
+		name    string
+		write   func() error
+		records uint64 // Records the write adds; 0 for none
+	}{
+		{"Insert", func() error {
+			_, err := coll.Insert(map[string]interface{}{"id": "a", "n": 1})
+			return err
+		}, 1},
+		{"Update", func() error {
+			return coll.Update("a", map[string]interface{}{"n": 2})
+		}, 1},
+		{"InsertMany", func() error {
+			_, err := coll.InsertMany([]map[string]interface{}{{"id": "b"}, {"id": "c"}, {"id": "d"}})
+			return err
+		}, 3},
+		{"Delete", func() error {
+			return coll.Delete("b")
+		}, 1},
+		{"DeleteMany", func() error {
+			_, err := coll.DeleteMany(map[string]interface{}{"id": map[string]interface{}{"$in": []interface{}{"c", "d"}}})
+			return err
+		}, 2},
+		{"UpdateOfMissingDocument", func() error {
+			if err := coll.Update("missing", map[string]interface{}{"n": 1}); err == nil {
+				t.Error("updating a missing document succeeded")
+			}
+			return nil
+		}, 0},
+		{"Reopen", func() error {
+			if err := db.Close(); err != nil {
+				return err
+			}
+			db, err = OpenDatabase(path)
+			coll = db.GetCollection("docs")
+			return err
+		}, 0},
+		{"InsertAfterReopen", func() error {
+			_, err := coll.Insert(map[string]interface{}{"id": "e"})
+			return err
+		}, 1},
+		{"Compact", func() error {
+			return db.Compact()
+		}, 0},
+		{"InsertAfterCompact", func() error {
+			_, err := coll.Insert(map[string]interface{}{"id": "f"})
+			return err
+		}, 1},
+		{"Checkpoint", func() error {
+			return db.Checkpoint()
+		}, 0},
+		{"InsertAfterCheckpoint", func() error {
+			_, err := coll.Insert(map[string]interface{}{"id": "g"})
+			return err
+		}, 1},
+		{"ReopenAfterCheckpoint", func() error {
+			if err := db.Close(); err != nil {
+				return err
+			}
+			db, err = OpenDatabase(path)
+			coll = db.GetCollection("docs")
+			return err
+		}, 0},
+	}
+	for _, step := range steps {
+		before := db.CurrentSequence()
+		if err := step.write(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if got, want := db.CurrentSequence(), before+step.records; got != want {
+			t.Fatalf("%s: sequence is %d, want %d", step.name, got, want)
+		}
+
+		// The write's records are the ones after the sequence before it
+		records, err := db.ReadSince(before)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if uint64(len(records)) != step.records {
+			t.Fatalf("%s: ReadSince returned %d records, want %d", step.name, len(records), step.records)
+		}
+		for i, record := range records {
+			if record.Seq != before+uint64(i)+1 {
+				t.Fatalf("%s: record %d has sequence %d, want %d", step.name, i, record.Seq, before+uint64(i)+1)
+			}
+		}
+	}
+
+	// Compaction dropped the deleted documents, so they are no longer
+	// reported, while the live ones are, at their latest sequence
+	records, err := db.ReadSince(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, record := range records {
+		if record.Doc == nil {
+			t.Fatalf("ReadSince reported the deletion of %s from before the compaction", record.ID)
+		}
+		ids = append(ids, record.ID)
+	}
+	sort.Strings(ids)
+	if got := strings.Join(ids, ","); got != "a,e,f,g" {
+		t.Fatalf("ReadSince returned documents %s, want a,e,f,g", got)
+	}
+}
@@ -0,0 +1,203 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// StorageEngine is the persistence layer behind a Database: an append-only
+// log of records, replayed on open and rewritten by compaction
+// Storage, the file backend, is the default; others are added with
+// RegisterStorageEngine or passed to OpenDatabaseWithStorage
+type StorageEngine interface {
+	// Append stamps a record with the next sequence number, persists it and
+	// returns the sequence number
+	Append(record StorageRecord) (uint64, error)
+
+	// AppendBatch persists several records at once, setting each one's Seq
+	// in place to consecutive sequence numbers
+	AppendBatch(records []StorageRecord) error
+
+	// LoadAll returns every stored record in log order and resumes
+	// sequencing after the newest one
+	LoadAll() ([]StorageRecord, error)
+
+	// ReadSince returns the stored records with a sequence number greater than seq
+	ReadSince(seq uint64) ([]StorageRecord, error)
+
+	// CurrentSequence returns the sequence number of the latest record
+	CurrentSequence() uint64
+
+	// Compact replaces the stored log with the given records, which keep
+	// their sequence numbers; the sequence must survive even if the newest
+	// record isn't among them
+	Compact(records []StorageRecord) error
+
+	// Sync flushes any buffered writes to durable storage
+	Sync() error
+
+	// Close releases the backend; no other method is called afterwards
+	Close() error
+}
+
+// StorageFactory opens a storage engine at a location (the part of the
+// database path after "scheme://")
+type StorageFactory func(location string, options Options) (StorageEngine, error)
+
+// Optional capabilities a storage engine can implement; the database uses
+// them when present
+type (
+	// storageFormatter backends store files whose format, compression and
+	// encryption can be chosen (see WithStorageFormat)
+	storageFormatter interface {
+		SetFormat(format int) error
+		SetCompression(compression string) error
+		SetPassphrase(passphrase string) error
+		Format() int
+		Encrypted() bool
+	}
+
+	// codecSetter backends can serialize binary records with another codec
+	// than JSON (see WithRecordCodec)
+	codecSetter interface {
+		SetCodec(codec string) error
+		Codec() string
+	}
+
+	// passphraseChanger backends can move an encrypted file to a key derived
+	// from another passphrase, which the next Compact writes (see
+	// ChangePassphrase)
+	passphraseChanger interface {
+		ChangePassphrase(current, next string) error
+	}
+
+	// storageSizer backends report their size and per-collection record
+	// counts, which Stats and automatic compaction rely on
+	storageSizer interface {
+		Size() int64
+		RecordCounts() map[string]int
+	}
+
+	// sizeLimiter backends refuse writes that would grow them past a size,
+	// checked against the encoded records as they are written (see
+	// Limits.MaxFileBytes)
+	sizeLimiter interface {
+		SetMaxSize(max int64)
+	}
+
+	// diskUsageReporter backends report how their bytes split between live
+	// and dead records (see DiskUsage)
+	diskUsageReporter interface {
+		DiskUsage() DiskUsage
+	}
+
+	// writeObserver backends report each successful write with the new size
+	writeObserver interface {
+		SetWriteHook(hook func(size int64))
+	}
+
+	// checkpointer backends can snapshot the live state and restart the log
+	// from it (see WithCheckpoints)
+	checkpointer interface {
+		Checkpoint(records []StorageRecord) error
+		WALRecords() int
+	}
+
+	// lazyLoader backends can index where each collection's records are and
+	// read one collection's records on demand (see WithLazyLoading)
+	lazyLoader interface {
+		LoadCollections() ([]string, error)
+		LoadCollection(name string) ([]StorageRecord, error)
+	}
+
+	// recoveryReporter backends report a torn write they repaired on load
+	recoveryReporter interface {
+		Recovery() (RecoveryInfo, bool)
+	}
+
+	// migrationReporter backends report an upgrade of an older file on load
+	migrationReporter interface {
+		Migration() (MigrationInfo, bool)
+	}
+
+	// readOnlyStorage backends can be opened for reading only (see WithReadOnly)
+	readOnlyStorage interface {
+		ReadOnly() bool
+	}
+
+	// groupCommitter backends share syncs between concurrent writers
+	groupCommitter interface {
+		SyncCounts() (writes, syncs uint64)
+	}
+
+	// latencyTracker backends time their writes (see WithWriteLatencyTracking)
+	latencyTracker interface {
+		EnableLatencyTracking()
+		WriteLatency() (LatencySnapshot, bool)
+	}
+)
+
+// storageEngines maps path schemes to the factories that open them
+var (
+	storageEnginesMu sync.RWMutex
+	storageEngines   = map[string]StorageFactory{
+		"file": func(location string, options Options) (StorageEngine, error) {
+			if options.ReadOnly {
+				return NewReadOnlyStorage(location)
+			}
+			return NewStorage(location)
+		},
+	}
+)
+
+// RegisterStorageEngine makes a backend available to OpenDatabase under a
+// scheme: paths of the form "scheme://location" are opened with its factory
+// It panics if the scheme is already registered or factory is nil
+func RegisterStorageEngine(scheme string, factory StorageFactory) {
+	storageEnginesMu.Lock()
+	defer storageEnginesMu.Unlock()
+
+	if factory == nil {
+		panic("tetodb: RegisterStorageEngine factory is nil")
+	}
+	if _, exists := storageEngines[scheme]; exists {
+		panic("tetodb: RegisterStorageEngine called twice for scheme " + scheme)
+	}
+	storageEngines[scheme] = factory
+}
+
+// StorageEngines returns the registered schemes, sorted
+func StorageEngines() []string {
+	storageEnginesMu.RLock()
+	defer storageEnginesMu.RUnlock()
+
+	schemes := make([]string, 0, len(storageEngines))
+	for scheme := range storageEngines {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// openStorageEngine opens the backend a database path names
+// Paths without a "scheme://" prefix are files, except MemoryPath
+func openStorageEngine(path string, options Options) (StorageEngine, error) {
+	if options.Ephemeral || path == MemoryPath {
+		return NewMemoryStorage(), nil
+	}
+
+	scheme, location := "file", path
+	if i := strings.Index(path, "://"); i > 0 {
+		scheme, location = path[:i], path[i+3:]
+	}
+
+	storageEnginesMu.RLock()
+	factory, exists := storageEngines[scheme]
+	storageEnginesMu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("unknown storage engine %q (available: %s)", scheme, strings.Join(StorageEngines(), ", "))
+	}
+	return factory(location, options)
+}
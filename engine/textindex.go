@@ -0,0 +1,147 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// stopWords are common English words left out of text indexes
+// They carry little meaning and would make the posting lists the largest
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "but": true, "by": true, "for": true, "from": true, "has": true,
+	"have": true, "in": true, "is": true, "it": true, "its": true, "of": true,
+	"on": true, "or": true, "that": true, "the": true, "this": true, "to": true,
+	"was": true, "were": true, "will": true, "with": true,
+}
+
+// textIndex is an inverted index from words to the documents containing them
+// Text is tokenized as for Search, and stop words are skipped
+type textIndex struct {
+	fields   []string                  // Indexed fields; empty means every string field
+	seq      uint64                    // Sequence of the record defining the index
+	hits     atomic.Uint64             // Searches the index answered
+	postings map[string]map[string]int // Word -> document ID -> occurrences
+	terms    map[string][]string       // Document ID -> its distinct words, for removal
+}
+
+// newTextIndex creates an empty text index over fields
+func newTextIndex(fields []string) *textIndex {
+	return &textIndex{
+		fields:   fields,
+		postings: make(map[string]map[string]int),
+		terms:    make(map[string][]string),
+	}
+}
+
+// add indexes the words of a document
+func (t *textIndex) add(id string, doc map[string]interface{}) {
+	freq := make(map[string]int)
+	count := func(text string) {
+		for _, token := range tokenize(text) {
+			if !stopWords[token] {
+				freq[token]++
+			}
+		}
+	}
+	if len(t.fields) == 0 {
+		forEachString(doc, count)
+	} else {
+		for _, field := range t.fields {
+			if value, exists := lookupPath(doc, field); exists {
+				forEachString(value, count)
+			}
+		}
+	}
+	if len(freq) == 0 {
+		return
+	}
+
+	words := make([]string, 0, len(freq))
+	for word, n := range freq {
+		if t.postings[word] == nil {
+			t.postings[word] = make(map[string]int)
+		}
+		t.postings[word][id] = n
+		words = append(words, word)
+	}
+	t.terms[id] = words
+}
+
+// remove drops a document from the index
+func (t *textIndex) remove(id string) {
+	for _, word := range t.terms[id] {
+		delete(t.postings[word], id)
+		if len(t.postings[word]) == 0 {
+			delete(t.postings, word)
+		}
+	}
+	delete(t.terms, id)
+}
+
+// covers reports whether the index answers a search over the given fields
+func (t *textIndex) covers(fields []string) bool {
+	if len(fields) != len(t.fields) {
+		return false
+	}
+	want := append([]string(nil), fields...)
+	sort.Strings(want)
+	for i, field := range want {
+		if field != t.fields[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// frequencies returns, for each document containing any of the terms, how
+// often each term occurs in it
+func (t *textIndex) frequencies(terms []string) map[string]map[string]int {
+	byDoc := make(map[string]map[string]int)
+	for _, term := range terms {
+		for id, n := range t.postings[term] {
+			if byDoc[id] == nil {
+				byDoc[id] = make(map[string]int, len(terms))
+			}
+			byDoc[id][term] = n
+		}
+	}
+	return byDoc
+}
+
+// CreateTextIndex builds an inverted index that Search uses instead of
+// reading every document, for searches over exactly these fields (none
+// means every string field, as with SearchOptions.Fields)
+// Stop words such as "the" and "and" are not indexed, so they are ignored
+// in searches the index answers. A collection has at most one text index;
+// like CreateIndex, it is maintained on writes and rebuilt on reopen
+func (c *Collection) CreateTextIndex(fields ...string) error {
+	for _, field := range fields {
+		if field == "" {
+			return fmt.Errorf("field names must not be empty")
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.textIndex != nil {
+		return fmt.Errorf("collection %s already has a text index", c.name)
+	}
+
+	sorted := append([]string(nil), fields...)
+	sort.Strings(sorted)
+	def := IndexDefinition{Kind: IndexKindText, Fields: sorted}
+	seq, err := c.persistIndex(def)
+	if err != nil {
+		return err
+	}
+	c.restoreIndex(def, seq)
+	return nil
+}
+
+// definition describes the collection's text index
+func (t *textIndex) definition() IndexDefinition {
+	return IndexDefinition{Kind: IndexKindText, Fields: t.fields}
+}
@@ -0,0 +1,459 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// ErrTxDone is returned when a transaction is used after Commit or Rollback
+var ErrTxDone = errors.New("transaction has already been committed or rolled back")
+
+// Tx is a set of writes across collections made all together or not at all
+// (see Database.Begin). Writes are buffered until Commit, so nothing reads
+// them before then but the transaction's own reads, which see what the
+// database's IsolationLevel lets them; a Tx is not safe for concurrent use
+type Tx struct {
+	db         *Database
+	writes     []txWrite
+	savepoints []savepoint // In the order they were set
+	isolation  IsolationLevel
+	snapshot   *Snapshot // What the reads see under IsolationSnapshot, taken by the first read or write
+	done       bool      // Committed or rolled back
+}
+
+// savepoint is a named point of a transaction, the number of writes buffered
+// when it was set
+type savepoint struct {
+	name   string
+	writes int
+}
+
+// txWrite is a write buffered in a transaction
+type txWrite struct {
+	collection string
+	id         string
+	doc        map[string]interface{} // Document to insert
+	plan       *updatePlan            // Update to apply
+	delete     bool
+}
+
+// Begin starts a transaction, at the database's isolation level (see
+// WithIsolation)
+func (db *Database) Begin() *Tx {
+	return &Tx{db: db, isolation: db.options.Isolation}
+}
+
+// Isolation returns the isolation level of the transaction
+func (tx *Tx) Isolation() IsolationLevel {
+	return tx.isolation
+}
+
+// begin takes the snapshot of a transaction under IsolationSnapshot, on its
+// first read or write
+func (tx *Tx) begin() error {
+	if tx.isolation != IsolationSnapshot || tx.snapshot != nil {
+		return nil
+	}
+	s, err := tx.db.Snapshot()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	tx.snapshot = s
+	return nil
+}
+
+// Insert buffers the insertion of a document into a collection
+// If the document doesn't have an "id" field one is generated, as Insert does
+// Returns the document ID
+func (tx *Tx) Insert(collName string, doc map[string]interface{}) (string, error) {
+	if tx.done {
+		return "", ErrTxDone
+	}
+	if err := tx.begin(); err != nil {
+		return "", err
+	}
+
+	var id string
+	if idVal, exists := doc["id"]; exists {
+		id = fmt.Sprintf("%v", idVal)
+	} else {
+		id = uuid.New().String()
+		doc["id"] = id
+	}
+	tx.writes = append(tx.writes, txWrite{collection: collName, id: id, doc: doc})
+	return id, nil
+}
+
+// Update buffers an update of a document, a plain or operator update as for
+// Collection.Update; it applies to the document as the transaction's earlier
+// writes leave it
+func (tx *Tx) Update(collName, id string, update map[string]interface{}) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if err := tx.begin(); err != nil {
+		return err
+	}
+
+	plan, err := parseUpdate(update)
+	if err != nil {
+		return fmt.Errorf("invalid update: %w", err)
+	}
+	tx.writes = append(tx.writes, txWrite{collection: collName, id: id, plan: plan})
+	return nil
+}
+
+// Delete buffers the deletion of a document
+func (tx *Tx) Delete(collName, id string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if err := tx.begin(); err != nil {
+		return err
+	}
+
+	tx.writes = append(tx.writes, txWrite{collection: collName, id: id, delete: true})
+	return nil
+}
+
+// FindByID retrieves a document as the transaction sees it, its own writes
+// included; nil if it doesn't exist
+func (tx *Tx) FindByID(collName, id string) (map[string]interface{}, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+
+	view, err := tx.view(collName)
+	if err != nil {
+		return nil, err
+	}
+	if doc, written := tx.overlay(view)[id]; written {
+		return view.detachDocument(doc), nil
+	}
+	return view.FindByID(id), nil
+}
+
+// Find searches a collection as the transaction sees it, its own writes
+// included, as Collection.Find does
+func (tx *Tx) Find(collName string, filter map[string]interface{}, opts ...FindOptions) ([]map[string]interface{}, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+
+	var options FindOptions
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+	view, err := tx.view(collName)
+	if err != nil {
+		return nil, err
+	}
+	written := tx.overlay(view)
+	if len(written) == 0 {
+		return view.FindContext(context.Background(), filter, options)
+	}
+
+	// The stored matches the transaction hasn't written, then the written
+	// documents that match, sorted and paged together
+	docs, err := view.find(context.Background(), filter, FindOptions{Collation: options.Collation, Hint: options.Hint}, nil)
+	if err != nil {
+		return nil, err
+	}
+	match := view.match
+	if options.Collation != nil {
+		match.Collation = options.Collation
+	}
+	options.Collation = match.Collation
+
+	results := make([]map[string]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		if _, changed := written[fmt.Sprintf("%v", doc["id"])]; !changed {
+			results = append(results, doc)
+		}
+	}
+	for _, doc := range written {
+		if doc != nil && (len(filter) == 0 || match.Matches(doc, filter)) {
+			results = append(results, doc)
+		}
+	}
+	return view.detach(options.apply(results)), nil
+}
+
+// view returns a collection as the transaction's reads see it: frozen in
+// its snapshot under IsolationSnapshot, otherwise as it is now
+func (tx *Tx) view(collName string) (*Collection, error) {
+	if err := tx.begin(); err != nil {
+		return nil, err
+	}
+	if tx.snapshot != nil {
+		return tx.snapshot.Collection(collName).coll, nil
+	}
+	return tx.db.LoadCollection(collName)
+}
+
+// overlay plays the transaction's writes to a collection over view, and
+// returns the documents they leave (nil for deleted ones) by ID. A write
+// that can't be made is left out; Commit reports it
+func (tx *Tx) overlay(view *Collection) map[string]map[string]interface{} {
+	view.mu.RLock()
+	defer view.mu.RUnlock()
+
+	set := newWriteSet()
+	for _, w := range tx.writes {
+		if w.collection == view.name {
+			set.stage(view, w)
+		}
+	}
+	return set.staged[view]
+}
+
+// Savepoint marks the writes buffered so far, so RollbackTo can later undo
+// just the ones after it, e.g. a sub-batch of an import that turned out to be
+// bad, and keep the transaction going. Setting a savepoint under a name
+// already used moves it
+func (tx *Tx) Savepoint(name string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	if i := tx.savepoint(name); i >= 0 {
+		tx.savepoints = append(tx.savepoints[:i], tx.savepoints[i+1:]...)
+	}
+	tx.savepoints = append(tx.savepoints, savepoint{name: name, writes: len(tx.writes)})
+	return nil
+}
+
+// RollbackTo discards the writes buffered since the named savepoint, and the
+// savepoints set after it. The savepoint itself stays, so it can be rolled
+// back to again
+func (tx *Tx) RollbackTo(name string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	i := tx.savepoint(name)
+	if i < 0 {
+		return fmt.Errorf("savepoint %s not found", name)
+	}
+	tx.writes = tx.writes[:tx.savepoints[i].writes]
+	tx.savepoints = tx.savepoints[:i+1]
+	return nil
+}
+
+// savepoint returns the position of a savepoint; -1 if there is none by that name
+func (tx *Tx) savepoint(name string) int {
+	for i, sp := range tx.savepoints {
+		if sp.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Rollback discards the buffered writes
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	tx.done = true
+	tx.writes, tx.savepoints, tx.snapshot = nil, nil, nil
+	return nil
+}
+
+// Commit makes the buffered writes, in order. Every write is checked first,
+// with all the collections involved locked; if any of them fails (a missing
+// document, an ID already taken, an update that can't apply, a limit) nothing
+// is written. Under IsolationSnapshot it also fails, with a
+// *WriteConflictError, if any document it writes was changed by someone
+// else since its snapshot was taken. Otherwise the records are persisted as
+// a single batch, in one write and sync, before any of them is applied in
+// memory
+// The transaction is finished either way
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	tx.done = true
+	writes := tx.writes
+	tx.writes, tx.savepoints = nil, nil
+	if len(writes) == 0 {
+		return nil
+	}
+	return tx.db.commit(writes, tx.snapshot)
+}
+
+// commit checks and makes the writes of a transaction; with a snapshot, the
+// documents written must not have changed since it was taken
+func (db *Database) commit(writes []txWrite, snapshot *Snapshot) error {
+	changes := db.changeSet()
+	defer changes.deliver()
+
+	var names []string
+	for _, w := range writes {
+		if _, err := db.LoadCollection(w.collection); err != nil {
+			return err
+		}
+		names = append(names, w.collection)
+	}
+	sort.Strings(names)
+
+	// Held so the collections can't be dropped while the batch is written
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	// Locked in name order, as RestoreTo does, so commits can't deadlock
+	colls := make(map[string]*Collection)
+	var locked []*Collection
+	for _, name := range names {
+		if colls[name] != nil {
+			continue
+		}
+		coll, exists := db.collections[name]
+		if !exists {
+			return fmt.Errorf("collection %s was dropped", name)
+		}
+		defer coll.lockAll()()
+		colls[name] = coll
+		locked = append(locked, coll)
+	}
+
+	if snapshot != nil {
+		if err := checkConflicts(snapshot, colls, writes); err != nil {
+			return err
+		}
+	}
+	set := newWriteSet()
+	for i, w := range writes {
+		if err := set.stage(colls[w.collection], w); err != nil {
+			return fmt.Errorf("write %d: %w", i, err)
+		}
+	}
+	if err := set.checkLimits(); err != nil {
+		return err
+	}
+	records := set.records
+
+	if err := db.storage.AppendBatch(records); err != nil {
+		return fmt.Errorf("failed to persist transaction: %w", err)
+	}
+
+	// Applied with every collection locked at once, so no read sees part of it
+	for _, coll := range locked {
+		coll.mu.Lock()
+	}
+	for _, record := range records {
+		changes.add(colls[record.Collection], record)
+		colls[record.Collection].applyRecord(record)
+	}
+	for _, coll := range locked {
+		coll.mu.Unlock()
+	}
+	return nil
+}
+
+// writeSet plays writes over the current documents without changing them,
+// so each write sees the ones staged before it, and collects their records
+type writeSet struct {
+	staged  map[*Collection]map[string]map[string]interface{} // Documents as the staged writes leave them; nil if deleted
+	records []StorageRecord
+	now     int64
+}
+
+func newWriteSet() *writeSet {
+	return &writeSet{staged: make(map[*Collection]map[string]map[string]interface{}), now: recordTime()}
+}
+
+// current returns a document as the staged writes leave it
+func (s *writeSet) current(coll *Collection, id string) (map[string]interface{}, bool) {
+	if doc, exists := s.staged[coll][id]; exists {
+		return doc, doc != nil
+	}
+	doc, exists := coll.documents.get(id)
+	return doc, exists
+}
+
+// stage checks a write against the documents and adds its record; a write
+// that fails adds nothing
+// Caller must lock the collection (see lockAll)
+func (s *writeSet) stage(coll *Collection, w txWrite) error {
+	doc, exists := s.current(coll, w.id)
+	record := StorageRecord{Collection: coll.name, ID: w.id, Time: s.now}
+	switch {
+	case w.plan != nil:
+		if !exists {
+			return fmt.Errorf("document with id %s not found", w.id)
+		}
+		updated, err := w.plan.apply(coll.match, doc)
+		if err != nil {
+			return fmt.Errorf("failed to update document %s: %w", w.id, err)
+		}
+		updated["id"] = w.id
+		stampVersion(updated, doc)
+		record.Doc, record.Op = updated, OpUpdate
+	case w.delete:
+		if !exists {
+			return fmt.Errorf("document with id %s not found", w.id)
+		}
+		record.Op = OpDelete
+	default:
+		if exists {
+			return fmt.Errorf("document with id %s already exists", w.id)
+		}
+		stampVersion(w.doc, nil)
+		record.Doc, record.Op = copyDocument(w.doc), OpInsert
+	}
+
+	if s.staged[coll] == nil {
+		s.staged[coll] = make(map[string]map[string]interface{})
+	}
+	s.staged[coll][w.id] = record.Doc
+	s.records = append(s.records, record)
+	return nil
+}
+
+// checkLimits makes sure the staged writes keep each collection within its limits
+func (s *writeSet) checkLimits() error {
+	for coll, docs := range s.staged {
+		added := 0
+		for id, doc := range docs {
+			_, existed := coll.documents.get(id)
+			if doc != nil && !existed {
+				added++
+			} else if doc == nil && existed {
+				added--
+			}
+		}
+		var records []StorageRecord
+		for _, record := range s.records {
+			if record.Collection == coll.name {
+				records = append(records, record)
+			}
+		}
+		if err := coll.checkLimits(records, added); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyRecord applies a document record that has been persisted to memory
+// Caller must hold the write lock
+func (c *Collection) applyRecord(record StorageRecord) {
+	c.updateIndexes(record.ID, c.documents.doc(record.ID), record.Doc)
+	if record.Doc == nil {
+		c.documents.remove(record.ID)
+		delete(c.seqs, record.ID)
+		delete(c.times, record.ID)
+		delete(c.attachments, record.ID)
+		return
+	}
+	c.documents.set(record.ID, record.Doc)
+	c.seqs[record.ID] = record.Seq
+	c.times[record.ID] = record.Time
+}
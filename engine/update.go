@@ -0,0 +1,414 @@
+package engine
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// updateOperatorOrder is the order in which update operators are applied
+var updateOperatorOrder = []string{"$rename", "$set", "$unset", "$inc", "$push", "$pull"}
+
+// updatePlan is a parsed, validated update document
+// An update is either a plain document merged into the stored one, or a set
+// of MongoDB-style operators:
+//
+//	{"status": "active"}                       // Merge top-level fields
+//	{"$set": {"address.city": "Berlin"}}       // Set fields, creating parent objects
+//	{"$unset": {"legacy": ""}}                 // Remove fields
+//	{"$inc": {"stats.visits": 1}}              // Add to numbers (missing fields start at 0)
+//	{"$push": {"tags": "go"}}                  // Append to arrays; {"$each": [...]} appends several
+//	{"$pull": {"tags": "old"}}                 // Remove array elements equal to, or matching, a condition
+//	{"$rename": {"nick": "nickname"}}          // Move a field to a new path
+//
+// Paths use dot notation, with numeric segments indexing arrays. The id field
+// can't be modified
+type updatePlan struct {
+	merge   map[string]interface{} // Plain fields to merge (non-operator updates)
+	replace map[string]interface{} // Document replacing the stored one entirely (see parseReplacement)
+	ops     []updateOp             // Operators, in application order
+}
+
+// updateOp is a single operator applied to a single path
+type updateOp struct {
+	op      string      // Operator, e.g. "$set"
+	path    string      // Dot-notation field path
+	operand interface{} // Operator argument for this path
+}
+
+// parseUpdate validates an update document
+// Operator and plain fields can't be mixed in the same update
+func parseUpdate(update map[string]interface{}) (*updatePlan, error) {
+	if _, isOps := operatorExpression(update); !isOps {
+		for key := range update {
+			if strings.HasPrefix(key, "$") {
+				return nil, fmt.Errorf("update cannot mix operators and plain fields")
+			}
+		}
+		return &updatePlan{merge: copyDocument(update)}, nil
+	}
+
+	for key := range update {
+		if !containsString(updateOperatorOrder, key) {
+			return nil, fmt.Errorf("unknown update operator %s", key)
+		}
+	}
+
+	plan := &updatePlan{}
+	for _, op := range updateOperatorOrder {
+		raw, present := update[op]
+		if !present {
+			continue
+		}
+
+		fields, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s expects an object of fields", op)
+		}
+
+		// Sort paths so updates apply deterministically
+		paths := make([]string, 0, len(fields))
+		for path := range fields {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+
+		for _, path := range paths {
+			operand := fields[path]
+			if err := validateUpdateOp(op, path, operand); err != nil {
+				return nil, err
+			}
+			// Copied, as the operand ends up in stored documents
+			plan.ops = append(plan.ops, updateOp{op: op, path: path, operand: copyValue(operand)})
+		}
+	}
+
+	return plan, nil
+}
+
+// parseReplacement validates a replacement document for Replace and ReplaceOne
+// A replacement holds plain fields only, and may repeat the id but not change it
+func parseReplacement(id string, doc map[string]interface{}) (*updatePlan, error) {
+	for key := range doc {
+		if strings.HasPrefix(key, "$") {
+			return nil, fmt.Errorf("replacement document cannot contain operator %s", key)
+		}
+	}
+	if docID, hasID := doc["id"]; hasID && docID != id {
+		return nil, fmt.Errorf("replacement document cannot change the id")
+	}
+	return &updatePlan{replace: doc}, nil
+}
+
+// validateUpdateOp checks a single operator argument before anything is applied
+func validateUpdateOp(op, path string, operand interface{}) error {
+	if path == "" {
+		return fmt.Errorf("%s: empty field path", op)
+	}
+	if path == "id" || strings.HasPrefix(path, "id.") {
+		return fmt.Errorf("%s: the id field can't be modified", op)
+	}
+
+	switch op {
+	case "$inc":
+		if _, ok := toFloat64(operand); !ok {
+			return fmt.Errorf("$inc: value for %s must be a number", path)
+		}
+	case "$rename":
+		target, ok := operand.(string)
+		if !ok || target == "" {
+			return fmt.Errorf("$rename: new name for %s must be a non-empty string", path)
+		}
+		if target == "id" || strings.HasPrefix(target, "id.") {
+			return fmt.Errorf("$rename: the id field can't be modified")
+		}
+		if target == path {
+			return fmt.Errorf("$rename: %s can't be renamed to itself", path)
+		}
+	case "$push":
+		if each, hasEach := pushEach(operand); hasEach && each == nil {
+			return fmt.Errorf("$push: $each for %s must be an array", path)
+		}
+	}
+	return nil
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, elem := range list {
+		if elem == s {
+			return true
+		}
+	}
+	return false
+}
+
+// apply returns a new version of doc with the update applied; doc itself is
+// not modified. Only the objects and arrays the update changes are copied,
+// the new version sharing the rest with doc, which is safe as stored
+// documents are never changed in place
+// If any operator fails, the error is returned and nothing should be persisted
+func (p *updatePlan) apply(m MatchOptions, doc map[string]interface{}) (map[string]interface{}, error) {
+	if p.replace != nil {
+		return copyDocument(p.replace), nil
+	}
+
+	updated := maps.Clone(doc)
+	if updated == nil {
+		updated = make(map[string]interface{})
+	}
+
+	if p.merge != nil {
+		for key, value := range p.merge {
+			updated[key] = value
+		}
+		return updated, nil
+	}
+
+	for _, u := range p.ops {
+		if err := u.apply(m, updated); err != nil {
+			return nil, err
+		}
+	}
+	return updated, nil
+}
+
+// apply runs a single operator against a document
+func (u updateOp) apply(m MatchOptions, doc map[string]interface{}) error {
+	switch u.op {
+	case "$set":
+		return modifyPath(doc, u.path, true, func(interface{}, bool) (interface{}, bool, error) {
+			return u.operand, true, nil
+		})
+
+	case "$unset":
+		return modifyPath(doc, u.path, false, func(interface{}, bool) (interface{}, bool, error) {
+			return nil, false, nil
+		})
+
+	case "$inc":
+		return modifyPath(doc, u.path, true, func(old interface{}, exists bool) (interface{}, bool, error) {
+			if !exists || old == nil {
+				return u.operand, true, nil
+			}
+			return addNumbers(old, u.operand, u.path)
+		})
+
+	case "$push":
+		return modifyPath(doc, u.path, true, func(old interface{}, exists bool) (interface{}, bool, error) {
+			values, hasEach := pushEach(u.operand)
+			if !hasEach {
+				values = []interface{}{u.operand}
+			}
+			if !exists || old == nil {
+				return append([]interface{}{}, values...), true, nil
+			}
+			list, isArray := old.([]interface{})
+			if !isArray {
+				return nil, true, fmt.Errorf("$push: %s is not an array", u.path)
+			}
+			return append(slices.Clip(list), values...), true, nil // Clipped so the shared array isn't written to
+		})
+
+	case "$pull":
+		return modifyPath(doc, u.path, false, func(old interface{}, exists bool) (interface{}, bool, error) {
+			if !exists {
+				return nil, false, nil
+			}
+			list, isArray := old.([]interface{})
+			if !isArray {
+				return nil, true, fmt.Errorf("$pull: %s is not an array", u.path)
+			}
+			kept := make([]interface{}, 0, len(list))
+			for _, elem := range list {
+				if !m.pullMatches(elem, u.operand) {
+					kept = append(kept, elem)
+				}
+			}
+			return kept, true, nil
+		})
+
+	case "$rename":
+		var moved interface{}
+		var found bool
+		err := modifyPath(doc, u.path, false, func(old interface{}, exists bool) (interface{}, bool, error) {
+			moved, found = old, exists
+			return nil, false, nil
+		})
+		if err != nil || !found {
+			return err
+		}
+		return modifyPath(doc, u.operand.(string), true, func(interface{}, bool) (interface{}, bool, error) {
+			return moved, true, nil
+		})
+	}
+	return fmt.Errorf("unknown update operator %s", u.op)
+}
+
+// pushEach extracts the values of a {"$each": [...]} $push operand
+// hasEach is true if the operand uses $each; values is nil if $each isn't an array
+func pushEach(operand interface{}) (values []interface{}, hasEach bool) {
+	spec, ok := operand.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	raw, ok := spec["$each"]
+	if !ok || len(spec) != 1 {
+		return nil, false
+	}
+	values, _ = raw.([]interface{})
+	return values, true
+}
+
+// pullMatches reports whether an array element should be removed by $pull
+// The condition is an operator expression, a filter for object elements,
+// or a plain value compared for equality
+func (m MatchOptions) pullMatches(elem interface{}, condition interface{}) bool {
+	if ops, isOps := operatorExpression(condition); isOps {
+		return m.matchOperators(elem, true, ops)
+	}
+	if filter, isFilter := condition.(map[string]interface{}); isFilter {
+		if elemDoc, isDoc := elem.(map[string]interface{}); isDoc {
+			return m.Matches(elemDoc, filter)
+		}
+	}
+	return m.valuesMatch(elem, condition)
+}
+
+// addNumbers implements $inc on an existing value
+// Two ints stay an int; any other combination of numbers becomes a float64
+func addNumbers(old, delta interface{}, path string) (interface{}, bool, error) {
+	if a, ok := old.(int); ok {
+		if b, ok := delta.(int); ok {
+			return a + b, true, nil
+		}
+	}
+
+	a, ok := toFloat64(old)
+	if !ok {
+		return nil, true, fmt.Errorf("$inc: %s is not a number", path)
+	}
+	b, _ := toFloat64(delta)
+	return a + b, true, nil
+}
+
+// pathModifier computes the new value for a path from its current value
+// Returning keep=false removes the field (or nulls an array element)
+type pathModifier func(old interface{}, exists bool) (value interface{}, keep bool, err error)
+
+// modifyPath resolves a dot-notation path and replaces its value using fn
+// A top-level key that literally contains the dots takes precedence, as in lookupPath
+// With create set, missing parent objects are created along the way;
+// otherwise a missing parent leaves the document untouched
+// doc must be the caller's own copy; the objects and arrays on the path are
+// copied before they are changed, so it may share the others with the
+// version it was copied from
+func modifyPath(doc map[string]interface{}, path string, create bool, fn pathModifier) error {
+	segments := strings.Split(path, ".")
+	if _, literal := doc[path]; literal {
+		segments = []string{path}
+	}
+
+	var container interface{} = doc
+	for i, segment := range segments[:len(segments)-1] {
+		next, exists := pathChild(container, segment)
+		if !exists || next == nil {
+			if !create {
+				return nil
+			}
+			parent, isMap := container.(map[string]interface{})
+			if !isMap {
+				return fmt.Errorf("cannot create %s: %s is not an object", path, strings.Join(segments[:i+1], "."))
+			}
+			next = make(map[string]interface{})
+			parent[segment] = next
+			container = next
+			continue
+		}
+
+		switch child := next.(type) {
+		case map[string]interface{}:
+			next = maps.Clone(child)
+		case []interface{}:
+			next = slices.Clone(child)
+		default:
+			if !create {
+				return nil
+			}
+			return fmt.Errorf("cannot traverse %s: %s is not an object", path, strings.Join(segments[:i+1], "."))
+		}
+		setChild(container, segment, next)
+		container = next
+	}
+
+	last := segments[len(segments)-1]
+	switch c := container.(type) {
+	case map[string]interface{}:
+		old, exists := c[last]
+		value, keep, err := fn(old, exists)
+		if err != nil {
+			return err
+		}
+		if keep {
+			c[last] = value
+		} else {
+			delete(c, last)
+		}
+
+	case []interface{}:
+		index, err := strconv.Atoi(last)
+		if err != nil {
+			return fmt.Errorf("cannot use %s: %q is not an array index", path, last)
+		}
+		inRange := index >= 0 && index < len(c)
+		var old interface{}
+		if inRange {
+			old = c[index]
+		}
+		value, keep, err := fn(old, inRange)
+		if err != nil {
+			return err
+		}
+		if !inRange {
+			if keep {
+				return fmt.Errorf("cannot set %s: index out of range", path)
+			}
+			return nil
+		}
+		if !keep {
+			value = nil // Removing an element would shift the others; null it instead
+		}
+		c[index] = value
+	}
+	return nil
+}
+
+// setChild replaces the child of an object or array that pathChild found
+func setChild(container interface{}, segment string, value interface{}) {
+	switch c := container.(type) {
+	case map[string]interface{}:
+		c[segment] = value
+	case []interface{}:
+		index, _ := strconv.Atoi(segment)
+		c[index] = value
+	}
+}
+
+// pathChild returns the child of an object or array for a path segment
+func pathChild(container interface{}, segment string) (interface{}, bool) {
+	switch c := container.(type) {
+	case map[string]interface{}:
+		value, exists := c[segment]
+		return value, exists
+	case []interface{}:
+		index, err := strconv.Atoi(segment)
+		if err != nil || index < 0 || index >= len(c) {
+			return nil, false
+		}
+		return c[index], true
+	}
+	return nil, false
+}
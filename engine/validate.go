@@ -0,0 +1,186 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// RecordError describes a record that could not be read from a storage file
+type RecordError struct {
+	Line    int    `json:"line"`    // 1-based line number in the file (record number in FormatBinary files)
+	Message string `json:"message"` // What went wrong
+}
+
+// FileReport is the result of validating a storage file with ValidateFile
+type FileReport struct {
+	Path             string         `json:"path"`               // File that was validated
+	FormatVersion    int            `json:"format_version"`     // Detected storage format (FormatJSONLines or FormatBinary)
+	StorageVersion   int            `json:"storage_version"`    // Version from the header record (see StorageVersion), 1 without one; 0 if encrypted
+	Encrypted        bool           `json:"encrypted"`          // The file is encrypted, so only checksums were verified
+	Lines            int            `json:"lines"`              // Total number of lines, including empty ones (records in FormatBinary files)
+	Records          int            `json:"records"`            // Number of well-formed records
+	Deletes          int            `json:"deletes"`            // Well-formed records that are deletions
+	Indexes          int            `json:"indexes"`            // Well-formed records that define indexes
+	Attachments      int            `json:"attachments"`        // Well-formed records holding attachment chunks or removals
+	LastSequence     uint64         `json:"last_sequence"`      // Highest sequence number in the file
+	ParseErrors      []RecordError  `json:"parse_errors"`       // Records that could not be decoded
+	ChecksumFailures []RecordError  `json:"checksum_failures"`  // Records whose checksum didn't match (formats with checksums only)
+	Collections      map[string]int `json:"collections"`        // Live documents per collection after replaying the snapshot, if any, and the log
+	Documents        int            `json:"documents"`          // Total live documents
+	Snapshot         *FileReport    `json:"snapshot,omitempty"` // The checkpoint snapshot beside the file (see WithCheckpoints), if there is one
+}
+
+// Valid reports whether the file, and its snapshot if it has one, had no
+// unreadable or corrupt records
+func (r *FileReport) Valid() bool {
+	if r.Snapshot != nil && !r.Snapshot.Valid() {
+		return false
+	}
+	return len(r.ParseErrors) == 0 && len(r.ChecksumFailures) == 0
+}
+
+// ValidateFile scans a storage file and reports on its contents
+// It doesn't open a Database or keep documents in memory, only the IDs
+// needed to tally live documents, so it can be run offline against any file
+// A checkpointed database keeps its live state in <path>.snapshot and only
+// the writes since in the file itself; the snapshot is validated too, and
+// reported in Snapshot, and the documents are tallied across both
+// Records of an encrypted file can't be decoded without the passphrase, so
+// for those only the framing and checksums are checked; Records counts the
+// intact ones and no documents are tallied
+// An error is returned only if the file itself can't be read
+func ValidateFile(path string) (FileReport, error) {
+	// Track live IDs per collection so updates and deletes are tallied correctly
+	live := make(map[string]map[string]bool)
+
+	// Log records up to the snapshot's last sequence are already in it: a
+	// crash during a checkpoint can leave them behind (see Storage.Checkpoint)
+	var snapshot *FileReport
+	var floor uint64
+	if _, err := os.Stat(snapshotPath(path)); err == nil {
+		report, err := validateRecords(snapshotPath(path), live, 0)
+		if err != nil {
+			return FileReport{Path: path, Collections: make(map[string]int)}, fmt.Errorf("failed to validate snapshot: %w", err)
+		}
+		tallyDocuments(&report, live)
+		snapshot, floor = &report, report.LastSequence
+	}
+
+	report, err := validateRecords(path, live, floor)
+	if err != nil {
+		return report, err
+	}
+	report.Snapshot = snapshot
+	tallyDocuments(&report, live)
+	return report, nil
+}
+
+// validateRecords scans the records of a storage file into a report,
+// applying to live the documents written after floor
+func validateRecords(path string, live map[string]map[string]bool, floor uint64) (FileReport, error) {
+	report := FileReport{
+		Path:        path,
+		Collections: make(map[string]int),
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return report, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	reader, err := newRecordReader(file)
+	if err != nil {
+		return report, err
+	}
+	report.FormatVersion = reader.format
+	report.Encrypted = reader.encrypted
+	if !reader.encrypted {
+		report.StorageVersion = 1
+	}
+
+	for {
+		line, readErr := reader.next()
+		if readErr == io.EOF {
+			break
+		}
+
+		report.Lines++
+		lineNo := report.Lines
+
+		if readErr == errRecordChecksum {
+			report.ChecksumFailures = append(report.ChecksumFailures, RecordError{Line: lineNo, Message: readErr.Error()})
+			continue
+		}
+		if readErr == errRecordEncoding {
+			report.ParseErrors = append(report.ParseErrors, RecordError{Line: lineNo, Message: readErr.Error()})
+			continue
+		}
+		if readErr == io.ErrUnexpectedEOF {
+			report.ParseErrors = append(report.ParseErrors, RecordError{Line: lineNo, Message: "file ends partway through a record"})
+			break
+		}
+		if readErr == errRecordLength {
+			// Records after a bad length can't be found without resyncing (see Repair)
+			report.ParseErrors = append(report.ParseErrors, RecordError{Line: lineNo, Message: readErr.Error()})
+			break
+		}
+		if readErr != nil {
+			return report, readErr
+		}
+		if reader.encrypted {
+			report.Records++
+			continue
+		}
+
+		if len(line) > 0 {
+			if record, err := reader.decode(line, false); err != nil {
+				report.ParseErrors = append(report.ParseErrors, RecordError{Line: lineNo, Message: err.Error()})
+			} else if record.Header != nil {
+				report.StorageVersion = record.Header.Version
+			} else if record.Collection == "" || record.ID == "" {
+				report.ParseErrors = append(report.ParseErrors, RecordError{Line: lineNo, Message: "record is missing collection or id"})
+			} else {
+				report.Records++
+
+				// Legacy records without a sequence are numbered by position, as in LoadAll
+				if record.Seq == 0 {
+					record.Seq = max(report.LastSequence, floor) + 1
+				}
+				if record.Seq > report.LastSequence {
+					report.LastSequence = record.Seq
+				}
+
+				if live[record.Collection] == nil {
+					live[record.Collection] = make(map[string]bool)
+				}
+				if record.Index != nil {
+					report.Indexes++
+				} else if record.Attachment != nil {
+					report.Attachments++
+				} else if record.Doc == nil {
+					report.Deletes++
+					if record.Seq > floor {
+						delete(live[record.Collection], record.ID)
+					}
+				} else if record.Seq > floor {
+					live[record.Collection][record.ID] = true
+				}
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// tallyDocuments counts the live documents into a report, skipping
+// collections that ended up empty
+func tallyDocuments(report *FileReport, live map[string]map[string]bool) {
+	for collName, ids := range live {
+		if len(ids) > 0 {
+			report.Collections[collName] = len(ids)
+			report.Documents += len(ids)
+		}
+	}
+}
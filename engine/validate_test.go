@@ -0,0 +1,203 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateFile(t *testing.T) {
+	tests := []struct {
+		file             string
+		format           int
+		storageVersion   int
+		lines            int
+		records          int
+		deletes          int
+		indexes          int
+		lastSequence     uint64
+		parseErrors      []int // Lines that failed to parse
+		checksumFailures []int // Lines whose checksum didn't match
+		collections      map[string]int
+	}{
+		{
+			file: "valid.jsonl", format: FormatJSONLines, storageVersion: 2,
+			lines: 7, records: 6, deletes: 1, indexes: 1, lastSequence: 6,
+			collections: map[string]int{"users": 1, "orders": 1},
+		},
+		{
+			// A broken line, a record without an id, an empty line, a record
+			// without a sequence and a line that isn't JSON
+			file: "corrupt.jsonl", format: FormatJSONLines, storageVersion: 2,
+			lines: 12, records: 7, deletes: 1, indexes: 1, lastSequence: 6,
+			parseErrors: []int{3, 6, 10},
+			collections: map[string]int{"users": 2, "orders": 1},
+		},
+		{
+			// The last line was cut off partway through
+			file: "truncated.jsonl", format: FormatJSONLines, storageVersion: 2,
+			lines: 7, records: 5, deletes: 1, indexes: 1, lastSequence: 5,
+			parseErrors: []int{7},
+			collections: map[string]int{"users": 1},
+		},
+		{
+			// Written before header records and sequence numbers
+			file: "legacy.jsonl", format: FormatJSONLines, storageVersion: 1,
+			lines: 3, records: 3, deletes: 1, lastSequence: 3,
+			collections: map[string]int{"users": 1},
+		},
+		{
+			file: "valid.bin", format: FormatBinary, storageVersion: 2,
+			lines: 7, records: 6, deletes: 1, indexes: 1, lastSequence: 6,
+			collections: map[string]int{"users": 1, "orders": 1},
+		},
+		{
+			// A byte of bob's insert was flipped, so his deletion is the only
+			// record of him left
+			file: "checksum.bin", format: FormatBinary, storageVersion: 2,
+			lines: 7, records: 5, deletes: 1, indexes: 1, lastSequence: 6,
+			checksumFailures: []int{3},
+			collections:      map[string]int{"users": 1, "orders": 1},
+		},
+		{
+			file: "truncated.bin", format: FormatBinary, storageVersion: 2,
+			lines: 7, records: 5, deletes: 1, indexes: 1, lastSequence: 5,
+			parseErrors: []int{7},
+			collections: map[string]int{"users": 1},
+		},
+		{
+			// The length of alice's update runs past the end, so nothing after
+			// it can be found
+			file: "badlength.bin", format: FormatBinary, storageVersion: 2,
+			lines: 4, records: 2, lastSequence: 2,
+			parseErrors: []int{4},
+			collections: map[string]int{"users": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			path := filepath.Join("testdata", tt.file)
+			report, err := ValidateFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := FileReport{
+				Path:           path,
+				FormatVersion:  tt.format,
+				StorageVersion: tt.storageVersion,
+				Lines:          tt.lines,
+				Records:        tt.records,
+				Deletes:        tt.deletes,
+				Indexes:        tt.indexes,
+				LastSequence:   tt.lastSequence,
+				Collections:    tt.collections,
+			}
+			for _, c := range tt.collections {
+				want.Documents += c
+			}
+			got := report
+			got.ParseErrors, got.ChecksumFailures = nil, nil
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got  %+v\nwant %+v", got, want)
+			}
+			if got := errorLines(report.ParseErrors); !reflect.DeepEqual(got, tt.parseErrors) {
+				t.Errorf("got parse errors on lines %v, want %v (%v)", got, tt.parseErrors, report.ParseErrors)
+			}
+			if got := errorLines(report.ChecksumFailures); !reflect.DeepEqual(got, tt.checksumFailures) {
+				t.Errorf("got checksum failures on lines %v, want %v", got, tt.checksumFailures)
+			}
+			if valid := tt.parseErrors == nil && tt.checksumFailures == nil; report.Valid() != valid {
+				t.Errorf("got Valid() %v, want %v", report.Valid(), valid)
+			}
+		})
+	}
+}
+
+// errorLines returns the lines of the record errors, nil if there are none
+func errorLines(errs []RecordError) []int {
+	var lines []int
+	for _, e := range errs {
+		lines = append(lines, e.Line)
+	}
+	return lines
+}
+
+func TestValidateFileMissing(t *testing.T) {
+	_, err := ValidateFile(filepath.Join("testdata", "missing.jsonl"))
+	if err == nil || !strings.Contains(err.Error(), "failed to open file") {
+		t.Fatalf("got %v, want an open error", err)
+	}
+}
+
+func TestValidateFileWithSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := OpenDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll := db.GetCollection("docs")
+	for _, id := range []string{"a", "b", "c"} {
+		if _, err := coll.Insert(map[string]interface{}{"id": id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logBefore, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	// Since the checkpoint: one insert and one delete of a snapshot document
+	if _, err := coll.Insert(map[string]interface{}{"id": "d"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := coll.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := ValidateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Snapshot == nil {
+		t.Fatal("the snapshot wasn't reported")
+	}
+	if report.Snapshot.Path != snapshotPath(path) || report.Snapshot.Records != 3 || report.Snapshot.Documents != 3 {
+		t.Errorf("got snapshot %+v, want its 3 documents", *report.Snapshot)
+	}
+	if report.Records != 2 || report.Documents != 3 || report.Collections["docs"] != 3 || !report.Valid() {
+		t.Errorf("got %+v, want 2 records and 3 documents across both files", report)
+	}
+
+	// A crash partway through a checkpoint leaves the old log beside the new
+	// snapshot: its records are in the snapshot, so aren't counted twice
+	if err := os.WriteFile(path, logBefore, 0644); err != nil {
+		t.Fatal(err)
+	}
+	report, err = ValidateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Documents != 3 {
+		t.Errorf("got %d documents, want the snapshot's 3", report.Documents)
+	}
+
+	// A damaged snapshot makes the report invalid
+	if err := os.WriteFile(snapshotPath(path), []byte("not json\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	report, err = ValidateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Valid() || len(report.Snapshot.ParseErrors) != 1 {
+		t.Errorf("got a valid report for a damaged snapshot: %+v", *report.Snapshot)
+	}
+}
@@ -0,0 +1,81 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+)
+
+// VersionField holds a document's version: 1 when it is inserted, one more
+// on every update or replacement. The engine sets it on each write, so any
+// value written to it is overwritten; documents from files written before
+// versions were kept have none and count as version 0
+const VersionField = "_version"
+
+// ErrVersionConflict matches (with errors.Is) the VersionConflictError
+// returned when a document changed since the version an update expected
+var ErrVersionConflict = errors.New("document version conflict")
+
+// VersionConflictError reports a conditional update refused because the
+// document is no longer at the expected version (see UpdateIfVersion)
+type VersionConflictError struct {
+	Collection string // Collection of the document
+	ID         string // Document updated
+	Expected   int64  // Version the update was made against
+	Actual     int64  // Version the document is at now
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("document %s in collection %s is at version %d, not %d", e.ID, e.Collection, e.Actual, e.Expected)
+}
+
+// Is makes errors.Is(err, ErrVersionConflict) match
+func (e *VersionConflictError) Is(target error) bool {
+	return target == ErrVersionConflict
+}
+
+// documentVersion returns the version of a document; 0 if it has none
+func documentVersion(doc map[string]interface{}) int64 {
+	switch v := doc[VersionField].(type) {
+	case float64:
+		return int64(v)
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	}
+	return 0
+}
+
+// stampVersion sets the version of a document written over previous, which
+// is nil for an insert
+// The version is stored as a float64, as it reads back from JSON
+func stampVersion(doc, previous map[string]interface{}) {
+	doc[VersionField] = float64(documentVersion(previous) + 1)
+}
+
+// UpdateIfVersion updates a document as Update does, but only if it is still
+// at the given version (its VersionField), e.g. the version a client read
+// before editing it; otherwise it fails with a *VersionConflictError, so two
+// writers can't silently overwrite each other's changes
+func (c *Collection) UpdateIfVersion(id string, version int64, update map[string]interface{}) error {
+	plan, err := parseUpdate(update)
+	if err != nil {
+		return fmt.Errorf("invalid update: %w", err)
+	}
+
+	changes := c.db.changeSet()
+	defer changes.deliver()
+
+	unlock := c.lockDocument(id)
+	defer unlock()
+
+	existingDoc, exists := c.stored(id)
+	if !exists {
+		return fmt.Errorf("document with id %s not found", id)
+	}
+	if actual := documentVersion(existingDoc); actual != version {
+		return &VersionConflictError{Collection: c.name, ID: id, Expected: version, Actual: actual}
+	}
+
+	return c.applyUpdate(changes, id, existingDoc, plan)
+}
@@ -0,0 +1,202 @@
+package engine
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ChangeEvent is a write to a document, as Watch delivers it
+type ChangeEvent struct {
+	Collection string                 // Collection of the document
+	Op         string                 // OpInsert, OpUpdate or OpDelete
+	ID         string                 // Document written
+	Doc        map[string]interface{} // The document as written; nil for a deletion
+}
+
+// WatchOptions narrows down the writes a watch is told about
+type WatchOptions struct {
+	Collection string                 // Only writes to this collection ("" for all)
+	Filter     map[string]interface{} // Only writes to documents matching it before or after the write, so a watcher also hears of documents leaving the matching set
+}
+
+// watchers holds the watches of a database
+type watchers struct {
+	mu      sync.RWMutex
+	watches map[int]*watch
+	next    int
+	active  atomic.Int32 // Watches registered, so writes skip the bookkeeping when there are none
+
+	// Change sets are delivered in the order they were installed in, as
+	// each takes a ticket while it holds the locks of its documents
+	order   sync.Mutex
+	turn    *sync.Cond // Signalled as each change set has been delivered
+	tickets uint64     // Tickets taken
+	served  uint64     // Change sets delivered
+}
+
+// watch is a function registered with Watch
+type watch struct {
+	options WatchOptions
+	fn      func(ChangeEvent)
+}
+
+// Watch calls fn with every write made to the database's documents from now
+// on that opts selects, e.g. to refresh a view without polling Find, and
+// returns the function that stops it. The writes of a batch, transaction or
+// restore are delivered one by one once they are all visible
+// fn runs in the writing goroutine, before the call that made the write
+// returns but after the write has released its locks, and writes are
+// delivered in the order they were made. It may read and snapshot the
+// database but must not write to it (hand the event to another goroutine
+// for that), and must treat the document as read-only if the database is
+// opened WithZeroCopyReads
+func (db *Database) Watch(opts WatchOptions, fn func(ChangeEvent)) func() {
+	db.watchers.mu.Lock()
+	defer db.watchers.mu.Unlock()
+
+	if db.watchers.watches == nil {
+		db.watchers.watches = make(map[int]*watch)
+	}
+	key := db.watchers.next
+	db.watchers.next++
+	db.watchers.watches[key] = &watch{options: opts, fn: fn}
+	db.watchers.active.Add(1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			db.watchers.mu.Lock()
+			defer db.watchers.mu.Unlock()
+
+			delete(db.watchers.watches, key)
+			db.watchers.active.Add(-1)
+		})
+	}
+}
+
+// changeSet collects the writes a call installs, to deliver them to the
+// watches once they are all visible. A nil changeSet, for a database nobody
+// watches, collects nothing
+type changeSet struct {
+	db      *Database
+	changes []change
+	ticket  uint64 // Place in the delivery order, taken with the first change
+}
+
+// change is an installed document record, with the version it replaced
+type change struct {
+	coll   *Collection
+	record StorageRecord
+	before map[string]interface{} // nil for an insert
+}
+
+// changeSet returns the set collecting the writes of a call; nil if there
+// are no watches
+func (db *Database) changeSet() *changeSet {
+	if db == nil || db.watchers.active.Load() == 0 {
+		return nil
+	}
+	return &changeSet{db: db}
+}
+
+// add records a write about to be installed in c
+// Caller must hold c's write lock
+func (s *changeSet) add(c *Collection, record StorageRecord) {
+	if s == nil || c.frozen != nil {
+		return
+	}
+	if len(s.changes) == 0 {
+		s.ticket = s.db.watchers.take()
+	}
+	before, _ := c.documents.get(record.ID)
+	s.changes = append(s.changes, change{coll: c, record: record, before: before})
+}
+
+// deliver calls the watches that select them with the writes recorded, in
+// the order the watches were registered
+// It waits for the change sets installed before it to be delivered first
+// Caller must not hold db.mu or any lock of a collection, so watches can read
+// and snapshot the database
+func (s *changeSet) deliver() {
+	if s == nil || len(s.changes) == 0 {
+		return
+	}
+	s.db.watchers.await(s.ticket)
+	defer s.db.watchers.pass()
+
+	s.db.watchers.mu.RLock()
+	keys := make([]int, 0, len(s.db.watchers.watches))
+	for key := range s.db.watchers.watches {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	watches := make([]*watch, len(keys))
+	for i, key := range keys {
+		watches[i] = s.db.watchers.watches[key]
+	}
+	s.db.watchers.mu.RUnlock()
+
+	for _, ch := range s.changes {
+		c, record := ch.coll, ch.record
+		event := ChangeEvent{Collection: c.name, Op: OpUpdate, ID: record.ID}
+		switch {
+		case ch.before == nil:
+			event.Op = OpInsert
+		case record.Doc == nil:
+			event.Op = OpDelete
+		}
+
+		for _, w := range watches {
+			if w.options.Collection != "" && w.options.Collection != c.name {
+				continue
+			}
+			if len(w.options.Filter) > 0 && !c.matchesEither(w.options.Filter, ch.before, record.Doc) {
+				continue
+			}
+			if record.Doc != nil {
+				event.Doc = c.detachDocument(record.Doc)
+			}
+			w.fn(event)
+		}
+	}
+}
+
+// take returns the next ticket in the delivery order
+func (w *watchers) take() uint64 {
+	w.order.Lock()
+	defer w.order.Unlock()
+
+	ticket := w.tickets
+	w.tickets++
+	return ticket
+}
+
+// await waits for the change sets with earlier tickets to be delivered
+func (w *watchers) await(ticket uint64) {
+	w.order.Lock()
+	defer w.order.Unlock()
+
+	if w.turn == nil {
+		w.turn = sync.NewCond(&w.order)
+	}
+	for w.served != ticket {
+		w.turn.Wait()
+	}
+}
+
+// pass lets the change set with the next ticket be delivered
+func (w *watchers) pass() {
+	w.order.Lock()
+	defer w.order.Unlock()
+
+	w.served++
+	if w.turn != nil {
+		w.turn.Broadcast()
+	}
+}
+
+// matchesEither reports whether either version of a document matches filter
+func (c *Collection) matchesEither(filter, before, after map[string]interface{}) bool {
+	return (before != nil && c.match.Matches(before, filter)) || (after != nil && c.match.Matches(after, filter))
+}
@@ -0,0 +1,173 @@
+package engine
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestWatchCallbacksMayReadTheDatabase checks that writes tell their watches
+// after unlocking, so a callback can call back into the database
+func TestWatchCallbacksMayReadTheDatabase(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(db *Database) error
+	}{
+		{"Insert", func(db *Database) error {
+			_, err := db.GetCollection("docs").Insert(map[string]interface{}{"n": 1})
+			return err
+		}},
+		{"UpdateMany", func(db *Database) error {
+			_, err := db.GetCollection("docs").UpdateMany(map[string]interface{}{"group": "a"}, map[string]interface{}{"$inc": map[string]interface{}{"v": 1}})
+			return err
+		}},
+		{"InsertMany", func(db *Database) error {
+			_, err := db.GetCollection("docs").InsertMany([]map[string]interface{}{{"n": 1}, {"n": 2}})
+			return err
+		}},
+		{"DeleteMany", func(db *Database) error {
+			_, err := db.GetCollection("docs").DeleteMany(map[string]interface{}{})
+			return err
+		}},
+		{"DropCollection", func(db *Database) error {
+			return db.DropCollection("docs")
+		}},
+		{"RenameCollection", func(db *Database) error {
+			return db.RenameCollection("docs", "renamed")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDatabase(t)
+			insertCounters(t, db.GetCollection("docs"), "a", 3)
+
+			events := 0
+			stop := db.Watch(WatchOptions{}, func(event ChangeEvent) {
+				events++
+				db.ListCollections()
+				db.GetCollection("docs").Count()
+				if _, err := db.Snapshot(); err != nil {
+					t.Error(err)
+				}
+			})
+			defer stop()
+
+			done := make(chan error, 1)
+			go func() { done <- tt.write(db) }()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("write deadlocked with a watch reading the database")
+			}
+			if events == 0 {
+				t.Fatal("the watch heard of no writes")
+			}
+		})
+	}
+}
+
+// TestWatchCallbacksMayReadDuringCompaction checks that a callback can
+// snapshot the database and get new collections while it is compacted,
+// which waits for the writes in progress
+func TestWatchCallbacksMayReadDuringCompaction(t *testing.T) {
+	db := openTestDatabase(t)
+	coll := db.GetCollection("docs")
+
+	events := 0
+	stop := db.Watch(WatchOptions{Collection: "docs"}, func(event ChangeEvent) {
+		if _, err := db.Snapshot(); err != nil {
+			t.Error(err)
+		}
+		db.GetCollection(fmt.Sprintf("other-%d", events))
+		events++
+	})
+	defer stop()
+
+	stopCompacting := make(chan struct{})
+	compacted := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-stopCompacting:
+				compacted <- nil
+				return
+			default:
+			}
+			if err := db.Compact(); err != nil {
+				compacted <- err
+				return
+			}
+		}
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		for i := range 50 {
+			if _, err := coll.Insert(map[string]interface{}{"n": i}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("writes deadlocked with a watch reading the database during compaction")
+	}
+	close(stopCompacting)
+	if err := <-compacted; err != nil {
+		t.Fatal(err)
+	}
+	if events != 50 {
+		t.Fatalf("the watch heard of %d writes, want 50", events)
+	}
+}
+
+// TestWatchDeliversWritesToADocumentInOrder checks that concurrent writes to
+// a document are delivered in the order they were made, though each is
+// delivered after its locks are released
+func TestWatchDeliversWritesToADocumentInOrder(t *testing.T) {
+	db := openTestDatabase(t)
+	coll := db.GetCollection("docs")
+	if _, err := coll.Insert(map[string]interface{}{"id": "counter", "n": 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	var versions []int64
+	stop := db.Watch(WatchOptions{}, func(event ChangeEvent) {
+		versions = append(versions, documentVersion(event.Doc))
+	})
+	defer stop()
+
+	const writers, writes = 8, 50
+	var wg sync.WaitGroup
+	for range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range writes {
+				if _, err := coll.Increment("counter", "n", 1); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(versions) != writers*writes {
+		t.Fatalf("the watch heard of %d writes, want %d", len(versions), writers*writes)
+	}
+	for i, version := range versions {
+		if want := int64(i + 2); version != want {
+			t.Fatalf("event %d is of version %d, want %d", i, version, want)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// Package bridge holds what the WebAssembly builds, wasm (syscall/js) and
+// wasi (exported functions), share: the options their calls take and how
+// they read filters given as strings
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/malazaysc/tetodb/engine"
+)
+
+// ParseFilter decodes a filter given as a string
+// JSON objects are decoded as-is, a string starting with "$" is a JSONPath that
+// must select something (see engine.CompileJSONPath), and anything else is
+// parsed as a filter expression such as "age >= 18 AND role = admin"
+// (see engine.ParseFilterExpression)
+func ParseFilter(raw string) (map[string]interface{}, error) {
+	trimmed := strings.TrimSpace(raw)
+	if strings.HasPrefix(trimmed, "{") {
+		var filter map[string]interface{}
+		if err := json.Unmarshal([]byte(raw), &filter); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		return filter, nil
+	}
+	if strings.HasPrefix(trimmed, "$") {
+		if _, err := engine.CompileJSONPath(trimmed); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"$jsonPath": trimmed}, nil
+	}
+	return engine.ParseFilterExpression(raw)
+}
+
+// OpenOptions mirrors the options object accepted by tetoDBOpen and tetodb_open
+type OpenOptions struct {
+	TrackWriteLatency bool                     `json:"trackWriteLatency"`
+	StrictTypes       bool                     `json:"strictTypes"`
+	DateLayouts       []string                 `json:"dateLayouts"`
+	EpochUnit         string                   `json:"epochUnit"`       // "s" (default), "ms", "us" or "ns"
+	Collation         *engine.Collation        `json:"collation"`       // Default string comparison, e.g. {"locale": "de", "caseInsensitive": true}
+	StorageFormat     string                   `json:"storageFormat"`   // "json" or "binary" (see engine.WithStorageFormat)
+	Compression       string                   `json:"compression"`     // "gzip" (see engine.WithCompression)
+	Codec             string                   `json:"codec"`           // "msgpack", "cbor" or "json" (see engine.WithRecordCodec)
+	AutoCompaction    *engine.CompactionPolicy `json:"autoCompaction"`  // e.g. {"deadRatio": 0.5, "minRecords": 1000, "maxFileBytes": 0}
+	CheckpointEvery   int                      `json:"checkpointEvery"` // Snapshot the log after this many writes (see engine.WithCheckpoints)
+	Ephemeral         bool                     `json:"ephemeral"`       // Keep everything in memory (see engine.WithEphemeral)
+	ReadOnly          bool                     `json:"readOnly"`        // Open the file for reading only (see engine.WithReadOnly)
+	LazyLoading       bool                     `json:"lazyLoading"`     // Read collections when first used (see engine.WithLazyLoading)
+	Limits            *engine.Limits           `json:"limits"`          // e.g. {"maxFileBytes": 0, "maxDocuments": 0, "maxDocumentBytes": 0}
+	Isolation         string                   `json:"isolation"`       // "read_committed" (default) or "snapshot" (see engine.WithIsolation)
+	Passphrase        string                   `json:"passphrase"`      // Encrypt the file under a key derived from it (see engine.WithEncryption)
+}
+
+// storageFormats maps storageFormat names onto engine formats
+var storageFormats = map[string]int{
+	"json":   engine.FormatJSONLines,
+	"binary": engine.FormatBinary,
+}
+
+// isolationLevels maps isolation names onto engine levels
+var isolationLevels = map[string]engine.IsolationLevel{
+	engine.IsolationReadCommitted.String(): engine.IsolationReadCommitted,
+	engine.IsolationSnapshot.String():      engine.IsolationSnapshot,
+}
+
+// epochUnits maps epochUnit names onto durations
+var epochUnits = map[string]time.Duration{
+	"s":  time.Second,
+	"ms": time.Millisecond,
+	"us": time.Microsecond,
+	"ns": time.Nanosecond,
+}
+
+// EngineOptions converts open options into engine options
+func (o OpenOptions) EngineOptions() ([]engine.Option, error) {
+	// Results are converted for the host straight away and never changed, so
+	// copying them first would be wasted
+	opts := []engine.Option{engine.WithZeroCopyReads()}
+	if o.TrackWriteLatency {
+		opts = append(opts, engine.WithWriteLatencyTracking())
+	}
+	if o.StrictTypes {
+		opts = append(opts, engine.WithStrictTypes())
+	}
+	if len(o.DateLayouts) > 0 {
+		opts = append(opts, engine.WithDateLayouts(o.DateLayouts...))
+	}
+	if o.EpochUnit != "" {
+		unit, ok := epochUnits[o.EpochUnit]
+		if !ok {
+			return nil, fmt.Errorf("unknown epochUnit %q", o.EpochUnit)
+		}
+		opts = append(opts, engine.WithEpochUnit(unit))
+	}
+	if o.Collation != nil {
+		opts = append(opts, engine.WithCollation(*o.Collation))
+	}
+	if o.StorageFormat != "" {
+		format, ok := storageFormats[o.StorageFormat]
+		if !ok {
+			return nil, fmt.Errorf("unknown storageFormat %q", o.StorageFormat)
+		}
+		opts = append(opts, engine.WithStorageFormat(format))
+	}
+	if o.Compression != "" {
+		opts = append(opts, engine.WithCompression(o.Compression))
+	}
+	if o.Codec != "" {
+		opts = append(opts, engine.WithRecordCodec(o.Codec))
+	}
+	if o.AutoCompaction != nil {
+		opts = append(opts, engine.WithAutoCompaction(*o.AutoCompaction))
+	}
+	if o.CheckpointEvery > 0 {
+		opts = append(opts, engine.WithCheckpoints(o.CheckpointEvery))
+	}
+	if o.Ephemeral {
+		opts = append(opts, engine.WithEphemeral())
+	}
+	if o.ReadOnly {
+		opts = append(opts, engine.WithReadOnly())
+	}
+	if o.LazyLoading {
+		opts = append(opts, engine.WithLazyLoading())
+	}
+	if o.Limits != nil {
+		opts = append(opts, engine.WithLimits(*o.Limits))
+	}
+	if o.Isolation != "" {
+		level, ok := isolationLevels[o.Isolation]
+		if !ok {
+			return nil, fmt.Errorf("unknown isolation %q", o.Isolation)
+		}
+		opts = append(opts, engine.WithIsolation(level))
+	}
+	if o.Passphrase != "" {
+		opts = append(opts, engine.WithEncryption(o.Passphrase))
+	}
+	return opts, nil
+}
+
+// FindOptions mirrors the options object accepted by tetoDBFind and tetodb_find
+type FindOptions struct {
+	Sort       interface{}            `json:"sort"` // See engine.ParseSort for accepted forms
+	Skip       int                    `json:"skip"`
+	Limit      int                    `json:"limit"`
+	Projection map[string]interface{} `json:"projection"`
+	Paginate   bool                   `json:"paginate"`  // Return a page with a continuation token (see engine.Collection.FindPage)
+	PageToken  string                 `json:"pageToken"` // Token from the previous page; implies paginate
+	TimeoutMs  int                    `json:"timeoutMs"` // Abort the query after this many milliseconds (0 means no limit)
+	Collation  *engine.Collation      `json:"collation"` // Overrides the database collation for this query
+	Hint       string                 `json:"hint"`      // Index to force, "-name" to avoid, or "$natural" (see engine.FindOptions.Hint)
+}
+
+// QueryContext returns a context that expires after timeoutMs (never if it is 0)
+func QueryContext(timeoutMs int) (context.Context, context.CancelFunc) {
+	if timeoutMs <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), time.Duration(timeoutMs)*time.Millisecond)
+}
+
+// EngineOptions converts find options into engine find options
+func (o FindOptions) EngineOptions() (engine.FindOptions, error) {
+	if o.Skip < 0 || o.Limit < 0 || o.TimeoutMs < 0 {
+		return engine.FindOptions{}, fmt.Errorf("skip, limit and timeoutMs must not be negative")
+	}
+
+	sortFields, err := engine.ParseSort(o.Sort)
+	if err != nil {
+		return engine.FindOptions{}, err
+	}
+
+	projection, err := engine.NewProjection(o.Projection)
+	if err != nil {
+		return engine.FindOptions{}, err
+	}
+
+	return engine.FindOptions{
+		Sort:       sortFields,
+		Skip:       o.Skip,
+		Limit:      o.Limit,
+		Projection: projection,
+		Collation:  o.Collation,
+		Hint:       o.Hint,
+	}, nil
+}
@@ -0,0 +1,39 @@
+#!/usr/bin/env node
+/**
+ * Build wasm/tetodb.wasm and copy Go's wasm_exec.js next to it
+ *
+ * Both are build outputs and aren't checked in; npm runs this on install
+ * (the prepare script), or run it after changing the Go code:
+ *
+ *   npm run build
+ */
+
+const { execFileSync } = require('child_process');
+const fs = require('fs');
+const path = require('path');
+
+const root = path.join(__dirname, '..');
+const repoRoot = path.join(root, '..');
+const outputDir = path.join(root, 'wasm');
+
+fs.mkdirSync(outputDir, { recursive: true });
+
+console.log('Building TetoDB WebAssembly module...');
+execFileSync('go', ['build', '-o', path.join(outputDir, 'tetodb.wasm'), './wasm'], {
+  cwd: repoRoot,
+  env: { ...process.env, GOOS: 'js', GOARCH: 'wasm' },
+  stdio: 'inherit',
+});
+
+// Go 1.24 moved wasm_exec.js from misc/wasm to lib/wasm
+const goroot = execFileSync('go', ['env', 'GOROOT'], { encoding: 'utf8' }).trim();
+const runtime = ['lib/wasm/wasm_exec.js', 'misc/wasm/wasm_exec.js']
+  .map((file) => path.join(goroot, file))
+  .find((file) => fs.existsSync(file));
+if (!runtime) {
+  console.error(`Error: wasm_exec.js not found in ${goroot}`);
+  process.exit(1);
+}
+fs.copyFileSync(runtime, path.join(outputDir, 'wasm_exec.js'));
+
+console.log('Build complete! WASM module at: nodejs/wasm/tetodb.wasm');
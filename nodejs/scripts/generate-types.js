@@ -0,0 +1,372 @@
+#!/usr/bin/env node
+/**
+ * Generate src/tetodb.d.ts, the TypeScript definitions of TetoDB
+ *
+ * The wrapper classes are declared from the JSDoc of src/tetodb.js, and the
+ * raw tetoDB* functions from the export table of the WASM module (the
+ * js.Global().Set calls in wasm/*.go) and the Args/Returns comments of the
+ * functions it registers. Run it after changing either:
+ *
+ *   node scripts/generate-types.js          # Write src/tetodb.d.ts
+ *   node scripts/generate-types.js --check  # Fail if it is out of date
+ */
+
+const fs = require('fs');
+const path = require('path');
+
+const root = path.join(__dirname, '..');
+const wrapperPath = path.join(root, 'src/tetodb.js');
+const outputPath = path.join(root, 'src/tetodb.d.ts');
+const wasmDir = path.join(root, '../wasm');
+
+/**
+ * Split a list at the commas that aren't nested in brackets
+ *
+ * @param {string} text - Comma-separated list
+ * @returns {Array<string>} - Trimmed, non-empty items
+ */
+function splitTopLevel(text) {
+  const items = [];
+  let depth = 0;
+  let start = 0;
+  for (let i = 0; i < text.length; i++) {
+    const c = text[i];
+    if ('([{<'.includes(c)) {
+      depth++;
+    } else if (')]}>'.includes(c)) {
+      depth--;
+    } else if (c === ',' && depth === 0) {
+      items.push(text.slice(start, i));
+      start = i + 1;
+    }
+  }
+  items.push(text.slice(start));
+  return items.map(item => item.trim()).filter(item => item !== '');
+}
+
+/**
+ * Find the bracket closing the one at start
+ *
+ * @param {string} text - Text holding the brackets
+ * @param {number} start - Index of the opening bracket
+ * @returns {number} - Index of the closing bracket, or -1 if it isn't closed
+ */
+function matchingBracket(text, start) {
+  const open = text[start];
+  const close = { '{': '}', '[': ']', '(': ')' }[open];
+  let depth = 0;
+  for (let i = start; i < text.length; i++) {
+    if (text[i] === open) {
+      depth++;
+    } else if (text[i] === close && --depth === 0) {
+      return i;
+    }
+  }
+  return -1;
+}
+
+/**
+ * Convert a JSDoc type to TypeScript
+ *
+ * @param {string} type - JSDoc type, e.g. 'Array<object>' or 'function(object): boolean'
+ * @returns {string} - TypeScript type
+ */
+function tsType(type) {
+  type = type.trim();
+  if (type === '*' || type === '') {
+    return 'any';
+  }
+  const fn = type.match(/^function\((.*?)\):\s*(.+)$/);
+  if (fn) {
+    const args = splitTopLevel(fn[1]).map((arg, i) => `arg${i}: ${tsType(arg)}`);
+    return `((${args.join(', ')}) => ${tsType(fn[2])})`;
+  }
+  return type
+    .replace(/\bobject\b/g, 'Document')
+    .replace(/\bArray\b(?!<)/g, 'Array<any>')
+    .replace(/\bfunction\b/g, 'Function')
+    .replace(/\|/g, ' | ');
+}
+
+/**
+ * Parse the tags of a JSDoc comment
+ *
+ * @param {string} comment - The comment, from '/**' to its end
+ * @returns {{params: Array<object>, returns: string|null, properties: Array<object>, private: boolean}} - Its tags
+ */
+function parseJSDoc(comment) {
+  const doc = { params: [], returns: null, properties: [], private: false };
+  const tag = /@(param|returns|property|private)\b\s*/g;
+  let m;
+  while ((m = tag.exec(comment)) !== null) {
+    if (m[1] === 'private') {
+      doc.private = true;
+      continue;
+    }
+    const open = tag.lastIndex;
+    if (comment[open] !== '{') {
+      continue;
+    }
+    const close = matchingBracket(comment, open);
+    const type = comment.slice(open + 1, close);
+    const rest = comment.slice(close + 1).match(/^\s*([\w.]+)?(?:\s*-\s*(.*))?/);
+    if (m[1] === 'returns') {
+      doc.returns = type;
+    } else {
+      (m[1] === 'param' ? doc.params : doc.properties).push({ type, name: rest[1] || '', desc: rest[2] || '' });
+    }
+  }
+  return doc;
+}
+
+/**
+ * Declare the parameters of a method from its signature and JSDoc
+ *
+ * An object parameter described as "as for find" or "see find" also takes
+ * the fields of find's parameter of the same name
+ *
+ * @param {string} signature - Parameter list as written in the source
+ * @param {Array<object>} params - The @param tags of its JSDoc
+ * @param {object} methods - The @param tags of every method of the class, by name
+ * @returns {string} - TypeScript parameter list
+ */
+function tsParams(signature, params, methods) {
+  return splitTopLevel(signature).map((param) => {
+    const [name, defaultValue] = param.split('=').map(part => part.trim());
+    const tag = params.find(p => p.name === name);
+    let fields = params.filter(p => p.name.startsWith(`${name}.`));
+    const like = tag && tag.desc.match(/\b(?:as for|see) (\w+)\b/);
+    if (like && methods[like[1]]) {
+      const own = fields.map(f => f.name);
+      fields = methods[like[1]].filter(p => p.name.startsWith(`${name}.`) && !own.includes(p.name)).concat(fields);
+    }
+    let type = tag ? tsType(tag.type) : 'any';
+    if (fields.length > 0) {
+      const members = fields.map(f => `${f.name.slice(name.length + 1)}?: ${tsType(f.type)}`);
+      type = `{ ${members.join('; ')} }`;
+    }
+    return `${name}${defaultValue !== undefined ? '?' : ''}: ${type}`;
+  }).join(', ');
+}
+
+/**
+ * Declare the classes exported by the JS wrapper
+ *
+ * @param {string} source - Source of src/tetodb.js
+ * @returns {string} - Class declarations
+ */
+function declareClasses(source) {
+  const exported = source.match(/module\.exports = \{([^}]*)\}/)[1].split(',').map(name => name.trim());
+  const declarations = [];
+
+  const classPattern = /(\/\*\*(?:(?!\*\/)[\s\S])*\*\/)\nclass (\w+) \{\n([\s\S]*?)\n\}\n/g;
+  let c;
+  while ((c = classPattern.exec(source)) !== null) {
+    const [, classComment, className, body] = c;
+    if (!exported.includes(className)) {
+      continue;
+    }
+
+    const lines = [classComment, `export class ${className} {`];
+    for (const property of parseJSDoc(classComment).properties) {
+      lines.push(`  ${property.name}: ${tsType(property.type)};`);
+    }
+
+    const methodPattern = /(\/\*\*(?:(?!\*\/)[\s\S])*\*\/)\n  (static )?(async )?(\w+)\(([^)]*)\) \{/g;
+    const methods = {};
+    for (const [, comment, , , name] of body.matchAll(methodPattern)) {
+      methods[name] = parseJSDoc(comment).params;
+    }
+
+    let m;
+    while ((m = methodPattern.exec(body)) !== null) {
+      const [, comment, isStatic, isAsync, name, signature] = m;
+      const doc = parseJSDoc(comment);
+      if (doc.private || name.startsWith('_')) {
+        continue;
+      }
+
+      const params = tsParams(signature, doc.params, methods);
+      lines.push('');
+      lines.push(`  ${comment}`);
+      if (name === 'constructor') {
+        lines.push(`  constructor(${params});`);
+        continue;
+      }
+      let returns = doc.returns ? tsType(doc.returns) : 'void';
+      if (isAsync && !returns.startsWith('Promise<')) {
+        returns = `Promise<${returns}>`;
+      }
+      lines.push(`  ${isStatic ? 'static ' : ''}${name}(${params}): ${returns};`);
+    }
+    lines.push('}');
+    declarations.push(lines.join('\n'));
+  }
+  return declarations.join('\n\n');
+}
+
+// Go types of the Args and Returns comments, and their TypeScript types
+const goTypes = {
+  string: 'string',
+  number: 'number',
+  int: 'number',
+  bool: 'boolean',
+  object: 'Record<string, any>',
+  array: 'Array<any>',
+  function: '(...args: any[]) => any',
+  Uint8Array: 'Uint8Array',
+};
+
+/**
+ * TypeScript type of a type named in a Go doc comment, e.g. "object|string"
+ * for either
+ *
+ * @param {string} type - Type name, or names separated by '|'
+ * @returns {string} - TypeScript type
+ */
+function goType(type) {
+  return type.split('|').map(name => goTypes[name] || 'any').join(' | ');
+}
+
+/**
+ * Read the bracketed list that starts a comment line, joining the lines it
+ * continues on
+ *
+ * @param {Array<string>} lines - Comment lines, without the '// '
+ * @param {number} i - Line holding the list
+ * @param {string} open - Bracket opening the list
+ * @returns {{text: string, next: number}} - The list without its brackets, and the line after it
+ */
+function bracketed(lines, i, open) {
+  let text = lines[i];
+  let next = i + 1;
+  const start = text.indexOf(open);
+  while (matchingBracket(text, start) < 0 && next < lines.length) {
+    text += ` ${lines[next++]}`;
+  }
+  return { text: text.slice(start + 1, matchingBracket(text, start)), next };
+}
+
+/**
+ * Declare one tetoDB* function from the doc comment of the Go function it runs
+ *
+ * @param {string} exportName - Name it is registered under
+ * @param {string} goName - Go function registered
+ * @param {Array<string>} comment - Its doc comment lines, without the '// '
+ * @param {boolean} async - Whether it can return a Promise
+ * @returns {string} - Function declaration
+ */
+function declareExport(exportName, goName, comment, async) {
+  const docs = [];
+  const params = [];
+  let fields = [];
+  for (let i = 0; i < comment.length;) {
+    if (comment[i].startsWith('Args:')) {
+      const list = bracketed(comment, i, '[');
+      for (const arg of splitTopLevel(list.text)) {
+        const note = arg.match(/\((.*)\)$/);
+        const [name, type] = arg.replace(/\(.*\)$/, '').trim().split(/\s+/);
+        const optional = note && note[1].startsWith('optional');
+        params.push(`${name}${optional ? '?' : ''}: ${goType(type)}`);
+        if (note && note[1] !== 'optional') {
+          docs.push(`@param ${name} - ${note[1].replace(/^optional; /, '')}`);
+        }
+      }
+      i = list.next;
+    } else if (comment[i].startsWith('Returns:')) {
+      const list = bracketed(comment, i, '{');
+      fields = splitTopLevel(list.text)
+        .map(field => field.match(/^(\w+):\s*([\w|]+)/))
+        .filter(field => field && field[1] !== 'success' && field[1] !== 'error')
+        .map(([, name, type]) => `${name}: ${goType(type)}`);
+      // The rest of the sentence the list ends, if any, is left out
+      i = list.next;
+      while (i < comment.length && !/^(Args|Returns):/.test(comment[i]) && /^[a-z]/.test(comment[i])) {
+        i++;
+      }
+    } else {
+      docs.push(comment[i]);
+      i++;
+    }
+  }
+
+  // "insertDocument inserts ..." describes the function as "Inserts ..."
+  if (docs.length > 0 && docs[0].startsWith(`${goName} `)) {
+    const rest = docs[0].slice(goName.length + 1);
+    docs[0] = rest.charAt(0).toUpperCase() + rest.slice(1);
+  }
+
+  let result = fields.length > 0 ? `TetoDBResult<{ ${fields.join('; ')} }>` : 'TetoDBResult';
+  if (async) {
+    result = `${result} | Promise<${result}>`;
+  }
+  return [
+    '  /**',
+    ...docs.map(line => `   * ${line}`),
+    '   */',
+    `  function ${exportName}(${params.join(', ')}): ${result};`,
+  ].join('\n');
+}
+
+/**
+ * Declare the tetoDB* functions the WASM module registers
+ *
+ * @param {Array<string>} sources - Sources of the Go files of the module
+ * @returns {{declarations: string, names: Array<string>}} - Declarations of the functions, and their names
+ */
+function declareExports(sources) {
+  const source = sources.join('\n');
+  const table = [...source.matchAll(/js\.Global\(\)\.Set\("(\w+)", js\.FuncOf\(serialized\((\w+)\)\)\)/g)];
+  const declarations = table.map(([, exportName, goName]) => {
+    const func = source.match(new RegExp(`((?:^//.*\\n)+)func ${goName}\\(this js\\.Value[^\\n]*\\n([\\s\\S]*?)\\n}\\n`, 'm'));
+    if (!func) {
+      throw new Error(`no documented Go function ${goName} for ${exportName}`);
+    }
+    const comment = func[1].trim().split('\n').map(line => line.replace(/^\/\/ ?/, ''));
+    const async = /newPromise\(|openAsync\(/.test(func[2]);
+    return declareExport(exportName, goName, comment, async);
+  });
+  return { declarations: declarations.join('\n\n'), names: table.map(([, name]) => name) };
+}
+
+function main() {
+  const wrapper = fs.readFileSync(wrapperPath, 'utf8');
+  const goSources = fs.readdirSync(wasmDir)
+    .filter(name => name.endsWith('.go'))
+    .sort()
+    .map(name => fs.readFileSync(path.join(wasmDir, name), 'utf8'));
+  const exports = declareExports(goSources);
+
+  for (const name of exports.names) {
+    if (!wrapper.includes(`${name}(`)) {
+      console.warn(`Warning: ${name} isn't wrapped by src/tetodb.js`);
+    }
+  }
+
+  const output = `// Code generated by scripts/generate-types.js from src/tetodb.js and wasm/*.go; DO NOT EDIT.
+
+/** A document: a JSON object with an "id" field */
+export type Document = Record<string, any>;
+
+${declareClasses(wrapper)}
+
+declare global {
+  /** What every tetoDB* function returns: success, or an error and why */
+  type TetoDBResult<T = {}> = { success: boolean; error?: string } & Partial<T>;
+
+${exports.declarations}
+}
+`;
+
+  if (process.argv.includes('--check')) {
+    const current = fs.existsSync(outputPath) ? fs.readFileSync(outputPath, 'utf8') : '';
+    if (current !== output) {
+      console.error('src/tetodb.d.ts is out of date: run node scripts/generate-types.js');
+      process.exit(1);
+    }
+    return;
+  }
+  fs.writeFileSync(outputPath, output);
+}
+
+main();
@@ -2,69 +2,195 @@
  * TetoDB - A tiny embeddable NoSQL database compiled to WebAssembly
  *
  * This module provides a JavaScript wrapper around the Go WASM implementation
- * of TetoDB, offering a clean Promise-based API for Node.js applications.
+ * of TetoDB, offering a clean Promise-based API for Node.js applications and
+ * browsers. In a browser, load wasm/wasm_exec.js and then this file with
+ * <script> tags; TetoDB is then a global.
  */
 
-const fs = require('fs');
-const path = require('path');
+const isNode = typeof process !== 'undefined' && !!(process.versions && process.versions.node);
+const fs = isNode ? require('fs') : null;
+const path = isNode ? require('path') : null;
 
-// Load the Go WASM runtime
-require('../wasm/wasm_exec.js');
+// Where this script was loaded from in a browser; the WASM module is looked
+// for next to it
+const scriptURL = typeof document !== 'undefined' && document.currentScript ? document.currentScript.src : null;
+
+/**
+ * Adapt Node's fs module to how the Go runtime calls it: the WASM module
+ * reads and writes files inside synchronous calls, while JavaScript waits,
+ * so the callbacks have to run before each fs call returns
+ *
+ * @param {object} nodeFS - Node's fs module
+ * @returns {object} - fs methods calling back at once (see syscall/fs_js.go)
+ */
+function synchronousFS(nodeFS) {
+  const bridge = Object.create(nodeFS);
+  const methods = ['open', 'close', 'read', 'write', 'fstat', 'stat', 'lstat', 'fsync', 'ftruncate', 'truncate',
+    'unlink', 'rename', 'mkdir', 'rmdir', 'readdir', 'readlink', 'symlink', 'link', 'chmod', 'fchmod', 'chown',
+    'fchown', 'lchown', 'utimes'];
+  for (const name of methods) {
+    const sync = nodeFS[`${name}Sync`];
+    bridge[name] = (...args) => {
+      const callback = args.pop();
+      let result;
+      try {
+        result = sync(...args);
+      } catch (err) {
+        callback(err);
+        return;
+      }
+      callback(null, result);
+    };
+  }
+  return bridge;
+}
+
+// The Go WASM runtime reads files through the fs global; it is loaded with
+// the module (see loadWasm), and in a browser with a <script> tag
+if (isNode && !globalThis.fs) {
+  globalThis.fs = synchronousFS(fs);
+}
+
+// The WASM module, loaded once and shared by every TetoDB: each database
+// opened in it is told apart by its handle
+let wasmModule = null;
+
+/**
+ * Load and start the WASM module, once
+ *
+ * @param {string} wasmPath - tetodb.wasm file in Node.js, or URL in a browser; by default the one in ../wasm/
+ * @param {string} wasmExecPath - wasm_exec.js file in Node.js; by default the one in ../wasm/
+ * @returns {Promise<WebAssembly.Instance>} - The running module
+ */
+function loadWasm(wasmPath, wasmExecPath) {
+  if (!wasmModule) {
+    wasmModule = (async () => {
+      if (isNode && typeof Go === 'undefined') {
+        require(wasmExecPath ? path.resolve(wasmExecPath) : '../wasm/wasm_exec.js');
+      }
+      if (typeof Go === 'undefined') {
+        throw new Error('Go WASM runtime not loaded: add a <script> tag for wasm_exec.js before tetodb.js');
+      }
+      const go = new Go();
+
+      let result;
+      if (isNode) {
+        const wasmBuffer = fs.readFileSync(wasmPath || path.join(__dirname, '../wasm/tetodb.wasm'));
+        result = await WebAssembly.instantiate(wasmBuffer, go.importObject);
+      } else {
+        const url = wasmPath || new URL('../wasm/tetodb.wasm', scriptURL || location.href).href;
+        result = await WebAssembly.instantiateStreaming(fetch(url), go.importObject);
+      }
+
+      // Run the Go runtime
+      go.run(result.instance);
+
+      // Wait a bit for Go to register functions
+      await new Promise(resolve => setTimeout(resolve, 100));
+      return result.instance;
+    })();
+
+    // Let a failed load be retried, e.g. with another path
+    wasmModule.catch(() => {
+      wasmModule = null;
+    });
+  }
+  return wasmModule;
+}
 
 /**
  * TetoDB class - Main database interface
+ * Any number of TetoDB instances can be open at once, on different paths
+ *
+ * @property {boolean} isOpen - Whether a database is open
+ * @property {string|null} dbPath - Path of the open database
+ * @property {number|null} handle - Handle of the open database in the WASM module
  */
 class TetoDB {
   constructor() {
     this.isOpen = false;
     this.dbPath = null;
+    this.handle = null;
     this.wasmInstance = null;
   }
 
   /**
    * Initialize and load the WASM module
-   * This must be called before opening a database
+   * This must be called before opening a database; open calls it with the
+   * default options if it hasn't been
+   *
+   * @param {object} options - Load options (optional)
+   * @param {string} options.wasmPath - The tetodb.wasm file in Node.js, or its URL in a browser; by default the one in ../wasm/, next to the wrapper
+   * @param {string} options.wasmExecPath - The wasm_exec.js file in Node.js, which must come from the toolchain that built the module (e.g. TinyGo's for wasm/tinygo/tetodb.wasm); by default the one in ../wasm/. In a browser it is loaded with a <script> tag
    */
-  async init() {
+  async init(options = {}) {
     if (this.wasmInstance) {
       return; // Already initialized
     }
 
-    const wasmPath = path.join(__dirname, '../wasm/tetodb.wasm');
-    const wasmBuffer = fs.readFileSync(wasmPath);
+    this.wasmInstance = await loadWasm(options.wasmPath, options.wasmExecPath);
+  }
 
-    const go = new Go();
-    const result = await WebAssembly.instantiate(wasmBuffer, go.importObject);
+  /**
+   * Close every open database, e.g. before the process exits
+   *
+   * @returns {Promise<number>} - Number of databases closed
+   */
+  static async closeAll() {
+    if (!wasmModule) {
+      return 0;
+    }
+    await wasmModule;
 
-    // Run the Go runtime
-    go.run(result.instance);
+    const result = await tetoDBCloseAll();
 
-    this.wasmInstance = result.instance;
+    if (!result.success) {
+      throw new Error(result.error);
+    }
 
-    // Wait a bit for Go to register functions
-    await new Promise(resolve => setTimeout(resolve, 100));
+    return result.closed;
   }
 
   /**
    * Open a database at the specified path
    * Creates the database if it doesn't exist
    *
-   * @param {string} dbPath - Path to the database file
+   * @param {string} dbPath - Path to the database file, ':memory:' for an in-memory database, 'indexeddb://name' in a browser, or 'opfs://path' in a Web Worker; a browser keeps a plain path in IndexedDB, as 'indexeddb://path'
+   * @param {object} options - Open options (optional)
+   * @param {boolean} options.trackWriteLatency - Record write latency percentiles in stats
+   * @param {boolean} options.strictTypes - Never match numbers against numeric strings in filters
+   * @param {string[]} options.dateLayouts - Go time layouts recognised as dates in filters
+   * @param {string} options.epochUnit - Unit of numeric timestamps: 's' (default), 'ms', 'us' or 'ns'
+   * @param {object} options.collation - Default string comparison, e.g. {locale: 'de', caseInsensitive: true, numeric: true}
+   * @param {string} options.storageFormat - File format to write: 'json' (default for new files) or 'binary'
+   * @param {string} options.compression - Compress large records: 'gzip' (implies the binary format)
+   * @param {string} options.codec - Serialize records with 'msgpack' or 'cbor' instead of 'json' (implies the binary format)
+   * @param {object} options.autoCompaction - Compact in the background, e.g. {deadRatio: 0.5, minRecords: 1000, maxFileBytes: 64 * 1024 * 1024}
+   * @param {number} options.checkpointEvery - Snapshot the database after this many writes, keeping the log short
+   * @param {boolean} options.ephemeral - Keep the database in memory and ignore dbPath; nothing is saved
+   * @param {boolean} options.readOnly - Open an existing database file for reading only; writes fail
+   * @param {boolean} options.lazyLoading - Read each collection from the file when it is first used instead of on open
+   * @param {object} options.limits - Refuse writes over these limits, e.g. {maxFileBytes: 50 * 1024 * 1024, maxDocuments: 10000, maxDocumentBytes: 64 * 1024}
+   * @param {string} options.isolation - What transactions read: 'read_committed' (default) or 'snapshot', whose commits fail with a conflict error if another write got there first
+   * @param {string} options.passphrase - Encrypt the file with AES-256-GCM under a key derived from this passphrase (implies the binary format); an encrypted file only opens with it
+   * @param {object} options.adapter - Keep the database with these functions instead, dbPath only naming it: {read(), append(text), replace(text), close()}, each returning its result or a Promise (see README)
    * @returns {Promise<TetoDB>} - Returns this for chaining
    */
-  async open(dbPath) {
+  async open(dbPath, options = {}) {
     if (!this.wasmInstance) {
       await this.init();
     }
 
-    const result = tetoDBOpen(dbPath);
+    const { adapter, ...openOptions } = options;
+    const result = await tetoDBOpen(dbPath, openOptions, adapter);
 
     if (!result.success) {
       throw new Error(result.error);
     }
 
     this.isOpen = true;
-    this.dbPath = dbPath;
+    this.dbPath = result.path;
+    this.handle = result.handle;
 
     return this;
   }
@@ -83,6 +209,42 @@ class TetoDB {
     return new Collection(name, this);
   }
 
+  /**
+   * List the collections by name
+   *
+   * @returns {Promise<Array<string>>} - Collection names, sorted
+   */
+  async listCollections() {
+    this._checkOpen();
+
+    const result = tetoDBListCollections(this.handle);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+
+    return result.collections;
+  }
+
+  /**
+   * Run a SQL-like SELECT statement
+   * e.g. "SELECT name, age FROM users WHERE age >= 18 ORDER BY age DESC LIMIT 10"
+   *
+   * @param {string} sql - SELECT statement
+   * @returns {Promise<Array>} - Matching documents, or [{ count }] for SELECT COUNT(*)
+   */
+  async query(sql) {
+    this._checkOpen();
+
+    const result = tetoDBQuery(this.handle, sql);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+
+    return result.documents;
+  }
+
   /**
    * Get database statistics
    *
@@ -91,7 +253,7 @@ class TetoDB {
   async stats() {
     this._checkOpen();
 
-    const result = tetoDBStats();
+    const result = tetoDBStats(this.handle);
 
     if (!result.success) {
       throw new Error(result.error);
@@ -100,6 +262,25 @@ class TetoDB {
     return result.stats;
   }
 
+  /**
+   * Get the memory the module uses, to watch or cap the database's footprint
+   * The heap and gc figures cover the whole module, every open database
+   * included; memory estimates what this database's loaded collections hold
+   *
+   * @returns {Promise<object>} - { heap, gc (null in a TinyGo build), memory: { documents, bytes, collections } }
+   */
+  async runtimeStats() {
+    this._checkOpen();
+
+    const result = tetoDBRuntimeStats(this.handle);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+
+    return { heap: result.heap, gc: result.gc, memory: result.memory };
+  }
+
   /**
    * Compact the database file
    * Removes deleted/updated records and reclaims disk space
@@ -109,11 +290,220 @@ class TetoDB {
   async compact() {
     this._checkOpen();
 
-    const result = tetoDBCompact();
+    const result = tetoDBCompact(this.handle);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+  }
+
+  /**
+   * Change the passphrase of a database opened with options.passphrase
+   * The file is rewritten under a key derived from the new passphrase, so
+   * it only opens with that one from then on
+   *
+   * @param {string} current - Passphrase the database is encrypted under
+   * @param {string} next - New passphrase
+   * @returns {Promise<void>}
+   */
+  async changePassphrase(current, next) {
+    this._checkOpen();
+
+    const result = tetoDBChangePassphrase(this.handle, current, next);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+  }
+
+  /**
+   * Change when an IndexedDB, OPFS or storage adapter database writes to its storage
+   * 'write' (the default) flushes each write as it is made; 'interval' batches
+   * the writes made in between into one flush every intervalMs; 'manual' only
+   * flushes on flush() and close(). Reads see every write straight away, but
+   * writes not yet flushed are lost if the page goes away first, so call
+   * flush() on visibilitychange or pagehide
+   *
+   * @param {object} policy - Flush policy
+   * @param {string} policy.mode - 'write', 'interval' or 'manual'
+   * @param {number} policy.intervalMs - Time between flushes in 'interval' mode
+   * @returns {Promise<void>}
+   */
+  async setFlushPolicy(policy) {
+    this._checkOpen();
+
+    const result = tetoDBSetFlushPolicy(this.handle, policy);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+  }
+
+  /**
+   * Write every write held back by the flush policy to the browser's storage
+   * or the storage adapter (other databases are synced to disk)
+   *
+   * @returns {Promise<void>} - Resolves once the writes have landed
+   */
+  async flush() {
+    this._checkOpen();
+
+    const result = await tetoDBFlush(this.handle);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+  }
+
+  /**
+   * Advance a named sequence, e.g. for invoice numbers
+   * Values start at 1 and keep increasing across reopens; concurrent callers
+   * never get the same one
+   *
+   * @param {string} name - Sequence name
+   * @returns {Promise<number>} - The new value
+   */
+  async nextSequence(name) {
+    this._checkOpen();
+
+    const result = tetoDBNextSequence(this.handle, name);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+
+    return result.value;
+  }
+
+  /**
+   * Copy the database while writes continue
+   * The copy holds the live documents and indexes as a database file, in the
+   * same format and encryption; write it to a path and open that to restore
+   *
+   * @returns {Promise<Uint8Array>} - Contents of the backup file
+   */
+  async backup() {
+    this._checkOpen();
+
+    const result = tetoDBBackup(this.handle);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+
+    return result.data;
+  }
+
+  /**
+   * Roll the database back to its documents at a past time, e.g. to undo an
+   * accidental mass delete. The rollback is appended to the log, so it can be
+   * undone by restoring to a later time; compaction discards the history
+   * needed to restore to a time before it
+   *
+   * @param {Date|number} time - When to restore to, as a Date or milliseconds since the epoch
+   * @returns {Promise<void>}
+   */
+  async restoreTo(time) {
+    this._checkOpen();
+
+    const result = tetoDBRestoreTo(this.handle, time instanceof Date ? time.getTime() : time);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+  }
+
+  /**
+   * Copy the database as a JSON lines database file, whatever its storage,
+   * e.g. for a download-as-file backup; unlike backup() it is never
+   * compressed or encrypted, so any TetoDB database can import it
+   *
+   * @returns {Promise<Uint8Array>} - Contents of the file
+   */
+  async export() {
+    this._checkOpen();
+
+    const result = tetoDBExport(this.handle);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+
+    return result.data;
+  }
+
+  /**
+   * Replace everything in the database with the contents of a database
+   * file, such as one export() or backup() made, e.g. a file dropped on the
+   * page. Its documents are written as one batch, so restoreTo a time before
+   * brings the old ones back
+   *
+   * @param {Uint8Array|ArrayBuffer|Blob} data - Contents of the file
+   * @returns {Promise<void>}
+   */
+  async import(data) {
+    this._checkOpen();
+
+    if (typeof Blob !== 'undefined' && data instanceof Blob) {
+      data = await data.arrayBuffer();
+    }
+    if (data instanceof ArrayBuffer) {
+      data = new Uint8Array(data);
+    }
+
+    const result = tetoDBImport(this.handle, data);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+  }
+
+  /**
+   * Start a transaction: its writes are buffered until commit, which makes
+   * them all or none
+   *
+   * @returns {Transaction} - The transaction
+   */
+  begin() {
+    this._checkOpen();
+
+    const result = tetoDBBegin(this.handle);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+
+    return new Transaction(result.tx, this);
+  }
+
+  /**
+   * Call a function with every write made to the database from now on, e.g.
+   * to re-render a view without polling find. The callback receives
+   * {collection, op, id, doc}, where op is 'insert', 'update' or 'delete' and
+   * doc is the document as written (null for a delete); it runs after the
+   * call that made the write has returned, so it may use the database
+   *
+   * @param {function(object): void} callback - Called with each change
+   * @param {object} options - Watch options (optional)
+   * @param {string} options.collection - Only writes to this collection
+   * @param {object|string} options.filter - Only writes to documents matching this filter before or after the write
+   * @returns {function(): void} - Stops the watch
+   */
+  watch(callback, options = {}) {
+    this._checkOpen();
+
+    const handle = this.handle;
+    const result = tetoDBWatch(handle, callback, options);
 
     if (!result.success) {
       throw new Error(result.error);
     }
+
+    return () => {
+      if (this.handle === handle) {
+        tetoDBUnwatch(handle, result.watch);
+      }
+    };
   }
 
   /**
@@ -126,7 +516,7 @@ class TetoDB {
       return;
     }
 
-    const result = tetoDBClose();
+    const result = await tetoDBClose(this.handle);
 
     if (!result.success) {
       throw new Error(result.error);
@@ -134,6 +524,7 @@ class TetoDB {
 
     this.isOpen = false;
     this.dbPath = null;
+    this.handle = null;
   }
 
   /**
@@ -149,8 +540,17 @@ class TetoDB {
 
 /**
  * Collection class - Represents a collection of documents
+ *
+ * @property {string} name - Collection name
+ * @property {TetoDB} db - Database the collection belongs to
  */
 class Collection {
+  /**
+   * Use TetoDB.collection rather than constructing one directly
+   *
+   * @param {string} name - Collection name
+   * @param {TetoDB} db - Database the collection belongs to
+   */
   constructor(name, db) {
     this.name = name;
     this.db = db;
@@ -165,8 +565,7 @@ class Collection {
   async insert(document) {
     this.db._checkOpen();
 
-    const jsonDoc = JSON.stringify(document);
-    const result = tetoDBInsert(this.name, jsonDoc);
+    const result = tetoDBInsert(this.db.handle, this.name, document);
 
     if (!result.success) {
       throw new Error(result.error);
@@ -176,39 +575,113 @@ class Collection {
   }
 
   /**
-   * Insert multiple documents
+   * Insert multiple documents as one batch: if any of them can't be inserted
+   * (e.g. its ID is taken) none are, and the rest are written together
    *
    * @param {Array<object>} documents - Array of documents to insert
    * @returns {Promise<Array<string>>} - Array of inserted document IDs
    */
   async insertMany(documents) {
-    const ids = [];
+    this.db._checkOpen();
+
+    const result = tetoDBInsertMany(this.db.handle, this.name, documents);
 
-    for (const doc of documents) {
-      const id = await this.insert(doc);
-      ids.push(id);
+    if (!result.success) {
+      throw new Error(result.error);
     }
 
-    return ids;
+    return result.ids;
   }
 
   /**
    * Find documents matching a filter
    *
-   * @param {object} filter - Filter criteria (optional)
+   * @param {object|string} filter - Filter criteria or expression (optional)
+   * @param {object} options - Find options (optional)
+   * @param {string|Array} options.sort - Sort keys, e.g. '-age,name' or [{field: 'age', direction: 'desc', nulls: 'last'}]
+   * @param {number} options.skip - Number of matching documents to skip
+   * @param {number} options.limit - Maximum number of documents to return
+   * @param {object} options.projection - Fields to include ({name: 1}) or exclude ({password: 0})
+   * @param {number} options.timeoutMs - Fail with a deadline error if the query runs longer
+   * @param {object} options.collation - String comparison for this query's filter and sort (overrides the database default)
+   * @param {string} options.hint - Index to use (a name from listIndexes), '-name' to avoid one, or '$natural' to scan without indexes
    * @returns {Promise<Array<object>>} - Array of matching documents
    */
-  async find(filter = {}) {
+  async find(filter = {}, options = {}) {
     this.db._checkOpen();
 
-    const filterJSON = Object.keys(filter).length > 0 ? JSON.stringify(filter) : '';
-    const result = tetoDBFind(this.name, filterJSON);
+    const result = tetoDBFind(this.db.handle, this.name, filter, options);
 
     if (!result.success) {
       throw new Error(result.error);
     }
 
-    return JSON.parse(result.documents);
+    return result.documents;
+  }
+
+  /**
+   * Call a function with each matching document as soon as it is found
+   * Documents are delivered during the scan instead of being collected into an
+   * array first; return false from the callback to stop early. The scan reads
+   * the collection as it was when findEach was called, so the callback may call
+   * other TetoDB methods, but doesn't see the writes they make
+   *
+   * @param {object|string} filter - Filter criteria or expression
+   * @param {function(object): (boolean|void)} callback - Called with each document
+   * @returns {Promise<number>} - Number of documents delivered
+   */
+  async findEach(filter, callback) {
+    this.db._checkOpen();
+
+    const result = tetoDBFindEach(this.db.handle, this.name, filter, callback);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+
+    return result.count;
+  }
+
+  /**
+   * Find one page of documents, sorted deterministically
+   * Results are ordered by options.sort with the document id as a tie-breaker.
+   * Pass the returned nextToken as options.pageToken to fetch the next page;
+   * it is empty once there are no more documents
+   *
+   * @param {object|string} filter - Filter criteria or expression (optional)
+   * @param {object} options - Find options, as for find (limit sets the page size)
+   * @param {string} options.pageToken - Token from the previous page (omit for the first page)
+   * @returns {Promise<{documents: Array<object>, nextToken: string}>} - The page and the token for the next one
+   */
+  async findPage(filter = {}, options = {}) {
+    this.db._checkOpen();
+
+    const result = tetoDBFind(this.db.handle, this.name, filter, { ...options, paginate: true });
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+
+    return { documents: result.documents, nextToken: result.nextToken };
+  }
+
+  /**
+   * Explain how a find would be executed
+   *
+   * @param {object|string} filter - Filter criteria or expression (optional)
+   * @param {object} options - Find options (optional, see find)
+   * @returns {Promise<object>} - Plan with predicates, index usage, documents scanned/returned and elapsed_ns
+   */
+  async explain(filter = {}, options = {}) {
+    this.db._checkOpen();
+
+    const result = tetoDBExplain(this.db.handle, this.name, filter, options);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+
+    return result.plan;
   }
 
   /**
@@ -220,24 +693,25 @@ class Collection {
   async findById(id) {
     this.db._checkOpen();
 
-    const result = tetoDBFindByID(this.name, id);
+    const result = tetoDBFindByID(this.db.handle, this.name, id);
 
     if (!result.success) {
       // Document not found
       return null;
     }
 
-    return JSON.parse(result.document);
+    return result.document;
   }
 
   /**
    * Find the first document matching a filter
    *
-   * @param {object} filter - Filter criteria
+   * @param {object|string} filter - Filter criteria or expression
+   * @param {object} options - Find options (optional, see find)
    * @returns {Promise<object|null>} - The first matching document or null
    */
-  async findOne(filter = {}) {
-    const docs = await this.find(filter);
+  async findOne(filter = {}, options = {}) {
+    const docs = await this.find(filter, { ...options, limit: 1 });
     return docs.length > 0 ? docs[0] : null;
   }
 
@@ -245,14 +719,13 @@ class Collection {
    * Update a document by ID
    *
    * @param {string} id - Document ID
-   * @param {object} update - Fields to update
+   * @param {object} update - Fields to merge, or update operators ($set, $unset, $inc, $push, $pull, $rename)
    * @returns {Promise<void>}
    */
   async updateById(id, update) {
     this.db._checkOpen();
 
-    const updateJSON = JSON.stringify(update);
-    const result = tetoDBUpdate(this.name, id, updateJSON);
+    const result = tetoDBUpdate(this.db.handle, this.name, id, update);
 
     if (!result.success) {
       throw new Error(result.error);
@@ -260,50 +733,155 @@ class Collection {
   }
 
   /**
-   * Update the first document matching a filter
+   * Update a document by ID only if it is still at the version read before
+   * editing it (its _version field), so concurrent edits, e.g. from two tabs,
+   * can't overwrite each other. On a conflict the error has code
+   * 'VERSION_CONFLICT' and the document's current version
    *
-   * @param {object} filter - Filter criteria
-   * @param {object} update - Fields to update
-   * @returns {Promise<boolean>} - True if a document was updated
+   * @param {string} id - Document ID
+   * @param {number} version - Expected _version of the document
+   * @param {object} update - Fields to merge, or update operators
+   * @returns {Promise<void>}
    */
-  async updateOne(filter, update) {
-    const doc = await this.findOne(filter);
+  async updateIfVersion(id, version, update) {
+    this.db._checkOpen();
 
-    if (!doc) {
-      return false;
-    }
+    const result = tetoDBUpdateIfVersion(this.db.handle, this.name, id, version, update);
 
-    await this.updateById(doc.id, update);
-    return true;
+    if (!result.success) {
+      const error = new Error(result.error);
+      if (result.conflict) {
+        error.code = 'VERSION_CONFLICT';
+        error.version = result.version;
+      }
+      throw error;
+    }
   }
 
   /**
-   * Delete a document by ID
+   * Update a document by ID only if it still matches a condition, checked
+   * and written in one step so no other write comes between them, e.g. to
+   * move an order from 'pending' to 'paid' exactly once
    *
    * @param {string} id - Document ID
-   * @returns {Promise<void>}
+   * @param {object} condition - Filter the document must match
+   * @param {object} update - Fields to merge, or update operators
+   * @returns {Promise<boolean>} - True if the update was applied
    */
-  async deleteById(id) {
+  async updateWhere(id, condition, update) {
     this.db._checkOpen();
 
-    const result = tetoDBDelete(this.name, id);
+    const result = tetoDBUpdateWhere(this.db.handle, this.name, id, condition, update);
 
     if (!result.success) {
       throw new Error(result.error);
     }
+
+    return result.applied;
   }
 
   /**
-   * Delete the first document matching a filter
+   * Add to a numeric field of a document in one step, so concurrent
+   * increments are never lost (a missing field starts at 0)
    *
-   * @param {object} filter - Filter criteria
-   * @returns {Promise<boolean>} - True if a document was deleted
+   * @param {string} id - Document ID
+   * @param {string} field - Field to add to (dot paths reach nested fields)
+   * @param {number} delta - Amount to add (default 1)
+   * @returns {Promise<number>} - The new value
    */
-  async deleteOne(filter) {
-    const doc = await this.findOne(filter);
+  async increment(id, field, delta = 1) {
+    this.db._checkOpen();
 
-    if (!doc) {
-      return false;
+    const result = tetoDBIncrement(this.db.handle, this.name, id, field, delta);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+
+    return result.value;
+  }
+
+  /**
+   * Update the first document matching a filter
+   *
+   * @param {object|string} filter - Filter criteria or expression
+   * @param {object} update - Fields to merge, or update operators (see updateById)
+   * @returns {Promise<boolean>} - True if a document was updated
+   */
+  async updateOne(filter, update) {
+    const doc = await this.findOne(filter);
+
+    if (!doc) {
+      return false;
+    }
+
+    await this.updateById(doc.id, update);
+    return true;
+  }
+
+  /**
+   * Replace a document by ID
+   * Unlike updateById, fields missing from the new document are removed
+   *
+   * @param {string} id - Document ID
+   * @param {object} doc - The new document (its id, if given, must match)
+   * @returns {Promise<void>}
+   */
+  async replaceById(id, doc) {
+    this.db._checkOpen();
+
+    const result = tetoDBReplace(this.db.handle, this.name, id, doc);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+  }
+
+  /**
+   * Replace the first document matching a filter
+   *
+   * @param {object|string} filter - Filter criteria or expression
+   * @param {object} doc - The new document
+   * @returns {Promise<boolean>} - True if a document was replaced
+   */
+  async replaceOne(filter, doc) {
+    const existing = await this.findOne(filter);
+
+    if (!existing) {
+      return false;
+    }
+
+    await this.replaceById(existing.id, doc);
+    return true;
+  }
+
+  /**
+   * Delete a document by ID
+   *
+   * @param {string} id - Document ID
+   * @returns {Promise<void>}
+   */
+  async deleteById(id) {
+    this.db._checkOpen();
+
+    const result = tetoDBDelete(this.db.handle, this.name, id);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+  }
+
+  /**
+   * Delete the first document matching a filter
+   *
+   * @param {object|string} filter - Filter criteria or expression
+   * @returns {Promise<boolean>} - True if a document was deleted
+   */
+  async deleteOne(filter) {
+    const doc = await this.findOne(filter);
+
+    if (!doc) {
+      return false;
     }
 
     await this.deleteById(doc.id);
@@ -313,7 +891,7 @@ class Collection {
   /**
    * Delete all documents matching a filter
    *
-   * @param {object} filter - Filter criteria
+   * @param {object|string} filter - Filter criteria or expression
    * @returns {Promise<number>} - Number of documents deleted
    */
   async deleteMany(filter) {
@@ -326,17 +904,320 @@ class Collection {
     return docs.length;
   }
 
+  /**
+   * Store a blob under a name alongside a document, replacing any attachment
+   * of that name. Attachments are kept out of the document, so queries never
+   * see them, and are removed with it
+   *
+   * @param {string} id - Document ID
+   * @param {string} name - Attachment name
+   * @param {Uint8Array} data - Attachment contents
+   * @returns {Promise<void>}
+   */
+  async putAttachment(id, name, data) {
+    this.db._checkOpen();
+
+    const result = tetoDBPutAttachment(this.db.handle, this.name, id, name, data);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+  }
+
+  /**
+   * Get the contents of a document's attachment
+   *
+   * @param {string} id - Document ID
+   * @param {string} name - Attachment name
+   * @returns {Promise<Uint8Array|null>} - The contents or null if there is no such attachment
+   */
+  async getAttachment(id, name) {
+    this.db._checkOpen();
+
+    const result = tetoDBGetAttachment(this.db.handle, this.name, id, name);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+
+    return result.found ? result.data : null;
+  }
+
+  /**
+   * List the attachments of a document, sorted by name
+   *
+   * @param {string} id - Document ID
+   * @returns {Promise<Array<{name: string, size: number}>>} - Attachment names and sizes in bytes
+   */
+  async listAttachments(id) {
+    this.db._checkOpen();
+
+    const result = tetoDBListAttachments(this.db.handle, this.name, id);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+
+    return result.attachments;
+  }
+
+  /**
+   * Delete a document's attachment
+   *
+   * @param {string} id - Document ID
+   * @param {string} name - Attachment name
+   * @returns {Promise<void>}
+   */
+  async deleteAttachment(id, name) {
+    this.db._checkOpen();
+
+    const result = tetoDBDeleteAttachment(this.db.handle, this.name, id, name);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+  }
+
   /**
    * Count documents in the collection
    *
-   * @param {object} filter - Filter criteria (optional)
+   * @param {object|string} filter - Filter criteria or expression (optional)
    * @returns {Promise<number>} - Number of documents
    */
   async count(filter = {}) {
     this.db._checkOpen();
 
-    const filterJSON = Object.keys(filter).length > 0 ? JSON.stringify(filter) : '';
-    const result = tetoDBCount(this.name, filterJSON);
+    const result = tetoDBCount(this.db.handle, this.name, filter);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+
+    return result.count;
+  }
+
+  /**
+   * Run an aggregation pipeline
+   *
+   * @param {Array<object>} pipeline - Stages such as $match, $group, $sort, $skip, $limit, $project, $lookup, $sample, $facet, $bucket, $bucketAuto
+   * @param {object} options - Aggregation options (optional)
+   * @param {number} options.timeoutMs - Fail with a deadline error if the pipeline runs longer
+   * @returns {Promise<Array<object>>} - The pipeline output
+   */
+  async aggregate(pipeline, options = {}) {
+    this.db._checkOpen();
+
+    const result = tetoDBAggregate(this.db.handle, this.name, pipeline, options);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+
+    return result.documents;
+  }
+
+  /**
+   * Pick random documents
+   *
+   * @param {number} n - Number of documents to return
+   * @returns {Promise<Array<object>>} - Up to n documents, chosen uniformly at random
+   */
+  async sample(n) {
+    return this.aggregate([{ $sample: { size: n } }]);
+  }
+
+  /**
+   * Full-text search across string fields
+   *
+   * @param {string} query - Words to search for
+   * @param {object} options - Search options (optional)
+   * @param {Array<string>} options.fields - Only search these fields
+   * @param {object} options.filter - Filter documents must also match
+   * @param {boolean} options.matchAll - Require every word instead of any
+   * @param {number} options.limit - Maximum number of results
+   * @returns {Promise<Array<{id: string, document: object, score: number}>>} - Results, best first
+   */
+  async search(query, options = {}) {
+    this.db._checkOpen();
+
+    const result = tetoDBSearch(this.db.handle, this.name, query, options);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+
+    return result.results;
+  }
+
+  /**
+   * Index a field so find() only examines documents holding the queried
+   * values, for equality ($eq, $in) and range ($gt, $gte, $lt, $lte) conditions
+   * The index definition is stored in the database file and rebuilt on open
+   *
+   * @param {string} field - Field to index (dot notation allowed)
+   * @param {object} options - Index options (optional)
+   * @param {object|string} options.filter - Only index documents matching this filter (a partial index)
+   * @returns {Promise<void>}
+   */
+  async createIndex(field, options = {}) {
+    this.db._checkOpen();
+
+    const result = tetoDBCreateIndex(this.db.handle, this.name, field, options);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+  }
+
+  /**
+   * Describe the collection's indexes
+   *
+   * @returns {Promise<Array<object>>} - [{name, kind, field, entries, memory_bytes, hits, ...}]
+   */
+  async listIndexes() {
+    this.db._checkOpen();
+
+    const result = tetoDBListIndexes(this.db.handle, this.name);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+
+    return result.indexes;
+  }
+
+  /**
+   * Remove an index
+   *
+   * @param {string} name - Index name as reported by listIndexes (the field, 'geo:<field>' or 'text')
+   * @returns {Promise<void>}
+   */
+  async dropIndex(name) {
+    this.db._checkOpen();
+
+    const result = tetoDBDropIndex(this.db.handle, this.name, name);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+  }
+
+  /**
+   * Index a location field for $near and $geoWithin queries
+   * Locations are [lon, lat] arrays or GeoJSON points. The index definition
+   * is stored in the database file and the index is rebuilt on open
+   *
+   * @param {string} field - Field holding the location (dot notation allowed)
+   * @returns {Promise<void>}
+   */
+  async createGeoIndex(field) {
+    this.db._checkOpen();
+
+    const result = tetoDBCreateGeoIndex(this.db.handle, this.name, field);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+  }
+
+  /**
+   * Remove the collection with its documents and indexes
+   *
+   * @returns {Promise<void>}
+   */
+  async drop() {
+    this.db._checkOpen();
+
+    const result = tetoDBDropCollection(this.db.handle, this.name);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+  }
+
+  /**
+   * Move the collection's documents, indexes and attachments to a new name,
+   * in one batch; this object then refers to the collection by the new name
+   *
+   * @param {string} name - New name, not used by a collection with documents or indexes
+   * @returns {Promise<void>}
+   */
+  async rename(name) {
+    this.db._checkOpen();
+
+    const result = tetoDBRenameCollection(this.db.handle, this.name, name);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+
+    this.name = name;
+  }
+
+  /**
+   * Make a list of writes in one call, persisted as one batch, e.g.
+   * [{type: 'insert', doc}, {type: 'update', id, update}, {type: 'replace', id, doc}, {type: 'delete', id}]
+   * An operation that fails is skipped, its result's error saying why, and
+   * the others still go ahead; use a transaction to make all or none
+   *
+   * @param {Array<object>} operations - Writes to make, in order
+   * @returns {Promise<Array<object>>} - One {id, error} per operation; error is unset if it was applied
+   */
+  async bulkWrite(operations) {
+    this.db._checkOpen();
+
+    const result = tetoDBBulkWrite(this.db.handle, this.name, operations);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+
+    return result.results;
+  }
+
+  /**
+   * Call a function with every write made to the collection from now on
+   * (see TetoDB.watch)
+   *
+   * @param {function(object): void} callback - Called with each change
+   * @param {object|string} filter - Only writes to documents matching this filter before or after the write (optional)
+   * @returns {function(): void} - Stops the watch
+   */
+  watch(callback, filter = {}) {
+    return this.db.watch(callback, { collection: this.name, filter });
+  }
+
+  /**
+   * Build an inverted index so search() over the same fields doesn't read
+   * every document. Stop words are not indexed and are ignored by indexed
+   * searches. A collection has at most one text index
+   *
+   * @param {Array<string>} fields - Fields to index (optional; all string fields if omitted)
+   * @returns {Promise<void>}
+   */
+  async createTextIndex(fields = []) {
+    this.db._checkOpen();
+
+    const result = tetoDBCreateTextIndex(this.db.handle, this.name, fields);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+  }
+
+  /**
+   * Copy documents matching a filter into another collection
+   *
+   * @param {string} destination - Name of the destination collection
+   * @param {object|string} filter - Filter criteria or expression (optional)
+   * @param {object} options - Copy options (optional)
+   * @param {boolean} options.preserveIds - Keep source IDs instead of generating new ones
+   * @returns {Promise<number>} - Number of documents copied
+   */
+  async copyTo(destination, filter = {}, options = {}) {
+    this.db._checkOpen();
+
+    const result = tetoDBCopyTo(this.db.handle, this.name, destination, filter, !!options.preserveIds);
 
     if (!result.success) {
       throw new Error(result.error);
@@ -346,4 +1227,118 @@ class Collection {
   }
 }
 
-module.exports = { TetoDB, Collection };
+/**
+ * Transaction class - Writes across collections made all together or not at
+ * all. Nothing reads them before commit but the transaction itself
+ *
+ * @property {number} id - ID of the transaction in the WASM module
+ * @property {TetoDB} db - Database the transaction belongs to
+ */
+class Transaction {
+  /**
+   * Use TetoDB.begin rather than constructing one directly
+   *
+   * @param {number} id - ID of the transaction in the WASM module
+   * @param {TetoDB} db - Database the transaction belongs to
+   */
+  constructor(id, db) {
+    this.id = id;
+    this.db = db;
+  }
+
+  /**
+   * Buffer an insert
+   *
+   * @param {string} collection - Collection name
+   * @param {object} document - The document to insert
+   * @returns {Promise<string>} - The document's ID
+   */
+  async insert(collection, document) {
+    this.db._checkOpen();
+
+    const result = tetoDBTxInsert(this.db.handle, this.id, collection, document);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+
+    return result.id;
+  }
+
+  /**
+   * Buffer an update
+   *
+   * @param {string} collection - Collection name
+   * @param {string} id - Document ID
+   * @param {object} update - Fields to set, or update operators
+   * @returns {Promise<void>}
+   */
+  async update(collection, id, update) {
+    this.db._checkOpen();
+
+    const result = tetoDBTxUpdate(this.db.handle, this.id, collection, id, update);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+  }
+
+  /**
+   * Buffer a deletion
+   *
+   * @param {string} collection - Collection name
+   * @param {string} id - Document ID
+   * @returns {Promise<void>}
+   */
+  async delete(collection, id) {
+    this.db._checkOpen();
+
+    const result = tetoDBTxDelete(this.db.handle, this.id, collection, id);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+  }
+
+  /**
+   * Make the buffered writes, all or none. Under snapshot isolation the
+   * error has conflict set if another write got there first; the
+   * transaction can then be retried. The transaction is finished either way
+   *
+   * @returns {Promise<void>}
+   */
+  async commit() {
+    this.db._checkOpen();
+
+    const result = tetoDBCommit(this.db.handle, this.id);
+
+    if (!result.success) {
+      const error = new Error(result.error);
+      error.conflict = !!result.conflict;
+      throw error;
+    }
+  }
+
+  /**
+   * Discard the buffered writes
+   *
+   * @returns {Promise<void>}
+   */
+  async rollback() {
+    this.db._checkOpen();
+
+    const result = tetoDBRollback(this.db.handle, this.id);
+
+    if (!result.success) {
+      throw new Error(result.error);
+    }
+  }
+}
+
+if (typeof module !== 'undefined' && module.exports) {
+  module.exports = { TetoDB, Collection, Transaction };
+} else {
+  globalThis.TetoDB = TetoDB;
+  globalThis.TetoDBCollection = Collection;
+  globalThis.TetoDBTransaction = Transaction;
+}
@@ -0,0 +1,284 @@
+/**
+ * TetoDB Web Worker client - the TetoDB API for a database running in a
+ * Web Worker (see worker.js), so queries and writes never block rendering
+ *
+ * The methods are those of TetoDB, Collection and Transaction in tetodb.js,
+ * with the same arguments and results, sent to the worker as messages. All
+ * of them return Promises, including collection-free ones the main-thread
+ * API runs synchronously: begin and watch. Load this file with a <script>
+ * tag (TetoDBWorker is then a global) or bundle it.
+ */
+
+// Methods forwarded as they are, by the object they belong to
+const databaseMethods = ['query', 'stats', 'runtimeStats', 'compact', 'changePassphrase', 'nextSequence', 'backup', 'restoreTo', 'export', 'import',
+  'listCollections', 'setFlushPolicy', 'flush'];
+const collectionMethods = ['insert', 'insertMany', 'find', 'findPage', 'explain', 'findById', 'findOne',
+  'updateById', 'updateIfVersion', 'updateWhere', 'increment', 'updateOne', 'replaceById', 'replaceOne',
+  'deleteById', 'deleteOne', 'deleteMany', 'putAttachment', 'getAttachment', 'listAttachments',
+  'deleteAttachment', 'count', 'aggregate', 'sample', 'search', 'createIndex', 'listIndexes', 'dropIndex',
+  'createGeoIndex', 'createTextIndex', 'copyTo', 'bulkWrite', 'drop'];
+const transactionMethods = ['insert', 'update', 'delete', 'commit', 'rollback'];
+
+/**
+ * TetoDBWorker class - A database in a Web Worker
+ *
+ * @property {Worker} worker - The worker running worker.js
+ * @property {boolean} isOpen - Whether a database is open
+ * @property {string|null} dbPath - Path of the open database
+ */
+class TetoDBWorker {
+  /**
+   * Start a worker, or use one already running worker.js
+   *
+   * @param {Worker|string|URL} worker - The worker, or the URL of worker.js to start one from
+   */
+  constructor(worker) {
+    this.worker = typeof worker === 'string' || worker instanceof URL ? new Worker(worker) : worker;
+    this.isOpen = false;
+    this.dbPath = null;
+    this.pending = new Map();
+    this.watches = new Map();
+    this.nextRequest = 1;
+    this.nextWatch = 1;
+
+    this.worker.onmessage = (event) => this._receive(event.data);
+    this.worker.onerror = (event) => {
+      const error = new Error(event.message || 'TetoDB worker failed');
+      for (const { reject } of this.pending.values()) {
+        reject(error);
+      }
+      this.pending.clear();
+    };
+  }
+
+  /**
+   * Load the WASM module in the worker; open does it with the default
+   * options if it hasn't been
+   *
+   * @param {object} options - Load options (optional)
+   * @param {string} options.wasmPath - URL of tetodb.wasm; by default ../wasm/tetodb.wasm relative to worker.js
+   * @returns {Promise<void>}
+   */
+  init(options = {}) {
+    return this._request('init', { wasmPath: options.wasmPath });
+  }
+
+  /**
+   * Open the worker's database (see TetoDB.open)
+   *
+   * @param {string} dbPath - Database path, e.g. 'opfs://app.db'
+   * @param {object} options - Open options, as for TetoDB.open (optional)
+   * @returns {Promise<TetoDBWorker>} - Returns this for chaining
+   */
+  async open(dbPath, options = {}) {
+    const result = await this._request('open', { path: dbPath, options });
+    this.isOpen = true;
+    this.dbPath = result.path;
+    return this;
+  }
+
+  /**
+   * Get a collection by name
+   *
+   * @param {string} name - Collection name
+   * @returns {WorkerCollection} - Collection in the worker
+   */
+  collection(name) {
+    return new WorkerCollection(name, this);
+  }
+
+  /**
+   * Start a transaction (see TetoDB.begin)
+   *
+   * @returns {Promise<WorkerTransaction>} - The transaction
+   */
+  async begin() {
+    return new WorkerTransaction(await this._request('begin'), this);
+  }
+
+  /**
+   * Call a function with every write made from now on (see TetoDB.watch)
+   *
+   * @param {function(object): void} callback - Called with each change
+   * @param {object} options - Watch options, as for TetoDB.watch (optional)
+   * @returns {Promise<function(): Promise<void>>} - Stops the watch
+   */
+  async watch(callback, options = {}) {
+    const watch = this.nextWatch++;
+    this.watches.set(watch, callback);
+    try {
+      await this._request('watch', { watch, options });
+    } catch (err) {
+      this.watches.delete(watch);
+      throw err;
+    }
+    return async () => {
+      if (this.watches.delete(watch)) {
+        await this._request('unwatch', { watch });
+      }
+    };
+  }
+
+  /**
+   * Close the database; the worker keeps running, so another can be opened
+   *
+   * @returns {Promise<void>}
+   */
+  async close() {
+    await this._request('close');
+    this.watches.clear();
+    this.isOpen = false;
+    this.dbPath = null;
+  }
+
+  /**
+   * Stop the worker, abandoning the database without closing it
+   */
+  terminate() {
+    this.worker.terminate();
+    this.watches.clear();
+    this.isOpen = false;
+  }
+
+  /**
+   * Internal helper to send a request to the worker
+   * @private
+   */
+  _request(op, payload = {}) {
+    return new Promise((resolve, reject) => {
+      const id = this.nextRequest++;
+      this.pending.set(id, { resolve, reject });
+      this.worker.postMessage({ id, op, payload });
+    });
+  }
+
+  /**
+   * Internal helper to dispatch a message from the worker
+   * @private
+   */
+  _receive(message) {
+    if (message.watch !== undefined) {
+      const callback = this.watches.get(message.watch);
+      if (callback) {
+        callback(message.change);
+      }
+      return;
+    }
+
+    const request = this.pending.get(message.id);
+    if (!request) {
+      return;
+    }
+    this.pending.delete(message.id);
+    if (message.error) {
+      const error = new Error(message.error.message);
+      error.conflict = message.error.conflict;
+      request.reject(error);
+    } else {
+      request.resolve(message.result);
+    }
+  }
+}
+
+/**
+ * WorkerCollection class - A collection of a database in a Web Worker
+ *
+ * @property {string} name - Collection name
+ * @property {TetoDBWorker} db - Database the collection belongs to
+ */
+class WorkerCollection {
+  /**
+   * Use TetoDBWorker.collection rather than constructing one directly
+   *
+   * @param {string} name - Collection name
+   * @param {TetoDBWorker} db - Database the collection belongs to
+   */
+  constructor(name, db) {
+    this.name = name;
+    this.db = db;
+  }
+
+  /**
+   * Call a function with each matching document (see Collection.findEach)
+   * The documents are found in the worker and then posted all together
+   *
+   * @param {object|string} filter - Filter criteria or expression
+   * @param {function(object): (boolean|void)} callback - Called with each document
+   * @returns {Promise<number>} - Number of documents delivered
+   */
+  async findEach(filter, callback) {
+    const docs = await this.find(filter);
+    let count = 0;
+    for (const doc of docs) {
+      count++;
+      if (callback(doc) === false) {
+        break;
+      }
+    }
+    return count;
+  }
+
+  /**
+   * Move the collection to a new name (see Collection.rename)
+   *
+   * @param {string} name - New name
+   * @returns {Promise<void>}
+   */
+  async rename(name) {
+    await this.db._request('collection', { collection: this.name, method: 'rename', args: [name] });
+    this.name = name;
+  }
+
+  /**
+   * Call a function with every write made to the collection from now on
+   * (see Collection.watch)
+   *
+   * @param {function(object): void} callback - Called with each change
+   * @param {object|string} filter - Only writes to documents matching this filter before or after the write (optional)
+   * @returns {Promise<function(): Promise<void>>} - Stops the watch
+   */
+  watch(callback, filter = {}) {
+    return this.db.watch(callback, { collection: this.name, filter });
+  }
+}
+
+/**
+ * WorkerTransaction class - A transaction of a database in a Web Worker
+ *
+ * @property {number} id - ID of the transaction in the worker
+ * @property {TetoDBWorker} db - Database the transaction belongs to
+ */
+class WorkerTransaction {
+  /**
+   * Use TetoDBWorker.begin rather than constructing one directly
+   *
+   * @param {number} id - ID of the transaction in the worker
+   * @param {TetoDBWorker} db - Database the transaction belongs to
+   */
+  constructor(id, db) {
+    this.id = id;
+    this.db = db;
+  }
+}
+
+for (const name of databaseMethods) {
+  TetoDBWorker.prototype[name] = function (...args) {
+    return this._request('db', { method: name, args });
+  };
+}
+for (const name of collectionMethods) {
+  WorkerCollection.prototype[name] = function (...args) {
+    return this.db._request('collection', { collection: this.name, method: name, args });
+  };
+}
+for (const name of transactionMethods) {
+  WorkerTransaction.prototype[name] = function (...args) {
+    return this.db._request('tx', { tx: this.id, method: name, args });
+  };
+}
+
+if (typeof module !== 'undefined' && module.exports) {
+  module.exports = { TetoDBWorker, WorkerCollection, WorkerTransaction };
+} else {
+  globalThis.TetoDBWorker = TetoDBWorker;
+}
@@ -0,0 +1,137 @@
+/**
+ * TetoDB Web Worker entry - runs the database off the main thread
+ *
+ * Start it with new Worker('src/worker.js') and talk to it through
+ * TetoDBWorker (worker-client.js), or post the messages directly:
+ *
+ *   request:  {id, op, payload}
+ *   response: {id, result} or {id, error: {message, conflict}}
+ *   change:   {watch, change}, for each write a watch reports
+ *
+ * The ops and their payloads:
+ *
+ *   init       {wasmPath}                    Load the WASM module (open does it otherwise)
+ *   open       {path, options}               Open the worker's database; result {path}
+ *   close      {}                            Close it, ending its transactions and watches
+ *   db         {method, args}                Call a TetoDB method, e.g. query or stats
+ *   collection {collection, method, args}    Call a Collection method, e.g. find
+ *   begin      {}                            Start a transaction; result is its ID
+ *   tx         {tx, method, args}            Call a Transaction method, e.g. insert or commit
+ *   watch      {watch, options}              Watch writes (see TetoDB.watch) under the ID given
+ *   unwatch    {watch}                       Stop a watch
+ *
+ * Requests are handled one at a time, in the order they were posted, so
+ * each sees the writes of the ones before it. The WASM module is fetched
+ * from ../wasm/tetodb.wasm relative to this script unless init says where.
+ * opfs:// databases can only be opened here, in a worker.
+ */
+
+importScripts('../wasm/wasm_exec.js', 'tetodb.js');
+
+const db = new TetoDB();
+const transactions = new Map();
+const watches = new Map();
+let nextTransaction = 1;
+
+// Methods that take callbacks or return objects that can't be posted; the
+// ops above stand in for them
+const unposted = new Set(['constructor', 'init', 'open', 'close', 'collection', 'begin', 'watch', 'findEach']);
+
+/**
+ * Look up a method the protocol lets messages call
+ *
+ * @param {object} target - TetoDB, Collection or Transaction
+ * @param {string} name - Method name
+ * @returns {function} - The method, bound to target
+ */
+function method(target, name) {
+  if (typeof name !== 'string' || name.startsWith('_') || unposted.has(name) || typeof target[name] !== 'function') {
+    throw new Error(`unknown method ${name}`);
+  }
+  return target[name].bind(target);
+}
+
+const ops = {
+  async init({ wasmPath }) {
+    await db.init({ wasmPath });
+  },
+
+  async open({ path, options }) {
+    await db.open(path, options);
+    return { path: db.dbPath };
+  },
+
+  async close() {
+    transactions.clear();
+    for (const stop of watches.values()) {
+      stop();
+    }
+    watches.clear();
+    await db.close();
+  },
+
+  db({ method: name, args = [] }) {
+    return method(db, name)(...args);
+  },
+
+  collection({ collection, method: name, args = [] }) {
+    return method(db.collection(collection), name)(...args);
+  },
+
+  begin() {
+    const id = nextTransaction++;
+    transactions.set(id, db.begin());
+    return id;
+  },
+
+  tx({ tx, method: name, args = [] }) {
+    const transaction = transactions.get(tx);
+    if (!transaction) {
+      throw new Error(`transaction ${tx} is not open`);
+    }
+    // Finished either way
+    if (name === 'commit' || name === 'rollback') {
+      transactions.delete(tx);
+    }
+    return method(transaction, name)(...args);
+  },
+
+  watch({ watch, options }) {
+    if (watches.has(watch)) {
+      throw new Error(`watch ${watch} already exists`);
+    }
+    watches.set(watch, db.watch(change => self.postMessage({ watch, change }), options));
+  },
+
+  unwatch({ watch }) {
+    const stop = watches.get(watch);
+    if (stop) {
+      stop();
+      watches.delete(watch);
+    }
+  },
+};
+
+/**
+ * Handle a request and post its response
+ *
+ * @param {object} message - {id, op, payload}
+ * @returns {Promise<void>}
+ */
+async function handle({ id, op, payload }) {
+  try {
+    if (!Object.prototype.hasOwnProperty.call(ops, op)) {
+      throw new Error(`unknown op ${op}`);
+    }
+    const result = await ops[op](payload || {});
+    self.postMessage({ id, result });
+  } catch (err) {
+    self.postMessage({ id, error: { message: err.message, conflict: !!err.conflict } });
+  }
+}
+
+// Chained, so requests run one after the other even when one waits
+let queue = Promise.resolve();
+self.onmessage = (event) => {
+  queue = queue.then(() => handle(event.data));
+};
@@ -0,0 +1,379 @@
+//go:build wasip1 && go1.24
+
+// The wasi module is TetoDB for server-side WebAssembly runtimes such as
+// Wasmtime and wazero, e.g. to embed in a plugin system. It is a WASI
+// reactor (build it with GOOS=wasip1 GOARCH=wasm -buildmode=c-shared) whose
+// functions take plain numbers, with strings passed as a pointer and a length:
+//
+//   - The host reserves memory with tetodb_alloc, writes a UTF-8 argument
+//     there and frees it with tetodb_free after the call
+//   - Documents, filters and options are JSON; a filter may also be a filter
+//     expression such as "age >= 18", and an empty one matches everything
+//   - Calls return 0, or -1 if they failed (tetodb_open returns the handle),
+//     and leave a JSON object at tetodb_result_ptr, tetodb_result_len bytes
+//     long: the result, or {"error": message}. It is kept until the next call
+//
+// Database files are opened through WASI, so their directory must be
+// preopened by the host. Calls must not be made concurrently
+package main
+
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/malazaysc/tetodb/engine"
+	"github.com/malazaysc/tetodb/internal/bridge"
+)
+
+// databases holds the open databases by handle
+var databases = make(map[int32]*engine.Database)
+
+// nextHandle is the handle the next database opened gets; handles aren't
+// reused, so a stale one never reaches another database
+var nextHandle int32 = 1
+
+// main does nothing: a reactor's functions are called by the host once it
+// has initialized the module
+func main() {}
+
+// lookup returns the database a handle refers to
+func lookup(handle int32) (*engine.Database, error) {
+	db, exists := databases[handle]
+	if !exists {
+		return nil, fmt.Errorf("database not open (handle %d)", handle)
+	}
+	return db, nil
+}
+
+// filterArg decodes a filter argument; empty matches everything
+func filterArg(ptr unsafe.Pointer, length uint32) (map[string]interface{}, error) {
+	if length == 0 {
+		return map[string]interface{}{}, nil
+	}
+	return bridge.ParseFilter(text(ptr, length))
+}
+
+// objectArg decodes a JSON object argument
+func objectArg(ptr unsafe.Pointer, length uint32) (map[string]interface{}, error) {
+	var object map[string]interface{}
+	if err := decode(ptr, length, &object); err != nil {
+		return nil, err
+	}
+	if object == nil {
+		return nil, fmt.Errorf("expected an object")
+	}
+	return object, nil
+}
+
+// openDatabase opens a database (see tetoDBOpen for the options)
+// Result: {handle, path}
+//
+//go:wasmexport tetodb_open
+func openDatabase(path unsafe.Pointer, pathLen uint32, options unsafe.Pointer, optionsLen uint32) int32 {
+	var opts bridge.OpenOptions
+	if err := decode(options, optionsLen, &opts); err != nil {
+		return fail(fmt.Errorf("invalid options: %w", err))
+	}
+	engineOpts, err := opts.EngineOptions()
+	if err != nil {
+		return fail(fmt.Errorf("invalid options: %w", err))
+	}
+
+	name := text(path, pathLen)
+	db, err := engine.OpenDatabase(name, engineOpts...)
+	if err != nil {
+		return fail(fmt.Errorf("failed to open database: %w", err))
+	}
+
+	handle := nextHandle
+	nextHandle++
+	databases[handle] = db
+	succeed(map[string]interface{}{
+		"handle": handle,
+		"path":   name,
+	})
+	return handle
+}
+
+// closeDatabase closes a database, after which its handle is invalid
+//
+//go:wasmexport tetodb_close
+func closeDatabase(handle int32) int32 {
+	db, err := lookup(handle)
+	if err != nil {
+		return fail(err)
+	}
+
+	delete(databases, handle)
+	if err := db.Close(); err != nil {
+		return fail(fmt.Errorf("failed to close database: %w", err))
+	}
+	return succeed(map[string]interface{}{})
+}
+
+// insertDocument inserts a document into a collection
+// Result: {id}
+//
+//go:wasmexport tetodb_insert
+func insertDocument(handle int32, collection unsafe.Pointer, collectionLen uint32, doc unsafe.Pointer, docLen uint32) int32 {
+	db, err := lookup(handle)
+	if err != nil {
+		return fail(err)
+	}
+
+	document, err := objectArg(doc, docLen)
+	if err != nil {
+		return fail(fmt.Errorf("invalid document: %w", err))
+	}
+
+	id, err := db.GetCollection(text(collection, collectionLen)).Insert(document)
+	if err != nil {
+		return fail(fmt.Errorf("insert failed: %w", err))
+	}
+	return succeed(map[string]interface{}{"id": id})
+}
+
+// insertDocuments inserts a JSON array of documents as one batch
+// Result: {ids}
+//
+//go:wasmexport tetodb_insert_many
+func insertDocuments(handle int32, collection unsafe.Pointer, collectionLen uint32, docs unsafe.Pointer, docsLen uint32) int32 {
+	db, err := lookup(handle)
+	if err != nil {
+		return fail(err)
+	}
+
+	var documents []map[string]interface{}
+	if err := decode(docs, docsLen, &documents); err != nil {
+		return fail(fmt.Errorf("invalid documents: %w", err))
+	}
+
+	ids, err := db.GetCollection(text(collection, collectionLen)).InsertMany(documents)
+	if err != nil {
+		return fail(fmt.Errorf("insert failed: %w", err))
+	}
+	return succeed(map[string]interface{}{"ids": ids})
+}
+
+// findDocuments finds the documents matching a filter (see tetoDBFind for
+// the options; paginate isn't supported)
+// Result: {documents, count}
+//
+//go:wasmexport tetodb_find
+func findDocuments(handle int32, collection unsafe.Pointer, collectionLen uint32, filter unsafe.Pointer, filterLen uint32, options unsafe.Pointer, optionsLen uint32) int32 {
+	db, err := lookup(handle)
+	if err != nil {
+		return fail(err)
+	}
+
+	criteria, err := filterArg(filter, filterLen)
+	if err != nil {
+		return fail(fmt.Errorf("invalid filter: %w", err))
+	}
+	var opts bridge.FindOptions
+	if err := decode(options, optionsLen, &opts); err != nil {
+		return fail(fmt.Errorf("invalid options: %w", err))
+	}
+	findOpts, err := opts.EngineOptions()
+	if err != nil {
+		return fail(fmt.Errorf("invalid options: %w", err))
+	}
+
+	ctx, cancel := bridge.QueryContext(opts.TimeoutMs)
+	defer cancel()
+
+	docs, err := db.GetCollection(text(collection, collectionLen)).FindContext(ctx, criteria, findOpts)
+	if err != nil {
+		return fail(fmt.Errorf("find failed: %w", err))
+	}
+	return succeed(map[string]interface{}{
+		"documents": docs,
+		"count":     len(docs),
+	})
+}
+
+// findDocumentByID finds a document by its ID
+// Result: {document}, with document null if there is none
+//
+//go:wasmexport tetodb_find_by_id
+func findDocumentByID(handle int32, collection unsafe.Pointer, collectionLen uint32, id unsafe.Pointer, idLen uint32) int32 {
+	db, err := lookup(handle)
+	if err != nil {
+		return fail(err)
+	}
+
+	doc := db.GetCollection(text(collection, collectionLen)).FindByID(text(id, idLen))
+	return succeed(map[string]interface{}{"document": doc})
+}
+
+// updateDocument applies an update (fields to set, or operators such as
+// $set and $inc) to a document
+//
+//go:wasmexport tetodb_update
+func updateDocument(handle int32, collection unsafe.Pointer, collectionLen uint32, id unsafe.Pointer, idLen uint32, update unsafe.Pointer, updateLen uint32) int32 {
+	db, err := lookup(handle)
+	if err != nil {
+		return fail(err)
+	}
+
+	changes, err := objectArg(update, updateLen)
+	if err != nil {
+		return fail(fmt.Errorf("invalid update: %w", err))
+	}
+
+	if err := db.GetCollection(text(collection, collectionLen)).Update(text(id, idLen), changes); err != nil {
+		return fail(fmt.Errorf("update failed: %w", err))
+	}
+	return succeed(map[string]interface{}{})
+}
+
+// replaceDocument replaces a document as a whole
+//
+//go:wasmexport tetodb_replace
+func replaceDocument(handle int32, collection unsafe.Pointer, collectionLen uint32, id unsafe.Pointer, idLen uint32, doc unsafe.Pointer, docLen uint32) int32 {
+	db, err := lookup(handle)
+	if err != nil {
+		return fail(err)
+	}
+
+	document, err := objectArg(doc, docLen)
+	if err != nil {
+		return fail(fmt.Errorf("invalid document: %w", err))
+	}
+
+	if err := db.GetCollection(text(collection, collectionLen)).Replace(text(id, idLen), document); err != nil {
+		return fail(fmt.Errorf("replace failed: %w", err))
+	}
+	return succeed(map[string]interface{}{})
+}
+
+// deleteDocument deletes a document
+//
+//go:wasmexport tetodb_delete
+func deleteDocument(handle int32, collection unsafe.Pointer, collectionLen uint32, id unsafe.Pointer, idLen uint32) int32 {
+	db, err := lookup(handle)
+	if err != nil {
+		return fail(err)
+	}
+
+	if err := db.GetCollection(text(collection, collectionLen)).Delete(text(id, idLen)); err != nil {
+		return fail(fmt.Errorf("delete failed: %w", err))
+	}
+	return succeed(map[string]interface{}{})
+}
+
+// countDocuments counts the documents matching a filter
+// Result: {count}
+//
+//go:wasmexport tetodb_count
+func countDocuments(handle int32, collection unsafe.Pointer, collectionLen uint32, filter unsafe.Pointer, filterLen uint32) int32 {
+	db, err := lookup(handle)
+	if err != nil {
+		return fail(err)
+	}
+
+	criteria, err := filterArg(filter, filterLen)
+	if err != nil {
+		return fail(fmt.Errorf("invalid filter: %w", err))
+	}
+
+	count := db.GetCollection(text(collection, collectionLen)).CountWhere(criteria)
+	return succeed(map[string]interface{}{"count": count})
+}
+
+// aggregateDocuments runs a JSON array of pipeline stages
+// Result: {documents}
+//
+//go:wasmexport tetodb_aggregate
+func aggregateDocuments(handle int32, collection unsafe.Pointer, collectionLen uint32, pipeline unsafe.Pointer, pipelineLen uint32) int32 {
+	db, err := lookup(handle)
+	if err != nil {
+		return fail(err)
+	}
+
+	var stages []map[string]interface{}
+	if err := decode(pipeline, pipelineLen, &stages); err != nil {
+		return fail(fmt.Errorf("invalid pipeline: %w", err))
+	}
+
+	docs, err := db.GetCollection(text(collection, collectionLen)).Aggregate(stages)
+	if err != nil {
+		return fail(fmt.Errorf("aggregate failed: %w", err))
+	}
+	return succeed(map[string]interface{}{"documents": docs})
+}
+
+// runQuery runs a SQL query (see engine.Database.Query)
+// Result: {rows}
+//
+//go:wasmexport tetodb_query
+func runQuery(handle int32, sql unsafe.Pointer, sqlLen uint32) int32 {
+	db, err := lookup(handle)
+	if err != nil {
+		return fail(err)
+	}
+
+	rows, err := db.Query(text(sql, sqlLen))
+	if err != nil {
+		return fail(fmt.Errorf("query failed: %w", err))
+	}
+	return succeed(map[string]interface{}{"rows": rows})
+}
+
+// createIndex indexes a field (dot notation allowed)
+//
+//go:wasmexport tetodb_create_index
+func createIndex(handle int32, collection unsafe.Pointer, collectionLen uint32, field unsafe.Pointer, fieldLen uint32) int32 {
+	db, err := lookup(handle)
+	if err != nil {
+		return fail(err)
+	}
+
+	if err := db.GetCollection(text(collection, collectionLen)).CreateIndex(text(field, fieldLen)); err != nil {
+		return fail(fmt.Errorf("create index failed: %w", err))
+	}
+	return succeed(map[string]interface{}{})
+}
+
+// dropIndex removes the index of a field
+//
+//go:wasmexport tetodb_drop_index
+func dropIndex(handle int32, collection unsafe.Pointer, collectionLen uint32, field unsafe.Pointer, fieldLen uint32) int32 {
+	db, err := lookup(handle)
+	if err != nil {
+		return fail(err)
+	}
+
+	if err := db.GetCollection(text(collection, collectionLen)).DropIndex(text(field, fieldLen)); err != nil {
+		return fail(fmt.Errorf("drop index failed: %w", err))
+	}
+	return succeed(map[string]interface{}{})
+}
+
+// getStats reports database statistics (see engine.Database.Stats)
+// Result: {stats}
+//
+//go:wasmexport tetodb_stats
+func getStats(handle int32) int32 {
+	db, err := lookup(handle)
+	if err != nil {
+		return fail(err)
+	}
+
+	return succeed(map[string]interface{}{"stats": db.Stats()})
+}
+
+// compactDatabase compacts the database file
+//
+//go:wasmexport tetodb_compact
+func compactDatabase(handle int32) int32 {
+	db, err := lookup(handle)
+	if err != nil {
+		return fail(err)
+	}
+
+	if err := db.Compact(); err != nil {
+		return fail(fmt.Errorf("compact failed: %w", err))
+	}
+	return succeed(map[string]interface{}{})
+}
@@ -0,0 +1,83 @@
+//go:build wasip1 && go1.24
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"unsafe"
+)
+
+// allocations keeps the buffers tetodb_alloc handed to the host alive until
+// it frees them
+var allocations = make(map[unsafe.Pointer][]byte)
+
+// result holds the JSON the last call produced, until the next call
+var result []byte
+
+// alloc reserves size bytes of linear memory for the host to write an
+// argument into; the host frees them with tetodb_free once the call it
+// passed them to has returned
+//
+//go:wasmexport tetodb_alloc
+func alloc(size uint32) unsafe.Pointer {
+	buf := make([]byte, max(size, 1))
+	ptr := unsafe.Pointer(unsafe.SliceData(buf))
+	allocations[ptr] = buf
+	return ptr
+}
+
+// free releases memory tetodb_alloc reserved
+//
+//go:wasmexport tetodb_free
+func free(ptr unsafe.Pointer) {
+	delete(allocations, ptr)
+}
+
+// resultPtr returns where the last call's result is
+//
+//go:wasmexport tetodb_result_ptr
+func resultPtr() unsafe.Pointer {
+	return unsafe.Pointer(unsafe.SliceData(result))
+}
+
+// resultLen returns the length of the last call's result in bytes
+//
+//go:wasmexport tetodb_result_len
+func resultLen() uint32 {
+	return uint32(len(result))
+}
+
+// succeed sets the result of a call that worked and returns its status
+func succeed(data map[string]interface{}) int32 {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return fail(fmt.Errorf("failed to encode result: %w", err))
+	}
+	result = encoded
+	return 0
+}
+
+// fail sets the result of a call that failed to {"error": message} and
+// returns its status
+func fail(err error) int32 {
+	result, _ = json.Marshal(map[string]string{"error": err.Error()})
+	return -1
+}
+
+// text copies the string of length bytes the host wrote at ptr
+func text(ptr unsafe.Pointer, length uint32) string {
+	if length == 0 {
+		return ""
+	}
+	return string(unsafe.Slice((*byte)(ptr), length))
+}
+
+// decode decodes the JSON the host wrote at ptr into target; an empty
+// argument leaves target as it is
+func decode(ptr unsafe.Pointer, length uint32, target interface{}) error {
+	if length == 0 {
+		return nil
+	}
+	return json.Unmarshal(unsafe.Slice((*byte)(ptr), length), target)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"syscall/js"
+)
+
+// adapterSink keeps a bufferedStorage's log with a storage adapter passed to
+// tetoDBOpen: a JavaScript object whose functions store the log as text, in
+// the JSON-lines format file databases use, wherever the application wants
+// (localStorage, a native file system, a remote API, ...):
+//
+//	read()          The log written so far: a string, a Uint8Array or ArrayBuffer, or null if there is none
+//	append(text)    Add lines to the end of the log
+//	replace(text)   Replace the whole log (after compaction)
+//	close()         Optional; called once everything has been written
+//
+// Each may return its result or a Promise of it, and fails by throwing or
+// rejecting. They are called one at a time, from outside exported calls
+type adapterSink struct {
+	adapter js.Value
+}
+
+// openAdapterStorage loads the log a storage adapter holds
+// It waits on the adapter, so must not run inside an exported call
+func openAdapterStorage(adapter js.Value) (*bufferedStorage, error) {
+	for _, name := range []string{"read", "append", "replace"} {
+		if adapter.Get(name).Type() != js.TypeFunction {
+			return nil, fmt.Errorf("storage adapter has no %s function", name)
+		}
+	}
+
+	value, err := callAdapter(adapter, "read")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from the storage adapter: %w", err)
+	}
+	data, err := adapterData(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 && data[0] != '{' {
+		return nil, fmt.Errorf("storage adapter data is not a JSON-lines log")
+	}
+	return newBufferedStorage(decodeJSONLines(data), adapterSink{adapter: adapter}, "the storage adapter")
+}
+
+// adapterData converts what an adapter's read returned to the log's bytes
+func adapterData(value js.Value) ([]byte, error) {
+	switch {
+	case value.IsUndefined() || value.IsNull():
+		return nil, nil
+	case value.Type() == js.TypeString:
+		return []byte(value.String()), nil
+	case value.InstanceOf(js.Global().Get("ArrayBuffer")):
+		value = js.Global().Get("Uint8Array").New(value)
+	case !value.InstanceOf(js.Global().Get("Uint8Array")):
+		return nil, fmt.Errorf("storage adapter read must return a string, a Uint8Array or an ArrayBuffer")
+	}
+	data := make([]byte, value.Get("length").Int())
+	js.CopyBytesToGo(data, value)
+	return data, nil
+}
+
+// write hands the writes to the adapter in one call: an append, or a
+// replace if one of them replaces the log, as everything before it is then
+// superseded
+func (sink adapterSink) write(writes []logWrite) error {
+	var text []byte
+	replace := false
+	for _, write := range writes {
+		if write.replace {
+			text, replace = nil, true
+		}
+		for _, record := range write.records {
+			data, err := json.Marshal(record)
+			if err != nil {
+				return fmt.Errorf("failed to marshal record: %w", err)
+			}
+			text = append(append(text, data...), '\n')
+		}
+	}
+
+	method := "append"
+	if replace {
+		method = "replace"
+	} else if len(text) == 0 {
+		return nil
+	}
+	_, err := callAdapter(sink.adapter, method, string(text))
+	return err
+}
+
+// close calls the adapter's close function, if it has one
+func (sink adapterSink) close() {
+	if sink.adapter.Get("close").Type() != js.TypeFunction {
+		return
+	}
+	if _, err := callAdapter(sink.adapter, "close"); err != nil {
+		fmt.Printf("Warning: failed to close the storage adapter: %v\n", err)
+	}
+}
+
+// callAdapter calls a function of a storage adapter and waits for its
+// result if it returns a Promise (any thenable)
+func callAdapter(adapter js.Value, method string, args ...interface{}) (result js.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	result = adapter.Call(method, args...)
+	if result.Type() == js.TypeObject && result.Get("then").Type() == js.TypeFunction {
+		return awaitPromise(result)
+	}
+	return result, nil
+}
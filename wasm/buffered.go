@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/malazaysc/tetodb/engine"
+)
+
+// bufferedStorage is a storage engine whose log lives in memory and is
+// copied to a sink in the background (IndexedDB, or a JavaScript storage
+// adapter), the writes made since the last flush going to the sink together
+// Sinks are asynchronous and exported calls can't wait on JavaScript, so
+// writes return before they are durable; Close hands back a channel that is
+// closed once everything has been flushed. A flush policy (see
+// tetoDBSetFlushPolicy) can hold writes back so more of them share one
+type bufferedStorage struct {
+	*engine.MemoryStorage
+	sink logSink
+	kind string // What the sink is, for errors, e.g. "IndexedDB"
+
+	mu      sync.Mutex
+	pending []logWrite    // Writes not yet handed to the sink
+	waiters []chan error  // Told the outcome once the pending writes have been flushed (see flushNow)
+	err     error         // First failed flush; later writes fail with it
+	wake    chan struct{} // Signals the flusher that writes are pending
+	done    chan struct{} // Closed once the flusher has written everything and exited
+	closed  bool
+	mode    flushMode  // When writes are handed to the flusher
+	timer   flushTimer // Wakes the flusher in flushInterval mode
+}
+
+// logWrite is a batch of records for a sink
+type logWrite struct {
+	records []engine.StorageRecord
+	replace bool // Replace everything written before (compaction)
+}
+
+// logSink is where a bufferedStorage copies its log. Its methods are only
+// called by the flusher, outside exported calls, so they may wait on
+// JavaScript
+type logSink interface {
+	// write applies writes in order, in a single transaction if the sink has them
+	write(writes []logWrite) error
+	// close releases the sink once everything has been written
+	close()
+}
+
+// newBufferedStorage starts a buffered storage over the log already loaded
+// from its sink
+func newBufferedStorage(records []engine.StorageRecord, sink logSink, kind string) (*bufferedStorage, error) {
+	memory, err := engine.NewMemoryStorageFrom(records)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &bufferedStorage{
+		MemoryStorage: memory,
+		sink:          sink,
+		kind:          kind,
+		wake:          make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+	go s.flusher()
+	return s, nil
+}
+
+// Append adds a record to the log and queues it for the sink
+func (s *bufferedStorage) Append(record engine.StorageRecord) (uint64, error) {
+	if err := s.failed(); err != nil {
+		return 0, err
+	}
+	seq, err := s.MemoryStorage.Append(record)
+	if err != nil {
+		return 0, err
+	}
+	record.Seq = seq
+	s.queue(logWrite{records: []engine.StorageRecord{record}})
+	return seq, nil
+}
+
+// AppendBatch adds several records to the log and queues them for the sink
+func (s *bufferedStorage) AppendBatch(records []engine.StorageRecord) error {
+	if err := s.failed(); err != nil {
+		return err
+	}
+	if err := s.MemoryStorage.AppendBatch(records); err != nil {
+		return err
+	}
+	s.queue(logWrite{records: append([]engine.StorageRecord(nil), records...)})
+	return nil
+}
+
+// Compact rewrites the log and queues replacing the sink's contents
+func (s *bufferedStorage) Compact(records []engine.StorageRecord) error {
+	if err := s.failed(); err != nil {
+		return err
+	}
+	if err := s.MemoryStorage.Compact(records); err != nil {
+		return err
+	}
+	log, err := s.MemoryStorage.LoadAll()
+	if err != nil {
+		return err
+	}
+	s.queue(logWrite{records: log, replace: true})
+	return nil
+}
+
+// Sync asks the flusher to write pending records now; it can't wait for them
+func (s *bufferedStorage) Sync() error {
+	s.signal()
+	return s.failed()
+}
+
+// Close stops accepting writes; the flusher writes what is pending, closes
+// the sink and then closes the channel Flushed returns
+func (s *bufferedStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		s.timer.reset(0, nil)
+		close(s.wake)
+	}
+	return nil
+}
+
+// Flushed returns a channel closed once the storage is closed and every
+// write has reached the sink
+func (s *bufferedStorage) Flushed() <-chan struct{} {
+	return s.done
+}
+
+// failed returns the error of a failed flush, if any, or an error after Close
+func (s *bufferedStorage) failed() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("storage is closed")
+	}
+	return s.err
+}
+
+// queue adds a write for the flusher, waking it unless the flush policy
+// defers the write
+func (s *bufferedStorage) queue(write logWrite) {
+	s.mu.Lock()
+	s.pending = append(s.pending, write)
+	deferred := s.mode != flushEachWrite
+	s.mu.Unlock()
+	if !deferred {
+		s.signal()
+	}
+}
+
+// setFlushPolicy changes when queued writes wake the flusher
+func (s *bufferedStorage) setFlushPolicy(mode flushMode, interval time.Duration) {
+	s.mu.Lock()
+	s.mode = mode
+	s.timer.reset(interval, s.signal)
+	s.mu.Unlock()
+	if mode == flushEachWrite {
+		s.signal()
+	}
+}
+
+// flushNow wakes the flusher; the channel receives the outcome once it has
+// written everything queued so far
+func (s *bufferedStorage) flushNow() <-chan error {
+	done := make(chan error, 1)
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		done <- fmt.Errorf("storage is closed")
+		return done
+	}
+	s.waiters = append(s.waiters, done)
+	s.mu.Unlock()
+	s.signal()
+	return done
+}
+
+// signal wakes the flusher without waiting for it
+func (s *bufferedStorage) signal() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default: // A wake-up is already pending
+	}
+}
+
+// flusher copies queued writes to the sink until the storage is closed
+func (s *bufferedStorage) flusher() {
+	defer close(s.done)
+	defer s.sink.close()
+
+	for range s.wake {
+		s.flush()
+	}
+	s.flush()
+}
+
+// flush hands everything queued so far to the sink at once
+func (s *bufferedStorage) flush() {
+	s.mu.Lock()
+	writes, waiters := s.pending, s.waiters
+	s.pending, s.waiters = nil, nil
+	s.mu.Unlock()
+
+	if len(writes) > 0 {
+		if err := s.sink.write(writes); err != nil {
+			s.mu.Lock()
+			if s.err == nil {
+				s.err = fmt.Errorf("failed to write to %s: %w", s.kind, err)
+			}
+			s.mu.Unlock()
+		}
+	}
+
+	s.mu.Lock()
+	err := s.err
+	s.mu.Unlock()
+	for _, done := range waiters {
+		done <- err
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"syscall/js"
+	"time"
+)
+
+// flushMode says when a browser storage engine writes what the database
+// wrote to the browser's storage
+type flushMode int
+
+const (
+	flushEachWrite flushMode = iota // As each write is made (the default)
+	flushInterval                   // On a timer, the writes in between landing together
+	flushManual                     // Only on tetoDBFlush and when the database is closed
+)
+
+// flushModes maps the modes tetoDBSetFlushPolicy accepts
+var flushModes = map[string]flushMode{
+	"write":    flushEachWrite,
+	"interval": flushInterval,
+	"manual":   flushManual,
+}
+
+// flushPolicy mirrors the policy object accepted by tetoDBSetFlushPolicy
+type flushPolicy struct {
+	Mode       string `json:"mode"`
+	IntervalMs int    `json:"intervalMs"`
+}
+
+// flushingStorage is a browser storage engine whose flushes can be deferred,
+// so that a burst of writes costs one write to the browser's storage
+type flushingStorage interface {
+	// setFlushPolicy changes when writes are flushed; those pending are
+	// flushed straight away when the mode becomes flushEachWrite
+	setFlushPolicy(mode flushMode, interval time.Duration)
+	// flushNow flushes every pending write; the channel receives the outcome
+	// once it is known, which for IndexedDB and adapters is after the
+	// exported call returns
+	flushNow() <-chan error
+}
+
+// flushTimer calls a storage engine's flush on an interval
+type flushTimer struct {
+	stop chan struct{} // Stops the running timer; nil if none runs
+}
+
+// reset stops the running timer and, for a positive interval, starts one
+// calling flush; the storage's lock must be held, and flush not need it
+// held, as it runs on a goroutine of its own
+func (t *flushTimer) reset(interval time.Duration, flush func()) {
+	if t.stop != nil {
+		close(t.stop)
+		t.stop = nil
+	}
+	if interval <= 0 {
+		return
+	}
+
+	stop := make(chan struct{})
+	t.stop = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				flush()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// setFlushPolicy changes when an IndexedDB, OPFS or storage adapter database
+// writes to its storage, e.g. to batch a burst of inserts into one write
+// Writes the database makes are seen by its reads straight away whatever the
+// policy; only their reaching the browser's storage is deferred, so writes
+// not yet flushed are lost if the page is closed without tetoDBFlush or
+// tetoDBClose. The policy lasts until the database is closed
+// Args: [handle number, policy object|string ({mode: 'write'|'interval'|'manual', intervalMs: number})]
+// Returns: {success: bool, error: string}
+func setFlushPolicy(this js.Value, args []js.Value) interface{} {
+	inst, args, err := lookupHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 1 {
+		return makeError("missing policy argument")
+	}
+
+	var policy flushPolicy
+	if err := decodeArg(args[0], &policy); err != nil {
+		return makeError(fmt.Sprintf("invalid policy: %v", err))
+	}
+	mode, known := flushModes[policy.Mode]
+	if !known {
+		return makeError(fmt.Sprintf("invalid policy: unknown mode %q (use write, interval or manual)", policy.Mode))
+	}
+	var interval time.Duration
+	if mode == flushInterval {
+		if policy.IntervalMs <= 0 {
+			return makeError("invalid policy: interval mode needs a positive intervalMs")
+		}
+		interval = time.Duration(policy.IntervalMs) * time.Millisecond
+	}
+
+	if inst.flushes == nil {
+		return makeError("flush policies are only supported for IndexedDB, OPFS and storage adapter databases")
+	}
+	inst.flushes.setFlushPolicy(mode, interval)
+
+	return makeSuccess(map[string]interface{}{
+		"message": "Flush policy set successfully",
+	})
+}
+
+// flushDatabase writes every pending write to the browser's storage (or the
+// storage adapter), e.g. on visibilitychange or beforeunload; other
+// databases are synced to disk
+// Args: [handle number]
+// Returns: {success: bool, error: string}
+// For IndexedDB and adapter databases with writes in flight it returns a
+// Promise of the result, resolved once they have landed
+func flushDatabase(this js.Value, args []js.Value) interface{} {
+	inst, _, err := lookupHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	outcome := func(err error) interface{} {
+		if err != nil {
+			return makeError(fmt.Sprintf("flush failed: %v", err))
+		}
+		return makeSuccess(map[string]interface{}{
+			"message": "Database flushed successfully",
+		})
+	}
+	if inst.flushes == nil {
+		return outcome(inst.db.Sync())
+	}
+
+	done := inst.flushes.flushNow()
+	select {
+	case err := <-done:
+		return outcome(err)
+	default:
+		return newPromise(func() interface{} {
+			return outcome(<-done)
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"syscall/js"
+
+	"github.com/malazaysc/tetodb/engine"
+)
+
+// instance is a database opened with tetoDBOpen
+type instance struct {
+	db      *engine.Database
+	storage *bufferedStorage   // Storage of a database opened from IndexedDB or an adapter, whose writes closing waits for; nil for others
+	flushes flushingStorage    // Storage whose flushes tetoDBSetFlushPolicy can defer (IndexedDB, OPFS, adapters); nil for others
+	watches map[int]*watcher   // Watches registered with tetoDBWatch, by ID
+	txs     map[int]*engine.Tx // Transactions started with tetoDBBegin and not yet finished, by ID
+}
+
+// instances holds the open databases by handle, so a page can have several
+// open at once. It is only used inside the operation queue (see serialized),
+// so it needs no lock of its own
+var instances = make(map[int]*instance)
+
+// nextHandle is the handle the next database opened gets; handles aren't
+// reused, so a stale one never reaches another database
+var nextHandle = 1
+
+// register adds an opened database to the registry and returns its handle
+func register(db *engine.Database, storage engine.StorageEngine) int {
+	handle := nextHandle
+	nextHandle++
+	browserStorage, _ := storage.(*bufferedStorage)
+	flushes, _ := storage.(flushingStorage)
+	instances[handle] = &instance{db: db, storage: browserStorage, flushes: flushes}
+	return handle
+}
+
+// openHandle looks up the database whose handle is the first argument of an
+// exported call, and returns it with the remaining arguments
+func openHandle(args []js.Value) (*engine.Database, []js.Value, error) {
+	inst, args, err := lookupHandle(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	return inst.db, args, nil
+}
+
+// lookupHandle is openHandle returning the whole instance
+func lookupHandle(args []js.Value) (*instance, []js.Value, error) {
+	if len(args) < 1 || args[0].Type() != js.TypeNumber {
+		return nil, nil, fmt.Errorf("missing database handle")
+	}
+	handle := args[0].Int()
+	inst, exists := instances[handle]
+	if !exists {
+		return nil, nil, fmt.Errorf("database not open (handle %d)", handle)
+	}
+	return inst, args[1:], nil
+}
+
+// close closes a registered database, stopping its watches, and removes it
+// from the registry
+// The returned channel is closed once its IndexedDB or adapter writes have
+// landed; nil if it has no such writes to wait for
+func (inst *instance) close(handle int) (<-chan struct{}, error) {
+	if err := inst.db.Close(); err != nil {
+		return nil, err
+	}
+	for _, w := range inst.watches {
+		w.close()
+	}
+	delete(instances, handle)
+	if inst.storage == nil {
+		return nil, nil
+	}
+	return inst.storage.Flushed(), nil
+}
+
+// closeAllDatabases closes every open database, e.g. when a page unloads
+// Args: []
+// Returns: {success: bool, closed: int, error: string}
+// Every database is closed even if one fails; error names the failures
+func closeAllDatabases(this js.Value, args []js.Value) interface{} {
+	handles := make([]int, 0, len(instances))
+	for handle := range instances {
+		handles = append(handles, handle)
+	}
+	sort.Ints(handles)
+
+	var failures []string
+	var flushed []<-chan struct{}
+	closed := 0
+	for _, handle := range handles {
+		done, err := instances[handle].close(handle)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("handle %d: %v", handle, err))
+			continue
+		}
+		closed++
+		if done != nil {
+			flushed = append(flushed, done)
+		}
+	}
+
+	result := makeSuccess(map[string]interface{}{
+		"closed": closed,
+	})
+	if len(failures) > 0 {
+		result = makeError(fmt.Sprintf("close failed: %v", failures))
+		result["closed"] = closed
+	}
+
+	// IndexedDB writes may still be in flight; resolve once they have landed
+	if len(flushed) > 0 {
+		return newPromise(func() interface{} {
+			for _, done := range flushed {
+				<-done
+			}
+			return result
+		})
+	}
+	return result
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"syscall/js"
+
+	"github.com/malazaysc/tetodb/engine"
+)
+
+// idbScheme prefixes database paths kept in IndexedDB, e.g. "indexeddb://notes"
+const idbScheme = "indexeddb://"
+
+// idbStore is the object store holding the log, keyed by sequence number
+const idbStore = "records"
+
+// idbSink keeps a bufferedStorage's log in an IndexedDB object store, one
+// record per key, so browser pages get a database that survives reloads
+type idbSink struct {
+	idb js.Value // Open IDBDatabase
+}
+
+// openIDBStorage opens (or creates) an IndexedDB database and loads its log
+// It waits on IndexedDB, so must not run inside an exported call
+func openIDBStorage(name string) (*bufferedStorage, error) {
+	factory := js.Global().Get("indexedDB")
+	if factory.IsUndefined() {
+		return nil, fmt.Errorf("IndexedDB is not available in this environment")
+	}
+
+	request := factory.Call("open", name, 1)
+	upgrade := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		request.Get("result").Call("createObjectStore", idbStore)
+		return nil
+	})
+	request.Set("onupgradeneeded", upgrade)
+	result, err := idbWait(request, "onsuccess", "onerror")
+	request.Set("onupgradeneeded", js.Null())
+	upgrade.Release()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open IndexedDB database %q: %w", name, err)
+	}
+
+	records, err := idbLoad(result)
+	if err != nil {
+		result.Call("close")
+		return nil, err
+	}
+	s, err := newBufferedStorage(records, idbSink{idb: result}, "IndexedDB")
+	if err != nil {
+		result.Call("close")
+		return nil, err
+	}
+	return s, nil
+}
+
+// idbLoad reads every record in the object store, in sequence order
+func idbLoad(idb js.Value) ([]engine.StorageRecord, error) {
+	request := idb.Call("transaction", idbStore, "readonly").Call("objectStore", idbStore).Call("getAll")
+	values, err := idbWait(request, "onsuccess", "onerror")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read IndexedDB records: %w", err)
+	}
+
+	records := make([]engine.StorageRecord, 0, values.Length())
+	for i := 0; i < values.Length(); i++ {
+		var record engine.StorageRecord
+		if err := json.Unmarshal([]byte(values.Index(i).String()), &record); err != nil {
+			fmt.Printf("Warning: failed to parse record: %v\n", err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// write applies writes to the object store in a single transaction
+func (sink idbSink) write(writes []logWrite) error {
+	return idbPut(sink.idb, writes)
+}
+
+// close closes the IndexedDB database
+func (sink idbSink) close() {
+	sink.idb.Call("close")
+}
+
+// idbPut applies writes to the object store in a single transaction
+func idbPut(idb js.Value, writes []logWrite) error {
+	tx := idb.Call("transaction", idbStore, "readwrite")
+	store := tx.Call("objectStore", idbStore)
+	for _, write := range writes {
+		if write.replace {
+			store.Call("clear")
+		}
+		for _, record := range write.records {
+			data, err := json.Marshal(record)
+			if err != nil {
+				tx.Call("abort")
+				return fmt.Errorf("failed to marshal record: %w", err)
+			}
+			store.Call("put", string(data), record.Seq)
+		}
+	}
+	_, err := idbWait(tx, "oncomplete", "onabort")
+	return err
+}
+
+// idbWait waits for an IndexedDB request or transaction to fire its success
+// or failure event, returning the request's result
+func idbWait(target js.Value, success, failure string) (js.Value, error) {
+	done := make(chan error, 1)
+	onSuccess := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		done <- nil
+		return nil
+	})
+	onFailure := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		done <- fmt.Errorf("%s", idbError(target.Get("error")))
+		return nil
+	})
+	target.Set(success, onSuccess)
+	target.Set(failure, onFailure)
+
+	err := <-done
+	target.Set(success, js.Null())
+	target.Set(failure, js.Null())
+	onSuccess.Release()
+	onFailure.Release()
+	if err != nil {
+		return js.Undefined(), err
+	}
+	return target.Get("result"), nil
+}
+
+// idbError describes a DOMException from IndexedDB
+func idbError(err js.Value) string {
+	if err.IsNull() || err.IsUndefined() {
+		return "transaction aborted"
+	}
+	return err.Get("name").String() + ": " + err.Get("message").String()
+}
+
+// isIDBPath reports whether a database path names an IndexedDB database
+func isIDBPath(path string) bool {
+	return strings.HasPrefix(path, idbScheme)
+}
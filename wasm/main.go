@@ -1,15 +1,21 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"syscall/js"
+	"time"
 
 	"github.com/malazaysc/tetodb/engine"
+	"github.com/malazaysc/tetodb/internal/bridge"
 )
 
-// Global database instance
-var db *engine.Database
+// ops serializes every exported call, so a call always observes the writes
+// of calls made before it, even if the bridge later becomes asynchronous
+var ops = engine.NewOpQueue(64)
 
 // main is the entry point for the WASM module
 // It registers JavaScript functions and keeps the Go runtime alive
@@ -17,16 +23,58 @@ func main() {
 	fmt.Println("TetoDB WASM module loaded")
 
 	// Register JavaScript functions
-	js.Global().Set("tetoDBOpen", js.FuncOf(openDatabase))
-	js.Global().Set("tetoDBInsert", js.FuncOf(insertDocument))
-	js.Global().Set("tetoDBFind", js.FuncOf(findDocuments))
-	js.Global().Set("tetoDBFindByID", js.FuncOf(findDocumentByID))
-	js.Global().Set("tetoDBUpdate", js.FuncOf(updateDocument))
-	js.Global().Set("tetoDBDelete", js.FuncOf(deleteDocument))
-	js.Global().Set("tetoDBCount", js.FuncOf(countDocuments))
-	js.Global().Set("tetoDBStats", js.FuncOf(getStats))
-	js.Global().Set("tetoDBCompact", js.FuncOf(compactDatabase))
-	js.Global().Set("tetoDBClose", js.FuncOf(closeDatabase))
+	js.Global().Set("tetoDBOpen", js.FuncOf(serialized(openDatabase)))
+	js.Global().Set("tetoDBInsert", js.FuncOf(serialized(insertDocument)))
+	js.Global().Set("tetoDBInsertMany", js.FuncOf(serialized(insertDocuments)))
+	js.Global().Set("tetoDBFind", js.FuncOf(serialized(findDocuments)))
+	js.Global().Set("tetoDBFindEach", js.FuncOf(findEachDocument))
+	js.Global().Set("tetoDBFindByID", js.FuncOf(serialized(findDocumentByID)))
+	js.Global().Set("tetoDBExplain", js.FuncOf(serialized(explainQuery)))
+	js.Global().Set("tetoDBUpdate", js.FuncOf(serialized(updateDocument)))
+	js.Global().Set("tetoDBUpdateIfVersion", js.FuncOf(serialized(updateDocumentIfVersion)))
+	js.Global().Set("tetoDBUpdateWhere", js.FuncOf(serialized(updateDocumentWhere)))
+	js.Global().Set("tetoDBIncrement", js.FuncOf(serialized(incrementField)))
+	js.Global().Set("tetoDBReplace", js.FuncOf(serialized(replaceDocument)))
+	js.Global().Set("tetoDBDelete", js.FuncOf(serialized(deleteDocument)))
+	js.Global().Set("tetoDBPutAttachment", js.FuncOf(serialized(putAttachment)))
+	js.Global().Set("tetoDBGetAttachment", js.FuncOf(serialized(getAttachment)))
+	js.Global().Set("tetoDBListAttachments", js.FuncOf(serialized(listAttachments)))
+	js.Global().Set("tetoDBDeleteAttachment", js.FuncOf(serialized(deleteAttachment)))
+	js.Global().Set("tetoDBCount", js.FuncOf(serialized(countDocuments)))
+	js.Global().Set("tetoDBCopyTo", js.FuncOf(serialized(copyDocuments)))
+	js.Global().Set("tetoDBAggregate", js.FuncOf(serialized(aggregateDocuments)))
+	js.Global().Set("tetoDBSearch", js.FuncOf(serialized(searchDocuments)))
+	js.Global().Set("tetoDBCreateIndex", js.FuncOf(serialized(createIndex)))
+	js.Global().Set("tetoDBListIndexes", js.FuncOf(serialized(listIndexes)))
+	js.Global().Set("tetoDBDropIndex", js.FuncOf(serialized(dropIndex)))
+	js.Global().Set("tetoDBCreateGeoIndex", js.FuncOf(serialized(createGeoIndex)))
+	js.Global().Set("tetoDBCreateTextIndex", js.FuncOf(serialized(createTextIndex)))
+	js.Global().Set("tetoDBListCollections", js.FuncOf(serialized(listCollections)))
+	js.Global().Set("tetoDBDropCollection", js.FuncOf(serialized(dropCollection)))
+	js.Global().Set("tetoDBRenameCollection", js.FuncOf(serialized(renameCollection)))
+	js.Global().Set("tetoDBWatch", js.FuncOf(serialized(watchChanges)))
+	js.Global().Set("tetoDBUnwatch", js.FuncOf(serialized(unwatchChanges)))
+	js.Global().Set("tetoDBBegin", js.FuncOf(serialized(beginTransaction)))
+	js.Global().Set("tetoDBTxInsert", js.FuncOf(serialized(txInsert)))
+	js.Global().Set("tetoDBTxUpdate", js.FuncOf(serialized(txUpdate)))
+	js.Global().Set("tetoDBTxDelete", js.FuncOf(serialized(txDelete)))
+	js.Global().Set("tetoDBCommit", js.FuncOf(serialized(commitTransaction)))
+	js.Global().Set("tetoDBRollback", js.FuncOf(serialized(rollbackTransaction)))
+	js.Global().Set("tetoDBBulkWrite", js.FuncOf(serialized(bulkWriteDocuments)))
+	js.Global().Set("tetoDBQuery", js.FuncOf(serialized(runQuery)))
+	js.Global().Set("tetoDBStats", js.FuncOf(serialized(getStats)))
+	js.Global().Set("tetoDBRuntimeStats", js.FuncOf(serialized(getRuntimeStats)))
+	js.Global().Set("tetoDBCompact", js.FuncOf(serialized(compactDatabase)))
+	js.Global().Set("tetoDBChangePassphrase", js.FuncOf(serialized(changePassphrase)))
+	js.Global().Set("tetoDBSetFlushPolicy", js.FuncOf(serialized(setFlushPolicy)))
+	js.Global().Set("tetoDBFlush", js.FuncOf(serialized(flushDatabase)))
+	js.Global().Set("tetoDBNextSequence", js.FuncOf(serialized(nextSequence)))
+	js.Global().Set("tetoDBBackup", js.FuncOf(serialized(backupDatabase)))
+	js.Global().Set("tetoDBRestoreTo", js.FuncOf(serialized(restoreDatabase)))
+	js.Global().Set("tetoDBExport", js.FuncOf(serialized(exportDatabase)))
+	js.Global().Set("tetoDBImport", js.FuncOf(serialized(importDatabase)))
+	js.Global().Set("tetoDBClose", js.FuncOf(serialized(closeDatabase)))
+	js.Global().Set("tetoDBCloseAll", js.FuncOf(serialized(closeAllDatabases)))
 
 	fmt.Println("TetoDB API functions registered")
 
@@ -35,8 +83,12 @@ func main() {
 }
 
 // openDatabase opens a database file
-// Args: [path string]
-// Returns: {success: bool, error: string}
+// Args: [path string, options object|string (optional), adapter object (optional; {read, append, replace, close} functions)]
+// Returns: {success: bool, handle: number, path: string, error: string}
+// The handle is the first argument of every other call on the database, and
+// path is where the database is kept (see resolvePath). With a storage
+// adapter (see adapterSink) the database is kept by the adapter, and path
+// only names it; opening it then returns a Promise
 func openDatabase(this js.Value, args []js.Value) interface{} {
 	if len(args) < 1 {
 		return makeError("missing path argument")
@@ -44,8 +96,39 @@ func openDatabase(this js.Value, args []js.Value) interface{} {
 
 	path := args[0].String()
 
-	var err error
-	db, err = engine.OpenDatabase(path)
+	// Parse options if provided
+	var options bridge.OpenOptions
+	if err := decodeArg(optionalArg(args, 1), &options); err != nil {
+		return makeError(fmt.Sprintf("invalid options: %v", err))
+	}
+
+	engineOpts, err := options.EngineOptions()
+	if err != nil {
+		return makeError(fmt.Sprintf("invalid options: %v", err))
+	}
+
+	if adapter := optionalArg(args, 2); adapter.Type() == js.TypeObject {
+		return openAsync(path, engineOpts, func() (engine.StorageEngine, error) {
+			return openAdapterStorage(adapter)
+		})
+	}
+
+	path, err = resolvePath(path, options.Ephemeral)
+	if err != nil {
+		return makeError(fmt.Sprintf("failed to open database: %v", err))
+	}
+	if isIDBPath(path) {
+		return openAsync(path, engineOpts, func() (engine.StorageEngine, error) {
+			return openIDBStorage(strings.TrimPrefix(path, idbScheme))
+		})
+	}
+	if isOPFSPath(path) {
+		return openAsync(path, engineOpts, func() (engine.StorageEngine, error) {
+			return openOPFSStorage(strings.TrimPrefix(path, opfsScheme))
+		})
+	}
+
+	db, err := engine.OpenDatabase(path, engineOpts...)
 	if err != nil {
 		return makeError(fmt.Sprintf("failed to open database: %v", err))
 	}
@@ -53,28 +136,60 @@ func openDatabase(this js.Value, args []js.Value) interface{} {
 	return makeSuccess(map[string]interface{}{
 		"message": "Database opened successfully",
 		"path":    path,
+		"handle":  register(db, nil),
+	})
+}
+
+// openAsync opens a database on a browser storage engine (IndexedDB, OPFS or
+// a storage adapter)
+// Opening one means waiting on JavaScript, so it returns a Promise instead of
+// the result, and opens the database in the queue once the storage is ready
+func openAsync(path string, engineOpts []engine.Option, open func() (engine.StorageEngine, error)) interface{} {
+	return newPromise(func() interface{} {
+		storage, err := open()
+		if err != nil {
+			return makeError(fmt.Sprintf("failed to open database: %v", err))
+		}
+
+		var result interface{}
+		err = ops.Do(func() {
+			opened, err := engine.OpenDatabaseWithStorage(storage, engineOpts...)
+			if err != nil {
+				result = makeError(fmt.Sprintf("failed to open database: %v", err))
+				return
+			}
+			result = makeSuccess(map[string]interface{}{
+				"message": "Database opened successfully",
+				"path":    path,
+				"handle":  register(opened, storage),
+			})
+		})
+		if err != nil {
+			return makeError(err.Error())
+		}
+		return result
 	})
 }
 
 // insertDocument inserts a document into a collection
-// Args: [collection string, jsonDoc string]
+// Args: [handle number, collection string, doc object|string]
 // Returns: {success: bool, id: string, error: string}
 func insertDocument(this js.Value, args []js.Value) interface{} {
-	if db == nil {
-		return makeError("database not open")
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
 	}
 
 	if len(args) < 2 {
-		return makeError("missing arguments: collection, jsonDoc")
+		return makeError("missing arguments: collection, doc")
 	}
 
 	collectionName := args[0].String()
-	jsonDoc := args[1].String()
 
-	// Parse JSON document
-	var doc map[string]interface{}
-	if err := json.Unmarshal([]byte(jsonDoc), &doc); err != nil {
-		return makeError(fmt.Sprintf("invalid JSON: %v", err))
+	// Convert the document
+	doc, err := objectArg(args[1])
+	if err != nil {
+		return makeError(fmt.Sprintf("invalid document: %v", err))
 	}
 
 	// Get collection
@@ -91,12 +206,46 @@ func insertDocument(this js.Value, args []js.Value) interface{} {
 	})
 }
 
+// insertDocuments inserts several documents into a collection as one batch
+// Args: [handle number, collection string, docs array|string (documents)]
+// Returns: {success: bool, ids: array (of strings), error: string}
+func insertDocuments(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 2 {
+		return makeError("missing arguments: collection, docs")
+	}
+
+	collectionName := args[0].String()
+
+	docs, err := objectsArg(args[1])
+	if err != nil {
+		return makeError(fmt.Sprintf("invalid documents: %v", err))
+	}
+
+	coll := db.GetCollection(collectionName)
+
+	ids, err := coll.InsertMany(docs)
+	if err != nil {
+		return makeError(fmt.Sprintf("insert failed: %v", err))
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"ids": toJS(ids),
+	})
+}
+
 // findDocuments finds documents in a collection
-// Args: [collection string, filterJSON string]
-// Returns: {success: bool, documents: string (JSON array), error: string}
+// Args: [handle number, collection string, filter object|string, options object|string (optional)]
+// Returns: {success: bool, documents: array (of documents), count: int, nextToken: string, error: string}
+// nextToken is only set when paginating, and is "" on the last page
 func findDocuments(this js.Value, args []js.Value) interface{} {
-	if db == nil {
-		return makeError("database not open")
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
 	}
 
 	if len(args) < 1 {
@@ -106,42 +255,164 @@ func findDocuments(this js.Value, args []js.Value) interface{} {
 	collectionName := args[0].String()
 
 	// Parse filter if provided
-	var filter map[string]interface{}
-	if len(args) >= 2 && args[1].String() != "" {
-		if err := json.Unmarshal([]byte(args[1].String()), &filter); err != nil {
-			return makeError(fmt.Sprintf("invalid filter JSON: %v", err))
-		}
+	filter, err := filterArg(optionalArg(args, 1))
+	if err != nil {
+		return makeError(fmt.Sprintf("invalid filter: %v", err))
+	}
+
+	// Parse options if provided
+	var options bridge.FindOptions
+	if err := decodeArg(optionalArg(args, 2), &options); err != nil {
+		return makeError(fmt.Sprintf("invalid options: %v", err))
+	}
+
+	findOpts, err := options.EngineOptions()
+	if err != nil {
+		return makeError(fmt.Sprintf("invalid options: %v", err))
 	}
 
 	// Get collection
 	coll := db.GetCollection(collectionName)
 
-	// Find documents
+	ctx, cancel := bridge.QueryContext(options.TimeoutMs)
+	defer cancel()
+
+	// Find documents, a page at a time if requested
 	var docs []map[string]interface{}
-	if len(filter) > 0 {
-		docs = coll.Find(filter)
+	var nextToken string
+	paginate := options.Paginate || options.PageToken != ""
+	if paginate {
+		page, err := coll.FindPageContext(ctx, filter, findOpts, options.PageToken)
+		if err != nil {
+			return makeError(fmt.Sprintf("find failed: %v", err))
+		}
+		docs, nextToken = page.Documents, page.NextToken
 	} else {
-		docs = coll.FindAll()
+		docs, err = coll.FindContext(ctx, filter, findOpts)
+		if err != nil {
+			return makeError(fmt.Sprintf("find failed: %v", err))
+		}
+	}
+
+	result := map[string]interface{}{
+		"documents": toJS(docs),
+		"count":     len(docs),
+	}
+	if paginate {
+		result["nextToken"] = nextToken
+	}
+	return makeSuccess(result)
+}
+
+// findEachDocument calls a JS callback with each matching document as it is found
+// The callback receives the document as an object and can return false
+// to stop. The scan reads a snapshot taken in the queue, and the callback runs
+// after the queued part has finished (like watch callbacks, see watcher), so
+// it may call other tetoDB functions; it sees the documents as they were when
+// the call was made, not the writes it makes itself
+// Args: [handle number, collection string, filter object|string, callback function]
+// Returns: {success: bool, count: int (documents delivered), error: string}
+func findEachDocument(this js.Value, args []js.Value) interface{} {
+	var coll *engine.SnapshotCollection
+	var filter map[string]interface{}
+	var failure interface{}
+	err := ops.Do(func() {
+		db, args, err := openHandle(args)
+		if err != nil {
+			failure = makeError(err.Error())
+			return
+		}
+
+		if len(args) < 3 || args[2].Type() != js.TypeFunction {
+			failure = makeError("missing arguments: collection, filter, callback")
+			return
+		}
+
+		// Parse filter if provided
+		filter, err = filterArg(args[1])
+		if err != nil {
+			failure = makeError(fmt.Sprintf("invalid filter: %v", err))
+			return
+		}
+
+		// Snapshotting shares the documents rather than copying them
+		snapshot, err := db.Snapshot()
+		if err != nil {
+			failure = makeError(err.Error())
+			return
+		}
+		coll = snapshot.Collection(args[0].String())
+	})
+	if err != nil {
+		return makeError(err.Error())
+	}
+	if failure != nil {
+		return failure
+	}
+
+	callback := args[3]
+	count := 0
+	coll.FindEach(filter, func(doc map[string]interface{}) bool {
+		count++
+
+		ret := callback.Invoke(toJS(doc))
+		return !(ret.Type() == js.TypeBoolean && !ret.Bool())
+	})
+
+	return makeSuccess(map[string]interface{}{
+		"count": count,
+	})
+}
+
+// explainQuery runs a find and reports how it was executed
+// Args: [handle number, collection string, filter object|string, options object|string (optional)]
+// Returns: {success: bool, plan: object, error: string}
+func explainQuery(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 1 {
+		return makeError("missing collection argument")
+	}
+
+	collectionName := args[0].String()
+
+	// Parse filter if provided
+	filter, err := filterArg(optionalArg(args, 1))
+	if err != nil {
+		return makeError(fmt.Sprintf("invalid filter: %v", err))
 	}
 
-	// Serialize to JSON
-	jsonBytes, err := json.Marshal(docs)
+	// Parse options if provided
+	var options bridge.FindOptions
+	if err := decodeArg(optionalArg(args, 2), &options); err != nil {
+		return makeError(fmt.Sprintf("invalid options: %v", err))
+	}
+
+	findOpts, err := options.EngineOptions()
 	if err != nil {
-		return makeError(fmt.Sprintf("failed to serialize results: %v", err))
+		return makeError(fmt.Sprintf("invalid options: %v", err))
 	}
 
+	// Get collection
+	coll := db.GetCollection(collectionName)
+
+	plan := coll.Explain(filter, findOpts)
+
 	return makeSuccess(map[string]interface{}{
-		"documents": string(jsonBytes),
-		"count":     len(docs),
+		"plan": toJS(plan),
 	})
 }
 
 // findDocumentByID finds a single document by ID
-// Args: [collection string, id string]
-// Returns: {success: bool, document: string (JSON), error: string}
+// Args: [handle number, collection string, id string]
+// Returns: {success: bool, document: object, error: string}
 func findDocumentByID(this js.Value, args []js.Value) interface{} {
-	if db == nil {
-		return makeError("database not open")
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
 	}
 
 	if len(args) < 2 {
@@ -160,37 +431,31 @@ func findDocumentByID(this js.Value, args []js.Value) interface{} {
 		return makeError("document not found")
 	}
 
-	// Serialize to JSON
-	jsonBytes, err := json.Marshal(doc)
-	if err != nil {
-		return makeError(fmt.Sprintf("failed to serialize document: %v", err))
-	}
-
 	return makeSuccess(map[string]interface{}{
-		"document": string(jsonBytes),
+		"document": toJS(doc),
 	})
 }
 
 // updateDocument updates a document in a collection
-// Args: [collection string, id string, updateJSON string]
+// Args: [handle number, collection string, id string, update object|string]
 // Returns: {success: bool, error: string}
 func updateDocument(this js.Value, args []js.Value) interface{} {
-	if db == nil {
-		return makeError("database not open")
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
 	}
 
 	if len(args) < 3 {
-		return makeError("missing arguments: collection, id, updateJSON")
+		return makeError("missing arguments: collection, id, update")
 	}
 
 	collectionName := args[0].String()
 	id := args[1].String()
-	updateJSON := args[2].String()
 
-	// Parse update JSON
-	var update map[string]interface{}
-	if err := json.Unmarshal([]byte(updateJSON), &update); err != nil {
-		return makeError(fmt.Sprintf("invalid update JSON: %v", err))
+	// Convert the update
+	update, err := objectArg(args[2])
+	if err != nil {
+		return makeError(fmt.Sprintf("invalid update: %v", err))
 	}
 
 	// Get collection
@@ -206,12 +471,158 @@ func updateDocument(this js.Value, args []js.Value) interface{} {
 	})
 }
 
+// updateDocumentIfVersion updates a document only if it is still at the given version
+// Args: [handle number, collection string, id string, version number, update object|string]
+// Returns: {success: bool, conflict: bool, version: number, error: string}; on a
+// conflict, version is the document's current version
+func updateDocumentIfVersion(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 4 {
+		return makeError("missing arguments: collection, id, version, update")
+	}
+	if args[2].Type() != js.TypeNumber {
+		return makeError("version must be a number")
+	}
+
+	collectionName := args[0].String()
+	id := args[1].String()
+	version := int64(args[2].Float())
+
+	update, err := objectArg(args[3])
+	if err != nil {
+		return makeError(fmt.Sprintf("invalid update: %v", err))
+	}
+
+	coll := db.GetCollection(collectionName)
+
+	err = coll.UpdateIfVersion(id, version, update)
+	var conflict *engine.VersionConflictError
+	if errors.As(err, &conflict) {
+		result := makeError(err.Error())
+		result["conflict"] = true
+		result["version"] = conflict.Actual
+		return result
+	}
+	if err != nil {
+		return makeError(fmt.Sprintf("update failed: %v", err))
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"message": "Document updated successfully",
+	})
+}
+
+// updateDocumentWhere updates a document only if it still matches a condition
+// Args: [handle number, collection string, id string, condition object|string, update object|string]
+// Returns: {success: bool, applied: bool, error: string}
+func updateDocumentWhere(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 4 {
+		return makeError("missing arguments: collection, id, condition, update")
+	}
+
+	collectionName := args[0].String()
+	id := args[1].String()
+
+	condition, err := objectArg(args[2])
+	if err != nil {
+		return makeError(fmt.Sprintf("invalid condition: %v", err))
+	}
+	update, err := objectArg(args[3])
+	if err != nil {
+		return makeError(fmt.Sprintf("invalid update: %v", err))
+	}
+
+	coll := db.GetCollection(collectionName)
+
+	applied, err := coll.UpdateWhere(id, condition, update)
+	if err != nil {
+		return makeError(fmt.Sprintf("update failed: %v", err))
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"applied": applied,
+	})
+}
+
+// incrementField adds to a numeric field of a document
+// Args: [handle number, collection string, id string, field string, delta number]
+// Returns: {success: bool, value: number, error: string}
+func incrementField(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 4 {
+		return makeError("missing arguments: collection, id, field, delta")
+	}
+	if args[3].Type() != js.TypeNumber {
+		return makeError("delta must be a number")
+	}
+
+	coll := db.GetCollection(args[0].String())
+
+	value, err := coll.Increment(args[1].String(), args[2].String(), args[3].Float())
+	if err != nil {
+		return makeError(fmt.Sprintf("increment failed: %v", err))
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"value": value,
+	})
+}
+
+// replaceDocument overwrites a document in a collection, keeping its ID
+// Args: [handle number, collection string, id string, docJSON string]
+// Returns: {success: bool, error: string}
+func replaceDocument(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 3 {
+		return makeError("missing arguments: collection, id, docJSON")
+	}
+
+	collectionName := args[0].String()
+	id := args[1].String()
+
+	// Convert the document
+	doc, err := objectArg(args[2])
+	if err != nil {
+		return makeError(fmt.Sprintf("invalid document: %v", err))
+	}
+
+	// Get collection
+	coll := db.GetCollection(collectionName)
+
+	// Replace document
+	if err := coll.Replace(id, doc); err != nil {
+		return makeError(fmt.Sprintf("replace failed: %v", err))
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"message": "Document replaced successfully",
+	})
+}
+
 // deleteDocument deletes a document from a collection
-// Args: [collection string, id string]
+// Args: [handle number, collection string, id string]
 // Returns: {success: bool, error: string}
 func deleteDocument(this js.Value, args []js.Value) interface{} {
-	if db == nil {
-		return makeError("database not open")
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
 	}
 
 	if len(args) < 2 {
@@ -234,95 +645,801 @@ func deleteDocument(this js.Value, args []js.Value) interface{} {
 	})
 }
 
-// countDocuments counts documents in a collection
-// Args: [collection string, filterJSON string (optional)]
-// Returns: {success: bool, count: int, error: string}
-func countDocuments(this js.Value, args []js.Value) interface{} {
-	if db == nil {
-		return makeError("database not open")
+// putAttachment stores a blob under a name alongside a document
+// Args: [handle number, collection string, id string, name string, data Uint8Array]
+// Returns: {success: bool, error: string}
+func putAttachment(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
 	}
 
-	if len(args) < 1 {
-		return makeError("missing collection argument")
+	if len(args) < 4 {
+		return makeError("missing arguments: collection, id, name, data")
 	}
-
-	collectionName := args[0].String()
-
-	// Parse filter if provided
-	var filter map[string]interface{}
-	if len(args) >= 2 && args[1].String() != "" {
-		if err := json.Unmarshal([]byte(args[1].String()), &filter); err != nil {
-			return makeError(fmt.Sprintf("invalid filter JSON: %v", err))
-		}
+	if !args[3].InstanceOf(js.Global().Get("Uint8Array")) {
+		return makeError("attachment data must be a Uint8Array")
 	}
 
-	// Get collection
-	coll := db.GetCollection(collectionName)
+	data := make([]byte, args[3].Get("length").Int())
+	js.CopyBytesToGo(data, args[3])
 
-	// Count documents
-	var count int
-	if len(filter) > 0 {
-		count = coll.CountWhere(filter)
-	} else {
-		count = coll.Count()
+	coll := db.GetCollection(args[0].String())
+	if err := coll.PutAttachment(args[1].String(), args[2].String(), data); err != nil {
+		return makeError(fmt.Sprintf("put attachment failed: %v", err))
 	}
 
 	return makeSuccess(map[string]interface{}{
-		"count": count,
+		"message": "Attachment stored successfully",
 	})
 }
 
-// getStats returns database statistics
-// Args: []
-// Returns: {success: bool, stats: object, error: string}
-func getStats(this js.Value, args []js.Value) interface{} {
-	if db == nil {
-		return makeError("database not open")
+// getAttachment returns the data of a document's attachment
+// Args: [handle number, collection string, id string, name string]
+// Returns: {success: bool, data: Uint8Array, found: bool, error: string}
+func getAttachment(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 3 {
+		return makeError("missing arguments: collection, id, name")
 	}
 
-	stats := db.Stats()
+	coll := db.GetCollection(args[0].String())
+	attached, err := coll.GetAttachment(args[1].String(), args[2].String())
+	if errors.Is(err, engine.ErrAttachmentNotFound) {
+		return makeSuccess(map[string]interface{}{
+			"found": false,
+		})
+	}
+	if err != nil {
+		return makeError(fmt.Sprintf("get attachment failed: %v", err))
+	}
+	data := js.Global().Get("Uint8Array").New(len(attached))
+	js.CopyBytesToJS(data, attached)
 
 	return makeSuccess(map[string]interface{}{
-		"stats": stats,
+		"found": true,
+		"data":  data,
 	})
 }
 
-// compactDatabase performs database compaction
-// Args: []
-// Returns: {success: bool, error: string}
-func compactDatabase(this js.Value, args []js.Value) interface{} {
-	if db == nil {
-		return makeError("database not open")
+// listAttachments lists the attachments of a document
+// Args: [handle number, collection string, id string]
+// Returns: {success: bool, attachments: array (of {name, size}), error: string}
+func listAttachments(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
 	}
 
-	if err := db.Compact(); err != nil {
-		return makeError(fmt.Sprintf("compaction failed: %v", err))
+	if len(args) < 2 {
+		return makeError("missing arguments: collection, id")
 	}
 
+	coll := db.GetCollection(args[0].String())
+
 	return makeSuccess(map[string]interface{}{
-		"message": "Database compacted successfully",
+		"attachments": toJS(coll.ListAttachments(args[1].String())),
 	})
 }
 
-// closeDatabase closes the database
-// Args: []
+// deleteAttachment removes a document's attachment
+// Args: [handle number, collection string, id string, name string]
 // Returns: {success: bool, error: string}
-func closeDatabase(this js.Value, args []js.Value) interface{} {
-	if db == nil {
-		return makeError("database not open")
+func deleteAttachment(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
 	}
 
-	if err := db.Close(); err != nil {
-		return makeError(fmt.Sprintf("close failed: %v", err))
+	if len(args) < 3 {
+		return makeError("missing arguments: collection, id, name")
 	}
 
-	db = nil
+	coll := db.GetCollection(args[0].String())
+	if err := coll.DeleteAttachment(args[1].String(), args[2].String()); err != nil {
+		return makeError(fmt.Sprintf("delete attachment failed: %v", err))
+	}
 
 	return makeSuccess(map[string]interface{}{
-		"message": "Database closed successfully",
+		"message": "Attachment deleted successfully",
 	})
 }
 
+// countDocuments counts documents in a collection
+// Args: [handle number, collection string, filter object|string (optional)]
+// Returns: {success: bool, count: int, error: string}
+func countDocuments(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 1 {
+		return makeError("missing collection argument")
+	}
+
+	collectionName := args[0].String()
+
+	// Parse filter if provided
+	filter, err := filterArg(optionalArg(args, 1))
+	if err != nil {
+		return makeError(fmt.Sprintf("invalid filter: %v", err))
+	}
+
+	// Get collection
+	coll := db.GetCollection(collectionName)
+
+	// Count documents
+	var count int
+	if len(filter) > 0 {
+		count = coll.CountWhere(filter)
+	} else {
+		count = coll.Count()
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"count": count,
+	})
+}
+
+// copyDocuments copies matching documents from one collection into another
+// Args: [handle number, source string, destination string, filter object|string (optional), preserveIDs bool (optional)]
+// Returns: {success: bool, count: int, error: string}
+func copyDocuments(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 2 {
+		return makeError("missing arguments: source, destination")
+	}
+
+	sourceName := args[0].String()
+	destName := args[1].String()
+
+	// Parse filter if provided
+	filter, err := filterArg(optionalArg(args, 2))
+	if err != nil {
+		return makeError(fmt.Sprintf("invalid filter: %v", err))
+	}
+
+	preserveIDs := len(args) >= 4 && args[3].Truthy()
+
+	// Get collections
+	source := db.GetCollection(sourceName)
+	dest := db.GetCollection(destName)
+
+	count, err := source.CopyTo(dest, filter, preserveIDs)
+	if err != nil {
+		return makeError(fmt.Sprintf("copy failed: %v", err))
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"count": count,
+	})
+}
+
+// aggregateOptions mirrors the options object accepted by tetoDBAggregate
+type aggregateOptions struct {
+	TimeoutMs int `json:"timeoutMs"` // Abort the pipeline after this many milliseconds (0 means no limit)
+}
+
+// aggregateDocuments runs an aggregation pipeline on a collection
+// Args: [handle number, collection string, pipeline array|string (stages), options object|string (optional)]
+// Returns: {success: bool, documents: array (of documents), count: int, error: string}
+func aggregateDocuments(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 2 {
+		return makeError("missing arguments: collection, pipeline")
+	}
+
+	collectionName := args[0].String()
+
+	// Convert the pipeline
+	pipeline, err := objectsArg(args[1])
+	if err != nil {
+		return makeError(fmt.Sprintf("invalid pipeline: %v", err))
+	}
+
+	// Parse options if provided
+	var options aggregateOptions
+	if err := decodeArg(optionalArg(args, 2), &options); err != nil {
+		return makeError(fmt.Sprintf("invalid options: %v", err))
+	}
+
+	ctx, cancel := bridge.QueryContext(options.TimeoutMs)
+	defer cancel()
+
+	// Get collection
+	coll := db.GetCollection(collectionName)
+
+	docs, err := coll.AggregateContext(ctx, pipeline)
+	if err != nil {
+		return makeError(fmt.Sprintf("aggregation failed: %v", err))
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"documents": toJS(docs),
+		"count":     len(docs),
+	})
+}
+
+// searchOptions mirrors the options object accepted by tetoDBSearch
+type searchOptions struct {
+	Fields   []string               `json:"fields"`
+	Filter   map[string]interface{} `json:"filter"`
+	MatchAll bool                   `json:"matchAll"`
+	Limit    int                    `json:"limit"`
+}
+
+// searchDocuments runs a full-text search on a collection
+// Args: [handle number, collection string, query string, options object|string (optional)]
+// Returns: {success: bool, results: array (of {id, document, score}), count: int, error: string}
+func searchDocuments(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 2 {
+		return makeError("missing arguments: collection, query")
+	}
+
+	collectionName := args[0].String()
+	query := args[1].String()
+
+	// Parse options if provided
+	var options searchOptions
+	if err := decodeArg(optionalArg(args, 2), &options); err != nil {
+		return makeError(fmt.Sprintf("invalid options: %v", err))
+	}
+
+	// Get collection
+	coll := db.GetCollection(collectionName)
+
+	results := coll.Search(query, engine.SearchOptions{
+		Fields:   options.Fields,
+		Filter:   options.Filter,
+		MatchAll: options.MatchAll,
+		Limit:    options.Limit,
+	})
+
+	return makeSuccess(map[string]interface{}{
+		"results": toJS(results),
+		"count":   len(results),
+	})
+}
+
+// indexOptions mirrors the options object accepted by tetoDBCreateIndex
+type indexOptions struct {
+	Filter interface{} `json:"filter"` // Partial index filter: an object or a filter expression string
+}
+
+// createIndex builds a value index on a collection field
+// Args: [handle number, collection string, field string, options object|string (optional)]
+// Returns: {success: bool, error: string}
+func createIndex(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 2 {
+		return makeError("missing arguments: collection, field")
+	}
+
+	collectionName := args[0].String()
+	field := args[1].String()
+
+	var options indexOptions
+	if err := decodeArg(optionalArg(args, 2), &options); err != nil {
+		return makeError(fmt.Sprintf("invalid options: %v", err))
+	}
+
+	var engineOpts engine.IndexOptions
+	switch filter := options.Filter.(type) {
+	case nil:
+	case map[string]interface{}:
+		engineOpts.Filter = filter
+	case string:
+		parsed, err := bridge.ParseFilter(filter)
+		if err != nil {
+			return makeError(fmt.Sprintf("invalid filter: %v", err))
+		}
+		engineOpts.Filter = parsed
+	default:
+		return makeError("invalid filter: must be an object or a filter expression")
+	}
+
+	// Get collection
+	coll := db.GetCollection(collectionName)
+
+	if err := coll.CreateIndex(field, engineOpts); err != nil {
+		return makeError(fmt.Sprintf("create index failed: %v", err))
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"message": "Index created successfully",
+	})
+}
+
+// listIndexes describes a collection's indexes
+// Args: [handle number, collection string]
+// Returns: {success: bool, indexes: array (of index info), error: string}
+func listIndexes(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 1 {
+		return makeError("missing collection argument")
+	}
+
+	coll := db.GetCollection(args[0].String())
+
+	return makeSuccess(map[string]interface{}{
+		"indexes": toJS(coll.ListIndexes()),
+	})
+}
+
+// dropIndex removes an index by name (as reported by tetoDBListIndexes)
+// Args: [handle number, collection string, name string]
+// Returns: {success: bool, error: string}
+func dropIndex(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 2 {
+		return makeError("missing arguments: collection, name")
+	}
+
+	coll := db.GetCollection(args[0].String())
+
+	if err := coll.DropIndex(args[1].String()); err != nil {
+		return makeError(fmt.Sprintf("drop index failed: %v", err))
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"message": "Index dropped successfully",
+	})
+}
+
+// createGeoIndex builds a geohash index on a collection's location field
+// Args: [handle number, collection string, field string]
+// Returns: {success: bool, error: string}
+func createGeoIndex(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 2 {
+		return makeError("missing arguments: collection, field")
+	}
+
+	collectionName := args[0].String()
+	field := args[1].String()
+
+	// Get collection
+	coll := db.GetCollection(collectionName)
+
+	if err := coll.CreateGeoIndex(field); err != nil {
+		return makeError(fmt.Sprintf("create geo index failed: %v", err))
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"message": "Geo index created successfully",
+	})
+}
+
+// createTextIndex builds an inverted index used by tetoDBSearch
+// Args: [handle number, collection string, fields array|string (optional; field names, all string fields if omitted)]
+// Returns: {success: bool, error: string}
+func createTextIndex(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 1 {
+		return makeError("missing collection argument")
+	}
+
+	collectionName := args[0].String()
+
+	var fields []string
+	if err := decodeArg(optionalArg(args, 1), &fields); err != nil {
+		return makeError(fmt.Sprintf("invalid fields: %v", err))
+	}
+
+	// Get collection
+	coll := db.GetCollection(collectionName)
+
+	if err := coll.CreateTextIndex(fields...); err != nil {
+		return makeError(fmt.Sprintf("create text index failed: %v", err))
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"message": "Text index created successfully",
+	})
+}
+
+// listCollections lists the database's collections by name
+// Args: [handle number]
+// Returns: {success: bool, collections: array (of string), error: string}
+func listCollections(this js.Value, args []js.Value) interface{} {
+	db, _, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	names := db.ListCollections()
+	sort.Strings(names)
+
+	return makeSuccess(map[string]interface{}{
+		"collections": toJS(names),
+	})
+}
+
+// dropCollection removes a collection with its documents and indexes
+// Args: [handle number, collection string]
+// Returns: {success: bool, error: string}
+func dropCollection(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 1 {
+		return makeError("missing collection argument")
+	}
+
+	if err := db.DropCollection(args[0].String()); err != nil {
+		return makeError(fmt.Sprintf("drop collection failed: %v", err))
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"message": "Collection dropped successfully",
+	})
+}
+
+// renameCollection moves a collection to a name no other collection uses
+// Args: [handle number, collection string, name string]
+// Returns: {success: bool, error: string}
+func renameCollection(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 2 {
+		return makeError("missing arguments: collection, name")
+	}
+
+	if err := db.RenameCollection(args[0].String(), args[1].String()); err != nil {
+		return makeError(fmt.Sprintf("rename collection failed: %v", err))
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"message": "Collection renamed successfully",
+	})
+}
+
+// getStats returns database statistics
+// Args: [handle number]
+// Returns: {success: bool, stats: object, error: string}
+func getStats(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"stats": toJS(db.Stats()),
+	})
+}
+
+// getRuntimeStats reports the memory the module uses: the Go heap and the
+// garbage collector's cycles and pauses (shared by every open database; gc is
+// null in a TinyGo build), and the database's own estimate of what its loaded
+// collections hold (see engine.MemoryUsage), so an application can watch or
+// cap the footprint on a constrained device
+// Args: [handle number]
+// Returns: {success: bool, heap: object, gc: object, memory: object, error: string}
+func getRuntimeStats(this js.Value, args []js.Value) interface{} {
+	db, _, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	heap, gc := runtimeMemory()
+	var collector interface{}
+	if gc != nil {
+		collector = toJS(gc)
+	}
+	return makeSuccess(map[string]interface{}{
+		"heap":   toJS(heap),
+		"gc":     collector,
+		"memory": toJS(db.MemoryUsage()),
+	})
+}
+
+// runQuery runs a SQL-like SELECT statement
+// Args: [handle number, sql string]
+// Returns: {success: bool, documents: array (of rows), count: int, error: string}
+func runQuery(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 1 {
+		return makeError("missing sql argument")
+	}
+
+	rows, err := db.Query(args[0].String())
+	if err != nil {
+		return makeError(fmt.Sprintf("query failed: %v", err))
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"documents": toJS(rows),
+		"count":     len(rows),
+	})
+}
+
+// compactDatabase performs database compaction
+// Args: [handle number]
+// Returns: {success: bool, error: string}
+func compactDatabase(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if err := db.Compact(); err != nil {
+		return makeError(fmt.Sprintf("compaction failed: %v", err))
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"message": "Database compacted successfully",
+	})
+}
+
+// changePassphrase moves an encrypted database (opened with the passphrase
+// option) to a key derived from a new passphrase, in Go, by compacting it
+// Args: [handle number, current string, next string]
+// Returns: {success: bool, error: string}
+func changePassphrase(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 2 {
+		return makeError("missing current or next passphrase argument")
+	}
+
+	if err := db.ChangePassphrase(args[0].String(), args[1].String()); err != nil {
+		return makeError(fmt.Sprintf("failed to change passphrase: %v", err))
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"message": "Passphrase changed successfully",
+	})
+}
+
+// nextSequence advances a named sequence
+// Args: [handle number, name string]
+// Returns: {success: bool, value: number, error: string}
+func nextSequence(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 1 {
+		return makeError("missing argument: name")
+	}
+
+	value, err := db.NextSequence(args[0].String())
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"value": value,
+	})
+}
+
+// backupDatabase copies the database, as the bytes of a database file
+// Args: [handle number]
+// Returns: {success: bool, data: Uint8Array, error: string}
+func backupDatabase(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	var buf bytes.Buffer
+	if err := db.Backup(&buf); err != nil {
+		return makeError(fmt.Sprintf("backup failed: %v", err))
+	}
+	data := js.Global().Get("Uint8Array").New(buf.Len())
+	js.CopyBytesToJS(data, buf.Bytes())
+
+	return makeSuccess(map[string]interface{}{
+		"data": data,
+	})
+}
+
+// restoreDatabase rolls the database back to its documents at a past time
+// Args: [handle number, timestamp number (milliseconds since the epoch, as Date.now() gives)]
+// Returns: {success: bool, error: string}
+func restoreDatabase(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+	if len(args) < 1 {
+		return makeError("missing timestamp argument")
+	}
+	if args[0].Type() != js.TypeNumber {
+		return makeError("timestamp must be a number of milliseconds since the epoch")
+	}
+
+	at := time.UnixMilli(int64(args[0].Float()))
+	if err := db.RestoreTo(at); err != nil {
+		return makeError(fmt.Sprintf("restore failed: %v", err))
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"message": "Database restored to " + at.Format(time.RFC3339Nano),
+	})
+}
+
+// exportDatabase copies the database as the bytes of a JSON lines database
+// file, whatever its storage engine, e.g. to download as a backup
+// Args: [handle number]
+// Returns: {success: bool, data: Uint8Array, error: string}
+func exportDatabase(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	var buf bytes.Buffer
+	if err := db.Export(&buf); err != nil {
+		return makeError(fmt.Sprintf("export failed: %v", err))
+	}
+	data := js.Global().Get("Uint8Array").New(buf.Len())
+	js.CopyBytesToJS(data, buf.Bytes())
+
+	return makeSuccess(map[string]interface{}{
+		"data": data,
+	})
+}
+
+// importDatabase replaces the database's contents with those of a database
+// file, such as one tetoDBExport or tetoDBBackup made
+// Args: [handle number, data Uint8Array]
+// Returns: {success: bool, error: string}
+func importDatabase(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 1 {
+		return makeError("missing data argument")
+	}
+	if !args[0].InstanceOf(js.Global().Get("Uint8Array")) {
+		return makeError("import data must be a Uint8Array")
+	}
+
+	data := make([]byte, args[0].Get("length").Int())
+	js.CopyBytesToGo(data, args[0])
+
+	if err := db.Import(bytes.NewReader(data)); err != nil {
+		return makeError(fmt.Sprintf("import failed: %v", err))
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"message": "Database imported successfully",
+	})
+}
+
+// closeDatabase closes the database, after which its handle is invalid
+// Args: [handle number]
+// Returns: {success: bool, error: string}
+func closeDatabase(this js.Value, args []js.Value) interface{} {
+	inst, _, err := lookupHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	flushed, err := inst.close(args[0].Int())
+	if err != nil {
+		return makeError(fmt.Sprintf("close failed: %v", err))
+	}
+
+	result := makeSuccess(map[string]interface{}{
+		"message": "Database closed successfully",
+	})
+
+	// IndexedDB writes may still be in flight; resolve once they have landed
+	if flushed != nil {
+		return newPromise(func() interface{} {
+			<-flushed
+			return result
+		})
+	}
+	return result
+}
+
+// serialized wraps an exported function so it runs through the operation queue
+func serialized(fn func(js.Value, []js.Value) interface{}) func(js.Value, []js.Value) interface{} {
+	return func(this js.Value, args []js.Value) interface{} {
+		var result interface{}
+		if err := ops.Do(func() { result = fn(this, args) }); err != nil {
+			return makeError(err.Error())
+		}
+		return result
+	}
+}
+
+// newPromise returns a JavaScript Promise resolved with the result of run
+// run executes in its own goroutine, outside the exported call, so it may
+// wait on JavaScript callbacks
+func newPromise(run func() interface{}) js.Value {
+	var executor js.Func
+	executor = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		resolve := args[0]
+		executor.Release()
+		go func() {
+			resolve.Invoke(run())
+		}()
+		return nil
+	})
+	return js.Global().Get("Promise").New(executor)
+}
+
+// awaitPromise waits for a JavaScript Promise to settle
+// It must not be called inside an exported call (see newPromise)
+func awaitPromise(promise js.Value) (js.Value, error) {
+	type settled struct {
+		value js.Value
+		err   error
+	}
+	done := make(chan settled, 1)
+	onFulfilled := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		done <- settled{value: args[0]}
+		return nil
+	})
+	onRejected := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		done <- settled{err: fmt.Errorf("%s", js.Global().Get("String").Invoke(args[0]).String())}
+		return nil
+	})
+	defer onFulfilled.Release()
+	defer onRejected.Release()
+
+	promise.Call("then", onFulfilled, onRejected)
+	result := <-done
+	return result.value, result.err
+}
+
 // makeSuccess creates a success response object
 func makeSuccess(data map[string]interface{}) map[string]interface{} {
 	result := map[string]interface{}{
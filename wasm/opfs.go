@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"syscall/js"
+	"time"
+
+	"github.com/malazaysc/tetodb/engine"
+)
+
+// opfsScheme prefixes database paths in the Origin Private File System,
+// e.g. "opfs://data/app.db"
+const opfsScheme = "opfs://"
+
+// opfsStorage is a storage engine for Web Workers that keeps the log in an
+// Origin Private File System file, in the JSON-lines format file databases
+// use. It writes through a synchronous access handle, so unlike IndexedDB
+// every write is on disk (flushed) before it returns, unless a flush policy
+// (see tetoDBSetFlushPolicy) defers the flushes
+type opfsStorage struct {
+	handle js.Value // FileSystemSyncAccessHandle of the database file
+	mu     sync.Mutex
+
+	seq     uint64               // Sequence number of the latest record
+	tail    engine.StorageRecord // Latest record, kept so compaction never loses the sequence
+	size    int64                // Bytes in the file
+	maxSize int64                // Writes that would grow the file past this are refused (see SetMaxSize); 0 means no limit
+	counts  map[string]int       // Records in the file per collection, live or superseded
+	onWrite func(size int64)     // Called after every successful write with the new size
+	mode    flushMode            // When appended records are flushed
+	dirty   bool                 // Records have been written since the last flush
+	timer   flushTimer           // Flushes in flushInterval mode
+}
+
+// openOPFSStorage opens (or creates) a file in the origin's private file
+// system; slashes in the name separate directories, which are created too
+// It waits on Promises, so must not run inside an exported call
+func openOPFSStorage(name string) (*opfsStorage, error) {
+	storage := js.Global().Get("navigator").Get("storage")
+	if storage.IsUndefined() || storage.Get("getDirectory").IsUndefined() {
+		return nil, fmt.Errorf("the Origin Private File System is not available in this environment")
+	}
+
+	parts := strings.Split(strings.Trim(name, "/"), "/")
+	if parts[len(parts)-1] == "" {
+		return nil, fmt.Errorf("missing OPFS file name")
+	}
+	dir, err := awaitPromise(storage.Call("getDirectory"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the OPFS root: %w", err)
+	}
+	create := map[string]interface{}{"create": true}
+	for _, part := range parts[:len(parts)-1] {
+		if dir, err = awaitPromise(dir.Call("getDirectoryHandle", part, create)); err != nil {
+			return nil, fmt.Errorf("failed to open OPFS directory %q: %w", part, err)
+		}
+	}
+	file, err := awaitPromise(dir.Call("getFileHandle", parts[len(parts)-1], create))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open OPFS file %q: %w", name, err)
+	}
+	if file.Get("createSyncAccessHandle").IsUndefined() {
+		return nil, fmt.Errorf("OPFS databases must be opened in a dedicated Web Worker")
+	}
+	handle, err := awaitPromise(file.Call("createSyncAccessHandle"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock OPFS file %q: %w", name, err)
+	}
+
+	return &opfsStorage{
+		handle: handle,
+		size:   int64(handle.Call("getSize").Float()),
+		counts: make(map[string]int),
+	}, nil
+}
+
+// LoadAll reads every record in the file and resumes sequencing after the newest
+func (s *opfsStorage) LoadAll() ([]engine.StorageRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.readRecords()
+	if err != nil {
+		return nil, err
+	}
+	s.counts = make(map[string]int)
+	for _, record := range records {
+		s.counts[record.Collection]++
+	}
+	if len(records) > 0 {
+		s.tail = records[len(records)-1]
+		s.seq = s.tail.Seq
+	}
+	return records, nil
+}
+
+// ReadSince returns every record in the file with a sequence number greater than seq
+func (s *opfsStorage) ReadSince(seq uint64) ([]engine.StorageRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.readRecords()
+	if err != nil {
+		return nil, err
+	}
+	var newer []engine.StorageRecord
+	for _, record := range records {
+		if record.Seq > seq {
+			newer = append(newer, record)
+		}
+	}
+	return newer, nil
+}
+
+// readRecords reads and decodes every line of the file
+// Caller must hold the lock
+func (s *opfsStorage) readRecords() ([]engine.StorageRecord, error) {
+	buf := js.Global().Get("Uint8Array").New(s.size)
+	read := s.handle.Call("read", buf, map[string]interface{}{"at": 0}).Int()
+	data := make([]byte, read)
+	js.CopyBytesToGo(data, buf)
+
+	if len(data) > 0 && data[0] != '{' {
+		return nil, fmt.Errorf("OPFS databases must use the JSON-lines format")
+	}
+	return decodeJSONLines(data), nil
+}
+
+// decodeJSONLines decodes a log in the JSON-lines format file databases use
+// Records written before sequence numbers existed are numbered by their position
+func decodeJSONLines(data []byte) []engine.StorageRecord {
+	var records []engine.StorageRecord
+	var lastSeq uint64
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) == 0 {
+			continue
+		}
+		var record engine.StorageRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			fmt.Printf("Warning: failed to parse record: %v\n", err)
+			continue
+		}
+		if record.Seq == 0 {
+			record.Seq = lastSeq + 1
+		}
+		if record.Seq > lastSeq {
+			lastSeq = record.Seq
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// CurrentSequence returns the sequence number of the latest record
+func (s *opfsStorage) CurrentSequence() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.seq
+}
+
+// Append writes a record to the end of the file and flushes it
+func (s *opfsStorage) Append(record engine.StorageRecord) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record.Seq = s.seq + 1
+	data, err := json.Marshal(record)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal record: %w", err)
+	}
+	data = append(data, '\n')
+	if err := engine.CheckFileSize([]engine.StorageRecord{record}, s.size, int64(len(data)), s.maxSize); err != nil {
+		return 0, err
+	}
+	if err := s.write(data, record); err != nil {
+		return 0, err
+	}
+	return record.Seq, nil
+}
+
+// AppendBatch writes several records with a single write and flush
+// Each record's Seq field is set in place to the sequence number it was assigned
+func (s *opfsStorage) AppendBatch(records []engine.StorageRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var data []byte
+	for i := range records {
+		records[i].Seq = s.seq + uint64(i) + 1
+		encoded, err := json.Marshal(records[i])
+		if err != nil {
+			return fmt.Errorf("failed to marshal record: %w", err)
+		}
+		data = append(append(data, encoded...), '\n')
+	}
+	if err := engine.CheckFileSize(records, s.size, int64(len(data)), s.maxSize); err != nil {
+		return err
+	}
+	return s.write(data, records...)
+}
+
+// write appends encoded records at the end of the file and flushes them,
+// unless the flush policy defers it
+// Caller must hold the lock
+func (s *opfsStorage) write(data []byte, records ...engine.StorageRecord) error {
+	if err := s.writeAt(data, s.size); err != nil {
+		return err
+	}
+	s.dirty = true
+	if s.mode == flushEachWrite {
+		if err := s.flush(); err != nil {
+			return err
+		}
+	}
+	s.size += int64(len(data))
+	for _, record := range records {
+		s.counts[record.Collection]++
+	}
+	s.tail = records[len(records)-1]
+	s.seq = s.tail.Seq
+	if s.onWrite != nil {
+		s.onWrite(s.size)
+	}
+	return nil
+}
+
+// writeAt writes data at an offset of the file
+// Caller must hold the lock
+func (s *opfsStorage) writeAt(data []byte, offset int64) error {
+	buf := js.Global().Get("Uint8Array").New(len(data))
+	js.CopyBytesToJS(buf, data)
+	written, err := s.call("write", buf, map[string]interface{}{"at": offset})
+	if err != nil {
+		return fmt.Errorf("failed to write to OPFS file: %w", err)
+	}
+	if written.Int() != len(data) {
+		return fmt.Errorf("failed to write to OPFS file: wrote %d of %d bytes", written.Int(), len(data))
+	}
+	return nil
+}
+
+// flush persists what has been written to the file
+// Caller must hold the lock
+func (s *opfsStorage) flush() error {
+	if _, err := s.call("flush"); err != nil {
+		return fmt.Errorf("failed to flush OPFS file: %w", err)
+	}
+	s.dirty = false
+	return nil
+}
+
+// call invokes a method of the access handle, which throws on failure, e.g.
+// when the origin's quota is used up
+func (s *opfsStorage) call(method string, args ...interface{}) (result js.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return s.handle.Call(method, args...), nil
+}
+
+// Compact rewrites the file with only the given records, in sequence order
+// Access handles can't rename, so the file is rewritten in place
+func (s *opfsStorage) Compact(records []engine.StorageRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Seq < records[j].Seq })
+	if s.tail.Seq > 0 && (len(records) == 0 || records[len(records)-1].Seq < s.tail.Seq) {
+		records = append(records, s.tail)
+	}
+
+	var data []byte
+	counts := make(map[string]int)
+	for _, record := range records {
+		encoded, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to marshal record: %w", err)
+		}
+		data = append(append(data, encoded...), '\n')
+		counts[record.Collection]++
+	}
+
+	// Shrink first: a failed rewrite then loses the end of the log, which is
+	// still in memory and written again by the next Compact, rather than
+	// leaving old versions after the new ones
+	if _, err := s.call("truncate", 0); err != nil {
+		return fmt.Errorf("failed to truncate OPFS file: %w", err)
+	}
+	s.size = 0
+	if err := s.writeAt(data, 0); err != nil {
+		return err
+	}
+	if err := s.flush(); err != nil {
+		return err
+	}
+	s.size, s.counts = int64(len(data)), counts
+	return nil
+}
+
+// Sync flushes the file; Appends already flush before returning unless the
+// flush policy defers it
+func (s *opfsStorage) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.flush()
+}
+
+// setFlushPolicy changes when appended records are flushed
+func (s *opfsStorage) setFlushPolicy(mode flushMode, interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mode = mode
+	s.timer.reset(interval, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.dirty {
+			if err := s.flush(); err != nil {
+				fmt.Printf("Warning: %v\n", err)
+			}
+		}
+	})
+	if mode == flushEachWrite && s.dirty {
+		if err := s.flush(); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+	}
+}
+
+// flushNow flushes the file; being synchronous, the outcome is known when
+// it returns
+func (s *opfsStorage) flushNow() <-chan error {
+	done := make(chan error, 1)
+	done <- s.Sync()
+	return done
+}
+
+// Close flushes deferred writes and releases the access handle, unlocking
+// the file for other workers
+func (s *opfsStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.timer.reset(0, nil)
+	var flushErr error
+	if s.dirty {
+		flushErr = s.flush()
+	}
+	if _, err := s.call("close"); err != nil {
+		return fmt.Errorf("failed to close OPFS file: %w", err)
+	}
+	return flushErr
+}
+
+// SetWriteHook installs a function called after every successful write with
+// the new file size, while the storage lock is held
+func (s *opfsStorage) SetWriteHook(hook func(size int64)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.onWrite = hook
+}
+
+// SetMaxSize makes writes that would grow the file past max bytes fail
+// with a LimitError (see engine.Limits.MaxFileBytes); 0 removes the limit
+func (s *opfsStorage) SetMaxSize(max int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maxSize = max
+}
+
+// Size returns the size of the file in bytes
+func (s *opfsStorage) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size
+}
+
+// RecordCounts returns how many records each collection has in the file,
+// counting superseded versions and deletions as well as live documents
+func (s *opfsStorage) RecordCounts() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[string]int, len(s.counts))
+	for name, n := range s.counts {
+		counts[name] = n
+	}
+	return counts
+}
+
+// isOPFSPath reports whether a database path names an OPFS file
+func isOPFSPath(path string) bool {
+	return strings.HasPrefix(path, opfsScheme)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"syscall/js"
+
+	"github.com/malazaysc/tetodb/engine"
+)
+
+// resolvePath returns where a database given by path is kept. Without a
+// file system a plain path is kept in IndexedDB, under the path as the
+// name, so the same code opens a file under Node.js and a persistent
+// database in a browser
+func resolvePath(path string, ephemeral bool) (string, error) {
+	if ephemeral || path == engine.MemoryPath || isIDBPath(path) || isOPFSPath(path) || hasFileSystem() {
+		return path, nil
+	}
+	if !js.Global().Get("indexedDB").Truthy() {
+		return "", fmt.Errorf("%s: there is no file system or IndexedDB to keep it in; open %s instead", path, engine.MemoryPath)
+	}
+	return idbScheme + path, nil
+}
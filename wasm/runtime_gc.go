@@ -0,0 +1,47 @@
+//go:build !tinygo
+
+package main
+
+import (
+	"runtime"
+	"syscall/js"
+)
+
+// hasFileSystem reports whether database paths can name files, i.e. the
+// module runs under Node.js with its fs module. Elsewhere, e.g. in a
+// browser, wasm_exec.js stands in a stub whose every call fails, and whose
+// constants are all -1
+func hasFileSystem() bool {
+	fs := js.Global().Get("fs")
+	if !fs.Truthy() || !fs.Get("constants").Truthy() {
+		return false
+	}
+	return fs.Get("constants").Get("O_WRONLY").Int() >= 0
+}
+
+// runtimeMemory reports the Go heap and the garbage collector's work, for
+// tetoDBRuntimeStats
+func runtimeMemory() (heap, gc map[string]interface{}) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	heap = map[string]interface{}{
+		"alloc":   stats.HeapAlloc, // Bytes of live objects and garbage not yet collected
+		"sys":     stats.HeapSys,   // Bytes of WASM memory the heap has claimed
+		"inuse":   stats.HeapInuse,
+		"objects": stats.HeapObjects,
+		"total":   stats.Sys, // Bytes claimed by the runtime as a whole
+	}
+	var lastPause uint64
+	if stats.NumGC > 0 {
+		lastPause = stats.PauseNs[(stats.NumGC+255)%256]
+	}
+	gc = map[string]interface{}{
+		"cycles":       stats.NumGC,
+		"pauseTotalNs": stats.PauseTotalNs,
+		"lastPauseNs":  lastPause,
+		"nextHeap":     stats.NextGC, // Heap size at which the next cycle starts
+		"cpuFraction":  stats.GCCPUFraction,
+	}
+	return heap, gc
+}
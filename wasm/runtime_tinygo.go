@@ -0,0 +1,26 @@
+//go:build tinygo
+
+package main
+
+import "runtime"
+
+// hasFileSystem is always false in a TinyGo build: TinyGo's os package has no
+// file system under js/wasm, even in Node.js, so plain paths are kept in
+// IndexedDB as in a browser
+func hasFileSystem() bool {
+	return false
+}
+
+// runtimeMemory reports the heap of a TinyGo build, for tetoDBRuntimeStats
+// TinyGo's collector keeps no record of its cycles or pauses, so gc is nil
+func runtimeMemory() (heap, gc map[string]interface{}) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	heap = map[string]interface{}{
+		"alloc": stats.HeapAlloc,
+		"sys":   stats.HeapSys,
+		"total": stats.Sys,
+	}
+	return heap, nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall/js"
+
+	"github.com/malazaysc/tetodb/engine"
+)
+
+// nextTx is the ID the next transaction gets; IDs are unique across
+// databases and never reused, so a finished transaction's ID fails cleanly
+var nextTx = 1
+
+// openTx looks up the transaction whose ID is the first of the arguments
+// after the database handle, and returns it with the remaining arguments
+func openTx(args []js.Value) (*instance, int, *engine.Tx, []js.Value, error) {
+	inst, args, err := lookupHandle(args)
+	if err != nil {
+		return nil, 0, nil, nil, err
+	}
+	if len(args) < 1 || args[0].Type() != js.TypeNumber {
+		return nil, 0, nil, nil, fmt.Errorf("missing transaction argument")
+	}
+	id := args[0].Int()
+	tx, exists := inst.txs[id]
+	if !exists {
+		return nil, 0, nil, nil, fmt.Errorf("transaction %d is not open", id)
+	}
+	return inst, id, tx, args[1:], nil
+}
+
+// beginTransaction starts a transaction, whose writes are buffered until
+// tetoDBCommit (see engine.Database.Begin)
+// Args: [handle number]
+// Returns: {success: bool, tx: number, error: string}
+func beginTransaction(this js.Value, args []js.Value) interface{} {
+	inst, _, err := lookupHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	id := nextTx
+	nextTx++
+	if inst.txs == nil {
+		inst.txs = make(map[int]*engine.Tx)
+	}
+	inst.txs[id] = inst.db.Begin()
+
+	return makeSuccess(map[string]interface{}{
+		"tx": id,
+	})
+}
+
+// txInsert buffers an insert in a transaction
+// Args: [handle number, tx number, collection string, doc object|string]
+// Returns: {success: bool, id: string, error: string}
+func txInsert(this js.Value, args []js.Value) interface{} {
+	_, _, tx, args, err := openTx(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 2 {
+		return makeError("missing arguments: collection, doc")
+	}
+
+	doc, err := objectArg(args[1])
+	if err != nil {
+		return makeError(fmt.Sprintf("invalid document: %v", err))
+	}
+
+	id, err := tx.Insert(args[0].String(), doc)
+	if err != nil {
+		return makeError(fmt.Sprintf("insert failed: %v", err))
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"id": id,
+	})
+}
+
+// txUpdate buffers an update in a transaction
+// Args: [handle number, tx number, collection string, id string, update object|string]
+// Returns: {success: bool, error: string}
+func txUpdate(this js.Value, args []js.Value) interface{} {
+	_, _, tx, args, err := openTx(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 3 {
+		return makeError("missing arguments: collection, id, update")
+	}
+
+	update, err := objectArg(args[2])
+	if err != nil {
+		return makeError(fmt.Sprintf("invalid update: %v", err))
+	}
+
+	if err := tx.Update(args[0].String(), args[1].String(), update); err != nil {
+		return makeError(fmt.Sprintf("update failed: %v", err))
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"message": "Update buffered successfully",
+	})
+}
+
+// txDelete buffers a deletion in a transaction
+// Args: [handle number, tx number, collection string, id string]
+// Returns: {success: bool, error: string}
+func txDelete(this js.Value, args []js.Value) interface{} {
+	_, _, tx, args, err := openTx(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 2 {
+		return makeError("missing arguments: collection, id")
+	}
+
+	if err := tx.Delete(args[0].String(), args[1].String()); err != nil {
+		return makeError(fmt.Sprintf("delete failed: %v", err))
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"message": "Delete buffered successfully",
+	})
+}
+
+// commitTransaction makes the writes of a transaction, all or none
+// Args: [handle number, tx number]
+// Returns: {success: bool, conflict: bool, error: string}
+// conflict is set if a snapshot isolation transaction lost to a concurrent
+// write and may be retried. The transaction is finished either way
+func commitTransaction(this js.Value, args []js.Value) interface{} {
+	inst, id, tx, _, err := openTx(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	delete(inst.txs, id)
+	err = tx.Commit()
+	if errors.Is(err, engine.ErrWriteConflict) {
+		result := makeError(err.Error())
+		result["conflict"] = true
+		return result
+	}
+	if err != nil {
+		return makeError(fmt.Sprintf("commit failed: %v", err))
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"message": "Transaction committed successfully",
+	})
+}
+
+// rollbackTransaction discards the writes of a transaction
+// Args: [handle number, tx number]
+// Returns: {success: bool, error: string}
+func rollbackTransaction(this js.Value, args []js.Value) interface{} {
+	inst, id, tx, _, err := openTx(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	delete(inst.txs, id)
+	if err := tx.Rollback(); err != nil {
+		return makeError(fmt.Sprintf("rollback failed: %v", err))
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"message": "Transaction rolled back successfully",
+	})
+}
+
+// bulkWriteDocuments makes a list of writes to a collection in one call, as
+// one batch (see engine.Collection.BulkWrite)
+// Args: [handle number, collection string, ops array|string (operations: {type, id, doc, update})]
+// Returns: {success: bool, results: array (of {id, error}), applied: int, error: string}
+// An operation that fails is skipped, its result's error saying why, and the
+// others still go ahead; error is only set if the batch couldn't be written
+func bulkWriteDocuments(this js.Value, args []js.Value) interface{} {
+	db, args, err := openHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 2 {
+		return makeError("missing arguments: collection, ops")
+	}
+
+	list, err := objectsArg(args[1])
+	if err != nil {
+		return makeError(fmt.Sprintf("invalid operations: %v", err))
+	}
+	ops := make([]engine.WriteOperation, len(list))
+	for i, op := range list {
+		ops[i].Type, _ = op["type"].(string)
+		ops[i].ID, _ = op["id"].(string)
+		ops[i].Doc, _ = op["doc"].(map[string]interface{})
+		ops[i].Update, _ = op["update"].(map[string]interface{})
+	}
+
+	coll := db.GetCollection(args[0].String())
+
+	writeResults, err := coll.BulkWrite(ops)
+	if err != nil {
+		return makeError(fmt.Sprintf("bulk write failed: %v", err))
+	}
+
+	results := make([]interface{}, len(writeResults))
+	applied := 0
+	for i, r := range writeResults {
+		result := map[string]interface{}{"id": r.ID}
+		if r.Err != nil {
+			result["error"] = r.Err.Error()
+		} else {
+			applied++
+		}
+		results[i] = result
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"results": results,
+		"applied": applied,
+	})
+}
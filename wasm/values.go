@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"syscall/js"
+
+	"github.com/malazaysc/tetodb/internal/bridge"
+)
+
+// Documents, filters and options cross the bridge as JavaScript values,
+// converted field by field, rather than encoded to JSON on one side and
+// parsed on the other. Arguments may still be given as JSON strings
+
+var (
+	jsObject = js.Global().Get("Object")
+	jsArray  = js.Global().Get("Array")
+)
+
+// fromJS converts a JavaScript value the way json.Unmarshal decodes its
+// JSON.stringify: objects become maps, arrays slices and numbers float64,
+// a value with a toJSON method (e.g. a Date) is what it returns, and
+// undefined and function fields are left out
+func fromJS(v js.Value) interface{} {
+	switch v.Type() {
+	case js.TypeString:
+		return v.String()
+	case js.TypeBoolean:
+		return v.Bool()
+	case js.TypeNumber:
+		number := v.Float()
+		if math.IsNaN(number) || math.IsInf(number, 0) {
+			return nil
+		}
+		return number
+	case js.TypeObject:
+		if toJSON := v.Get("toJSON"); toJSON.Type() == js.TypeFunction {
+			return fromJS(v.Call("toJSON"))
+		}
+		if jsArray.Call("isArray", v).Bool() {
+			list := make([]interface{}, v.Length())
+			for i := range list {
+				list[i] = fromJS(v.Index(i))
+			}
+			return list
+		}
+		keys := jsObject.Call("keys", v)
+		obj := make(map[string]interface{}, keys.Length())
+		for i := 0; i < keys.Length(); i++ {
+			key := keys.Index(i).String()
+			value := v.Get(key)
+			switch value.Type() {
+			case js.TypeUndefined, js.TypeFunction, js.TypeSymbol:
+				continue
+			}
+			obj[key] = fromJS(value)
+		}
+		return obj
+	}
+	return nil
+}
+
+// toJS converts a Go value to one js.ValueOf accepts, as its JSON would
+// decode: documents pass through field by field, and anything else, e.g. an
+// index info struct, goes through its JSON encoding
+func toJS(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, bool, string, float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, js.Value:
+		return v
+	case map[string]interface{}:
+		obj := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			obj[key] = toJS(elem)
+		}
+		return obj
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, elem := range v {
+			list[i] = toJS(elem)
+		}
+		return list
+	case []map[string]interface{}:
+		list := make([]interface{}, len(v))
+		for i, elem := range v {
+			list[i] = toJS(elem)
+		}
+		return list
+	case []string:
+		list := make([]interface{}, len(v))
+		for i, elem := range v {
+			list[i] = elem
+		}
+		return list
+	case json.Number:
+		number, _ := v.Float64()
+		return number
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil
+	}
+	return toJS(decoded)
+}
+
+// isBlank reports whether an optional argument was left out: undefined,
+// null or ""
+func isBlank(v js.Value) bool {
+	switch v.Type() {
+	case js.TypeUndefined, js.TypeNull:
+		return true
+	case js.TypeString:
+		return v.String() == ""
+	}
+	return false
+}
+
+// objectArg decodes an object argument, e.g. a document or an update: a
+// JavaScript object or its JSON
+func objectArg(v js.Value) (map[string]interface{}, error) {
+	switch v.Type() {
+	case js.TypeString:
+		var obj map[string]interface{}
+		if err := json.Unmarshal([]byte(v.String()), &obj); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		if obj != nil {
+			return obj, nil
+		}
+	case js.TypeObject:
+		if obj, ok := fromJS(v).(map[string]interface{}); ok {
+			return obj, nil
+		}
+	}
+	return nil, fmt.Errorf("expected an object")
+}
+
+// objectsArg decodes an array of objects, e.g. documents to insert: a
+// JavaScript array or its JSON
+func objectsArg(v js.Value) ([]map[string]interface{}, error) {
+	if v.Type() == js.TypeString {
+		var list []map[string]interface{}
+		if err := json.Unmarshal([]byte(v.String()), &list); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		return list, nil
+	}
+	if v.Type() != js.TypeObject || !jsArray.Call("isArray", v).Bool() {
+		return nil, fmt.Errorf("expected an array")
+	}
+
+	list := make([]map[string]interface{}, v.Length())
+	for i := range list {
+		obj, ok := fromJS(v.Index(i)).(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("element %d: expected an object", i)
+		}
+		list[i] = obj
+	}
+	return list, nil
+}
+
+// filterArg decodes an optional filter argument: an object, or a string as
+// bridge.ParseFilter takes; nil if it was left out
+func filterArg(v js.Value) (map[string]interface{}, error) {
+	if isBlank(v) {
+		return nil, nil
+	}
+	if v.Type() == js.TypeString {
+		return bridge.ParseFilter(v.String())
+	}
+	return objectArg(v)
+}
+
+// decodeArg decodes an optional argument into target, e.g. an options
+// struct, from a JavaScript value or its JSON; target is left as it is if
+// the argument was left out
+func decodeArg(v js.Value, target interface{}) error {
+	if isBlank(v) {
+		return nil
+	}
+	if v.Type() == js.TypeString {
+		return json.Unmarshal([]byte(v.String()), target)
+	}
+	data, err := json.Marshal(fromJS(v))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, target)
+}
+
+// optionalArg returns args[i], or undefined if there are fewer arguments
+func optionalArg(args []js.Value, i int) js.Value {
+	if i < len(args) {
+		return args[i]
+	}
+	return js.Undefined()
+}
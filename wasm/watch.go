@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"syscall/js"
+
+	"github.com/malazaysc/tetodb/engine"
+	"github.com/malazaysc/tetodb/internal/bridge"
+)
+
+// watcher passes the writes a tetoDBWatch selects on to its callback
+// Writes are seen inside the exported call that makes them, and the
+// callback can't run there (it could call back into the queue, see
+// serialized), so they are queued and delivered, in order, by a goroutine
+// of their own once the call has returned
+type watcher struct {
+	callback js.Value
+	stop     func() // Stops the engine watch
+
+	mu      sync.Mutex
+	pending []map[string]interface{} // Events not yet delivered
+	wake    chan struct{}            // Signals the deliverer that events are pending
+	done    chan struct{}            // Closed to stop the deliverer
+}
+
+// nextWatch is the ID the next watch gets; IDs are unique across databases
+var nextWatch = 1
+
+// watchOptions mirrors the options object accepted by tetoDBWatch
+type watchOptions struct {
+	Collection string      `json:"collection"` // Only writes to this collection
+	Filter     interface{} `json:"filter"`     // Only writes to documents matching it before or after: an object or a filter expression string
+}
+
+// watchChanges registers a callback called with every write to the database
+// The callback receives {collection, op, id, doc} (doc is null for a delete)
+// after the call that made the write has returned, so it may call other
+// tetoDB functions
+// Args: [handle number, callback function, options object|string (optional)]
+// Returns: {success: bool, watch: number, error: string}
+func watchChanges(this js.Value, args []js.Value) interface{} {
+	inst, args, err := lookupHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 1 || args[0].Type() != js.TypeFunction {
+		return makeError("missing callback argument")
+	}
+
+	var options watchOptions
+	if err := decodeArg(optionalArg(args, 1), &options); err != nil {
+		return makeError(fmt.Sprintf("invalid options: %v", err))
+	}
+	var filter map[string]interface{}
+	switch f := options.Filter.(type) {
+	case nil:
+	case map[string]interface{}:
+		filter = f
+	case string:
+		parsed, err := bridge.ParseFilter(f)
+		if err != nil {
+			return makeError(fmt.Sprintf("invalid filter: %v", err))
+		}
+		filter = parsed
+	default:
+		return makeError("invalid filter: must be an object or a filter expression")
+	}
+
+	w := &watcher{
+		callback: args[0],
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	w.stop = inst.db.Watch(engine.WatchOptions{Collection: options.Collection, Filter: filter}, w.queue)
+	go w.deliver()
+
+	id := nextWatch
+	nextWatch++
+	if inst.watches == nil {
+		inst.watches = make(map[int]*watcher)
+	}
+	inst.watches[id] = w
+
+	return makeSuccess(map[string]interface{}{
+		"watch": id,
+	})
+}
+
+// unwatchChanges stops a watch registered with tetoDBWatch; stopping one
+// that is already stopped does nothing
+// Args: [handle number, watch number]
+// Returns: {success: bool, error: string}
+func unwatchChanges(this js.Value, args []js.Value) interface{} {
+	inst, args, err := lookupHandle(args)
+	if err != nil {
+		return makeError(err.Error())
+	}
+
+	if len(args) < 1 || args[0].Type() != js.TypeNumber {
+		return makeError("missing watch argument")
+	}
+
+	id := args[0].Int()
+	if w, exists := inst.watches[id]; exists {
+		w.close()
+		delete(inst.watches, id)
+	}
+
+	return makeSuccess(map[string]interface{}{
+		"message": "Watch stopped successfully",
+	})
+}
+
+// queue takes a write from the engine, in the exported call making it
+func (w *watcher) queue(event engine.ChangeEvent) {
+	var doc interface{}
+	if event.Doc != nil {
+		doc = toJS(event.Doc)
+	}
+
+	w.mu.Lock()
+	w.pending = append(w.pending, map[string]interface{}{
+		"collection": event.Collection,
+		"op":         event.Op,
+		"id":         event.ID,
+		"doc":        doc,
+	})
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver calls the callback with the queued events until the watch stops
+func (w *watcher) deliver() {
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-w.wake:
+		}
+
+		w.mu.Lock()
+		events := w.pending
+		w.pending = nil
+		w.mu.Unlock()
+
+		for _, event := range events {
+			select {
+			case <-w.done:
+				return
+			default:
+			}
+			w.callback.Invoke(event)
+		}
+	}
+}
+
+// close stops the watch; events not yet delivered are dropped
+func (w *watcher) close() {
+	w.stop()
+	close(w.done)
+}